@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// CadastralNumber is a cadastral number region:area:quarter:object, e.g.
+// 16:50:130101:360. Object numbers are only unique within their quarter
+// and quarter numbers within their area, so the full number is the key of
+// an object.
+type CadastralNumber struct {
+	Region  int
+	Area    int
+	Quarter int
+	Object  int
+}
+
+// ParseCadastralNumber parses and validates a cadastral number. The region
+// and area have two digits, the quarter six or seven.
+func ParseCadastralNumber(s string) (CadastralNumber, error) {
+	parts := strings.Split(strings.TrimSpace(s), ":")
+	if len(parts) != 4 {
+		return CadastralNumber{}, fmt.Errorf("invalid cadastral number %q: expected region:area:quarter:object", s)
+	}
+
+	digits := [][2]int{{2, 2}, {2, 2}, {6, 7}, {1, 9}}
+	var values [4]int
+	for i, part := range parts {
+		if len(part) < digits[i][0] || len(part) > digits[i][1] {
+			return CadastralNumber{}, fmt.Errorf("invalid cadastral number %q: part %q has the wrong length", s, part)
+		}
+		v, err := strconv.Atoi(part)
+		if err != nil || v < 0 || strings.ContainsAny(part, "+-") {
+			return CadastralNumber{}, fmt.Errorf("invalid cadastral number %q: part %q is not a number", s, part)
+		}
+		values[i] = v
+	}
+
+	n := CadastralNumber{Region: values[0], Area: values[1], Quarter: values[2], Object: values[3]}
+	if err := n.Validate(); err != nil {
+		return CadastralNumber{}, err
+	}
+	return n, nil
+}
+
+// Validate checks that every part is in range
+func (n CadastralNumber) Validate() error {
+	switch {
+	case n.Region < 1 || n.Region > 99:
+		return fmt.Errorf("invalid cadastral number %s: region must be 1-99", n)
+	case n.Area < 0 || n.Area > 99:
+		return fmt.Errorf("invalid cadastral number %s: area must be 0-99", n)
+	case n.Quarter < 0 || n.Quarter > 9999999:
+		return fmt.Errorf("invalid cadastral number %s: quarter must be 0-9999999", n)
+	case n.Object < 1:
+		return fmt.Errorf("invalid cadastral number %s: object must be positive", n)
+	}
+	return nil
+}
+
+// String formats the number with a two-digit region and area and an at
+// least six-digit quarter, e.g. 16:50:130101:360
+func (n CadastralNumber) String() string {
+	return fmt.Sprintf("%02d:%02d:%06d:%d", n.Region, n.Area, n.Quarter, n.Object)
+}
+
+// QuarterNumber returns the cadastral number of the quarter, e.g.
+// 16:50:130101
+func (n CadastralNumber) QuarterNumber() string {
+	return fmt.Sprintf("%02d:%02d:%06d", n.Region, n.Area, n.Quarter)
+}
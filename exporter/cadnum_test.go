@@ -0,0 +1,94 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseCadastralNumber(t *testing.T) {
+	tests := []struct {
+		in   string
+		want CadastralNumber
+		err  string
+	}{
+		{in: "16:50:130101:360", want: CadastralNumber{Region: 16, Area: 50, Quarter: 130101, Object: 360}},
+		{in: "16:50:1301011:1", want: CadastralNumber{Region: 16, Area: 50, Quarter: 1301011, Object: 1}},
+		{in: " 16:00:000000:123456789 ", want: CadastralNumber{Region: 16, Area: 0, Quarter: 0, Object: 123456789}},
+
+		// Missing parts
+		{in: "", err: "expected region:area:quarter:object"},
+		{in: "16:50:130101", err: "expected region:area:quarter:object"},
+		{in: "16:50::360", err: "wrong length"},
+		{in: "16:50:130101:", err: "wrong length"},
+
+		// Non-numeric parts
+		{in: "16:5a:130101:360", err: "not a number"},
+		{in: "16:50:130101:36x", err: "not a number"},
+		{in: "16:50:+30101:360", err: "not a number"},
+		{in: "16:50:130101:-36", err: "not a number"},
+
+		// Out-of-range parts
+		{in: "00:50:130101:360", err: "region must be 1-99"},
+		{in: "16:50:130101:0", err: "object must be positive"},
+		{in: "160:50:130101:360", err: "wrong length"},
+		{in: "16:50:13010:360", err: "wrong length"},
+		{in: "16:50:13010100:360", err: "wrong length"},
+		{in: "16:50:130101:1234567890", err: "wrong length"},
+
+		// Leading or trailing colons
+		{in: ":16:50:130101:360", err: "expected region:area:quarter:object"},
+		{in: "16:50:130101:360:", err: "expected region:area:quarter:object"},
+	}
+	for _, tt := range tests {
+		got, err := ParseCadastralNumber(tt.in)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("ParseCadastralNumber(%q) error %v, want %q", tt.in, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseCadastralNumber(%q): %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseCadastralNumber(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+
+	n, err := ParseCadastralNumber("16:50:130101:360")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := n.String(); s != "16:50:130101:360" {
+		t.Errorf("String() = %q, want 16:50:130101:360", s)
+	}
+	if s := n.QuarterNumber(); s != "16:50:130101" {
+		t.Errorf("QuarterNumber() = %q, want 16:50:130101", s)
+	}
+}
+
+func TestCadastralNumberValidate(t *testing.T) {
+	tests := []struct {
+		n   CadastralNumber
+		err string
+	}{
+		{CadastralNumber{Region: 16, Area: 50, Quarter: 130101, Object: 360}, ""},
+		{CadastralNumber{Region: 0, Area: 50, Quarter: 130101, Object: 360}, "region"},
+		{CadastralNumber{Region: 100, Area: 50, Quarter: 130101, Object: 360}, "region"},
+		{CadastralNumber{Region: 16, Area: -1, Quarter: 130101, Object: 360}, "area"},
+		{CadastralNumber{Region: 16, Area: 100, Quarter: 130101, Object: 360}, "area"},
+		{CadastralNumber{Region: 16, Area: 50, Quarter: 10000000, Object: 360}, "quarter"},
+		{CadastralNumber{Region: 16, Area: 50, Quarter: 130101, Object: 0}, "object"},
+	}
+	for _, tt := range tests {
+		err := tt.n.Validate()
+		if tt.err == "" {
+			if err != nil {
+				t.Errorf("%+v: %v", tt.n, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%+v: error %v, want %q", tt.n, err, tt.err)
+		}
+	}
+}
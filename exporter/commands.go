@@ -0,0 +1,514 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"exporter/crs"
+)
+
+// runExport dispatches "export <format>" to the matching exporter
+func runExport(args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("missing export format (gpkg, geojson, shapefile, parquet, kml or tiles)")
+	}
+
+	switch args[0] {
+	case "gpkg":
+		return runExportGPKG(args[1:])
+	case "geojson":
+		return runExportGeoJSON(args[1:])
+	case "shapefile", "shp":
+		return runExportShapefile(args[1:])
+	case "parquet", "geoparquet":
+		return runExportParquet(args[1:])
+	case "kml", "kmz":
+		return runExportKML(args[1:])
+	case "tiles":
+		return runExportTiles(args[1:])
+	default:
+		return fmt.Errorf("unknown export format %q (expected gpkg, geojson, shapefile, parquet, kml or tiles)", args[0])
+	}
+}
+
+// runExportGPKG exports cadastral objects to a GeoPackage file
+func runExportGPKG(args []string) error {
+	var cfg Config
+	var filter Filter
+	var opts GPKGOptions
+	var optionsSchema string
+	fs := newFlagSet("export gpkg", &cfg)
+	fs.StringVar(&cfg.OutputFile, "output", "cadastral.gpkg", "Output GeoPackage file path")
+	fs.StringVar(&cfg.TargetCRS, "target-crs", "EPSG:3857", "Output CRS (e.g. EPSG:3857, EPSG:32639, EPSG:28409, msk16-1)")
+	fs.StringVar(&opts.GeometryType, "geometry-type", geometryTypeAuto, "Geometry type policy: auto (register the actual type, GEOMETRY if mixed), promote (write single geometries as multi geometries) or split (one table per geometry type)")
+	fs.StringVar(&optionsSchema, "options-schema", "", "JSON file mapping NSPD options to typed columns: [{\"option\": \"registration_date\", \"column\": \"reg_date\", \"type\": \"DATE\"}, ...]; default: a built-in mapping")
+	fs.StringVar(&opts.Mode, "mode", modeReplace, "Write mode: replace (recreate the file), append (add objects missing from an existing file) or upsert (also rewrite objects whose update_date changed and remove objects no longer SUCCESS)")
+	registerFilterFlags(fs, &filter)
+	fs.Parse(args)
+	if err := filter.Prepare(); err != nil {
+		return err
+	}
+	if err := opts.validate(); err != nil {
+		return err
+	}
+	target, err := crs.Lookup(cfg.TargetCRS)
+	if err != nil {
+		return fmt.Errorf("invalid -target-crs: %w", err)
+	}
+	opts.CRS = target
+	if opts.OptionColumns, err = loadOptionColumns(optionsSchema); err != nil {
+		return fmt.Errorf("invalid -options-schema: %w", err)
+	}
+
+	// Connect to PostgreSQL
+	pgDB, err := ConnectPostgreSQL(cfg)
+	if err != nil {
+		return err
+	}
+	defer CloseDB(pgDB)
+
+	// Create GeoPackage, or open the existing one in the incremental modes
+	var gpkgDB *sql.DB
+	if opts.incremental() {
+		gpkgDB, err = OpenGeoPackage(cfg.OutputFile)
+	} else {
+		gpkgDB, err = CreateGeoPackage(cfg.OutputFile)
+	}
+	if err != nil {
+		return err
+	}
+	defer CloseDB(gpkgDB)
+
+	if opts.incremental() {
+		if err := validateGeoPackage(gpkgDB, opts); err != nil {
+			return fmt.Errorf("cannot %s %s: %w", opts.Mode, cfg.OutputFile, err)
+		}
+	}
+
+	// Initialize GeoPackage structure
+	if err := InitGeoPackage(gpkgDB, target); err != nil {
+		return fmt.Errorf("failed to initialize GeoPackage: %w", err)
+	}
+
+	// Export data
+	started := time.Now()
+	src := NewSource(pgDB)
+	src.Filter = &filter
+	if err := ExportData(src, gpkgDB, opts); err != nil {
+		return fmt.Errorf("failed to export data: %w", err)
+	}
+
+	// Record where the data came from
+	stats, err := src.LoadStatusStats()
+	if err != nil {
+		return err
+	}
+	if err := writeExportMetadata(gpkgDB, ExportMetadata{
+		Source:    cfg.SourceDescription(),
+		Filter:    filter.Describe(),
+		Mode:      opts.Mode,
+		Version:   version,
+		Timestamp: started,
+		CRS:       target,
+		Stats:     stats,
+	}); err != nil {
+		return fmt.Errorf("failed to write metadata: %w", err)
+	}
+
+	log.Printf("Successfully exported data to %s", cfg.OutputFile)
+	return nil
+}
+
+// runExportGeoJSON exports cadastral objects to one or more GeoJSON files
+func runExportGeoJSON(args []string) error {
+	var cfg Config
+	var filter Filter
+	var opts GeoJSONOptions
+	fs := newFlagSet("export geojson", &cfg)
+	fs.StringVar(&cfg.OutputFile, "output", "cadastral.geojson", "Output GeoJSON file path")
+	fs.StringVar(&opts.Format, "format", formatGeoJSON, "Output format: geojson (FeatureCollection), geojsonseq (RFC 8142 text sequence), ndjson (one feature per line) or fgb (FlatGeobuf with a spatial index)")
+	fs.BoolVar(&opts.Append, "append", false, "Append to existing output files instead of overwriting them (geojsonseq and ndjson only)")
+	fs.StringVar(&opts.GroupBy, "group-by", "", "Group features by property (e.g., 'quarter_code', 'area_code', 'status'). Creates multiple FeatureCollections, one per unique value")
+	fs.IntVar(&opts.MaxOpenFiles, "max-open-files", 64, "Maximum number of group files kept open at once with -group-by")
+	fs.BoolVar(&opts.RFC7946, "rfc7946", false, "Enforce RFC 7946: ring orientation, antimeridian splitting, feature and collection bbox")
+	fs.IntVar(&opts.Precision, "precision", -1, "Round coordinates to this many decimals (e.g. 7 for EPSG:4326); -1 keeps full precision")
+	fs.StringVar(&cfg.TargetCRS, "target-crs", "EPSG:4326", "Output CRS (e.g. EPSG:4326, EPSG:3857, EPSG:32639, msk16-1); anything but EPSG:4326 is written with the legacy crs member")
+	fs.StringVar(&cfg.TargetCRS, "crs", "EPSG:4326", "Deprecated alias of -target-crs")
+	registerFilterFlags(fs, &filter)
+	fs.Parse(args)
+	if err := filter.Prepare(); err != nil {
+		return err
+	}
+	opts.OutputFile = cfg.OutputFile
+	target, err := crs.Lookup(cfg.TargetCRS)
+	if err != nil {
+		return fmt.Errorf("invalid -target-crs: %w", err)
+	}
+	opts.CRS = target
+
+	pgDB, err := ConnectPostgreSQL(cfg)
+	if err != nil {
+		return err
+	}
+	defer CloseDB(pgDB)
+
+	src := NewSource(pgDB)
+	src.Filter = &filter
+	if err := exportToGeoJSON(src, opts); err != nil {
+		return fmt.Errorf("failed to export data: %w", err)
+	}
+
+	log.Printf("Successfully exported data to %s", cfg.OutputFile)
+	return nil
+}
+
+// runExportShapefile exports cadastral objects to ESRI Shapefiles
+func runExportShapefile(args []string) error {
+	var cfg Config
+	var filter Filter
+	var opts ShapefileOptions
+	var optionsSchema string
+	fs := newFlagSet("export shapefile", &cfg)
+	fs.StringVar(&cfg.OutputFile, "output", "cadastral.shp", "Output .shp path; the .shx, .dbf, .prj and .cpg files are written next to it")
+	fs.StringVar(&cfg.TargetCRS, "target-crs", "EPSG:3857", "Output CRS (e.g. EPSG:3857, EPSG:32639, EPSG:28409, msk16-1), written to the .prj")
+	fs.StringVar(&opts.Encoding, "encoding", encodingUTF8, "Encoding of DBF text: utf-8 or cp1251 (for software that ignores the .cpg)")
+	fs.StringVar(&optionsSchema, "options-schema", "", "JSON file mapping NSPD options to DBF fields, as for export gpkg; default: the built-in mapping")
+	registerFilterFlags(fs, &filter)
+	fs.Parse(args)
+	if err := filter.Prepare(); err != nil {
+		return err
+	}
+	opts.OutputFile = cfg.OutputFile
+	target, err := crs.Lookup(cfg.TargetCRS)
+	if err != nil {
+		return fmt.Errorf("invalid -target-crs: %w", err)
+	}
+	opts.CRS = target
+	if opts.OptionColumns, err = loadOptionColumns(optionsSchema); err != nil {
+		return fmt.Errorf("invalid -options-schema: %w", err)
+	}
+
+	pgDB, err := ConnectPostgreSQL(cfg)
+	if err != nil {
+		return err
+	}
+	defer CloseDB(pgDB)
+
+	src := NewSource(pgDB)
+	src.Filter = &filter
+	if err := exportToShapefile(src, opts); err != nil {
+		return fmt.Errorf("failed to export data: %w", err)
+	}
+
+	log.Printf("Successfully exported data to %s", cfg.OutputFile)
+	return nil
+}
+
+// runExportParquet exports cadastral objects to a GeoParquet file
+func runExportParquet(args []string) error {
+	var cfg Config
+	var filter Filter
+	var opts ParquetOptions
+	var optionsSchema string
+	fs := newFlagSet("export parquet", &cfg)
+	fs.StringVar(&cfg.OutputFile, "output", "cadastral.parquet", "Output GeoParquet file")
+	fs.StringVar(&cfg.TargetCRS, "target-crs", "EPSG:4326", "Output CRS (e.g. EPSG:4326, EPSG:3857, EPSG:32639, msk16-1), written to the geo metadata as PROJJSON")
+	fs.IntVar(&opts.RowGroupSize, "row-group-size", 65536, "Rows per row group; smaller groups let readers skip more data by the bbox statistics")
+	fs.StringVar(&opts.Compression, "compression", compressionGzip, "Page compression: gzip or none")
+	fs.StringVar(&optionsSchema, "options-schema", "", "JSON file mapping NSPD options to typed columns, as for export gpkg; default: the built-in mapping")
+	registerFilterFlags(fs, &filter)
+	fs.Parse(args)
+	if err := filter.Prepare(); err != nil {
+		return err
+	}
+	opts.OutputFile = cfg.OutputFile
+	target, err := crs.Lookup(cfg.TargetCRS)
+	if err != nil {
+		return fmt.Errorf("invalid -target-crs: %w", err)
+	}
+	opts.CRS = target
+	if err := opts.validate(); err != nil {
+		return err
+	}
+	if opts.OptionColumns, err = loadOptionColumns(optionsSchema); err != nil {
+		return fmt.Errorf("invalid -options-schema: %w", err)
+	}
+
+	pgDB, err := ConnectPostgreSQL(cfg)
+	if err != nil {
+		return err
+	}
+	defer CloseDB(pgDB)
+
+	src := NewSource(pgDB)
+	src.Filter = &filter
+	if err := exportToParquet(src, opts); err != nil {
+		return fmt.Errorf("failed to export data: %w", err)
+	}
+
+	log.Printf("Successfully exported data to %s", cfg.OutputFile)
+	return nil
+}
+
+// runExportKML exports cadastral objects to a KML document or KMZ archive
+func runExportKML(args []string) error {
+	var cfg Config
+	var filter Filter
+	var opts KMLOptions
+	fs := newFlagSet("export kml", &cfg)
+	fs.StringVar(&cfg.OutputFile, "output", "cadastral.kml", "Output file: .kml, or .kmz for a zipped KML")
+	fs.StringVar(&opts.GroupBy, "group-by", "", "Put placemarks in one folder per property value (e.g. 'quarter_code', 'status'), as for export geojson")
+	fs.StringVar(&opts.StyleBy, "style-by", "status", "Column the polygon colours follow: status or land_record_category_type")
+	registerFilterFlags(fs, &filter)
+	fs.Parse(args)
+	if err := filter.Prepare(); err != nil {
+		return err
+	}
+	opts.OutputFile = cfg.OutputFile
+	if err := opts.validate(); err != nil {
+		return err
+	}
+
+	pgDB, err := ConnectPostgreSQL(cfg)
+	if err != nil {
+		return err
+	}
+	defer CloseDB(pgDB)
+
+	src := NewSource(pgDB)
+	src.Filter = &filter
+	if err := exportToKML(src, opts); err != nil {
+		return fmt.Errorf("failed to export data: %w", err)
+	}
+
+	log.Printf("Successfully exported data to %s", cfg.OutputFile)
+	return nil
+}
+
+// runExportTiles cuts cadastral objects into vector tiles in an MBTiles or
+// PMTiles file
+func runExportTiles(args []string) error {
+	var cfg Config
+	var filter Filter
+	var opts TilesOptions
+	var optionsSchema string
+	fs := newFlagSet("export tiles", &cfg)
+	fs.StringVar(&cfg.OutputFile, "output", "cadastral.pmtiles", "Output file: .pmtiles (single-file archive for static hosting) or .mbtiles (SQLite)")
+	fs.IntVar(&opts.MinZoom, "min-zoom", 10, "Lowest zoom level to generate")
+	fs.IntVar(&opts.MaxZoom, "max-zoom", 16, "Highest zoom level to generate; clients overzoom beyond it")
+	fs.StringVar(&opts.Layer, "layer", defaultTable, "Name of the vector tile layer")
+	fs.Float64Var(&opts.Tolerance, "simplify", 4, "Simplification tolerance in tile units (4096 per tile side, about 8 per screen pixel); 0 disables simplification")
+	fs.StringVar(&optionsSchema, "options-schema", "", "JSON file mapping NSPD options to tile attributes, as for export gpkg; default: the built-in mapping")
+	registerFilterFlags(fs, &filter)
+	fs.Parse(args)
+	if err := filter.Prepare(); err != nil {
+		return err
+	}
+	opts.OutputFile = cfg.OutputFile
+	if err := opts.validate(); err != nil {
+		return err
+	}
+	var err error
+	if opts.OptionColumns, err = loadOptionColumns(optionsSchema); err != nil {
+		return fmt.Errorf("invalid -options-schema: %w", err)
+	}
+
+	pgDB, err := ConnectPostgreSQL(cfg)
+	if err != nil {
+		return err
+	}
+	defer CloseDB(pgDB)
+
+	src := NewSource(pgDB)
+	src.Filter = &filter
+	if err := exportToTiles(src, opts); err != nil {
+		return fmt.Errorf("failed to export data: %w", err)
+	}
+
+	log.Printf("Successfully exported data to %s", cfg.OutputFile)
+	return nil
+}
+
+// runImport imports cadastral objects from a GeoPackage or GeoJSON file
+// into PostgreSQL, printing conflicts and invalid features to stdout
+func runImport(args []string) error {
+	var cfg Config
+	var opts ImportOptions
+	var sourceCRS, optionsSchema string
+	fs := newFlagSet("import", &cfg)
+	fs.StringVar(&opts.Input, "input", "", "Input file: GeoPackage (.gpkg), GeoJSON FeatureCollection (.geojson, .json) or GeoJSON sequence (.geojsons, .geojsonl, .ndjson, .jsonl)")
+	fs.StringVar(&opts.Layer, "layer", "", "GeoPackage table to import (default: every feature table except cadastral_quarters and cadastral_areas)")
+	fs.StringVar(&sourceCRS, "source-crs", "", "CRS of the input coordinates, overriding the srs_id or crs member of the file (e.g. EPSG:3857, msk16-1)")
+	fs.StringVar(&optionsSchema, "options-schema", "", "JSON file mapping NSPD options to columns, as for export gpkg; their columns are read back into the options")
+	fs.StringVar(&opts.OnConflict, "on-conflict", conflictSkip, "What to do with objects that differ from a stored SUCCESS object: skip (report them), update (overwrite and report them) or newer (overwrite if the imported update_date is later)")
+	fs.BoolVar(&opts.DryRun, "dry-run", false, "Report what would be imported and roll back")
+	fs.Parse(args)
+	if opts.Input == "" {
+		return fmt.Errorf("missing -input")
+	}
+	if err := opts.validate(); err != nil {
+		return err
+	}
+	if sourceCRS != "" {
+		c, err := crs.Lookup(sourceCRS)
+		if err != nil {
+			return fmt.Errorf("invalid -source-crs: %w", err)
+		}
+		opts.SourceCRS = c
+	}
+	var err error
+	if opts.OptionColumns, err = loadOptionColumns(optionsSchema); err != nil {
+		return fmt.Errorf("invalid -options-schema: %w", err)
+	}
+
+	pgDB, err := ConnectPostgreSQL(cfg)
+	if err != nil {
+		return err
+	}
+	defer CloseDB(pgDB)
+
+	if err := ImportData(pgDB, opts, os.Stdout); err != nil {
+		return fmt.Errorf("failed to import %s: %w", opts.Input, err)
+	}
+	return nil
+}
+
+// runStats prints object counts grouped by load status
+func runStats(args []string) error {
+	var cfg Config
+	fs := newFlagSet("stats", &cfg)
+	fs.Parse(args)
+
+	pgDB, err := ConnectPostgreSQL(cfg)
+	if err != nil {
+		return err
+	}
+	defer CloseDB(pgDB)
+
+	stats, err := NewSource(pgDB).LoadStatusStats()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "LOAD_STATUS\tOBJECTS\tWITH_DATA\tFIRST_UPDATE\tLAST_UPDATE")
+
+	var total, totalWithData int
+	for _, st := range stats {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\n",
+			st.Status, st.Objects, st.WithData, formatNullDate(st.FirstUpdate), formatNullDate(st.LastUpdate))
+		total += st.Objects
+		totalWithData += st.WithData
+	}
+
+	fmt.Fprintf(w, "TOTAL\t%d\t%d\t\t\n", total, totalWithData)
+	return w.Flush()
+}
+
+// runValidate decodes every exportable object and reports those whose
+// geometry cannot be converted, exiting with an error if any were found.
+// "validate gpkg" checks a GeoPackage file instead.
+func runValidate(args []string) error {
+	if len(args) > 0 && args[0] == "gpkg" {
+		return runValidateGPKG(args[1:])
+	}
+
+	var cfg Config
+	fs := newFlagSet("validate", &cfg)
+	fs.Parse(args)
+
+	pgDB, err := ConnectPostgreSQL(cfg)
+	if err != nil {
+		return err
+	}
+	defer CloseDB(pgDB)
+
+	var invalid int
+	src := NewSource(pgDB)
+	src.OnInvalid = func(code int, err error) {
+		invalid++
+		fmt.Printf("%d\t%v\n", code, err)
+	}
+
+	objects, err := src.Objects()
+	if err != nil {
+		return err
+	}
+	defer objects.Close()
+
+	var checked int
+	for objects.Next() {
+		obj := objects.Object()
+		checked++
+		if _, err := ConvertGeometryToGPKG(obj.Geometry, int32(sourceCRS.SRSID)); err != nil {
+			invalid++
+			fmt.Printf("%s\t%v\n", obj.CadNum, err)
+		}
+	}
+	if err := objects.Err(); err != nil {
+		return fmt.Errorf("failed to read objects: %w", err)
+	}
+	checked += objects.Skipped()
+
+	log.Printf("Checked %d objects, %d invalid", checked, invalid)
+	if invalid > 0 {
+		return fmt.Errorf("%d objects have invalid geometry", invalid)
+	}
+	return nil
+}
+
+// runValidateGPKG checks GeoPackage files for conformance and prints one
+// JSON report per file, exiting with an error if any file has errors
+func runValidateGPKG(args []string) error {
+	fs := flag.NewFlagSet("validate gpkg", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: gisdb validate gpkg <file.gpkg>...")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return fmt.Errorf("missing GeoPackage file")
+	}
+
+	var invalid int
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	for _, file := range fs.Args() {
+		db, err := OpenGeoPackageReadOnly(file)
+		if err != nil {
+			return err
+		}
+		report, err := CheckConformance(db, file)
+		CloseDB(db)
+		if err != nil {
+			return fmt.Errorf("failed to check %s: %w", file, err)
+		}
+		if err := encoder.Encode(report); err != nil {
+			return err
+		}
+		if !report.Valid {
+			invalid++
+		}
+		log.Printf("%s: %d errors, %d warnings", file, report.Errors, report.Warnings)
+	}
+
+	if invalid > 0 {
+		return fmt.Errorf("%d of %d files do not conform", invalid, fs.NArg())
+	}
+	return nil
+}
+
+// formatNullDate formats a nullable date as YYYY-MM-DD or "-"
+func formatNullDate(t sql.NullTime) string {
+	if !t.Valid {
+		return "-"
+	}
+	return t.Time.Format("2006-01-02")
+}
@@ -2,12 +2,14 @@ package main
 
 import (
 	"database/sql"
+	"flag"
 	"fmt"
 	"log"
+	"net/url"
 	"os"
+	"path/filepath"
 
 	_ "github.com/lib/pq"
-	_ "github.com/mattn/go-sqlite3"
 )
 
 // Config holds the application configuration
@@ -18,6 +20,24 @@ type Config struct {
 	PostgresPassword string
 	PostgresDB       string
 	OutputFile       string
+	TargetCRS        string
+}
+
+// newFlagSet creates a command flag set with the PostgreSQL connection flags
+// shared by every command bound to cfg
+func newFlagSet(name string, cfg *Config) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.StringVar(&cfg.PostgresHost, "pg-host", "localhost", "PostgreSQL host")
+	fs.IntVar(&cfg.PostgresPort, "pg-port", 5432, "PostgreSQL port")
+	fs.StringVar(&cfg.PostgresUser, "pg-user", "postgres", "PostgreSQL user")
+	fs.StringVar(&cfg.PostgresPassword, "pg-password", "postgres", "PostgreSQL password")
+	fs.StringVar(&cfg.PostgresDB, "pg-db", "postgres", "PostgreSQL database name")
+	return fs
+}
+
+// SourceDescription names the PostgreSQL database without credentials
+func (c Config) SourceDescription() string {
+	return fmt.Sprintf("PostgreSQL database %s at %s:%d", c.PostgresDB, c.PostgresHost, c.PostgresPort)
 }
 
 // ConnectPostgreSQL connects to the PostgreSQL database
@@ -45,7 +65,7 @@ func CreateGeoPackage(outputFile string) (*sql.DB, error) {
 		return nil, fmt.Errorf("failed to remove existing file: %w", err)
 	}
 
-	db, err := sql.Open("sqlite3", outputFile)
+	db, err := sql.Open(gpkgDriver, outputFile)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create GeoPackage: %w", err)
 	}
@@ -53,6 +73,42 @@ func CreateGeoPackage(outputFile string) (*sql.DB, error) {
 	return db, nil
 }
 
+// OpenGeoPackage opens an existing GeoPackage file for updating
+func OpenGeoPackage(outputFile string) (*sql.DB, error) {
+	if _, err := os.Stat(outputFile); err != nil {
+		return nil, fmt.Errorf("failed to open GeoPackage: %w", err)
+	}
+
+	db, err := sql.Open(gpkgDriver, outputFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open GeoPackage: %w", err)
+	}
+
+	return db, nil
+}
+
+// OpenGeoPackageReadOnly opens an existing GeoPackage file for reading. The
+// path is escaped into a file URI, so that "?", "#" and "%" in it are not
+// taken for URI syntax.
+func OpenGeoPackageReadOnly(path string) (*sql.DB, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, fmt.Errorf("failed to open GeoPackage: %w", err)
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open GeoPackage: %w", err)
+	}
+
+	// An absolute path keeps the URI free of an authority part
+	uri := &url.URL{Scheme: "file", Path: filepath.ToSlash(abs), RawQuery: "mode=ro"}
+	db, err := sql.Open(gpkgDriver, uri.String())
+	if err != nil {
+		return nil, fmt.Errorf("failed to open GeoPackage: %w", err)
+	}
+
+	return db, nil
+}
+
 // CloseDB safely closes a database connection
 func CloseDB(db *sql.DB) {
 	if db != nil {
@@ -0,0 +1,774 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"exporter/geom"
+)
+
+// maxIssuesPerCheck limits the issues reported for one check of one table;
+// further ones are only counted
+const maxIssuesPerCheck = 20
+
+// Issue severities of a conformance report
+const (
+	severityError   = "error"
+	severityWarning = "warning"
+)
+
+// ConformanceReport is the result of checking a GeoPackage against the
+// GeoPackage 1.3 requirements relevant to exported files
+type ConformanceReport struct {
+	File     string             `json:"file"`
+	Valid    bool               `json:"valid"`
+	Errors   int                `json:"errors"`
+	Warnings int                `json:"warnings"`
+	Tables   []ConformanceTable `json:"tables"`
+	Issues   []ConformanceIssue `json:"issues"`
+
+	// counts holds the issues per table and check, for maxIssuesPerCheck
+	counts map[string]int
+}
+
+// ConformanceTable summarizes a checked feature table
+type ConformanceTable struct {
+	Table          string      `json:"table"`
+	GeometryColumn string      `json:"geometry_column"`
+	GeometryType   string      `json:"geometry_type"`
+	SRSID          int         `json:"srs_id"`
+	Features       int         `json:"features"`
+	Extent         *[4]float64 `json:"extent,omitempty"` // min_x, min_y, max_x, max_y
+	SpatialIndex   bool        `json:"spatial_index"`
+}
+
+// ConformanceIssue is one failed check
+type ConformanceIssue struct {
+	Severity string `json:"severity"`
+	// Check names the checked requirement, e.g. application_id,
+	// required_table, srs_reference, geometry_header, geometry_type,
+	// envelope, rtree or contents_bounds
+	Check   string `json:"check"`
+	Table   string `json:"table,omitempty"`
+	Row     *int64 `json:"row,omitempty"`
+	Message string `json:"message"`
+}
+
+// add records an issue, counting but not listing those beyond
+// maxIssuesPerCheck for the same table and check
+func (r *ConformanceReport) add(severity, check, table string, row *int64, format string, args ...interface{}) {
+	if severity == severityError {
+		r.Errors++
+	} else {
+		r.Warnings++
+	}
+	key := table + "\x00" + check
+	r.counts[key]++
+	if r.counts[key] > maxIssuesPerCheck {
+		return
+	}
+	r.Issues = append(r.Issues, ConformanceIssue{
+		Severity: severity,
+		Check:    check,
+		Table:    table,
+		Row:      row,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+// finish summarizes the issues left out and sets Valid
+func (r *ConformanceReport) finish() {
+	for _, issue := range append([]ConformanceIssue(nil), r.Issues...) {
+		key := issue.Table + "\x00" + issue.Check
+		if n := r.counts[key]; n > maxIssuesPerCheck {
+			r.Issues = append(r.Issues, ConformanceIssue{
+				Severity: issue.Severity,
+				Check:    issue.Check,
+				Table:    issue.Table,
+				Message:  fmt.Sprintf("%d more %s issues not listed", n-maxIssuesPerCheck, issue.Check),
+			})
+			delete(r.counts, key)
+		}
+	}
+	r.Valid = r.Errors == 0
+	if r.Tables == nil {
+		r.Tables = []ConformanceTable{}
+	}
+	if r.Issues == nil {
+		r.Issues = []ConformanceIssue{}
+	}
+}
+
+// requiredColumns are the core GeoPackage tables every file must have and
+// their columns
+var requiredColumns = map[string][]string{
+	"gpkg_spatial_ref_sys":  {"srs_name", "srs_id", "organization", "organization_coordsys_id", "definition", "description"},
+	"gpkg_contents":         {"table_name", "data_type", "identifier", "description", "last_change", "min_x", "min_y", "max_x", "max_y", "srs_id"},
+	"gpkg_geometry_columns": {"table_name", "column_name", "geometry_type_name", "srs_id", "z", "m"},
+}
+
+// optionalColumns are the extension tables checked when present
+var optionalColumns = map[string][]string{
+	"gpkg_extensions":              {"table_name", "column_name", "extension_name", "definition", "scope"},
+	"gpkg_data_columns":            {"table_name", "column_name", "name", "title", "description", "mime_type", "constraint_name"},
+	"gpkg_data_column_constraints": {"constraint_name", "constraint_type", "value", "min", "min_is_inclusive", "max", "max_is_inclusive", "description"},
+	"gpkg_metadata":                {"id", "md_scope", "md_standard_uri", "mime_type", "metadata"},
+	"gpkg_metadata_reference":      {"reference_scope", "table_name", "column_name", "row_id_value", "timestamp", "md_file_id", "md_parent_id"},
+}
+
+// geometryTypeNames are the geometry types gpkg_geometry_columns may register
+var geometryTypeNames = map[string]bool{
+	"GEOMETRY": true, "POINT": true, "LINESTRING": true, "POLYGON": true,
+	"MULTIPOINT": true, "MULTILINESTRING": true, "MULTIPOLYGON": true, "GEOMETRYCOLLECTION": true,
+	"CIRCULARSTRING": true, "COMPOUNDCURVE": true, "CURVEPOLYGON": true,
+	"MULTICURVE": true, "MULTISURFACE": true, "CURVE": true, "SURFACE": true,
+}
+
+// CheckConformance checks a GeoPackage: the file header, SQLite integrity,
+// the required tables and columns, spatial reference system references,
+// the geometry blobs of every feature table against their registration,
+// the blob envelopes, the R-tree indexes and the gpkg_contents bounds.
+// The error is only set when the file cannot be read at all.
+func CheckConformance(db *sql.DB, file string) (*ConformanceReport, error) {
+	r := &ConformanceReport{File: file, counts: map[string]int{}}
+
+	if err := checkHeader(db, r); err != nil {
+		return nil, err
+	}
+
+	present, err := checkRequiredTables(db, r)
+	if err != nil {
+		return nil, err
+	}
+	if !present {
+		r.finish()
+		return r, nil
+	}
+
+	srsIDs, err := checkSpatialRefSys(db, r)
+	if err != nil {
+		return nil, err
+	}
+	contents, err := checkContents(db, r, srsIDs)
+	if err != nil {
+		return nil, err
+	}
+	columns, err := checkGeometryColumns(db, r, srsIDs, contents)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, c := range columns {
+		table, err := checkFeatureTable(db, r, c)
+		if err != nil {
+			return nil, err
+		}
+		if table == nil {
+			continue
+		}
+		if entry, ok := contents[c.table]; ok {
+			checkContentsBounds(r, entry, table)
+		}
+		r.Tables = append(r.Tables, table.ConformanceTable)
+	}
+
+	r.finish()
+	return r, nil
+}
+
+// checkHeader checks application_id, user_version and the SQLite integrity
+// and foreign key checks
+func checkHeader(db *sql.DB, r *ConformanceReport) error {
+	var applicationID, userVersion int64
+	if err := db.QueryRow("PRAGMA application_id").Scan(&applicationID); err != nil {
+		return fmt.Errorf("failed to read application_id: %w", err)
+	}
+	if uint32(applicationID) != gpkgApplicationID {
+		r.add(severityError, "application_id", "", nil,
+			"application_id is %#x, expected %#x (\"GPKG\")", uint32(applicationID), gpkgApplicationID)
+	}
+	if err := db.QueryRow("PRAGMA user_version").Scan(&userVersion); err != nil {
+		return fmt.Errorf("failed to read user_version: %w", err)
+	}
+	if userVersion < 10200 || userVersion >= 10400 {
+		r.add(severityWarning, "user_version", "", nil,
+			"user_version is %d, expected %d for GeoPackage 1.3", userVersion, gpkgUserVersion)
+	}
+
+	rows, err := db.Query("PRAGMA integrity_check")
+	if err != nil {
+		return fmt.Errorf("failed to run integrity_check: %w", err)
+	}
+	var messages []string
+	for rows.Next() {
+		var message string
+		if err := rows.Scan(&message); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to run integrity_check: %w", err)
+		}
+		if message != "ok" {
+			messages = append(messages, message)
+		}
+	}
+	rows.Close()
+	for _, message := range messages {
+		r.add(severityError, "integrity", "", nil, "%s", message)
+	}
+
+	rows, err = db.Query("PRAGMA foreign_key_check")
+	if err != nil {
+		return fmt.Errorf("failed to run foreign_key_check: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var table, parent string
+		var rowID sql.NullInt64
+		var fkid int
+		if err := rows.Scan(&table, &rowID, &parent, &fkid); err != nil {
+			return fmt.Errorf("failed to run foreign_key_check: %w", err)
+		}
+		var row *int64
+		if rowID.Valid {
+			row = &rowID.Int64
+		}
+		r.add(severityError, "foreign_key", table, row, "row references a missing row of %s", parent)
+	}
+	return rows.Err()
+}
+
+// checkRequiredTables checks the core tables and the columns of the core
+// and extension tables. It returns false if a core table is missing, as
+// the remaining checks need them.
+func checkRequiredTables(db *sql.DB, r *ConformanceReport) (bool, error) {
+	present := true
+	check := func(table string, columns []string, required bool) error {
+		have, err := tableColumns(db, table)
+		if err != nil {
+			return err
+		}
+		if len(have) == 0 {
+			if required {
+				r.add(severityError, "required_table", table, nil, "missing table %s", table)
+				present = false
+			}
+			return nil
+		}
+		for _, column := range columns {
+			if !have[column] {
+				r.add(severityError, "required_column", table, nil, "missing column %s", column)
+				if required {
+					present = false
+				}
+			}
+		}
+		return nil
+	}
+
+	for _, table := range []string{"gpkg_spatial_ref_sys", "gpkg_contents", "gpkg_geometry_columns"} {
+		if err := check(table, requiredColumns[table], true); err != nil {
+			return false, err
+		}
+	}
+	for _, table := range []string{
+		"gpkg_extensions", "gpkg_data_columns", "gpkg_data_column_constraints",
+		"gpkg_metadata", "gpkg_metadata_reference",
+	} {
+		if err := check(table, optionalColumns[table], false); err != nil {
+			return false, err
+		}
+	}
+	return present, nil
+}
+
+// checkSpatialRefSys checks the three required definitions and returns the
+// defined SRS ids
+func checkSpatialRefSys(db *sql.DB, r *ConformanceReport) (map[int]bool, error) {
+	rows, err := db.Query("SELECT srs_id FROM gpkg_spatial_ref_sys")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read gpkg_spatial_ref_sys: %w", err)
+	}
+	defer rows.Close()
+
+	srsIDs := map[int]bool{}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("failed to read gpkg_spatial_ref_sys: %w", err)
+		}
+		srsIDs[id] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read gpkg_spatial_ref_sys: %w", err)
+	}
+
+	for _, id := range []int{4326, -1, 0} {
+		if !srsIDs[id] {
+			r.add(severityError, "srs_required", "gpkg_spatial_ref_sys", nil, "missing required srs_id %d", id)
+		}
+	}
+	return srsIDs, nil
+}
+
+// contentsEntry is a row of gpkg_contents
+type contentsEntry struct {
+	dataType               string
+	srsID                  sql.NullInt64
+	minX, minY, maxX, maxY sql.NullFloat64
+}
+
+// checkContents checks the gpkg_contents rows: the table exists, the data
+// type is known, srs_id references a definition and last_change is a
+// timestamp
+func checkContents(db *sql.DB, r *ConformanceReport, srsIDs map[int]bool) (map[string]contentsEntry, error) {
+	rows, err := db.Query(`
+		SELECT c.table_name, c.data_type, c.srs_id, c.min_x, c.min_y, c.max_x, c.max_y,
+			CAST(c.last_change AS TEXT),
+			(SELECT count(*) FROM sqlite_master m WHERE m.name = c.table_name AND m.type IN ('table', 'view'))
+		FROM gpkg_contents c
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read gpkg_contents: %w", err)
+	}
+	defer rows.Close()
+
+	contents := map[string]contentsEntry{}
+	for rows.Next() {
+		var table string
+		var e contentsEntry
+		var lastChange sql.NullString
+		var exists int
+		if err := rows.Scan(&table, &e.dataType, &e.srsID, &e.minX, &e.minY, &e.maxX, &e.maxY, &lastChange, &exists); err != nil {
+			return nil, fmt.Errorf("failed to read gpkg_contents: %w", err)
+		}
+		contents[table] = e
+
+		if exists == 0 {
+			r.add(severityError, "contents_table", table, nil, "table or view %s does not exist", table)
+		}
+		switch e.dataType {
+		case "features", "attributes", "tiles", "2d-gridded-coverage":
+		default:
+			r.add(severityWarning, "contents_data_type", table, nil, "unknown data_type %q", e.dataType)
+		}
+		if e.srsID.Valid && !srsIDs[int(e.srsID.Int64)] {
+			r.add(severityError, "srs_reference", table, nil,
+				"gpkg_contents.srs_id %d is not in gpkg_spatial_ref_sys", e.srsID.Int64)
+		}
+		if e.dataType == "features" && !e.srsID.Valid {
+			r.add(severityError, "srs_reference", table, nil, "features table without srs_id in gpkg_contents")
+		}
+		if lastChange.Valid {
+			if _, err := time.Parse("2006-01-02T15:04:05.999Z", lastChange.String); err != nil {
+				if _, err := time.Parse("2006-01-02T15:04:05Z", lastChange.String); err != nil {
+					r.add(severityError, "contents_last_change", table, nil,
+						"last_change %q is not a UTC timestamp %%Y-%%m-%%dT%%H:%%M:%%fZ", lastChange.String)
+				}
+			}
+		}
+	}
+	return contents, rows.Err()
+}
+
+// registeredColumn is a row of gpkg_geometry_columns
+type registeredColumn struct {
+	table, column, geometryType string
+	srsID, z, m                 int
+}
+
+// checkGeometryColumns checks the gpkg_geometry_columns rows against
+// gpkg_contents and gpkg_spatial_ref_sys and returns the valid ones
+func checkGeometryColumns(db *sql.DB, r *ConformanceReport, srsIDs map[int]bool, contents map[string]contentsEntry) ([]registeredColumn, error) {
+	rows, err := db.Query(`
+		SELECT table_name, column_name, geometry_type_name, srs_id, z, m
+		FROM gpkg_geometry_columns
+		ORDER BY table_name
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read gpkg_geometry_columns: %w", err)
+	}
+	defer rows.Close()
+
+	var columns []registeredColumn
+	registered := map[string]bool{}
+	for rows.Next() {
+		var c registeredColumn
+		if err := rows.Scan(&c.table, &c.column, &c.geometryType, &c.srsID, &c.z, &c.m); err != nil {
+			return nil, fmt.Errorf("failed to read gpkg_geometry_columns: %w", err)
+		}
+		c.geometryType = strings.ToUpper(c.geometryType)
+		valid := true
+
+		if registered[c.table] {
+			r.add(severityError, "geometry_columns", c.table, nil, "more than one geometry column")
+			valid = false
+		}
+		registered[c.table] = true
+
+		entry, ok := contents[c.table]
+		switch {
+		case !ok:
+			r.add(severityError, "geometry_columns", c.table, nil, "table is not in gpkg_contents")
+			valid = false
+		case entry.dataType != "features":
+			r.add(severityError, "geometry_columns", c.table, nil, "gpkg_contents.data_type is %q, not features", entry.dataType)
+		case entry.srsID.Valid && int(entry.srsID.Int64) != c.srsID:
+			r.add(severityError, "srs_reference", c.table, nil,
+				"gpkg_geometry_columns.srs_id %d differs from gpkg_contents.srs_id %d", c.srsID, entry.srsID.Int64)
+		}
+		if !srsIDs[c.srsID] {
+			r.add(severityError, "srs_reference", c.table, nil,
+				"gpkg_geometry_columns.srs_id %d is not in gpkg_spatial_ref_sys", c.srsID)
+		}
+		if !geometryTypeNames[c.geometryType] {
+			r.add(severityError, "geometry_type", c.table, nil, "unknown geometry_type_name %q", c.geometryType)
+		}
+		if c.z < 0 || c.z > 2 || c.m < 0 || c.m > 2 {
+			r.add(severityError, "geometry_columns", c.table, nil, "z = %d and m = %d, expected 0, 1 or 2", c.z, c.m)
+		}
+		if valid {
+			columns = append(columns, c)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read gpkg_geometry_columns: %w", err)
+	}
+
+	for table, entry := range contents {
+		if entry.dataType == "features" && !registered[table] {
+			r.add(severityError, "geometry_columns", table, nil, "features table without a gpkg_geometry_columns row")
+		}
+	}
+	return columns, nil
+}
+
+// checkedTable is a feature table whose geometries were checked, with the
+// envelopes of its non-empty geometries by row id
+type checkedTable struct {
+	ConformanceTable
+	bounds    geom.Bounds
+	envelopes map[int64][4]float64
+}
+
+// checkFeatureTable checks the geometry blobs of a feature table against
+// its registration and its R-tree index. It returns nil if the table
+// cannot be read.
+func checkFeatureTable(db *sql.DB, r *ConformanceReport, c registeredColumn) (*checkedTable, error) {
+	pk, err := integerPrimaryKey(db, c.table)
+	if err != nil {
+		return nil, err
+	}
+	if pk == "" {
+		r.add(severityError, "primary_key", c.table, nil, "no INTEGER PRIMARY KEY column")
+		return nil, nil
+	}
+	columns, err := tableColumns(db, c.table)
+	if err != nil {
+		return nil, err
+	}
+	if !columns[c.column] {
+		r.add(severityError, "geometry_columns", c.table, nil, "geometry column %s does not exist", c.column)
+		return nil, nil
+	}
+
+	t := &checkedTable{
+		ConformanceTable: ConformanceTable{
+			Table:          c.table,
+			GeometryColumn: c.column,
+			GeometryType:   c.geometryType,
+			SRSID:          c.srsID,
+		},
+		bounds:    geom.EmptyBounds(),
+		envelopes: map[int64][4]float64{},
+	}
+
+	rows, err := db.Query(fmt.Sprintf(`SELECT "%s", "%s" FROM "%s"`, pk, c.column, c.table))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", c.table, err)
+	}
+	for rows.Next() {
+		var id int64
+		var blob []byte
+		if err := rows.Scan(&id, &blob); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to read %s: %w", c.table, err)
+		}
+		t.Features++
+		if blob == nil {
+			continue
+		}
+		checkGeometryBlob(r, c, t, id, blob)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", c.table, err)
+	}
+
+	if !t.bounds.IsEmpty() {
+		t.Extent = &[4]float64{t.bounds.MinX, t.bounds.MinY, t.bounds.MaxX, t.bounds.MaxY}
+	}
+
+	if err := checkSpatialIndex(db, r, c, t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// checkGeometryBlob checks the header, type, dimensions and envelope of
+// one geometry
+func checkGeometryBlob(r *ConformanceReport, c registeredColumn, t *checkedTable, id int64, blob []byte) {
+	row := &id
+	g, err := DecodeGPKG(blob)
+	if err != nil {
+		r.add(severityError, "geometry_header", c.table, row, "%v", err)
+		return
+	}
+	if g.Version != 0 {
+		r.add(severityError, "geometry_header", c.table, row, "version %d, expected 0", g.Version)
+	}
+	if int(g.SRSID) != c.srsID {
+		r.add(severityError, "geometry_srs", c.table, row, "srs_id %d, registered %d", g.SRSID, c.srsID)
+	}
+
+	geometryType := strings.ToUpper(g.Geometry.GeometryType())
+	if !geometryTypeConforms(c.geometryType, geometryType) {
+		r.add(severityError, "geometry_type", c.table, row, "%s in a %s column", geometryType, c.geometryType)
+	}
+
+	layout := g.Geometry.CoordLayout()
+	for _, dim := range []struct {
+		name    string
+		flag    int
+		present bool
+	}{{"Z", c.z, layout.HasZ()}, {"M", c.m, layout.HasM()}} {
+		if dim.flag == 0 && dim.present {
+			r.add(severityError, "geometry_dimensions", c.table, row, "%s values where they are prohibited", dim.name)
+		}
+		if dim.flag == 1 && !dim.present {
+			r.add(severityError, "geometry_dimensions", c.table, row, "no %s values where they are mandatory", dim.name)
+		}
+	}
+
+	empty := g.Geometry.IsEmpty()
+	if g.Empty != empty {
+		r.add(severityError, "geometry_header", c.table, row, "empty flag is %t for a geometry that is empty: %t", g.Empty, empty)
+	}
+	if empty {
+		return
+	}
+
+	envelope := CalculateEnvelope(g.Geometry)
+	t.envelopes[id] = envelope
+	t.bounds.Union(g.Geometry.Bounds())
+	if g.EnvelopeType == 0 {
+		return
+	}
+
+	expected := envelope[:]
+	hasZ, hasM := g.EnvelopeType == 2 || g.EnvelopeType == 4, g.EnvelopeType == 3 || g.EnvelopeType == 4
+	if hasZ {
+		minZ, maxZ, ok := geom.OrdinateRange(g.Geometry, false)
+		if !ok {
+			r.add(severityError, "envelope", c.table, row, "envelope has Z but the geometry has none")
+			return
+		}
+		expected = append(expected, minZ, maxZ)
+	}
+	if hasM {
+		minM, maxM, ok := geom.OrdinateRange(g.Geometry, true)
+		if !ok {
+			r.add(severityError, "envelope", c.table, row, "envelope has M but the geometry has none")
+			return
+		}
+		expected = append(expected, minM, maxM)
+	}
+	for i, v := range expected {
+		if !nearlyEqual(g.Envelope[i], v, 1e-9) {
+			r.add(severityError, "envelope", c.table, row, "envelope %v does not match the geometry %v", g.Envelope, expected)
+			return
+		}
+	}
+}
+
+// checkSpatialIndex checks the R-tree of a geometry column registered with
+// gpkg_rtree_index: it must hold one entry per non-empty geometry covering
+// its envelope, and the maintenance triggers must exist
+func checkSpatialIndex(db *sql.DB, r *ConformanceReport, c registeredColumn, t *checkedTable) error {
+	var registered int
+	err := db.QueryRow(`
+		SELECT count(*) FROM sqlite_master WHERE name = 'gpkg_extensions'
+	`).Scan(&registered)
+	if err != nil {
+		return fmt.Errorf("failed to read schema: %w", err)
+	}
+	if registered > 0 {
+		err = db.QueryRow(`
+			SELECT count(*) FROM gpkg_extensions
+			WHERE table_name = ? AND column_name = ? AND extension_name = 'gpkg_rtree_index'
+		`, c.table, c.column).Scan(&registered)
+		if err != nil {
+			return fmt.Errorf("failed to read gpkg_extensions: %w", err)
+		}
+	}
+	if registered == 0 {
+		return nil
+	}
+	t.SpatialIndex = true
+
+	rtree := rtreeTable(c.table, c.column)
+	var exists int
+	if err := db.QueryRow("SELECT count(*) FROM sqlite_master WHERE name = ?", rtree).Scan(&exists); err != nil {
+		return fmt.Errorf("failed to read schema: %w", err)
+	}
+	if exists == 0 {
+		r.add(severityError, "rtree", c.table, nil, "gpkg_rtree_index is registered but %s does not exist", rtree)
+		return nil
+	}
+
+	rows, err := db.Query(fmt.Sprintf(`SELECT id, minx, maxx, miny, maxy FROM "%s"`, rtree))
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", rtree, err)
+	}
+	seen := map[int64]bool{}
+	for rows.Next() {
+		var id int64
+		var e [4]float64
+		if err := rows.Scan(&id, &e[0], &e[1], &e[2], &e[3]); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to read %s: %w", rtree, err)
+		}
+		seen[id] = true
+		row := &id
+		envelope, ok := t.envelopes[id]
+		if !ok {
+			r.add(severityError, "rtree", c.table, row, "R-tree entry without a non-empty geometry")
+			continue
+		}
+		// R-tree coordinates are 32-bit floats rounded outwards
+		if !nearlyEqual(e[0], envelope[0], 1e-6) || !nearlyEqual(e[1], envelope[1], 1e-6) ||
+			!nearlyEqual(e[2], envelope[2], 1e-6) || !nearlyEqual(e[3], envelope[3], 1e-6) {
+			r.add(severityError, "rtree", c.table, row, "R-tree entry %v does not match the envelope %v", e, envelope)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to read %s: %w", rtree, err)
+	}
+	for id := range t.envelopes {
+		if !seen[id] {
+			row := id
+			r.add(severityError, "rtree", c.table, &row, "geometry missing from the R-tree")
+		}
+	}
+
+	// Insert and delete are needed by every trigger set; the update
+	// triggers differ between GeoPackage versions
+	triggers := map[string]bool{}
+	trows, err := db.Query("SELECT name FROM sqlite_master WHERE type = 'trigger' AND tbl_name = ?", c.table)
+	if err != nil {
+		return fmt.Errorf("failed to read triggers of %s: %w", c.table, err)
+	}
+	defer trows.Close()
+	for trows.Next() {
+		var name string
+		if err := trows.Scan(&name); err != nil {
+			return fmt.Errorf("failed to read triggers of %s: %w", c.table, err)
+		}
+		triggers[name] = true
+	}
+	for _, suffix := range []string{"insert", "delete"} {
+		if name := rtree + "_" + suffix; !triggers[name] {
+			r.add(severityError, "rtree_triggers", c.table, nil, "missing trigger %s", name)
+		}
+	}
+	var updates int
+	for name := range triggers {
+		if strings.HasPrefix(name, rtree+"_update") {
+			updates++
+		}
+	}
+	if updates == 0 {
+		r.add(severityError, "rtree_triggers", c.table, nil, "missing update triggers %s_update*", rtree)
+	}
+	return trows.Err()
+}
+
+// checkContentsBounds checks that the gpkg_contents bounds of a table cover
+// the extent of its geometries
+func checkContentsBounds(r *ConformanceReport, e contentsEntry, t *checkedTable) {
+	if !e.minX.Valid || !e.minY.Valid || !e.maxX.Valid || !e.maxY.Valid {
+		if !t.bounds.IsEmpty() {
+			r.add(severityWarning, "contents_bounds", t.Table, nil, "gpkg_contents has no bounds")
+		}
+		return
+	}
+	if t.bounds.IsEmpty() {
+		return
+	}
+	b := t.bounds
+	if e.minX.Float64 > b.MinX && !nearlyEqual(e.minX.Float64, b.MinX, 1e-9) ||
+		e.minY.Float64 > b.MinY && !nearlyEqual(e.minY.Float64, b.MinY, 1e-9) ||
+		e.maxX.Float64 < b.MaxX && !nearlyEqual(e.maxX.Float64, b.MaxX, 1e-9) ||
+		e.maxY.Float64 < b.MaxY && !nearlyEqual(e.maxY.Float64, b.MaxY, 1e-9) {
+		r.add(severityError, "contents_bounds", t.Table, nil,
+			"gpkg_contents bounds [%v %v %v %v] do not cover the extent [%v %v %v %v]",
+			e.minX.Float64, e.minY.Float64, e.maxX.Float64, e.maxY.Float64, b.MinX, b.MinY, b.MaxX, b.MaxY)
+	}
+}
+
+// integerPrimaryKey returns the INTEGER PRIMARY KEY column of a table, or
+// "" if it has none
+func integerPrimaryKey(db *sql.DB, table string) (string, error) {
+	rows, err := db.Query(fmt.Sprintf("SELECT name, type, pk FROM pragma_table_info('%s')", table))
+	if err != nil {
+		return "", fmt.Errorf("failed to read columns of %s: %w", table, err)
+	}
+	defer rows.Close()
+
+	var key string
+	var keys int
+	for rows.Next() {
+		var name, columnType string
+		var pk int
+		if err := rows.Scan(&name, &columnType, &pk); err != nil {
+			return "", fmt.Errorf("failed to read columns of %s: %w", table, err)
+		}
+		if pk > 0 {
+			keys++
+			if strings.EqualFold(columnType, "INTEGER") {
+				key = name
+			}
+		}
+	}
+	if keys != 1 {
+		return "", rows.Err()
+	}
+	return key, rows.Err()
+}
+
+// geometryTypeConforms reports whether a geometry of the given type may be
+// stored in a column registered with the given type
+func geometryTypeConforms(registered, actual string) bool {
+	switch registered {
+	case actual, "GEOMETRY":
+		return true
+	case "GEOMETRYCOLLECTION":
+		return actual == "MULTIPOINT" || actual == "MULTILINESTRING" || actual == "MULTIPOLYGON"
+	case "MULTICURVE":
+		return actual == "MULTILINESTRING"
+	case "MULTISURFACE":
+		return actual == "MULTIPOLYGON"
+	case "CURVE":
+		return actual == "LINESTRING"
+	case "SURFACE":
+		return actual == "POLYGON"
+	}
+	return false
+}
+
+// nearlyEqual compares two coordinates with a relative tolerance
+func nearlyEqual(a, b, tolerance float64) bool {
+	return math.Abs(a-b) <= tolerance*math.Max(1, math.Max(math.Abs(a), math.Abs(b)))
+}
@@ -0,0 +1,44 @@
+package main
+
+import "unicode/utf8"
+
+// cp1251High are the characters of Windows-1251 bytes 0x80-0xBF; 0x98 is
+// unassigned. Bytes 0xC0-0xFF are А-я in order.
+var cp1251High = [64]rune{
+	'Ђ', 'Ѓ', '‚', 'ѓ', '„', '…', '†', '‡', '€', '‰', 'Љ', '‹', 'Њ', 'Ќ', 'Ћ', 'Џ',
+	'ђ', '‘', '’', '“', '”', '•', '–', '—', utf8.RuneError, '™', 'љ', '›', 'њ', 'ќ', 'ћ', 'џ',
+	'\u00a0', 'Ў', 'ў', 'Ј', '¤', 'Ґ', '¦', '§', 'Ё', '©', 'Є', '«', '¬', '\u00ad', '®', 'Ї',
+	'°', '±', 'І', 'і', 'ґ', 'µ', '¶', '·', 'ё', '№', 'є', '»', 'ј', 'Ѕ', 'ѕ', 'ї',
+}
+
+// cp1251Bytes maps the characters of cp1251High to their bytes
+var cp1251Bytes = func() map[rune]byte {
+	m := make(map[rune]byte, len(cp1251High))
+	for i, r := range cp1251High {
+		if r != utf8.RuneError {
+			m[r] = byte(0x80 + i)
+		}
+	}
+	return m
+}()
+
+// encodeCP1251 encodes a string in Windows-1251, replacing characters the
+// code page lacks with '?'
+func encodeCP1251(s string) []byte {
+	b := make([]byte, 0, len(s))
+	for _, r := range s {
+		switch {
+		case r < 0x80:
+			b = append(b, byte(r))
+		case r >= 'А' && r <= 'я':
+			b = append(b, byte(r-'А'+0xC0))
+		default:
+			if c, ok := cp1251Bytes[r]; ok {
+				b = append(b, c)
+			} else {
+				b = append(b, '?')
+			}
+		}
+	}
+	return b
+}
@@ -0,0 +1,186 @@
+// Package crs is a small coordinate reference system registry and
+// transformer. It covers the systems the exporters write: WGS 84, Web
+// Mercator, UTM, Pulkovo 1942 Gauss-Krüger, ГСК-2011 and the МСК-16 local
+// systems of Tatarstan, with datum shifts done by 7-parameter Helmert
+// transformations through WGS 84.
+package crs
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// CRS is a registered coordinate reference system
+type CRS struct {
+	// SRSID is the identifier used in gpkg_spatial_ref_sys; it equals the
+	// EPSG code for EPSG systems
+	SRSID          int
+	Name           string
+	Organization   string
+	OrganizationID int
+	Description    string
+	Aliases        []string
+
+	Datum Datum
+	// Projection is nil for geographic systems, whose coordinates are
+	// longitude and latitude in degrees
+	Projection Projection
+
+	// definition overrides the generated WKT
+	definition string
+}
+
+// IsGeographic reports whether coordinates are longitude and latitude
+func (c *CRS) IsGeographic() bool {
+	return c.Projection == nil
+}
+
+// String returns the organization and identifier, e.g. EPSG:4326
+func (c *CRS) String() string {
+	return fmt.Sprintf("%s:%d", c.Organization, c.OrganizationID)
+}
+
+// URN returns the OGC URN of the system, as used by the legacy GeoJSON
+// "crs" member
+func (c *CRS) URN() string {
+	return fmt.Sprintf("urn:ogc:def:crs:%s::%d", c.Organization, c.OrganizationID)
+}
+
+// WKT returns the OGC WKT 1 definition of the system, including the
+// TOWGS84 parameters of non-WGS 84 datums
+func (c *CRS) WKT() string {
+	if c.definition != "" {
+		return c.definition
+	}
+
+	d := c.Datum
+	geogcs := fmt.Sprintf(`GEOGCS["%s",DATUM["%s",SPHEROID["%s",%s,%s]`,
+		d.CRSName, d.Name, d.Ellipsoid.Name, formatNumber(d.Ellipsoid.A), formatNumber(d.Ellipsoid.InvF))
+	if !d.ToWGS84.IsZero() {
+		h := d.ToWGS84
+		geogcs += fmt.Sprintf(`,TOWGS84[%s,%s,%s,%s,%s,%s,%s]`,
+			formatNumber(h.DX), formatNumber(h.DY), formatNumber(h.DZ),
+			formatNumber(h.RX), formatNumber(h.RY), formatNumber(h.RZ), formatNumber(h.DS))
+	}
+	geogcs += `],PRIMEM["Greenwich",0],UNIT["degree",0.0174532925199433]`
+
+	if c.IsGeographic() {
+		return geogcs + c.authority() + "]"
+	}
+	return fmt.Sprintf(`PROJCS["%s",%s],%s,UNIT["metre",1],AXIS["Easting",EAST],AXIS["Northing",NORTH]%s]`,
+		c.Name, geogcs, c.Projection.wkt(), c.authority())
+}
+
+func (c *CRS) authority() string {
+	if c.Organization != "EPSG" {
+		return ""
+	}
+	return fmt.Sprintf(`,AUTHORITY["EPSG","%d"]`, c.OrganizationID)
+}
+
+func formatNumber(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// registry holds the known systems by SRS id
+var registry = map[int]*CRS{}
+
+// Register adds a system to the registry, replacing one with the same SRS id
+func Register(c *CRS) {
+	registry[c.SRSID] = c
+}
+
+// Lookup finds a system by SRS id ("3857"), organization code
+// ("EPSG:3857") or alias ("msk16-1"), ignoring case
+func Lookup(name string) (*CRS, error) {
+	key := strings.ToLower(strings.TrimSpace(name))
+	key = strings.TrimPrefix(key, "epsg:")
+
+	if id, err := strconv.Atoi(key); err == nil {
+		if c, ok := registry[id]; ok {
+			return c, nil
+		}
+	}
+	for _, c := range registry {
+		if strings.EqualFold(c.String(), name) {
+			return c, nil
+		}
+		for _, alias := range c.Aliases {
+			if alias == key {
+				return c, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("unknown CRS %q (known: %s)", name, strings.Join(Names(), ", "))
+}
+
+// MustLookup is like Lookup but panics for systems that are not registered
+func MustLookup(name string) *CRS {
+	c, err := Lookup(name)
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
+// All returns the registered systems ordered by SRS id
+func All() []*CRS {
+	all := make([]*CRS, 0, len(registry))
+	for _, c := range registry {
+		all = append(all, c)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].SRSID < all[j].SRSID })
+	return all
+}
+
+// Names returns the organization codes of the registered systems
+func Names() []string {
+	var names []string
+	for _, c := range All() {
+		names = append(names, c.String())
+	}
+	return names
+}
+
+// Transformer converts coordinates between two systems: unproject, shift
+// the datum through WGS 84 if the datums differ, and project again
+type Transformer struct {
+	From, To *CRS
+}
+
+// NewTransformer returns a transformer from one system to another
+func NewTransformer(from, to *CRS) *Transformer {
+	return &Transformer{From: from, To: to}
+}
+
+// Identity reports whether the transformation leaves coordinates unchanged
+func (t *Transformer) Identity() bool {
+	return t.From == t.To
+}
+
+// Transform converts one position; geographic coordinates are longitude
+// and latitude in degrees
+func (t *Transformer) Transform(x, y float64) (float64, float64) {
+	if t.Identity() {
+		return x, y
+	}
+
+	lon, lat := x, y
+	if t.From.Projection != nil {
+		lon, lat = t.From.Projection.Inverse(x, y)
+	}
+
+	if t.From.Datum != t.To.Datum {
+		gx, gy, gz := t.From.Datum.Ellipsoid.toGeocentric(lon, lat)
+		gx, gy, gz = t.From.Datum.ToWGS84.forward(gx, gy, gz)
+		gx, gy, gz = t.To.Datum.ToWGS84.inverse(gx, gy, gz)
+		lon, lat = t.To.Datum.Ellipsoid.fromGeocentric(gx, gy, gz)
+	}
+
+	if t.To.Projection != nil {
+		return t.To.Projection.Forward(lon, lat)
+	}
+	return lon, lat
+}
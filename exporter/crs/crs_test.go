@@ -0,0 +1,184 @@
+package crs
+
+import (
+	"math"
+	"testing"
+)
+
+// dms converts degrees, minutes and seconds to decimal degrees
+func dms(d, m, s float64) float64 {
+	return math.Copysign(math.Abs(d)+m/60+s/3600, d)
+}
+
+// Published control points of the projections. Points of systems without
+// EPSG examples use the meridian quadrant, which a transverse Mercator
+// projection maps to the northing of the pole on its central meridian.
+var projectionTests = []struct {
+	name       string
+	projection Projection
+	lon, lat   float64
+	x, y       float64
+}{
+	{
+		// EPSG Guidance Note 7-2, Popular Visualisation Pseudo Mercator
+		name:       "EPSG:3857",
+		projection: WebMercator.Projection,
+		lon:        dms(-100, 20, 0), lat: dms(24, 22, 54.433),
+		x: -11169055.58, y: 2800000.00,
+	},
+	{
+		name:       "EPSG:3857 origin",
+		projection: WebMercator.Projection,
+		lon:        0, lat: 0,
+		x: 0, y: 0,
+	},
+	{
+		// GeographicLib GeoConvert example 33.3N 44.4E = 38n 444140.54
+		// 3684706.36, moved from zone 38 to the same offset in zone 39
+		name:       "EPSG:32639",
+		projection: UTM39N.Projection,
+		lon:        50.4, lat: 33.3,
+		x: 444140.54, y: 3684706.36,
+	},
+	{
+		name:       "EPSG:32639 origin",
+		projection: UTM39N.Projection,
+		lon:        51, lat: 0,
+		x: 500000, y: 0,
+	},
+	{
+		// Quadrant of the WGS 84 meridian: 10001965.729 m
+		name:       "EPSG:32639 pole",
+		projection: UTM39N.Projection,
+		lon:        51, lat: 90,
+		x: 500000, y: 0.9996 * 10001965.729,
+	},
+	{
+		// Quadrant of the Krassowsky meridian: 10002137.497 m
+		name:       "EPSG:28409 pole",
+		projection: Pulkovo1942GK9.Projection,
+		lon:        51, lat: 90,
+		x: 9500000, y: 10002137.497,
+	},
+	{
+		name:       "EPSG:28409 origin",
+		projection: Pulkovo1942GK9.Projection,
+		lon:        51, lat: 0,
+		x: 9500000, y: 0,
+	},
+	{
+		name:       "MSK-16 zone 1 pole",
+		projection: MSK16Z1.Projection,
+		lon:        49.03333333333, lat: 90,
+		x: 1300000, y: 10002137.497 - 5709414.70,
+	},
+	{
+		name:       "MSK-16 zone 2 pole",
+		projection: MSK16Z2.Projection,
+		lon:        52.03333333333, lat: 90,
+		x: 2300000, y: 10002137.497 - 5709414.70,
+	},
+	{
+		// Snyder, Map Projections: A Working Manual, p. 269: UTM on the
+		// Clarke 1866 ellipsoid
+		name:       "Snyder transverse Mercator",
+		projection: NewTransverseMercator(Ellipsoid{A: 6378206.4, InvF: 294.978698214}, -75, 0.9996, 0, 0),
+		lon:        dms(-73, 30, 0), lat: dms(40, 30, 0),
+		x: 127106.5, y: 4484124.4,
+	},
+}
+
+func TestProjectionControlPoints(t *testing.T) {
+	for _, tt := range projectionTests {
+		x, y := tt.projection.Forward(tt.lon, tt.lat)
+		if math.Abs(x-tt.x) > 0.05 || math.Abs(y-tt.y) > 0.05 {
+			t.Errorf("%s: forward (%v, %v) = (%.3f, %.3f), want (%.2f, %.2f)", tt.name, tt.lon, tt.lat, x, y, tt.x, tt.y)
+		}
+		lon, lat := tt.projection.Inverse(tt.x, tt.y)
+		if math.Abs(lat-tt.lat) > 1e-6 || (math.Abs(tt.lat) < 90 && math.Abs(lon-tt.lon) > 1e-6) {
+			t.Errorf("%s: inverse (%.2f, %.2f) = (%.9f, %.9f), want (%.9f, %.9f)", tt.name, tt.x, tt.y, lon, lat, tt.lon, tt.lat)
+		}
+	}
+}
+
+// EPSG Guidance Note 7-2: British National Grid, whose latitude of origin
+// of 49°N is applied by subtracting the northing of the origin
+func TestTransverseMercatorLatitudeOfOrigin(t *testing.T) {
+	airy := Ellipsoid{A: 6377563.396, InvF: 299.3249646}
+	p := NewTransverseMercator(airy, -2, 0.9996012717, 400000, -100000)
+	_, origin := p.Forward(-2, 49)
+	x, y := p.Forward(dms(0, 30, 0), dms(50, 30, 0))
+	y -= origin + 100000
+	if math.Abs(x-577274.99) > 0.01 || math.Abs(y-69740.50) > 0.01 {
+		t.Errorf("forward = (%.3f, %.3f), want (577274.99, 69740.50)", x, y)
+	}
+}
+
+// EPSG Guidance Note 7-2, Position Vector transformation from WGS 72 to
+// WGS 84
+func TestHelmert(t *testing.T) {
+	h := Helmert{DZ: 4.5, RZ: 0.554, DS: 0.219}
+	x, y, z := h.forward(3657660.66, 255768.55, 5201382.11)
+	if math.Abs(x-3657660.78) > 0.01 || math.Abs(y-255778.43) > 0.01 || math.Abs(z-5201387.75) > 0.01 {
+		t.Errorf("forward = (%.3f, %.3f, %.3f), want (3657660.78, 255778.43, 5201387.75)", x, y, z)
+	}
+	x, y, z = h.inverse(x, y, z)
+	if math.Abs(x-3657660.66) > 0.001 || math.Abs(y-255768.55) > 0.001 || math.Abs(z-5201382.11) > 0.001 {
+		t.Errorf("inverse = (%.4f, %.4f, %.4f), want (3657660.66, 255768.55, 5201382.11)", x, y, z)
+	}
+}
+
+func TestGeocentricRoundTrip(t *testing.T) {
+	for _, e := range []Ellipsoid{WGS84Ellipsoid, KrassowskyEllipsoid, GSK2011Ellipsoid} {
+		for _, p := range [][2]float64{{0, 0}, {49.1, 55.8}, {-120, -45}, {179.9, 89.9}} {
+			lon, lat := e.fromGeocentric(e.toGeocentric(p[0], p[1]))
+			if math.Abs(lon-p[0]) > 1e-11 || math.Abs(lat-p[1]) > 1e-11 {
+				t.Errorf("%s: (%v, %v) came back as (%v, %v)", e.Name, p[0], p[1], lon, lat)
+			}
+		}
+	}
+}
+
+// Positions across Tatarstan, within the МСК-16 zones and Gauss-Krüger
+// zone 9
+var tatarstan = [][2]float64{
+	{49.1221, 55.7887}, // Kazan
+	{52.4039, 55.7436}, // Naberezhnye Chelny
+	{48.5, 54.3},
+	{53.9, 56.6},
+}
+
+func TestTransformRoundTrip(t *testing.T) {
+	for _, c := range All() {
+		forward, inverse := NewTransformer(WGS84, c), NewTransformer(c, WGS84)
+		for _, p := range tatarstan {
+			x, y := forward.Transform(p[0], p[1])
+			lon, lat := inverse.Transform(x, y)
+			// 1e-8 degrees is about a millimetre
+			if math.Abs(lon-p[0]) > 1e-8 || math.Abs(lat-p[1]) > 1e-8 {
+				t.Errorf("%s: (%v, %v) came back as (%.10f, %.10f)", c, p[0], p[1], lon, lat)
+			}
+		}
+	}
+}
+
+// The datum shift of the Pulkovo 1942 systems moves positions in Tatarstan
+// by about 106 m; without it the projected coordinates would match the
+// projection of the WGS 84 position
+func TestTransformDatumShift(t *testing.T) {
+	for _, c := range []*CRS{Pulkovo1942GK9, MSK16Z1, MSK16Z2} {
+		p := tatarstan[0]
+		x, y := NewTransformer(WGS84, c).Transform(p[0], p[1])
+		px, py := c.Projection.Forward(p[0], p[1])
+		shift := math.Hypot(x-px, y-py)
+		if shift < 100 || shift > 110 {
+			t.Errorf("%s: datum shift of %.1f m, want about 106 m", c, shift)
+		}
+	}
+
+	// Web Mercator shares the WGS 84 datum and converts exactly
+	x, y := NewTransformer(WebMercator, WGS84).Transform(NewTransformer(WGS84, WebMercator).Transform(49.1221, 55.7887))
+	if math.Abs(x-49.1221) > 1e-12 || math.Abs(y-55.7887) > 1e-12 {
+		t.Errorf("EPSG:3857: came back as (%v, %v)", x, y)
+	}
+}
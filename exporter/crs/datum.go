@@ -0,0 +1,123 @@
+package crs
+
+import "math"
+
+// Ellipsoid is a reference ellipsoid given by its semi-major axis and
+// inverse flattening
+type Ellipsoid struct {
+	Name string
+	A    float64 // semi-major axis, metres
+	InvF float64 // inverse flattening
+}
+
+// Reference ellipsoids used by the registered systems
+var (
+	WGS84Ellipsoid      = Ellipsoid{Name: "WGS 84", A: 6378137, InvF: 298.257223563}
+	KrassowskyEllipsoid = Ellipsoid{Name: "Krassowsky 1940", A: 6378245, InvF: 298.3}
+	GSK2011Ellipsoid    = Ellipsoid{Name: "GSK-2011", A: 6378136.5, InvF: 298.2564151}
+)
+
+// F returns the flattening
+func (e Ellipsoid) F() float64 {
+	return 1 / e.InvF
+}
+
+// E2 returns the first eccentricity squared
+func (e Ellipsoid) E2() float64 {
+	f := e.F()
+	return f * (2 - f)
+}
+
+// toGeocentric converts geodetic longitude and latitude (degrees) at zero
+// height to earth-centred cartesian coordinates
+func (e Ellipsoid) toGeocentric(lon, lat float64) (x, y, z float64) {
+	phi, lambda := lat*math.Pi/180, lon*math.Pi/180
+	e2 := e.E2()
+	sinPhi := math.Sin(phi)
+	n := e.A / math.Sqrt(1-e2*sinPhi*sinPhi)
+	x = n * math.Cos(phi) * math.Cos(lambda)
+	y = n * math.Cos(phi) * math.Sin(lambda)
+	z = n * (1 - e2) * sinPhi
+	return x, y, z
+}
+
+// fromGeocentric converts earth-centred cartesian coordinates to geodetic
+// longitude and latitude in degrees, iterating on the latitude
+func (e Ellipsoid) fromGeocentric(x, y, z float64) (lon, lat float64) {
+	e2 := e.E2()
+	p := math.Hypot(x, y)
+	lambda := math.Atan2(y, x)
+	phi := math.Atan2(z, p*(1-e2))
+	for i := 0; i < 10; i++ {
+		sinPhi := math.Sin(phi)
+		n := e.A / math.Sqrt(1-e2*sinPhi*sinPhi)
+		next := math.Atan2(z+e2*n*sinPhi, p)
+		if math.Abs(next-phi) < 1e-14 {
+			phi = next
+			break
+		}
+		phi = next
+	}
+	return lambda * 180 / math.Pi, phi * 180 / math.Pi
+}
+
+// Helmert is a 7-parameter similarity transformation to WGS 84 in the
+// position vector convention (the PROJ +towgs84 convention)
+type Helmert struct {
+	DX, DY, DZ float64 // translations, metres
+	RX, RY, RZ float64 // rotations, arc-seconds
+	DS         float64 // scale difference, parts per million
+}
+
+// IsZero reports whether the transformation is the identity
+func (h Helmert) IsZero() bool {
+	return h == Helmert{}
+}
+
+// forward applies the transformation to geocentric coordinates
+func (h Helmert) forward(x, y, z float64) (float64, float64, float64) {
+	const arcsec = math.Pi / (180 * 3600)
+	rx, ry, rz := h.RX*arcsec, h.RY*arcsec, h.RZ*arcsec
+	s := 1 + h.DS*1e-6
+	return h.DX + s*(x-rz*y+ry*z),
+		h.DY + s*(rz*x+y-rx*z),
+		h.DZ + s*(-ry*x+rx*y+z)
+}
+
+// inverse undoes the transformation; with rotations of a few arc-seconds
+// negating the parameters is exact to well below a millimetre
+func (h Helmert) inverse(x, y, z float64) (float64, float64, float64) {
+	inv := Helmert{DX: -h.DX, DY: -h.DY, DZ: -h.DZ, RX: -h.RX, RY: -h.RY, RZ: -h.RZ, DS: -h.DS}
+	return inv.forward(x, y, z)
+}
+
+// Datum is a geodetic datum: an ellipsoid and its transformation to WGS 84
+type Datum struct {
+	Name      string // WKT datum name
+	CRSName   string // name of the geographic system on the datum
+	Ellipsoid Ellipsoid
+	ToWGS84   Helmert
+}
+
+// Datums of the registered systems
+var (
+	WGS84Datum = Datum{Name: "WGS_1984", CRSName: "WGS 84", Ellipsoid: WGS84Ellipsoid}
+
+	// Pulkovo 1942 (СК-42) with the GOST R 51794-2008 parameters, also
+	// used by the МСК-16 local systems derived from it
+	Pulkovo1942Datum = Datum{
+		Name:      "Pulkovo_1942",
+		CRSName:   "Pulkovo 1942",
+		Ellipsoid: KrassowskyEllipsoid,
+		ToWGS84:   Helmert{DX: 23.57, DY: -140.95, DZ: -79.8, RX: 0, RY: 0.35, RZ: 0.79, DS: -0.22},
+	}
+
+	// ГСК-2011 composed from the GOST 32453-2017 transformations
+	// ГСК-2011 → ПЗ-90.11 → WGS 84
+	GSK2011Datum = Datum{
+		Name:      "Geodezicheskaya_Sistema_Koordinat_2011",
+		CRSName:   "GSK-2011",
+		Ellipsoid: GSK2011Ellipsoid,
+		ToWGS84:   Helmert{DX: -0.013, DY: 0.120, DZ: 0.014, RX: -0.002862, RY: 0.003521, RZ: -0.004157, DS: -0.0086},
+	}
+)
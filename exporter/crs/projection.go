@@ -0,0 +1,183 @@
+package crs
+
+import (
+	"fmt"
+	"math"
+)
+
+// Projection maps geodetic longitude and latitude in degrees on the datum
+// ellipsoid to projected easting and northing in metres
+type Projection interface {
+	Forward(lon, lat float64) (x, y float64)
+	Inverse(x, y float64) (lon, lat float64)
+	// wkt returns the PROJECTION and PARAMETER elements of a WKT 1 PROJCS
+	wkt() string
+	// conversion returns the PROJJSON conversion of a ProjectedCRS
+	conversion() map[string]interface{}
+}
+
+// SphericalMercator is the spherical Mercator projection of EPSG:3857, which
+// treats WGS 84 coordinates as if they were on a sphere of radius a
+type SphericalMercator struct{}
+
+// webMercatorRadius is the sphere radius of EPSG:3857; pi times it is the
+// familiar 20037508.342789244 half width of the projection
+const webMercatorRadius = 6378137.0
+
+// Forward projects longitude and latitude to Web Mercator
+func (SphericalMercator) Forward(lon, lat float64) (float64, float64) {
+	x := webMercatorRadius * lon * math.Pi / 180
+	y := webMercatorRadius * math.Log(math.Tan(math.Pi/4+lat*math.Pi/360))
+	return x, y
+}
+
+// Inverse unprojects Web Mercator coordinates to longitude and latitude
+func (SphericalMercator) Inverse(x, y float64) (float64, float64) {
+	lon := x / webMercatorRadius * 180 / math.Pi
+	lat := (2*math.Atan(math.Exp(y/webMercatorRadius)) - math.Pi/2) * 180 / math.Pi
+	return lon, lat
+}
+
+func (SphericalMercator) wkt() string {
+	return `PROJECTION["Mercator_1SP"],PARAMETER["central_meridian",0],PARAMETER["scale_factor",1],` +
+		`PARAMETER["false_easting",0],PARAMETER["false_northing",0]`
+}
+
+func (SphericalMercator) conversion() map[string]interface{} {
+	return projjsonConversion("Popular Visualisation Pseudo-Mercator", "Popular Visualisation Pseudo Mercator", 1024,
+		projjsonParameter("Latitude of natural origin", 0, "degree", 8801),
+		projjsonParameter("Longitude of natural origin", 0, "degree", 8802),
+		projjsonParameter("False easting", 0, "metre", 8806),
+		projjsonParameter("False northing", 0, "metre", 8807))
+}
+
+// TransverseMercator is the ellipsoidal transverse Mercator projection
+// (Gauss-Krüger, UTM) with latitude of origin 0, computed with Krüger's
+// series to sixth order in the third flattening, accurate to a few
+// nanometres within 3900 km of the central meridian
+type TransverseMercator struct {
+	Ellipsoid       Ellipsoid
+	CentralMeridian float64 // degrees
+	ScaleFactor     float64
+	FalseEasting    float64
+	FalseNorthing   float64
+
+	e      float64
+	radius float64 // rectifying radius A
+	alpha  [6]float64
+	beta   [6]float64
+}
+
+// NewTransverseMercator returns a transverse Mercator projection with the
+// series coefficients of the ellipsoid precomputed
+func NewTransverseMercator(e Ellipsoid, centralMeridian, scaleFactor, falseEasting, falseNorthing float64) *TransverseMercator {
+	p := &TransverseMercator{
+		Ellipsoid:       e,
+		CentralMeridian: centralMeridian,
+		ScaleFactor:     scaleFactor,
+		FalseEasting:    falseEasting,
+		FalseNorthing:   falseNorthing,
+	}
+
+	f := e.F()
+	n := f / (2 - f)
+	n2, n3 := n*n, n*n*n
+	n4, n5, n6 := n3*n, n3*n2, n3*n3
+
+	p.e = math.Sqrt(e.E2())
+	p.radius = e.A / (1 + n) * (1 + n2/4 + n4/64 + n6/256)
+	p.alpha = [6]float64{
+		n/2 - 2*n2/3 + 5*n3/16 + 41*n4/180 - 127*n5/288 + 7891*n6/37800,
+		13*n2/48 - 3*n3/5 + 557*n4/1440 + 281*n5/630 - 1983433*n6/1935360,
+		61*n3/240 - 103*n4/140 + 15061*n5/26880 + 167603*n6/181440,
+		49561*n4/161280 - 179*n5/168 + 6601661*n6/7257600,
+		34729*n5/80640 - 3418889*n6/1995840,
+		212378941 * n6 / 319334400,
+	}
+	p.beta = [6]float64{
+		n/2 - 2*n2/3 + 37*n3/96 - n4/360 - 81*n5/512 + 96199*n6/604800,
+		n2/48 + n3/15 - 437*n4/1440 + 46*n5/105 - 1118711*n6/3870720,
+		17*n3/480 - 37*n4/840 - 209*n5/4480 + 5569*n6/90720,
+		4397*n4/161280 - 11*n5/504 - 830251*n6/7257600,
+		4583*n5/161280 - 108847*n6/3991680,
+		20648693 * n6 / 638668800,
+	}
+	return p
+}
+
+// Forward projects longitude and latitude to easting and northing
+func (p *TransverseMercator) Forward(lon, lat float64) (float64, float64) {
+	phi := lat * math.Pi / 180
+	lambda := (lon - p.CentralMeridian) * math.Pi / 180
+
+	// Conformal latitude
+	tau := math.Tan(phi)
+	sigma := math.Sinh(p.e * math.Atanh(p.e*tau/math.Sqrt(1+tau*tau)))
+	tauP := tau*math.Sqrt(1+sigma*sigma) - sigma*math.Sqrt(1+tau*tau)
+
+	xiP := math.Atan2(tauP, math.Cos(lambda))
+	etaP := math.Asinh(math.Sin(lambda) / math.Sqrt(tauP*tauP+math.Cos(lambda)*math.Cos(lambda)))
+
+	xi, eta := xiP, etaP
+	for j, a := range p.alpha {
+		k := 2 * float64(j+1)
+		xi += a * math.Sin(k*xiP) * math.Cosh(k*etaP)
+		eta += a * math.Cos(k*xiP) * math.Sinh(k*etaP)
+	}
+
+	x := p.FalseEasting + p.ScaleFactor*p.radius*eta
+	y := p.FalseNorthing + p.ScaleFactor*p.radius*xi
+	return x, y
+}
+
+// Inverse unprojects easting and northing to longitude and latitude
+func (p *TransverseMercator) Inverse(x, y float64) (float64, float64) {
+	xi := (y - p.FalseNorthing) / (p.ScaleFactor * p.radius)
+	eta := (x - p.FalseEasting) / (p.ScaleFactor * p.radius)
+
+	xiP, etaP := xi, eta
+	for j, b := range p.beta {
+		k := 2 * float64(j+1)
+		xiP -= b * math.Sin(k*xi) * math.Cosh(k*eta)
+		etaP -= b * math.Cos(k*xi) * math.Sinh(k*eta)
+	}
+
+	sinhEtaP := math.Sinh(etaP)
+	cosXiP := math.Cos(xiP)
+	tauP := math.Sin(xiP) / math.Sqrt(sinhEtaP*sinhEtaP+cosXiP*cosXiP)
+
+	// Newton iteration from the conformal to the geodetic latitude
+	e2 := p.e * p.e
+	tau := tauP
+	for i := 0; i < 10; i++ {
+		sigma := math.Sinh(p.e * math.Atanh(p.e*tau/math.Sqrt(1+tau*tau)))
+		tauI := tau*math.Sqrt(1+sigma*sigma) - sigma*math.Sqrt(1+tau*tau)
+		delta := (tauP - tauI) / math.Sqrt(1+tauI*tauI) *
+			(1 + (1-e2)*tau*tau) / ((1 - e2) * math.Sqrt(1+tau*tau))
+		tau += delta
+		if math.Abs(delta) < 1e-12 {
+			break
+		}
+	}
+
+	lat := math.Atan(tau) * 180 / math.Pi
+	lon := p.CentralMeridian + math.Atan2(sinhEtaP, cosXiP)*180/math.Pi
+	return lon, lat
+}
+
+func (p *TransverseMercator) wkt() string {
+	return fmt.Sprintf(`PROJECTION["Transverse_Mercator"],PARAMETER["latitude_of_origin",0],`+
+		`PARAMETER["central_meridian",%s],PARAMETER["scale_factor",%s],`+
+		`PARAMETER["false_easting",%s],PARAMETER["false_northing",%s]`,
+		formatNumber(p.CentralMeridian), formatNumber(p.ScaleFactor),
+		formatNumber(p.FalseEasting), formatNumber(p.FalseNorthing))
+}
+
+func (p *TransverseMercator) conversion() map[string]interface{} {
+	return projjsonConversion("Transverse Mercator", "Transverse Mercator", 9807,
+		projjsonParameter("Latitude of natural origin", 0, "degree", 8801),
+		projjsonParameter("Longitude of natural origin", p.CentralMeridian, "degree", 8802),
+		projjsonParameter("Scale factor at natural origin", p.ScaleFactor, "unity", 8805),
+		projjsonParameter("False easting", p.FalseEasting, "metre", 8806),
+		projjsonParameter("False northing", p.FalseNorthing, "metre", 8807))
+}
@@ -0,0 +1,120 @@
+package crs
+
+// projjsonSchema is the PROJJSON schema the definitions follow
+const projjsonSchema = "https://proj.org/schemas/v0.7/projjson.schema.json"
+
+// PROJJSON returns the PROJJSON definition of the system, as GeoParquet
+// metadata requires. Like WKT, systems on a datum other than WGS 84 are
+// wrapped in a BoundCRS carrying their Helmert transformation to WGS 84.
+func (c *CRS) PROJJSON() map[string]interface{} {
+	def := c.projjson()
+	def["$schema"] = projjsonSchema
+	return def
+}
+
+// projjson returns the definition without the schema member
+func (c *CRS) projjson() map[string]interface{} {
+	var def map[string]interface{}
+	if c.IsGeographic() {
+		def = geographicPROJJSON(c.Name, c.Datum)
+	} else {
+		def = map[string]interface{}{
+			"type":       "ProjectedCRS",
+			"name":       c.Name,
+			"base_crs":   geographicPROJJSON(c.Datum.CRSName, c.Datum),
+			"conversion": c.Projection.conversion(),
+			"coordinate_system": map[string]interface{}{
+				"subtype": "Cartesian",
+				"axis": []interface{}{
+					projjsonAxis("Easting", "E", "east", "metre"),
+					projjsonAxis("Northing", "N", "north", "metre"),
+				},
+			},
+		}
+	}
+	def["id"] = map[string]interface{}{"authority": c.Organization, "code": c.OrganizationID}
+
+	if h := c.Datum.ToWGS84; !h.IsZero() {
+		arcsec := map[string]interface{}{"type": "AngularUnit", "name": "arc-second", "conversion_factor": 4.84813681109536e-06}
+		ppm := map[string]interface{}{"type": "ScaleUnit", "name": "parts per million", "conversion_factor": 1e-06}
+		def = map[string]interface{}{
+			"type":       "BoundCRS",
+			"source_crs": def,
+			"target_crs": WGS84.projjson(),
+			"transformation": map[string]interface{}{
+				"name": c.Datum.CRSName + " to WGS 84",
+				"method": map[string]interface{}{
+					"name": "Position Vector transformation (geog2D domain)",
+					"id":   map[string]interface{}{"authority": "EPSG", "code": 9606},
+				},
+				"parameters": []interface{}{
+					projjsonParameter("X-axis translation", h.DX, "metre", 8605),
+					projjsonParameter("Y-axis translation", h.DY, "metre", 8606),
+					projjsonParameter("Z-axis translation", h.DZ, "metre", 8607),
+					projjsonParameter("X-axis rotation", h.RX, arcsec, 8608),
+					projjsonParameter("Y-axis rotation", h.RY, arcsec, 8609),
+					projjsonParameter("Z-axis rotation", h.RZ, arcsec, 8610),
+					projjsonParameter("Scale difference", h.DS, ppm, 8611),
+				},
+			},
+		}
+	}
+	return def
+}
+
+// geographicPROJJSON returns a GeographicCRS on the datum with latitude
+// and longitude axes in the EPSG order
+func geographicPROJJSON(name string, d Datum) map[string]interface{} {
+	return map[string]interface{}{
+		"type": "GeographicCRS",
+		"name": name,
+		"datum": map[string]interface{}{
+			"type": "GeodeticReferenceFrame",
+			"name": d.Name,
+			"ellipsoid": map[string]interface{}{
+				"name":               d.Ellipsoid.Name,
+				"semi_major_axis":    d.Ellipsoid.A,
+				"inverse_flattening": d.Ellipsoid.InvF,
+			},
+		},
+		"coordinate_system": map[string]interface{}{
+			"subtype": "ellipsoidal",
+			"axis": []interface{}{
+				projjsonAxis("Geodetic latitude", "Lat", "north", "degree"),
+				projjsonAxis("Geodetic longitude", "Lon", "east", "degree"),
+			},
+		},
+	}
+}
+
+func projjsonAxis(name, abbreviation, direction, unit string) map[string]interface{} {
+	return map[string]interface{}{"name": name, "abbreviation": abbreviation, "direction": direction, "unit": unit}
+}
+
+// projjsonParameter returns a parameter with its EPSG code; unit is a
+// PROJJSON unit name such as "metre" or a unit object
+func projjsonParameter(name string, value float64, unit interface{}, code int) map[string]interface{} {
+	return map[string]interface{}{
+		"name":  name,
+		"value": value,
+		"unit":  unit,
+		"id":    map[string]interface{}{"authority": "EPSG", "code": code},
+	}
+}
+
+// projjsonConversion returns the conversion of a ProjectedCRS by its
+// method's EPSG code
+func projjsonConversion(name, method string, code int, parameters ...map[string]interface{}) map[string]interface{} {
+	params := make([]interface{}, len(parameters))
+	for i, p := range parameters {
+		params[i] = p
+	}
+	return map[string]interface{}{
+		"name": name,
+		"method": map[string]interface{}{
+			"name": method,
+			"id":   map[string]interface{}{"authority": "EPSG", "code": code},
+		},
+		"parameters": params,
+	}
+}
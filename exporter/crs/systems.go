@@ -0,0 +1,96 @@
+package crs
+
+// SRS ids of the МСК-16 zones, which have no EPSG code
+const (
+	MSK16Zone1 = 1600001
+	MSK16Zone2 = 1600002
+)
+
+// The registered systems. EPSG:4326 and EPSG:3857 keep the definitions
+// GeoPackage readers commonly expect; the others are generated.
+var (
+	WGS84 = &CRS{
+		SRSID:          4326,
+		Name:           "WGS 84",
+		Organization:   "EPSG",
+		OrganizationID: 4326,
+		Description:    "WGS 84",
+		Aliases:        []string{"wgs84"},
+		Datum:          WGS84Datum,
+		definition:     `GEOGCS["WGS 84",DATUM["WGS_1984",SPHEROID["WGS 84",6378137,298.257223563,AUTHORITY["EPSG","7030"]],AUTHORITY["EPSG","6326"]],PRIMEM["Greenwich",0,AUTHORITY["EPSG","8901"]],UNIT["degree",0.0174532925199433,AUTHORITY["EPSG","9122"]],AUTHORITY["EPSG","4326"]]`,
+	}
+
+	WebMercator = &CRS{
+		SRSID:          3857,
+		Name:           "WGS 84 / Pseudo-Mercator",
+		Organization:   "EPSG",
+		OrganizationID: 3857,
+		Description:    "Popular Visualisation CRS / Mercator",
+		Aliases:        []string{"webmercator", "pseudo-mercator"},
+		Datum:          WGS84Datum,
+		Projection:     SphericalMercator{},
+		definition:     `PROJCS["WGS 84 / Pseudo-Mercator",GEOGCS["WGS 84",DATUM["WGS_1984",SPHEROID["WGS 84",6378137,298.257223563,AUTHORITY["EPSG","7030"]],AUTHORITY["EPSG","6326"]],PRIMEM["Greenwich",0,AUTHORITY["EPSG","8901"]],UNIT["degree",0.0174532925199433,AUTHORITY["EPSG","9122"]],AUTHORITY["EPSG","4326"]],PROJECTION["Mercator_1SP"],PARAMETER["central_meridian",0],PARAMETER["scale_factor",1],PARAMETER["false_easting",0],PARAMETER["false_northing",0],UNIT["metre",1,AUTHORITY["EPSG","9001"]],AXIS["X",EAST],AXIS["Y",NORTH],EXTENSION["PROJ4","+proj=merc +a=6378137 +b=6378137 +lat_ts=0.0 +lon_0=0.0 +x_0=0.0 +y_0=0 +k=1.0 +units=m +nadgrids=@null +wktext +no_defs"],AUTHORITY["EPSG","3857"]]`,
+	}
+
+	UTM39N = &CRS{
+		SRSID:          32639,
+		Name:           "WGS 84 / UTM zone 39N",
+		Organization:   "EPSG",
+		OrganizationID: 32639,
+		Description:    "UTM zone 39N, 48°E to 54°E",
+		Aliases:        []string{"utm39n"},
+		Datum:          WGS84Datum,
+		Projection:     NewTransverseMercator(WGS84Ellipsoid, 51, 0.9996, 500000, 0),
+	}
+
+	Pulkovo1942GK9 = &CRS{
+		SRSID:          28409,
+		Name:           "Pulkovo 1942 / Gauss-Kruger zone 9",
+		Organization:   "EPSG",
+		OrganizationID: 28409,
+		Description:    "СК-42 Gauss-Krüger zone 9, 48°E to 54°E",
+		Aliases:        []string{"sk42-9", "gk9"},
+		Datum:          Pulkovo1942Datum,
+		Projection:     NewTransverseMercator(KrassowskyEllipsoid, 51, 1, 9500000, 0),
+	}
+
+	GSK2011 = &CRS{
+		SRSID:          7683,
+		Name:           "GSK-2011",
+		Organization:   "EPSG",
+		OrganizationID: 7683,
+		Description:    "ГСК-2011 geographic coordinates",
+		Aliases:        []string{"gsk2011", "gsk-2011"},
+		Datum:          GSK2011Datum,
+	}
+
+	// МСК-16 zones as published for PROJ: transverse Mercator on the
+	// Krassowsky ellipsoid with the СК-42 datum shift
+	MSK16Z1 = &CRS{
+		SRSID:          MSK16Zone1,
+		Name:           "MSK-16 zone 1",
+		Organization:   "MSK-16",
+		OrganizationID: 1,
+		Description:    "МСК-16 (Tatarstan) zone 1",
+		Aliases:        []string{"msk16-1", "msk-16-1"},
+		Datum:          Pulkovo1942Datum,
+		Projection:     NewTransverseMercator(KrassowskyEllipsoid, 49.03333333333, 1, 1300000, -5709414.70),
+	}
+
+	MSK16Z2 = &CRS{
+		SRSID:          MSK16Zone2,
+		Name:           "MSK-16 zone 2",
+		Organization:   "MSK-16",
+		OrganizationID: 2,
+		Description:    "МСК-16 (Tatarstan) zone 2",
+		Aliases:        []string{"msk16-2", "msk-16-2"},
+		Datum:          Pulkovo1942Datum,
+		Projection:     NewTransverseMercator(KrassowskyEllipsoid, 52.03333333333, 1, 2300000, -5709414.70),
+	}
+)
+
+func init() {
+	for _, c := range []*CRS{WGS84, WebMercator, UTM39N, Pulkovo1942GK9, GSK2011, MSK16Z1, MSK16Z2} {
+		Register(c)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+)
+
+// maxEnumValues is the largest number of distinct values a categorical
+// column may have to be written as an enum constraint
+const maxEnumValues = 200
+
+// categoricalColumns are the object columns constrained to the values found
+// in PostgreSQL
+var categoricalColumns = []string{
+	"load_status", "status", "right_type",
+	"land_record_type", "land_record_subtype", "land_record_category_type",
+}
+
+// columnTitles are the human titles of the object columns and of the
+// columns of the default options mapping
+var columnTitles = map[string]string{
+	"cad_num":                               "Cadastral number",
+	"code":                                  "Object code",
+	"quarter_code":                          "Quarter code",
+	"load_status":                           "Load status",
+	"update_date":                           "Update date",
+	"area":                                  "Area, m²",
+	"cost_value":                            "Cadastral value",
+	"permitted_use_established_by_document": "Permitted use (by document)",
+	"right_type":                            "Right type",
+	"status":                                "Status",
+	"land_record_type":                      "Land record type",
+	"land_record_subtype":                   "Land record subtype",
+	"land_record_category_type":             "Land category",
+	"readable_address":                      "Address",
+	"quarter_cad_number":                    "Quarter cadastral number",
+	"ownership_type":                        "Ownership type",
+	"common_data_status":                    "Common data status",
+	"previously_posted":                     "Previously posted",
+	"specified_area":                        "Specified area, m²",
+	"declared_area":                         "Declared area, m²",
+	"land_record_area":                      "Land record area, m²",
+	"land_record_area_declaration":          "Declared land record area, m²",
+	"land_record_area_verified":             "Verified land record area, m²",
+	"registration_date":                     "Registration date",
+	"land_record_reg_date":                  "Land record registration date",
+	"cost_index":                            "Cost index",
+	"cost_application_date":                 "Cost application date",
+	"cost_approvement_date":                 "Cost approval date",
+	"cost_determination_date":               "Cost determination date",
+	"cost_registration_date":                "Cost registration date",
+	"determination_cause":                   "Cost determination cause",
+}
+
+// createSchemaTables creates the tables of the GeoPackage Schema extension,
+// which describe columns and their allowed values, and registers the
+// extension
+func createSchemaTables(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS gpkg_data_columns (
+			table_name TEXT NOT NULL,
+			column_name TEXT NOT NULL,
+			name TEXT,
+			title TEXT,
+			description TEXT,
+			mime_type TEXT,
+			constraint_name TEXT,
+			CONSTRAINT pk_gdc PRIMARY KEY (table_name, column_name),
+			CONSTRAINT gdc_tn UNIQUE (table_name, name)
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create gpkg_data_columns: %w", err)
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS gpkg_data_column_constraints (
+			constraint_name TEXT NOT NULL,
+			constraint_type TEXT NOT NULL,
+			value TEXT,
+			min NUMERIC,
+			min_is_inclusive BOOLEAN,
+			max NUMERIC,
+			max_is_inclusive BOOLEAN,
+			description TEXT,
+			CONSTRAINT gdcc_ntv UNIQUE (constraint_name, constraint_type, value)
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create gpkg_data_column_constraints: %w", err)
+	}
+
+	for _, table := range []string{"gpkg_data_columns", "gpkg_data_column_constraints"} {
+		if err := registerTableExtension(db, table, "gpkg_schema",
+			"http://www.geopackage.org/spec/#extension_schema", "read-write"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// enumConstraintName returns the name of the enum constraint of a
+// categorical column, shared by all objects tables
+func enumConstraintName(column string) string {
+	return "cadastral_" + column
+}
+
+// writeDataColumns describes the columns of the objects tables in
+// gpkg_data_columns and constrains the categorical columns to the given
+// values, by column
+func writeDataColumns(db *sql.DB, tables []string, optionColumns []OptionColumn, values map[string][]string) error {
+	constraints := map[string]string{}
+	for _, column := range categoricalColumns {
+		name := enumConstraintName(column)
+		if _, err := db.Exec("DELETE FROM gpkg_data_column_constraints WHERE constraint_name = ?", name); err != nil {
+			return fmt.Errorf("failed to clear constraint %s: %w", name, err)
+		}
+		if len(values[column]) == 0 {
+			continue
+		}
+		if len(values[column]) > maxEnumValues {
+			log.Printf("Column %s has %d distinct values, not writing an enum constraint", column, len(values[column]))
+			continue
+		}
+		for _, value := range values[column] {
+			_, err := db.Exec(`
+				INSERT INTO gpkg_data_column_constraints (constraint_name, constraint_type, value)
+				VALUES (?, 'enum', ?)
+			`, name, value)
+			if err != nil {
+				return fmt.Errorf("failed to write constraint %s: %w", name, err)
+			}
+		}
+		constraints[column] = name
+	}
+
+	// Titles of option columns come from the schema, or the defaults
+	titles := map[string]string{}
+	columns := append([]string(nil), cadastralObjectColumns...)
+	for _, c := range optionColumns {
+		columns = append(columns, c.columnName())
+		if c.Title != "" {
+			titles[c.columnName()] = c.Title
+		}
+	}
+
+	stmt, err := db.Prepare(`
+		INSERT INTO gpkg_data_columns (table_name, column_name, name, title, constraint_name)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (table_name, column_name) DO UPDATE SET
+			name = excluded.name, title = excluded.title, constraint_name = excluded.constraint_name
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare data columns statement: %w", err)
+	}
+	defer stmt.Close()
+
+	for _, table := range tables {
+		for _, column := range columns {
+			title, ok := titles[column]
+			if !ok {
+				title, ok = columnTitles[column]
+			}
+			constraint, constrained := constraints[column]
+			if !ok && !constrained {
+				continue
+			}
+
+			var name, titleValue, constraintValue interface{}
+			if ok {
+				name, titleValue = title, title
+			}
+			if constrained {
+				constraintValue = constraint
+			}
+			if _, err := stmt.Exec(table, column, name, titleValue, constraintValue); err != nil {
+				return fmt.Errorf("failed to describe column %s of %s: %w", column, table, err)
+			}
+		}
+	}
+	return nil
+}
@@ -1,193 +1,123 @@
 package main
 
 import (
-	"database/sql"
-	"encoding/json"
-	"flag"
 	"fmt"
 	"log"
-	"math"
-	"os"
-	"path/filepath"
 	"strings"
 
-	_ "github.com/lib/pq"
+	"exporter/crs"
 )
 
-func main() {
-	var (
-		pgHost     = flag.String("pg-host", "localhost", "PostgreSQL host")
-		pgPort     = flag.Int("pg-port", 5432, "PostgreSQL port")
-		pgUser     = flag.String("pg-user", "postgres", "PostgreSQL user")
-		pgPassword = flag.String("pg-password", "postgres", "PostgreSQL password")
-		pgDB       = flag.String("pg-db", "postgres", "PostgreSQL database name")
-		outputFile = flag.String("output", "cadastral.geojson", "Output GeoJSON file path")
-		groupBy    = flag.String("group-by", "", "Group features by property (e.g., 'quarter_code', 'area_code', 'status'). Creates multiple FeatureCollections, one per unique value")
-	)
-	flag.Parse()
-
-	// Connect to PostgreSQL
-	pgDSN := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable",
-		*pgHost, *pgPort, *pgUser, *pgPassword, *pgDB)
+// GeoJSONOptions configures the GeoJSON exporter
+type GeoJSONOptions struct {
+	OutputFile string
+	Format     string // geojson, geojsonseq, ndjson or fgb
+	Append     bool   // append to existing files (sequence formats only)
+
+	// With GroupBy set, one file per property value is written to a
+	// directory, keeping at most MaxOpenFiles of them open at a time
+	GroupBy      string
+	MaxOpenFiles int
+
+	// RFC7946 orients polygon rings, splits geometries crossing the
+	// antimeridian and writes feature and collection bbox members
+	RFC7946 bool
+	// Precision rounds coordinates to this many decimals; negative keeps
+	// the full precision
+	Precision int
+	// CRS is the output CRS; nil means EPSG:4326. Any other CRS is
+	// written with the legacy crs member; FlatGeobuf always records it in
+	// the file header.
+	CRS *crs.CRS
+}
 
-	pgDBConn, err := sql.Open("postgres", pgDSN)
-	if err != nil {
-		log.Fatalf("Failed to connect to PostgreSQL: %v", err)
+// exportToGeoJSON streams cadastral objects from the source to GeoJSON
+func exportToGeoJSON(src *Source, opts GeoJSONOptions) error {
+	if err := checkGeoJSONFormat(opts.Format); err != nil {
+		return err
 	}
-	defer pgDBConn.Close()
-
-	if err := pgDBConn.Ping(); err != nil {
-		log.Fatalf("Failed to ping PostgreSQL: %v", err)
+	if opts.Append && opts.Format != formatGeoJSONSeq && opts.Format != formatNDJSON {
+		return fmt.Errorf("appending is only supported for the %s and %s formats", formatGeoJSONSeq, formatNDJSON)
 	}
-
-	// Export to GeoJSON
-	if err := exportToGeoJSON(pgDBConn, *outputFile, *groupBy); err != nil {
-		log.Fatalf("Failed to export data: %v", err)
+	if opts.CRS == nil {
+		opts.CRS = crs.WGS84
 	}
+	if opts.RFC7946 && opts.CRS != crs.WGS84 {
+		return fmt.Errorf("RFC 7946 output requires CRS %s, not %s", crs.WGS84, opts.CRS)
+	}
+	transformer := crs.NewTransformer(sourceCRS, opts.CRS)
 
-	log.Printf("Successfully exported data to %s", *outputFile)
-}
-
-func exportToGeoJSON(pgDB *sql.DB, outputFile string, groupByProperty string) error {
-	// Query cadastral objects with their data
-	rows, err := pgDB.Query(`
-		SELECT 
-			o.code,
-			o.quarter_code,
-			o.load_status::text,
-			o.update_date,
-			o.data::text,
-			o.area,
-			o.cost_value,
-			o.permitted_use_established_by_document,
-			o.right_type,
-			o.status,
-			o.land_record_type,
-			o.land_record_subtype,
-			o.land_record_category_type
-		FROM object o
-		WHERE o.data IS NOT NULL
-		AND o.load_status = 'SUCCESS'
-	`)
+	objects, err := src.Objects()
 	if err != nil {
-		return fmt.Errorf("failed to query objects: %w", err)
+		return err
 	}
-	defer rows.Close()
-
-	// If grouping is enabled, use map to group by property value
-	// Otherwise, use single FeatureCollection
-	var groupedFeatures map[string][]interface{}
-	var singleFeatures []interface{}
-	var count int
+	defer objects.Close()
 
-	if groupByProperty != "" {
-		groupedFeatures = make(map[string][]interface{})
-		log.Printf("Grouping features by property: %s", groupByProperty)
+	var sink featureSink
+	var grouped *groupedFeatureWriter
+	if opts.GroupBy != "" {
+		log.Printf("Grouping features by property: %s", opts.GroupBy)
+		grouped, err = newGroupedFeatureWriter(opts)
+		if err != nil {
+			return err
+		}
+		sink = grouped
 	} else {
-		singleFeatures = []interface{}{}
-	}
-
-	for rows.Next() {
-		var code, quarterCode int
-		var loadStatus, dataStr string
-		var updateDate sql.NullTime
-		var area sql.NullInt64
-		var costValue sql.NullFloat64
-		var permittedUse, rightType, status sql.NullString
-		var landRecordType, landRecordSubtype, landRecordCategoryType sql.NullString
-
-		if err := rows.Scan(
-			&code,
-			&quarterCode,
-			&loadStatus,
-			&updateDate,
-			&dataStr,
-			&area,
-			&costValue,
-			&permittedUse,
-			&rightType,
-			&status,
-			&landRecordType,
-			&landRecordSubtype,
-			&landRecordCategoryType,
-		); err != nil {
-			log.Printf("Failed to scan row: %v", err)
-			continue
+		sink, err = createFeatureFile(opts.OutputFile, opts)
+		if err != nil {
+			return err
 		}
+	}
+	defer sink.Close()
 
-		// Parse the JSON data
-		var data map[string]interface{}
-		if err := json.Unmarshal([]byte(dataStr), &data); err != nil {
-			log.Printf("Failed to parse JSON for object %d: %v", code, err)
-			continue
-		}
+	var count int
+	for objects.Next() {
+		obj := objects.Object()
 
-		// Extract FeatureCollection from data
-		dataObj, ok := data["data"].(map[string]interface{})
-		if !ok {
-			log.Printf("No 'data' field in JSON for object %d", code)
+		// An empty geometry has no bounds to sort and index a FlatGeobuf
+		// feature by
+		if opts.Format == formatFlatGeobuf && obj.Geometry.IsEmpty() {
+			log.Printf("Skipping object %s: empty geometry", obj.CadNum)
 			continue
 		}
 
-		dataFeatures, ok := dataObj["features"].([]interface{})
-		if !ok || len(dataFeatures) == 0 {
-			log.Printf("No features in JSON for object %d", code)
-			continue
+		// GeoJSON coordinates are WGS84 by default; other CRSs carry the
+		// legacy crs member, on the collection or, for sequences, on
+		// every geometry. FlatGeobuf keeps the CRS in its header.
+		transformGeometry(obj.Geometry, transformer)
+		var geometry interface{} = obj.Geometry
+		if opts.CRS != crs.WGS84 && (opts.Format == formatGeoJSONSeq || opts.Format == formatNDJSON) {
+			geometry = geometryWithCRS{obj.Geometry, legacyCRS(opts.CRS)}
 		}
 
-		// Get first feature and update its properties with database fields
-		feature, ok := dataFeatures[0].(map[string]interface{})
-		if !ok {
-			log.Printf("Invalid feature structure for object %d", code)
-			continue
+		var bbox []float64
+		if opts.RFC7946 {
+			converted, b, err := applyRFC7946(obj.Geometry)
+			if err != nil {
+				log.Printf("Failed to apply RFC 7946 to object %s: %v", obj.CadNum, err)
+				continue
+			}
+			obj.Geometry, geometry, bbox = converted, converted, b
 		}
 
-		// Convert geometry coordinates from EPSG:3857 to EPSG:4326 (WGS84)
-		// GeoJSON standard requires WGS84 coordinates
-		if err := convertGeometryToWGS84(feature["geometry"]); err != nil {
-			log.Printf("Failed to convert geometry for object %d: %v", code, err)
-			continue
+		if opts.Precision >= 0 {
+			roundCoordinates(obj.Geometry, opts.Precision)
+			bbox = roundBBox(bbox, opts.Precision)
 		}
 
-		// Update properties with database fields
-		properties := map[string]interface{}{
-			"code":                                  code,
-			"quarter_code":                          quarterCode,
-			"load_status":                           loadStatus,
-			"area":                                  getNullableInt64(area),
-			"cost_value":                            getNullableFloat64(costValue),
-			"permitted_use_established_by_document": getNullableString(permittedUse),
-			"right_type":                            getNullableString(rightType),
-			"status":                                getNullableString(status),
-			"land_record_type":                      getNullableString(landRecordType),
-			"land_record_subtype":                   getNullableString(landRecordSubtype),
-			"land_record_category_type":             getNullableString(landRecordCategoryType),
+		feature := map[string]interface{}{
+			"type":       "Feature",
+			"id":         obj.CadNum.String(),
+			"geometry":   geometry,
+			"properties": objectProperties(obj),
 		}
 
-		if updateDate.Valid {
-			properties["update_date"] = updateDate.Time.Format("2006-01-02")
+		if bbox != nil {
+			feature["bbox"] = bbox
 		}
 
-		// Merge with existing properties if any
-		if existingProps, ok := feature["properties"].(map[string]interface{}); ok {
-			for k, v := range existingProps {
-				if _, exists := properties[k]; !exists {
-					properties[k] = v
-				}
-			}
-		}
-
-		feature["properties"] = properties
-
-		// Group by property if specified
-		if groupByProperty != "" {
-			groupValue := getGroupValue(properties, groupByProperty)
-			if groupValue == "" {
-				groupValue = "unknown"
-			}
-			groupedFeatures[groupValue] = append(groupedFeatures[groupValue], feature)
-		} else {
-			singleFeatures = append(singleFeatures, feature)
+		if err := sink.WriteFeature(feature); err != nil {
+			return err
 		}
 
 		count++
@@ -196,89 +126,60 @@ func exportToGeoJSON(pgDB *sql.DB, outputFile string, groupByProperty string) er
 		}
 	}
 
-	// Write to file
-	file, err := os.Create(outputFile)
-	if err != nil {
-		return fmt.Errorf("failed to create output file: %w", err)
+	if err := objects.Err(); err != nil {
+		return fmt.Errorf("failed to read objects: %w", err)
 	}
-	defer file.Close()
-
-	encoder := json.NewEncoder(file)
-	encoder.SetIndent("", "  ")
 
-	if groupByProperty != "" {
-		// Create directory for multiple files
-		outputDir := outputFile
-		// If output looks like a file (has extension), extract directory
-		if strings.Contains(outputDir, ".") && filepath.Ext(outputDir) != "" {
-			outputDir = filepath.Dir(outputDir)
-			if outputDir == "." {
-				outputDir = filepath.Base(outputFile)
-				outputDir = strings.TrimSuffix(outputDir, filepath.Ext(outputDir))
-			}
+	if grouped != nil {
+		files, dir := len(grouped.order), grouped.dir
+		if err := sink.Close(); err != nil {
+			return err
 		}
-
-		// Remove existing file/directory if it exists
-		if info, err := os.Stat(outputDir); err == nil {
-			if !info.IsDir() {
-				os.Remove(outputDir)
-			}
-		}
-
-		// Ensure directory exists
-		if err := os.MkdirAll(outputDir, 0755); err != nil {
-			return fmt.Errorf("failed to create output directory: %w", err)
-		}
-
-		// Create one file per group
-		baseName := "cadastral"
-		if strings.Contains(outputFile, ".") {
-			ext := filepath.Ext(outputFile)
-			baseName = strings.TrimSuffix(filepath.Base(outputFile), ext)
+		log.Printf("Total exported: %d features in %d files in directory: %s", count, files, dir)
+	} else {
+		if err := sink.Close(); err != nil {
+			return err
 		}
+		log.Printf("Total exported: %d features", count)
+	}
 
-		for groupValue, features := range groupedFeatures {
-			// Sanitize group value for filename
-			safeGroupValue := sanitizeFilename(groupValue)
-			// Include the grouping field name in the filename
-			filename := filepath.Join(outputDir, fmt.Sprintf("%s_%s_%s.geojson", baseName, groupByProperty, safeGroupValue))
-
-			// Create FeatureCollection for this group
-			featureCollection := map[string]interface{}{
-				"type":     "FeatureCollection",
-				"features": features,
-			}
+	return nil
+}
 
-			// Write to file
-			file, err := os.Create(filename)
-			if err != nil {
-				return fmt.Errorf("failed to create file %s: %w", filename, err)
-			}
+// objectProperties builds the feature properties of an object: database
+// fields take precedence over the original NSPD feature properties
+func objectProperties(obj *CadastralObject) map[string]interface{} {
+	properties := map[string]interface{}{
+		"cad_num":                               obj.CadNum.String(),
+		"code":                                  obj.Code,
+		"quarter_code":                          obj.QuarterCode,
+		"load_status":                           obj.LoadStatus,
+		"area":                                  getNullableInt64(obj.Area),
+		"cost_value":                            getNullableFloat64(obj.CostValue),
+		"permitted_use_established_by_document": getNullableString(obj.PermittedUseEstablishedByDoc),
+		"right_type":                            getNullableString(obj.RightType),
+		"status":                                getNullableString(obj.Status),
+		"land_record_type":                      getNullableString(obj.LandRecordType),
+		"land_record_subtype":                   getNullableString(obj.LandRecordSubtype),
+		"land_record_category_type":             getNullableString(obj.LandRecordCategoryType),
+	}
 
-			fileEncoder := json.NewEncoder(file)
-			fileEncoder.SetIndent("", "  ")
-			if err := fileEncoder.Encode(featureCollection); err != nil {
-				file.Close()
-				return fmt.Errorf("failed to encode GeoJSON for %s: %w", filename, err)
-			}
-			file.Close()
+	if obj.UpdateDate.Valid {
+		properties["update_date"] = obj.UpdateDate.Time.Format("2006-01-02")
+	}
+	// The NSPD feature id, replaced by the cadastral number as feature id
+	if obj.FeatureID != nil {
+		properties["nspd_id"] = obj.FeatureID
+	}
 
-			log.Printf("  Created: %s (%d features)", filename, len(features))
-		}
-		log.Printf("Total exported: %d features in %d files in directory: %s", count, len(groupedFeatures), outputDir)
-	} else {
-		// Single FeatureCollection
-		featureCollection := map[string]interface{}{
-			"type":     "FeatureCollection",
-			"features": singleFeatures,
+	// Merge with existing properties if any
+	for k, v := range obj.Properties {
+		if _, exists := properties[k]; !exists {
+			properties[k] = v
 		}
-		if err := encoder.Encode(featureCollection); err != nil {
-			return fmt.Errorf("failed to encode GeoJSON: %w", err)
-		}
-		log.Printf("Total exported: %d features", count)
 	}
 
-	return nil
+	return properties
 }
 
 // getGroupValue extracts the grouping value from properties
@@ -320,164 +221,3 @@ func sanitizeFilename(name string) string {
 	}
 	return result
 }
-
-// Helper functions for nullable SQL types
-func getNullableInt64(n sql.NullInt64) interface{} {
-	if n.Valid {
-		return n.Int64
-	}
-	return nil
-}
-
-func getNullableFloat64(n sql.NullFloat64) interface{} {
-	if n.Valid {
-		return n.Float64
-	}
-	return nil
-}
-
-func getNullableString(n sql.NullString) interface{} {
-	if n.Valid {
-		return n.String
-	}
-	return nil
-}
-
-// convertGeometryToWGS84 converts geometry coordinates from EPSG:3857 (Web Mercator) to EPSG:4326 (WGS84)
-func convertGeometryToWGS84(geometry interface{}) error {
-	geom, ok := geometry.(map[string]interface{})
-	if !ok {
-		return fmt.Errorf("geometry is not a map")
-	}
-
-	coords, ok := geom["coordinates"]
-	if !ok {
-		return fmt.Errorf("no coordinates in geometry")
-	}
-
-	// Convert coordinates based on geometry type
-	geomType, _ := geom["type"].(string)
-	switch geomType {
-	case "Point":
-		coordsArray, ok := coords.([]interface{})
-		if !ok || len(coordsArray) < 2 {
-			return fmt.Errorf("invalid point coordinates")
-		}
-		x, _ := toFloat64(coordsArray[0])
-		y, _ := toFloat64(coordsArray[1])
-		lon, lat := webMercatorToWGS84(x, y)
-		geom["coordinates"] = []float64{lon, lat}
-
-	case "LineString":
-		coordsArray, ok := coords.([]interface{})
-		if !ok {
-			return fmt.Errorf("invalid linestring coordinates")
-		}
-		converted := make([][]float64, len(coordsArray))
-		for i, point := range coordsArray {
-			pointArray, ok := point.([]interface{})
-			if !ok || len(pointArray) < 2 {
-				return fmt.Errorf("invalid point in linestring")
-			}
-			x, _ := toFloat64(pointArray[0])
-			y, _ := toFloat64(pointArray[1])
-			lon, lat := webMercatorToWGS84(x, y)
-			converted[i] = []float64{lon, lat}
-		}
-		geom["coordinates"] = converted
-
-	case "Polygon":
-		ringsArray, ok := coords.([]interface{})
-		if !ok {
-			return fmt.Errorf("invalid polygon coordinates")
-		}
-		converted := make([][][]float64, len(ringsArray))
-		for i, ring := range ringsArray {
-			ringArray, ok := ring.([]interface{})
-			if !ok {
-				return fmt.Errorf("invalid ring in polygon")
-			}
-			convertedRing := make([][]float64, len(ringArray))
-			for j, point := range ringArray {
-				pointArray, ok := point.([]interface{})
-				if !ok || len(pointArray) < 2 {
-					return fmt.Errorf("invalid point in ring")
-				}
-				x, _ := toFloat64(pointArray[0])
-				y, _ := toFloat64(pointArray[1])
-				lon, lat := webMercatorToWGS84(x, y)
-				convertedRing[j] = []float64{lon, lat}
-			}
-			converted[i] = convertedRing
-		}
-		geom["coordinates"] = converted
-
-	case "MultiPolygon":
-		multiPolyArray, ok := coords.([]interface{})
-		if !ok {
-			return fmt.Errorf("invalid multipolygon coordinates")
-		}
-		converted := make([][][][]float64, len(multiPolyArray))
-		for i, polygon := range multiPolyArray {
-			ringsArray, ok := polygon.([]interface{})
-			if !ok {
-				return fmt.Errorf("invalid polygon in multipolygon")
-			}
-			convertedPoly := make([][][]float64, len(ringsArray))
-			for j, ring := range ringsArray {
-				ringArray, ok := ring.([]interface{})
-				if !ok {
-					return fmt.Errorf("invalid ring in multipolygon")
-				}
-				convertedRing := make([][]float64, len(ringArray))
-				for k, point := range ringArray {
-					pointArray, ok := point.([]interface{})
-					if !ok || len(pointArray) < 2 {
-						return fmt.Errorf("invalid point in multipolygon")
-					}
-					x, _ := toFloat64(pointArray[0])
-					y, _ := toFloat64(pointArray[1])
-					lon, lat := webMercatorToWGS84(x, y)
-					convertedRing[k] = []float64{lon, lat}
-				}
-				convertedPoly[j] = convertedRing
-			}
-			converted[i] = convertedPoly
-		}
-		geom["coordinates"] = converted
-
-	default:
-		return fmt.Errorf("unsupported geometry type: %s", geomType)
-	}
-
-	// Remove CRS field if present (GeoJSON uses WGS84 by default)
-	delete(geom, "crs")
-	return nil
-}
-
-// webMercatorToWGS84 converts Web Mercator (EPSG:3857) coordinates to WGS84 (EPSG:4326)
-func webMercatorToWGS84(x, y float64) (lon, lat float64) {
-	// Web Mercator to WGS84 conversion
-	lon = x / 20037508.34 * 180.0
-	lat = y / 20037508.34 * 180.0
-	lat = 180.0 / math.Pi * (2.0*math.Atan(math.Exp(lat*math.Pi/180.0)) - math.Pi/2.0)
-	return lon, lat
-}
-
-// toFloat64 converts various numeric types to float64
-func toFloat64(v interface{}) (float64, error) {
-	switch val := v.(type) {
-	case float64:
-		return val, nil
-	case float32:
-		return float64(val), nil
-	case int:
-		return float64(val), nil
-	case int64:
-		return float64(val), nil
-	case json.Number:
-		return val.Float64()
-	default:
-		return 0, fmt.Errorf("cannot convert %T to float64", v)
-	}
-}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"exporter/crs"
+)
+
+// KMLOptions configures the KML exporter
+type KMLOptions struct {
+	// OutputFile is a .kml document or a .kmz archive holding one
+	OutputFile string
+	// GroupBy puts the placemarks in one folder per property value
+	GroupBy string
+	// StyleBy is the column the polygon colours follow: status or
+	// land_record_category_type
+	StyleBy string
+}
+
+// kmlStyleRules are the colour rules of the columns KML styles can follow
+var kmlStyleRules = map[string][]kmlStyleRule{
+	"status":                    kmlStatusColors,
+	"land_record_category_type": kmlCategoryColors,
+}
+
+// validate checks the option values
+func (o KMLOptions) validate() error {
+	switch strings.ToLower(filepath.Ext(o.OutputFile)) {
+	case ".kml", ".kmz":
+	default:
+		return fmt.Errorf("output %s must be a .kml or .kmz file", o.OutputFile)
+	}
+	if _, ok := kmlStyleRules[o.StyleBy]; !ok {
+		return fmt.Errorf("cannot style by %q (expected status or land_record_category_type)", o.StyleBy)
+	}
+	return nil
+}
+
+// kmlFolder is the group of placemarks of one grouping value
+type kmlFolder struct {
+	name       string
+	placemarks []spoolRecord
+}
+
+// kmlStyle is the shared style of one value of the style column
+type kmlStyle struct {
+	id    string
+	value string
+	color kmlColor
+}
+
+// kmlSpool collects the placemarks of a KML document. Styles precede the
+// folders in the document and each folder holds its placemarks together,
+// so placemarks are spooled to a temporary file and the document is
+// assembled when every style and group is known.
+type kmlSpool struct {
+	spool *recordSpool
+
+	opts    KMLOptions
+	folders map[string]*kmlFolder
+	styles  map[string]*kmlStyle
+	count   int
+}
+
+// createKMLSpool creates the spool of the KML document at path
+func createKMLSpool(path string, opts KMLOptions) (*kmlSpool, error) {
+	spool, err := createRecordSpool(path)
+	if err != nil {
+		return nil, err
+	}
+	return &kmlSpool{
+		spool:   spool,
+		opts:    opts,
+		folders: make(map[string]*kmlFolder),
+		styles:  make(map[string]*kmlStyle),
+	}, nil
+}
+
+// add spools the placemark of an object with WGS 84 coordinates
+func (s *kmlSpool) add(obj *CadastralObject) error {
+	properties := objectProperties(obj)
+	var folderName string
+	if s.opts.GroupBy != "" {
+		if folderName = getGroupValue(properties, s.opts.GroupBy); folderName == "" {
+			folderName = "unknown"
+		}
+	}
+	styleValue, _ := properties[s.opts.StyleBy].(string)
+	style, ok := s.styles[styleValue]
+	if !ok {
+		style = &kmlStyle{
+			id:    fmt.Sprintf("style_%d", len(s.styles)+1),
+			value: styleValue,
+			color: kmlStyleColor(kmlStyleRules[s.opts.StyleBy], styleValue),
+		}
+		s.styles[styleValue] = style
+	}
+
+	record, err := s.spool.add(appendKMLPlacemark(nil, obj, style.id))
+	if err != nil {
+		return err
+	}
+
+	folder, ok := s.folders[folderName]
+	if !ok {
+		folder = &kmlFolder{name: folderName}
+		s.folders[folderName] = folder
+	}
+	folder.placemarks = append(folder.placemarks, record)
+	s.count++
+	return nil
+}
+
+// appendKMLPlacemark appends the placemark of an object: its cadastral
+// number as name, the style of its value, the balloon and the attributes
+// as ExtendedData for GIS software
+func appendKMLPlacemark(buf []byte, obj *CadastralObject, styleID string) []byte {
+	cadNum := obj.CadNum.String()
+	buf = append(buf, "<Placemark><name>"...)
+	buf = append(buf, kmlEscape(cadNum)...)
+	buf = append(buf, "</name><styleUrl>#"+styleID+"</styleUrl><description><![CDATA["...)
+	buf = append(buf, kmlBalloon(obj)...)
+	buf = append(buf, "]]></description><ExtendedData>"...)
+	for i, value := range objectRowValues(obj, nil) {
+		if value == nil {
+			continue
+		}
+		buf = append(buf, `<Data name="`+objectRowColumns[i]+`"><value>`...)
+		buf = append(buf, kmlEscape(kmlValue(value))...)
+		buf = append(buf, "</value></Data>"...)
+	}
+	if address := kmlAddress(obj); address != "" {
+		buf = append(buf, `<Data name="readable_address"><value>`...)
+		buf = append(buf, kmlEscape(address)...)
+		buf = append(buf, "</value></Data>"...)
+	}
+	buf = append(buf, "</ExtendedData>"...)
+	buf = appendKMLGeometry(buf, obj.Geometry)
+	return append(buf, "</Placemark>\n"...)
+}
+
+// kmlValue formats an ExtendedData value: numbers in plain decimal
+// notation, as fmt writes large floats with an exponent
+func kmlValue(value interface{}) string {
+	switch v := value.(type) {
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case int:
+		return strconv.FormatInt(int64(v), 10)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// kmlAddress returns the readable address from the NSPD options
+func kmlAddress(obj *CadastralObject) string {
+	address, _ := obj.Options["readable_address"].(string)
+	return strings.TrimSpace(address)
+}
+
+// kmlBalloon returns the HTML table shown in the placemark balloon:
+// cadastral number, address, area, cadastral value, status, category and
+// permitted use, leaving out the missing ones
+func kmlBalloon(obj *CadastralObject) string {
+	rows := [][2]string{
+		{"cad_num", obj.CadNum.String()},
+		{"readable_address", kmlAddress(obj)},
+	}
+	if obj.Area.Valid {
+		rows = append(rows, [2]string{"area", groupDigits(strconv.FormatInt(obj.Area.Int64, 10))})
+	}
+	if obj.CostValue.Valid {
+		rows = append(rows, [2]string{"cost_value", groupDigits(strconv.FormatFloat(obj.CostValue.Float64, 'f', 2, 64)) + " ₽"})
+	}
+	rows = append(rows,
+		[2]string{"status", obj.Status.String},
+		[2]string{"land_record_category_type", obj.LandRecordCategoryType.String},
+		[2]string{"permitted_use_established_by_document", obj.PermittedUseEstablishedByDoc.String},
+	)
+
+	var b strings.Builder
+	b.WriteString("<table>")
+	for _, row := range rows {
+		if row[1] == "" {
+			continue
+		}
+		fmt.Fprintf(&b, `<tr><th align="left">%s</th><td>%s</td></tr>`, kmlEscape(columnTitles[row[0]]), kmlEscape(row[1]))
+	}
+	b.WriteString("</table>")
+	return b.String()
+}
+
+// groupDigits separates the thousands of a formatted number with spaces
+func groupDigits(s string) string {
+	integer, fraction, _ := strings.Cut(s, ".")
+	sign := ""
+	if strings.HasPrefix(integer, "-") {
+		sign, integer = "-", integer[1:]
+	}
+	var b strings.Builder
+	for i, r := range integer {
+		if i > 0 && (len(integer)-i)%3 == 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteRune(r)
+	}
+	if fraction != "" {
+		return sign + b.String() + "." + fraction
+	}
+	return sign + b.String()
+}
+
+// discard closes and removes the spool
+func (s *kmlSpool) discard() {
+	s.spool.discard()
+}
+
+// finish writes the KML document, zipped as doc.kml for .kmz outputs, and
+// removes the spool
+func (s *kmlSpool) finish() (err error) {
+	defer s.discard()
+
+	file, err := os.Create(s.opts.OutputFile)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", s.opts.OutputFile, err)
+	}
+	defer func() {
+		if cerr := file.Close(); err == nil && cerr != nil {
+			err = fmt.Errorf("failed to write %s: %w", s.opts.OutputFile, cerr)
+		}
+	}()
+
+	if !strings.EqualFold(filepath.Ext(s.opts.OutputFile), ".kmz") {
+		w := bufio.NewWriter(file)
+		if err := s.writeDocument(w); err != nil {
+			return err
+		}
+		if err := w.Flush(); err != nil {
+			return fmt.Errorf("failed to write %s: %w", s.opts.OutputFile, err)
+		}
+		return nil
+	}
+
+	// Google Earth opens the first .kml entry of a KMZ, named doc.kml by
+	// convention
+	zw := zip.NewWriter(file)
+	doc, err := zw.CreateHeader(&zip.FileHeader{Name: "doc.kml", Method: zip.Deflate, Modified: time.Now()})
+	if err != nil {
+		return fmt.Errorf("failed to create doc.kml: %w", err)
+	}
+	w := bufio.NewWriter(doc)
+	if err := s.writeDocument(w); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", s.opts.OutputFile, err)
+	}
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", s.opts.OutputFile, err)
+	}
+	return nil
+}
+
+// writeDocument writes the document: a legend of the style colours as its
+// description, the shared styles and the placemarks, in folders sorted by
+// grouping value
+func (s *kmlSpool) writeDocument(w io.Writer) error {
+	styles := make([]*kmlStyle, 0, len(s.styles))
+	for _, style := range s.styles {
+		styles = append(styles, style)
+	}
+	sort.Slice(styles, func(i, j int) bool { return styles[i].value < styles[j].value })
+
+	name := strings.TrimSuffix(filepath.Base(s.opts.OutputFile), filepath.Ext(s.opts.OutputFile))
+	fmt.Fprintf(w, "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<kml xmlns=\"http://www.opengis.net/kml/2.2\">\n<Document>\n<name>%s</name>\n", kmlEscape(name))
+	fmt.Fprintf(w, "<description><![CDATA[<b>%s</b><br>", kmlEscape(columnTitles[s.opts.StyleBy]))
+	for _, style := range styles {
+		value := style.value
+		if value == "" {
+			value = "—"
+		}
+		fmt.Fprintf(w, `<span style="color:#%s">■</span> %s<br>`, style.color, kmlEscape(value))
+	}
+	fmt.Fprint(w, "]]></description>\n")
+	for _, style := range styles {
+		writeKMLStyle(w, style.id, style.color)
+	}
+
+	names := make([]string, 0, len(s.folders))
+	for name := range s.folders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		folder := s.folders[name]
+		if s.opts.GroupBy != "" {
+			fmt.Fprintf(w, "<Folder><name>%s</name>\n", kmlEscape(folder.name))
+		}
+		for _, p := range folder.placemarks {
+			record, err := s.spool.read(p)
+			if err != nil {
+				return err
+			}
+			if _, err := w.Write(record); err != nil {
+				return fmt.Errorf("failed to write %s: %w", s.opts.OutputFile, err)
+			}
+		}
+		if s.opts.GroupBy != "" {
+			fmt.Fprint(w, "</Folder>\n")
+		}
+	}
+	_, err := fmt.Fprint(w, "</Document>\n</kml>\n")
+	return err
+}
+
+// exportToKML writes the cadastral objects to a KML document or KMZ
+// archive for Google Earth, coloured by status or land category and
+// optionally grouped in folders
+func exportToKML(src *Source, opts KMLOptions) error {
+	if err := opts.validate(); err != nil {
+		return err
+	}
+	transformer := crs.NewTransformer(sourceCRS, crs.WGS84)
+
+	spool, err := createKMLSpool(opts.OutputFile, opts)
+	if err != nil {
+		return err
+	}
+
+	objects, err := src.Objects()
+	if err != nil {
+		spool.discard()
+		return err
+	}
+	defer objects.Close()
+
+	for objects.Next() {
+		obj := objects.Object()
+		if obj.Geometry.IsEmpty() {
+			log.Printf("Skipping object %s: empty geometry", obj.CadNum)
+			continue
+		}
+		transformGeometry(obj.Geometry, transformer)
+		if err := spool.add(obj); err != nil {
+			spool.discard()
+			return err
+		}
+		if spool.count%100 == 0 {
+			log.Printf("Processed %d objects...", spool.count)
+		}
+	}
+	if err := objects.Err(); err != nil {
+		spool.discard()
+		return fmt.Errorf("failed to read objects: %w", err)
+	}
+
+	if err := spool.finish(); err != nil {
+		return err
+	}
+	if opts.GroupBy != "" {
+		log.Printf("Total exported: %d placemarks in %d folders", spool.count, len(spool.folders))
+	} else {
+		log.Printf("Total exported: %d placemarks", spool.count)
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"database/sql"
+	"strings"
+	"testing"
+
+	"exporter/geom"
+)
+
+func TestKMLValue(t *testing.T) {
+	tests := []struct {
+		value interface{}
+		want  string
+	}{
+		{2.5e6, "2500000"},
+		{1234567.89, "1234567.89"},
+		{1e21, "1000000000000000000000"},
+		{0.000001, "0.000001"},
+		{42, "42"},
+		{int64(9007199254740993), "9007199254740993"},
+		{"2.5e+06", "2.5e+06"},
+		{true, "true"},
+	}
+	for _, tt := range tests {
+		if got := kmlValue(tt.value); got != tt.want {
+			t.Errorf("kmlValue(%#v) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestKMLPlacemarkData(t *testing.T) {
+	cadNum, err := ParseCadastralNumber("16:50:011001:7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj := &CadastralObject{
+		CadNum:      cadNum,
+		Code:        7,
+		QuarterCode: 11001,
+		LoadStatus:  "loaded",
+		Area:        sql.NullInt64{Int64: 12000000, Valid: true},
+		CostValue:   sql.NullFloat64{Float64: 2500000, Valid: true},
+		Geometry:    &geom.Point{Layout: geom.XY, Coords: []float64{49.1, 55.8}},
+	}
+	placemark := string(appendKMLPlacemark(nil, obj, "style"))
+	for _, want := range []string{
+		`<Data name="area"><value>12000000</value></Data>`,
+		`<Data name="cost_value"><value>2500000</value></Data>`,
+	} {
+		if !strings.Contains(placemark, want) {
+			t.Errorf("placemark has no %s:\n%s", want, placemark)
+		}
+	}
+	if strings.Contains(placemark, "e+") {
+		t.Errorf("placemark has a number with an exponent:\n%s", placemark)
+	}
+}
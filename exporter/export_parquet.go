@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"exporter/crs"
+	"exporter/geom"
+)
+
+// Parquet compression options
+const (
+	compressionNone = "none"
+	compressionGzip = "gzip"
+)
+
+// geoParquetVersion is the GeoParquet specification version written to
+// the geo metadata
+const geoParquetVersion = "1.1.0"
+
+// ParquetOptions configures the GeoParquet exporter
+type ParquetOptions struct {
+	OutputFile string
+	CRS        *crs.CRS
+	// RowGroupSize is the number of rows per row group; each row group
+	// carries the bounding box of its rows in the bbox column statistics
+	RowGroupSize int
+	// Compression of the data pages: none or gzip
+	Compression string
+	// OptionColumns maps NSPD options to extra columns
+	OptionColumns []OptionColumn
+}
+
+// validate checks the option values
+func (o ParquetOptions) validate() error {
+	if o.RowGroupSize < 1 {
+		return fmt.Errorf("row group size must be positive, got %d", o.RowGroupSize)
+	}
+	switch o.Compression {
+	case compressionNone, compressionGzip:
+		return nil
+	}
+	return fmt.Errorf("unknown compression %q (expected %s or %s)", o.Compression, compressionNone, compressionGzip)
+}
+
+// codec returns the Parquet compression codec of the options
+func (o ParquetOptions) codec() int32 {
+	if o.Compression == compressionGzip {
+		return parquetGzip
+	}
+	return parquetUncompressed
+}
+
+// parquetSchema returns the columns of a GeoParquet export: the object
+// columns and option columns, the WKB geometry and its bbox covering. With
+// nullGeometry the geometry and bbox are optional, for objects with an
+// empty geometry.
+func parquetSchema(optionColumns []OptionColumn, nullGeometry bool) []parquetField {
+	str := func(name string, optional bool) parquetField {
+		return parquetField{name: name, typ: parquetByteArray, optional: optional, annotation: annotationString}
+	}
+	fields := []parquetField{
+		str("cad_num", false),
+		{name: "code", typ: parquetInt64},
+		{name: "quarter_code", typ: parquetInt64},
+		str("load_status", false),
+		{name: "update_date", typ: parquetInt32, optional: true, annotation: annotationDate},
+		{name: "area", typ: parquetInt64, optional: true},
+		{name: "cost_value", typ: parquetDouble, optional: true},
+		str("permitted_use_established_by_document", true),
+		str("right_type", true),
+		str("status", true),
+		str("land_record_type", true),
+		str("land_record_subtype", true),
+		str("land_record_category_type", true),
+	}
+	for _, c := range optionColumns {
+		f := parquetField{name: c.columnName(), optional: true}
+		switch c.Type {
+		case "INTEGER":
+			f.typ = parquetInt64
+		case "REAL":
+			f.typ = parquetDouble
+		case "BOOLEAN":
+			f.typ = parquetBoolean
+		case "DATE":
+			f.typ, f.annotation = parquetInt32, annotationDate
+		case "DATETIME":
+			f.typ, f.annotation = parquetInt64, annotationTimestampMillis
+		default:
+			f = str(f.name, true)
+		}
+		fields = append(fields, f)
+	}
+
+	bbox := parquetField{name: "bbox", optional: nullGeometry}
+	for _, name := range []string{"xmin", "ymin", "xmax", "ymax"} {
+		bbox.children = append(bbox.children, parquetField{name: name, typ: parquetDouble})
+	}
+	return append(fields,
+		parquetField{name: "geometry", typ: parquetByteArray, optional: nullGeometry},
+		bbox,
+	)
+}
+
+// parquetValue converts an attribute value read back from the spool to the
+// physical type of its column: integers and doubles from JSON numbers,
+// dates to days and timestamps to milliseconds since the Unix epoch
+func parquetValue(f parquetField, value interface{}) (interface{}, error) {
+	if value == nil {
+		return nil, nil
+	}
+	switch f.typ {
+	case parquetInt64, parquetDouble:
+		if s, ok := value.(string); ok && f.annotation == annotationTimestampMillis {
+			t, err := time.Parse(time.RFC3339Nano, s)
+			if err != nil {
+				return nil, err
+			}
+			return t.UnixMilli(), nil
+		}
+		n, ok := value.(json.Number)
+		if !ok {
+			return nil, fmt.Errorf("%v is not a number", value)
+		}
+		if f.typ == parquetDouble {
+			return n.Float64()
+		}
+		return n.Int64()
+	case parquetInt32:
+		s, _ := value.(string)
+		t, err := time.Parse("2006-01-02", s)
+		if err != nil {
+			return nil, fmt.Errorf("%v is not a date", value)
+		}
+		return int32(t.Unix() / 86400), nil
+	}
+	return value, nil
+}
+
+// parquetSpool collects the rows of a GeoParquet file. Rows are spooled to
+// a temporary file like FlatGeobuf features, as WKB and JSON values, and
+// written in Hilbert order of their envelopes so that the bbox statistics
+// of each row group cover a compact area. Rows of empty geometries have no
+// envelope to sort by and follow with a null geometry.
+type parquetSpool struct {
+	spool *recordSpool
+	rows  []spooledFeature
+	nulls []spooledFeature
+
+	geometryTypes map[string]bool
+}
+
+// createParquetSpool creates the spool of the GeoParquet file at path
+func createParquetSpool(path string) (*parquetSpool, error) {
+	spool, err := createRecordSpool(path)
+	if err != nil {
+		return nil, err
+	}
+	return &parquetSpool{
+		spool:         spool,
+		geometryTypes: make(map[string]bool),
+	}, nil
+}
+
+// add spools a geometry in the output CRS with its attribute values; an
+// empty geometry is spooled without WKB and written as null. GeoParquet has
+// no M coordinates, so they are dropped.
+func (s *parquetSpool) add(g geom.Geometry, values []interface{}) error {
+	var wkb []byte
+	layout, geometryType := geom.XY, g.GeometryType()
+	if g.CoordLayout().HasZ() {
+		layout, geometryType = geom.XYZ, geometryType+" Z"
+	}
+	if !g.IsEmpty() {
+		var err error
+		if wkb, err = geom.MarshalWKB(g, layout); err != nil {
+			return fmt.Errorf("failed to encode geometry: %w", err)
+		}
+	}
+	data, err := json.Marshal(values)
+	if err != nil {
+		return fmt.Errorf("failed to encode values: %w", err)
+	}
+
+	record := binary.LittleEndian.AppendUint32(nil, uint32(len(wkb)))
+	record = append(record, wkb...)
+	record = binary.LittleEndian.AppendUint32(record, uint32(len(data)))
+	record = append(record, data...)
+	if wkb == nil {
+		r, err := s.spool.add(record)
+		if err != nil {
+			return err
+		}
+		s.nulls = append(s.nulls, spooledFeature{r, geom.EmptyBounds()})
+		return nil
+	}
+	row, err := s.spool.addFeature(record, g.Bounds())
+	if err != nil {
+		return err
+	}
+	s.geometryTypes[geometryType] = true
+	s.rows = append(s.rows, row)
+	return nil
+}
+
+// count returns the number of spooled rows
+func (s *parquetSpool) count() int {
+	return len(s.rows) + len(s.nulls)
+}
+
+// discard closes and removes the spool
+func (s *parquetSpool) discard() {
+	s.spool.discard()
+}
+
+// finish writes the GeoParquet file from the spool and removes the spool
+func (s *parquetSpool) finish(opts ParquetOptions) error {
+	defer s.discard()
+	sortByHilbert(s.rows, s.spool.extent)
+
+	metadata, err := s.geoMetadata(opts.CRS)
+	if err != nil {
+		return err
+	}
+	schema := parquetSchema(opts.OptionColumns, len(s.nulls) > 0)
+	p, err := createParquet(opts.OutputFile, schema, opts.codec(), opts.RowGroupSize)
+	if err != nil {
+		return err
+	}
+	p.metadata = append(p.metadata, [2]string{"geo", metadata})
+
+	attributes := schema[:len(schema)-2]
+	for i, row := range append(s.rows, s.nulls...) {
+		record, err := s.spool.read(row.spoolRecord)
+		if err != nil {
+			p.discard()
+			return err
+		}
+		n := binary.LittleEndian.Uint32(record)
+
+		var values []interface{}
+		dec := json.NewDecoder(bytes.NewReader(record[8+n:]))
+		dec.UseNumber()
+		if err := dec.Decode(&values); err != nil {
+			p.discard()
+			return fmt.Errorf("failed to read spool: %w", err)
+		}
+		for j, f := range attributes {
+			if values[j], err = parquetValue(f, values[j]); err != nil {
+				p.discard()
+				return fmt.Errorf("invalid %s value: %w", f.name, err)
+			}
+		}
+
+		if n == 0 {
+			values = append(values, nil, nil, nil, nil, nil)
+		} else {
+			b := row.bounds
+			values = append(values, record[4:4+n], b.MinX, b.MinY, b.MaxX, b.MaxY)
+		}
+		if err := p.WriteRow(values); err != nil {
+			p.discard()
+			return err
+		}
+		if (i+1)%10000 == 0 {
+			log.Printf("Written %d rows...", i+1)
+		}
+	}
+	return p.Close()
+}
+
+// geoMetadata returns the GeoParquet "geo" file metadata: the WKB geometry
+// column with its geometry types, bbox, bbox covering columns and CRS.
+// Longitude and latitude on WGS 84 is the GeoParquet default CRS
+// (OGC:CRS84) and is left out.
+func (s *parquetSpool) geoMetadata(target *crs.CRS) (string, error) {
+	types := make([]string, 0, len(s.geometryTypes))
+	for t := range s.geometryTypes {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+
+	column := map[string]interface{}{
+		"encoding":       "WKB",
+		"geometry_types": types,
+		"covering": map[string]interface{}{
+			"bbox": map[string]interface{}{
+				"xmin": []string{"bbox", "xmin"},
+				"ymin": []string{"bbox", "ymin"},
+				"xmax": []string{"bbox", "xmax"},
+				"ymax": []string{"bbox", "ymax"},
+			},
+		},
+	}
+	if !s.spool.extent.IsEmpty() {
+		column["bbox"] = []float64{s.spool.extent.MinX, s.spool.extent.MinY, s.spool.extent.MaxX, s.spool.extent.MaxY}
+	}
+	if target != crs.WGS84 {
+		column["crs"] = target.PROJJSON()
+	}
+
+	data, err := json.Marshal(map[string]interface{}{
+		"version":        geoParquetVersion,
+		"primary_column": "geometry",
+		"columns":        map[string]interface{}{"geometry": column},
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to encode geo metadata: %w", err)
+	}
+	return string(data), nil
+}
+
+// exportToParquet writes the cadastral objects to a GeoParquet file with
+// typed attribute columns, a WKB geometry column and a bbox covering
+// column for row group pruning
+func exportToParquet(src *Source, opts ParquetOptions) error {
+	if err := opts.validate(); err != nil {
+		return err
+	}
+	transformer := crs.NewTransformer(sourceCRS, opts.CRS)
+
+	spool, err := createParquetSpool(opts.OutputFile)
+	if err != nil {
+		return err
+	}
+
+	objects, err := src.Objects()
+	if err != nil {
+		spool.discard()
+		return err
+	}
+	defer objects.Close()
+
+	for objects.Next() {
+		obj := objects.Object()
+		transformGeometry(obj.Geometry, transformer)
+		if err := spool.add(obj.Geometry, objectRowValues(obj, opts.OptionColumns)); err != nil {
+			spool.discard()
+			return err
+		}
+		if spool.count()%1000 == 0 {
+			log.Printf("Processed %d objects...", spool.count())
+		}
+	}
+	if err := objects.Err(); err != nil {
+		spool.discard()
+		return fmt.Errorf("failed to read objects: %w", err)
+	}
+
+	if len(spool.nulls) > 0 {
+		log.Printf("%d objects with an empty geometry have a null geometry", len(spool.nulls))
+	}
+	log.Printf("Writing %d objects in row groups of %d", spool.count(), opts.RowGroupSize)
+	if err := spool.finish(opts); err != nil {
+		return err
+	}
+	log.Printf("Total exported: %d objects", spool.count())
+	return nil
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"exporter/crs"
+)
+
+// ShapefileOptions configures the Shapefile exporter
+type ShapefileOptions struct {
+	// OutputFile is the .shp path; other files are named after it
+	OutputFile string
+	// Encoding of the DBF text: utf-8 or cp1251
+	Encoding string
+	CRS      *crs.CRS
+	// OptionColumns maps NSPD options to extra DBF fields
+	OptionColumns []OptionColumn
+}
+
+// validate checks the option values
+func (o ShapefileOptions) validate() error {
+	switch o.Encoding {
+	case encodingUTF8, encodingCP1251:
+		return nil
+	}
+	return fmt.Errorf("unknown encoding %q (expected %s or %s)", o.Encoding, encodingUTF8, encodingCP1251)
+}
+
+// maxDBFFieldName is the length limit of DBF field names
+const maxDBFFieldName = 10
+
+// shapefileFieldNames are the DBF field names of the object columns and
+// default option columns whose names exceed the DBF limit
+var shapefileFieldNames = map[string]string{
+	"quarter_code":                          "quarter",
+	"load_status":                           "load_stat",
+	"update_date":                           "upd_date",
+	"permitted_use_established_by_document": "perm_use",
+	"land_record_type":                      "lr_type",
+	"land_record_subtype":                   "lr_subtype",
+	"land_record_category_type":             "lr_categ",
+	"readable_address":                      "address",
+	"quarter_cad_number":                    "quarter_cn",
+	"ownership_type":                        "owner_type",
+	"common_data_status":                    "common_st",
+	"previously_posted":                     "prev_post",
+	"specified_area":                        "spec_area",
+	"declared_area":                         "decl_area",
+	"land_record_area":                      "lr_area",
+	"land_record_area_declaration":          "lr_area_dc",
+	"land_record_area_verified":             "lr_area_vr",
+	"registration_date":                     "reg_date",
+	"land_record_reg_date":                  "lr_reg_dt",
+	"cost_application_date":                 "cost_appl",
+	"cost_approvement_date":                 "cost_appr",
+	"cost_determination_date":               "cost_det",
+	"cost_registration_date":                "cost_reg",
+	"determination_cause":                   "det_cause",
+}
+
+// shapefileFields returns the DBF fields of the object columns followed by
+// the option columns. Names without a mapping are cut to 10 characters and
+// numbered if that makes them collide, e.g. registration_number becomes
+// registrati and a second such column registra_2.
+func shapefileFields(optionColumns []OptionColumn, encoding string) []dbfField {
+	// varchar(128) takes up to 256 bytes in UTF-8, more than the 254 a DBF
+	// character field holds, so full-length Cyrillic values are cut to 127
+	// characters; in CP1251 they take 128 bytes and fit
+	varchar := 254
+	if encoding == encodingCP1251 {
+		varchar = 128
+	}
+	fields := []dbfField{
+		{Name: "cad_num", Type: 'C', Length: 24},
+		{Name: "code", Type: 'N', Length: 10},
+		{Name: "quarter_code", Type: 'N', Length: 10},
+		{Name: "load_status", Type: 'C', Length: 16},
+		{Name: "update_date", Type: 'D', Length: 8},
+		{Name: "area", Type: 'N', Length: 11},
+		{Name: "cost_value", Type: 'N', Length: 20, Decimals: 2},
+		{Name: "permitted_use_established_by_document", Type: 'C', Length: varchar},
+		{Name: "right_type", Type: 'C', Length: varchar},
+		{Name: "status", Type: 'C', Length: varchar},
+		{Name: "land_record_type", Type: 'C', Length: varchar},
+		{Name: "land_record_subtype", Type: 'C', Length: varchar},
+		{Name: "land_record_category_type", Type: 'C', Length: varchar},
+	}
+	for _, c := range optionColumns {
+		f := dbfField{Name: c.columnName()}
+		switch c.Type {
+		case "INTEGER":
+			f.Type, f.Length = 'N', 18
+		case "REAL":
+			f.Type, f.Length, f.Decimals = 'N', 24, 6
+		case "BOOLEAN":
+			f.Type, f.Length = 'L', 1
+		case "DATE":
+			f.Type, f.Length = 'D', 8
+		case "DATETIME":
+			f.Type, f.Length = 'C', 24
+		default:
+			f.Type, f.Length = 'C', 254
+		}
+		fields = append(fields, f)
+	}
+
+	used := map[string]bool{}
+	for i := range fields {
+		name, ok := shapefileFieldNames[fields[i].Name]
+		if !ok {
+			name = fields[i].Name
+		}
+		if len(name) > maxDBFFieldName {
+			name = name[:maxDBFFieldName]
+		}
+		stem := name
+		for n := 2; used[strings.ToLower(name)]; n++ {
+			suffix := fmt.Sprintf("_%d", n)
+			name = stem[:min(len(stem), maxDBFFieldName-len(suffix))] + suffix
+		}
+		used[strings.ToLower(name)] = true
+		fields[i].Name = name
+	}
+	return fields
+}
+
+// shapefileLayer is the series of shapefiles written for one shape type;
+// a new file is started when the current one reaches the size limit
+type shapefileLayer struct {
+	base   string
+	files  []string
+	writer *shapefileWriter
+}
+
+// exportToShapefile streams cadastral objects from the source to
+// shapefiles, one per shape type and 2 GB chunk. If every object fits a
+// single file it is named after OutputFile; otherwise the files are
+// <name>_<type>.shp, <name>_<type>_2.shp and so on.
+func exportToShapefile(src *Source, opts ShapefileOptions) error {
+	if err := opts.validate(); err != nil {
+		return err
+	}
+	base := strings.TrimSuffix(opts.OutputFile, filepath.Ext(opts.OutputFile))
+	if dir := filepath.Dir(base); dir != "." {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("failed to create directory %s: %w", dir, err)
+		}
+	}
+
+	fields := shapefileFields(opts.OptionColumns, opts.Encoding)
+	transformer := crs.NewTransformer(sourceCRS, opts.CRS)
+
+	objects, err := src.Objects()
+	if err != nil {
+		return err
+	}
+	defer objects.Close()
+
+	layers := map[int]*shapefileLayer{}
+	var order []int
+	defer func() {
+		for _, layer := range layers {
+			if layer.writer != nil {
+				layer.writer.Close()
+			}
+		}
+	}()
+
+	var count int
+	for objects.Next() {
+		obj := objects.Object()
+		cadNum := obj.CadNum.String()
+
+		// Objects without geometry keep their attributes as a null shape in
+		// the file of their type, or the polygon file for collections
+		shapeType, ok := shapeTypeOf(obj.Geometry)
+		if obj.Geometry.IsEmpty() {
+			if !ok {
+				shapeType = shapePolygon
+			}
+			log.Printf("Writing object %s as a null shape: empty geometry", cadNum)
+		} else if !ok {
+			log.Printf("Skipping object %s: shapefiles cannot hold a %s", cadNum, obj.Geometry.GeometryType())
+			continue
+		}
+		transformGeometry(obj.Geometry, transformer)
+		content := encodeShape(obj.Geometry, shapeType)
+
+		layer, ok := layers[shapeType]
+		if !ok {
+			layer = &shapefileLayer{base: fmt.Sprintf("%s_%s", base, shapeTypeName(shapeType))}
+			layers[shapeType] = layer
+			order = append(order, shapeType)
+		}
+		if layer.writer == nil || !layer.writer.fits(content) {
+			if layer.writer != nil {
+				if err := layer.writer.Close(); err != nil {
+					return err
+				}
+			}
+			name := layer.base
+			if len(layer.files) > 0 {
+				name = fmt.Sprintf("%s_%d", layer.base, len(layer.files)+1)
+			}
+			if layer.writer, err = createShapefile(name, shapeType, fields, opts.Encoding, opts.CRS); err != nil {
+				return err
+			}
+			layer.files = append(layer.files, name)
+		}
+
+		overflow, err := layer.writer.write(obj.Geometry, content, objectRowValues(obj, opts.OptionColumns))
+		if err != nil {
+			return err
+		}
+		for _, name := range overflow {
+			log.Printf("Field %s of object %s does not fit its width and was cut or left blank", name, cadNum)
+		}
+
+		count++
+		if count%100 == 0 {
+			log.Printf("Processed %d objects...", count)
+		}
+	}
+	if err := objects.Err(); err != nil {
+		return fmt.Errorf("failed to read objects: %w", err)
+	}
+
+	var files []string
+	for _, shapeType := range order {
+		layer := layers[shapeType]
+		if err := layer.writer.Close(); err != nil {
+			return err
+		}
+		files = append(files, layer.files...)
+	}
+
+	// A single file takes the requested name; an export without objects
+	// still produces an empty polygon shapefile
+	switch len(files) {
+	case 0:
+		w, err := createShapefile(base, shapePolygon, fields, opts.Encoding, opts.CRS)
+		if err != nil {
+			return err
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+		files = []string{base}
+	case 1:
+		for _, ext := range []string{".shp", ".shx", ".dbf", ".prj", ".cpg"} {
+			if err := os.Rename(files[0]+ext, base+ext); err != nil {
+				return fmt.Errorf("failed to rename %s%s: %w", files[0], ext, err)
+			}
+		}
+		files = []string{base}
+	}
+
+	log.Printf("Total exported: %d objects in %d shapefiles: %s", count, len(files),
+		strings.Join(files, ".shp, ")+".shp")
+	return nil
+}
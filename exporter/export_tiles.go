@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+
+	"exporter/crs"
+)
+
+// maxTileZoom is the deepest zoom level the tiler accepts
+const maxTileZoom = 22
+
+// TilesOptions configures the vector tile exporter
+type TilesOptions struct {
+	// OutputFile is an .mbtiles or .pmtiles file
+	OutputFile string
+	MinZoom    int
+	MaxZoom    int
+	// Layer is the name of the vector tile layer
+	Layer string
+	// Tolerance is the simplification tolerance in tile units, of which a
+	// tile has 4096 across; 0 disables simplification
+	Tolerance float64
+	// OptionColumns maps NSPD options to extra attributes
+	OptionColumns []OptionColumn
+}
+
+// validate checks the option values
+func (o TilesOptions) validate() error {
+	switch strings.ToLower(filepath.Ext(o.OutputFile)) {
+	case ".mbtiles", ".pmtiles":
+	default:
+		return fmt.Errorf("output %s must be an .mbtiles or .pmtiles file", o.OutputFile)
+	}
+	if o.MinZoom < 0 || o.MaxZoom > maxTileZoom || o.MinZoom > o.MaxZoom {
+		return fmt.Errorf("invalid zoom range %d-%d (expected 0 <= min <= max <= %d)", o.MinZoom, o.MaxZoom, maxTileZoom)
+	}
+	if o.Layer == "" {
+		return fmt.Errorf("missing layer name")
+	}
+	if o.Tolerance < 0 {
+		return fmt.Errorf("simplification tolerance must not be negative")
+	}
+	return nil
+}
+
+// exportToTiles cuts the cadastral objects into Mapbox Vector Tiles for
+// each zoom level of the range and writes them to an MBTiles or PMTiles
+// file. The NSPD geometries are already in EPSG:3857, the tile CRS; they
+// are spooled to a temporary file while the levels are cut.
+func exportToTiles(src *Source, opts TilesOptions) error {
+	if err := opts.validate(); err != nil {
+		return err
+	}
+
+	features, err := createTileSpool(opts.OutputFile)
+	if err != nil {
+		return err
+	}
+	defer features.discard()
+
+	objects, err := src.Objects()
+	if err != nil {
+		return err
+	}
+	defer objects.Close()
+
+	for objects.Next() {
+		obj := objects.Object()
+		if obj.Geometry.IsEmpty() {
+			log.Printf("Skipping object %s: empty geometry", obj.CadNum)
+			continue
+		}
+		err := features.add(tileFeature{
+			geometry: obj.Geometry,
+			values:   objectRowValues(obj, opts.OptionColumns),
+		})
+		if err != nil {
+			return err
+		}
+		if len(features.features)%1000 == 0 {
+			log.Printf("Loaded %d objects...", len(features.features))
+		}
+	}
+	if err := objects.Err(); err != nil {
+		return fmt.Errorf("failed to read objects: %w", err)
+	}
+	log.Printf("Tiling %d objects at zoom levels %d-%d", len(features.features), opts.MinZoom, opts.MaxZoom)
+
+	meta := tilesetMetadata{
+		Name:        strings.TrimSuffix(filepath.Base(opts.OutputFile), filepath.Ext(opts.OutputFile)),
+		Description: "Cadastral objects",
+		MinZoom:     opts.MinZoom,
+		MaxZoom:     opts.MaxZoom,
+		Bounds:      [4]float64{-180, -85.0511287798066, 180, 85.0511287798066},
+		Layers: []vectorLayer{{
+			ID:      opts.Layer,
+			MinZoom: opts.MinZoom,
+			MaxZoom: opts.MaxZoom,
+			Fields:  tileFields(opts.OptionColumns),
+		}},
+	}
+	if extent := features.spool.extent; !extent.IsEmpty() {
+		toWGS84 := crs.NewTransformer(sourceCRS, crs.WGS84)
+		minLon, minLat := toWGS84.Transform(extent.MinX, extent.MinY)
+		maxLon, maxLat := toWGS84.Transform(extent.MaxX, extent.MaxY)
+		meta.Bounds = [4]float64{minLon, minLat, maxLon, maxLat}
+	}
+
+	var w tileWriter
+	if strings.EqualFold(filepath.Ext(opts.OutputFile), ".pmtiles") {
+		w, err = createPMTiles(opts.OutputFile, meta)
+	} else {
+		w, err = createMBTiles(opts.OutputFile, meta)
+	}
+	if err != nil {
+		return err
+	}
+
+	t := &tiler{
+		layer:     opts.Layer,
+		keys:      tileKeys(opts.OptionColumns),
+		tolerance: opts.Tolerance,
+	}
+	var total int
+	for z := opts.MinZoom; z <= opts.MaxZoom; z++ {
+		n, err := t.tileZoom(z, features, w)
+		if err != nil {
+			w.Close()
+			return err
+		}
+		total += n
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	log.Printf("Total exported: %d objects in %d tiles", len(features.features), total)
+	return nil
+}
+
+// tileKeys returns the attribute names of the tile features in the order
+// of objectRowValues
+func tileKeys(optionColumns []OptionColumn) []string {
+	keys := append([]string(nil), objectRowColumns...)
+	for _, c := range optionColumns {
+		keys = append(keys, c.columnName())
+	}
+	return keys
+}
+
+// tileFields returns the vector_layers field types of the attributes
+func tileFields(optionColumns []OptionColumn) map[string]string {
+	fields := make(map[string]string)
+	for _, name := range objectRowColumns {
+		fields[name] = "String"
+	}
+	for _, name := range []string{"code", "quarter_code", "area", "cost_value"} {
+		fields[name] = "Number"
+	}
+	for _, c := range optionColumns {
+		switch c.Type {
+		case "INTEGER", "REAL":
+			fields[c.columnName()] = "Number"
+		case "BOOLEAN":
+			fields[c.columnName()] = "Boolean"
+		default:
+			fields[c.columnName()] = "String"
+		}
+	}
+	return fields
+}
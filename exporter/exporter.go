@@ -2,137 +2,193 @@ package main
 
 import (
 	"database/sql"
-	"encoding/json"
 	"fmt"
 	"log"
+	"strings"
+
+	"exporter/crs"
+	"exporter/geom"
+)
+
+// Geometry type policies for GeoPackage export
+const (
+	// geometryTypeAuto registers the single geometry type of the layer, or
+	// GEOMETRY when it mixes types
+	geometryTypeAuto = "auto"
+	// geometryTypePromote writes Points, LineStrings and Polygons as their
+	// multi counterparts, so polygon layers become pure MULTIPOLYGON
+	geometryTypePromote = "promote"
+	// geometryTypeSplit writes each geometry type to its own table, e.g.
+	// cadastral_objects_multipolygon
+	geometryTypeSplit = "split"
+)
+
+// Write modes for GeoPackage export
+const (
+	// modeReplace recreates the output file
+	modeReplace = "replace"
+	// modeAppend adds the objects that are not in the existing file yet
+	modeAppend = "append"
+	// modeUpsert also rewrites objects whose update_date changed and removes
+	// objects that are no longer exportable
+	modeUpsert = "upsert"
 )
 
-// ExportData exports cadastral objects from PostgreSQL to GeoPackage
-func ExportData(pgDB *sql.DB, gpkgDB *sql.DB) error {
-	// Query cadastral objects with their data
-	rows, err := pgDB.Query(`
-		SELECT 
-			o.code,
-			o.quarter_code,
-			o.load_status::text,
-			o.update_date,
-			o.data::text,
-			o.area,
-			o.cost_value,
-			o.permitted_use_established_by_document,
-			o.right_type,
-			o.status,
-			o.land_record_type,
-			o.land_record_subtype,
-			o.land_record_category_type
-		FROM object o
-		WHERE o.data IS NOT NULL
-		AND o.load_status = 'SUCCESS'
-	`)
+// defaultTable is the feature table of the auto and promote policies
+const defaultTable = "cadastral_objects"
+
+// GPKGOptions holds the settings of a GeoPackage export
+type GPKGOptions struct {
+	// CRS is the target coordinate reference system
+	CRS *crs.CRS
+	// GeometryType is the geometry type policy: auto, promote or split
+	GeometryType string
+	// Mode is the write mode: replace, append or upsert
+	Mode string
+	// OptionColumns maps NSPD options to extra columns of the objects table
+	OptionColumns []OptionColumn
+}
+
+// validate checks the option values
+func (o GPKGOptions) validate() error {
+	switch o.GeometryType {
+	case geometryTypeAuto, geometryTypePromote, geometryTypeSplit:
+	default:
+		return fmt.Errorf("unknown geometry type policy %q (expected auto, promote or split)", o.GeometryType)
+	}
+	switch o.Mode {
+	case modeReplace, modeAppend, modeUpsert:
+	default:
+		return fmt.Errorf("unknown mode %q (expected replace, append or upsert)", o.Mode)
+	}
+	return nil
+}
+
+// incremental reports whether the export updates an existing file
+func (o GPKGOptions) incremental() bool {
+	return o.Mode == modeAppend || o.Mode == modeUpsert
+}
+
+// ExportData exports cadastral objects from the source to GeoPackage,
+// reprojecting them to the target CRS, together with the quarters and areas
+// they belong to. In the append and upsert modes the file must already hold
+// an export checked by validateGeoPackage.
+func ExportData(src *Source, gpkgDB *sql.DB, opts GPKGOptions) error {
+	if err := opts.validate(); err != nil {
+		return err
+	}
+
+	// Objects already in the file, by cadastral number
+	existing := map[string]existingObject{}
+	if opts.incremental() {
+		var err error
+		if existing, err = loadExistingObjects(gpkgDB); err != nil {
+			return err
+		}
+	}
+
+	// Quarters and areas are inserted first, as objects reference them
+	quarters, err := src.Quarters()
 	if err != nil {
-		return fmt.Errorf("failed to query objects: %w", err)
+		return err
+	}
+	if err := createHierarchyTables(gpkgDB, opts.CRS); err != nil {
+		return err
+	}
+	if err := insertHierarchy(gpkgDB, quarters, int32(opts.CRS.SRSID)); err != nil {
+		return err
 	}
-	defer rows.Close()
 
-	// Prepare insert statement
-	stmt, err := gpkgDB.Prepare(`
-		INSERT INTO cadastral_objects 
-		(code, quarter_code, load_status, update_date, area, cost_value,
-		 permitted_use_established_by_document, right_type, status,
-		 land_record_type, land_record_subtype, land_record_category_type, geometry)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
-	`)
+	objects, err := src.Objects()
 	if err != nil {
-		return fmt.Errorf("failed to prepare insert statement: %w", err)
-	}
-	defer stmt.Close()
-
-	var count int
-	var globalMinX, globalMinY, globalMaxX, globalMaxY float64
-	globalMinX = 1e10
-	globalMinY = 1e10
-	globalMaxX = -1e10
-	globalMaxY = -1e10
-
-	for rows.Next() {
-		var obj CadastralObject
-		if err := rows.Scan(
-			&obj.Code,
-			&obj.QuarterCode,
-			&obj.LoadStatus,
-			&obj.UpdateDate,
-			&obj.Data,
-			&obj.Area,
-			&obj.CostValue,
-			&obj.PermittedUseEstablishedByDoc,
-			&obj.RightType,
-			&obj.Status,
-			&obj.LandRecordType,
-			&obj.LandRecordSubtype,
-			&obj.LandRecordCategoryType,
-		); err != nil {
-			log.Printf("Failed to scan row: %v", err)
-			continue
-		}
+		return err
+	}
+	defer objects.Close()
+
+	transformer := crs.NewTransformer(sourceCRS, opts.CRS)
 
-		// Extract geometry from GeoJSON
-		geometry, err := extractGeometryFromJSON(obj.Data)
+	// Feature tables are opened when their first geometry arrives, or up
+	// front when they already exist
+	layers := map[string]*featureLayer{}
+	var order []string
+	defer func() {
+		for _, layer := range layers {
+			layer.close()
+		}
+	}()
+	layerFor := func(table string) (*featureLayer, error) {
+		if layer, ok := layers[table]; ok {
+			return layer, nil
+		}
+		layer, err := newFeatureLayer(gpkgDB, table, opts)
+		if err != nil {
+			return nil, err
+		}
+		layers[table] = layer
+		order = append(order, table)
+		return layer, nil
+	}
+	if opts.incremental() {
+		tables, err := existingFeatureTables(gpkgDB)
 		if err != nil {
-			log.Printf("Failed to extract geometry for object %d: %v", obj.Code, err)
+			return err
+		}
+		for _, table := range tables {
+			if _, err := layerFor(table); err != nil {
+				return err
+			}
+		}
+	}
+
+	var count, updated, unchanged int
+	for objects.Next() {
+		obj := objects.Object()
+		cadNum := obj.CadNum.String()
+
+		prev, exists := existing[cadNum]
+		if exists && (opts.Mode == modeAppend || prev.updateDate == formatUpdateDate(obj.UpdateDate)) {
+			unchanged++
 			continue
 		}
 
-		// Calculate envelope for this geometry
-		coordinates, ok := geometry["coordinates"]
-		if ok {
-			geomType, _ := geometry["type"].(string)
-			envelope := CalculateEnvelope(coordinates, geomType)
-			if envelope[0] < globalMinX {
-				globalMinX = envelope[0]
-			}
-			if envelope[1] > globalMaxX {
-				globalMaxX = envelope[1]
-			}
-			if envelope[2] < globalMinY {
-				globalMinY = envelope[2]
-			}
-			if envelope[3] > globalMaxY {
-				globalMaxY = envelope[3]
-			}
+		geometry := obj.Geometry
+		transformGeometry(geometry, transformer)
+		if opts.GeometryType == geometryTypePromote {
+			geometry = geom.Promote(geometry)
 		}
 
 		// Convert geometry to GPKG binary format
-		gpkgGeometry, err := ConvertGeometryToGPKG(geometry)
+		gpkgGeometry, err := ConvertGeometryToGPKG(geometry, int32(opts.CRS.SRSID))
 		if err != nil {
-			log.Printf("Failed to convert geometry for object %d: %v", obj.Code, err)
+			log.Printf("Failed to convert geometry for object %s: %v", cadNum, err)
 			continue
 		}
 
-		// Insert into GeoPackage
-		var updateDate interface{}
-		if obj.UpdateDate.Valid {
-			updateDate = obj.UpdateDate.Time.Format("2006-01-02")
-		}
-
-		_, err = stmt.Exec(
-			obj.Code,
-			obj.QuarterCode,
-			obj.LoadStatus,
-			updateDate,
-			getNullableInt64(obj.Area),
-			getNullableFloat64(obj.CostValue),
-			getNullableString(obj.PermittedUseEstablishedByDoc),
-			getNullableString(obj.RightType),
-			getNullableString(obj.Status),
-			getNullableString(obj.LandRecordType),
-			getNullableString(obj.LandRecordSubtype),
-			getNullableString(obj.LandRecordCategoryType),
-			gpkgGeometry,
-		)
+		table := defaultTable
+		if opts.GeometryType == geometryTypeSplit {
+			table = defaultTable + "_" + strings.ToLower(geometry.GeometryType())
+		}
+		layer, err := layerFor(table)
+		if err != nil {
+			return err
+		}
+
+		// A changed object is replaced, possibly in another table
+		var inserted bool
+		if exists {
+			inserted, err = layer.replace(gpkgDB, layers[prev.table], obj, geometry, gpkgGeometry)
+		} else {
+			inserted, err = layer.insert(nil, obj, geometry, gpkgGeometry)
+		}
 		if err != nil {
-			log.Printf("Failed to insert object %d: %v", obj.Code, err)
+			return err
+		}
+		if !inserted {
 			continue
 		}
+		if exists {
+			updated++
+		}
 
 		count++
 		if count%100 == 0 {
@@ -140,59 +196,337 @@ func ExportData(pgDB *sql.DB, gpkgDB *sql.DB) error {
 		}
 	}
 
-	log.Printf("Total exported: %d objects", count)
+	if err := objects.Err(); err != nil {
+		return fmt.Errorf("failed to read objects: %w", err)
+	}
 
-	// Update envelope in gpkg_contents with calculated bounds
-	if count > 0 {
-		if err := updateContentsEnvelope(gpkgDB, globalMinX, globalMinY, globalMaxX, globalMaxY); err != nil {
-			return fmt.Errorf("failed to update envelope: %w", err)
+	var removed int
+	if opts.Mode == modeUpsert {
+		if removed, err = removeObsoleteObjects(src, existing, layers); err != nil {
+			return err
 		}
 	}
 
+	// An export without features still produces the default table
+	if len(layers) == 0 && opts.GeometryType != geometryTypeSplit {
+		if _, err := layerFor(defaultTable); err != nil {
+			return err
+		}
+	}
+
+	for _, table := range order {
+		if err := layers[table].finish(gpkgDB); err != nil {
+			return err
+		}
+	}
+
+	// Enums hold the values of all objects, not only the exported ones, so
+	// that later incremental exports stay within them
+	values, err := src.DistinctValues(categoricalColumns)
+	if err != nil {
+		return err
+	}
+	if err := writeDataColumns(gpkgDB, order, opts.OptionColumns, values); err != nil {
+		return err
+	}
+
+	if err := dissolveHierarchy(gpkgDB, order, int32(opts.CRS.SRSID)); err != nil {
+		return err
+	}
+
+	if opts.incremental() {
+		log.Printf("Total exported: %d objects (%d new, %d updated), %d unchanged, %d removed",
+			count, count-updated, updated, unchanged, removed)
+	} else {
+		log.Printf("Total exported: %d objects", count)
+	}
 	return nil
 }
 
-// updateContentsEnvelope updates the envelope in gpkg_contents
-func updateContentsEnvelope(db *sql.DB, minX, minY, maxX, maxY float64) error {
-	_, err := db.Exec(`
-		UPDATE gpkg_contents 
-		SET min_x = ?, min_y = ?, max_x = ?, max_y = ?
-		WHERE table_name = 'cadastral_objects'
-	`, minX, minY, maxX, maxY)
+// featureLayer is a feature table being written, with the statistics
+// registered in the GeoPackage metadata once the export is done
+type featureLayer struct {
+	table         string
+	optionColumns []OptionColumn
+	insertStmt    *sql.Stmt
+	indexStmt     *sql.Stmt
+	deleteStmt    *sql.Stmt
 
-	return err
+	count, zCount, mCount int
+	bounds                geom.Bounds
+	// types counts the features of each geometry type
+	types map[string]int
+
+	// existing is the registration of a table that was already in the file
+	existing *geometryColumn
+}
+
+// geometryColumn is the registration of a feature table that already held
+// rows before the export
+type geometryColumn struct {
+	rows         int
+	geometryType string
+	z, m         int
+}
+
+// newFeatureLayer creates a feature table, or opens an existing one, and
+// prepares its statements
+func newFeatureLayer(db *sql.DB, table string, opts GPKGOptions) (*featureLayer, error) {
+	existing, err := loadGeometryColumn(db, table)
+	if err != nil {
+		return nil, err
+	}
+	if existing == nil {
+		identifier := "Cadastral Objects"
+		if suffix := strings.TrimPrefix(table, defaultTable+"_"); suffix != table {
+			identifier += " (" + suffix + ")"
+		}
+		if err := createFeatureTable(db, table, identifier, opts.CRS, opts.OptionColumns); err != nil {
+			return nil, err
+		}
+	}
+
+	// Prepare insert statement
+	columns := append([]string(nil), cadastralObjectColumns...)
+	for _, c := range opts.OptionColumns {
+		columns = append(columns, c.columnName())
+	}
+	insertStmt, err := db.Prepare(fmt.Sprintf(
+		"INSERT INTO %s (%s) VALUES (%s)",
+		table, strings.Join(columns, ", "), strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", ")))
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare insert statement: %w", err)
+	}
+
+	// The R-tree is filled directly from the computed envelopes; its
+	// triggers are only created after the bulk load. Existing files already
+	// have the triggers, which makes this a harmless second write.
+	indexStmt, err := db.Prepare(fmt.Sprintf(
+		"INSERT OR REPLACE INTO %s VALUES (?, ?, ?, ?, ?)", rtreeTable(table, "geometry")))
+	if err != nil {
+		insertStmt.Close()
+		return nil, fmt.Errorf("failed to prepare spatial index statement: %w", err)
+	}
+
+	// Deleting a row removes its R-tree entry through the delete trigger
+	deleteStmt, err := db.Prepare(fmt.Sprintf("DELETE FROM %s WHERE cad_num = ?", table))
+	if err != nil {
+		insertStmt.Close()
+		indexStmt.Close()
+		return nil, fmt.Errorf("failed to prepare delete statement: %w", err)
+	}
+
+	return &featureLayer{
+		table:         table,
+		optionColumns: opts.OptionColumns,
+		insertStmt:    insertStmt,
+		indexStmt:     indexStmt,
+		deleteStmt:    deleteStmt,
+		bounds:        geom.EmptyBounds(),
+		types:         map[string]int{},
+		existing:      existing,
+	}, nil
 }
 
-// extractGeometryFromJSON extracts the geometry from a GeoJSON data string
-func extractGeometryFromJSON(dataStr string) (map[string]interface{}, error) {
-	var data map[string]interface{}
-	if err := json.Unmarshal([]byte(dataStr), &data); err != nil {
-		return nil, fmt.Errorf("failed to parse JSON: %w", err)
+// insert writes one feature and indexes its geometry, within tx unless it
+// is nil. Features the table rejects are logged and skipped, returning false.
+func (l *featureLayer) insert(tx *sql.Tx, obj *CadastralObject, geometry geom.Geometry, gpkgGeometry []byte) (bool, error) {
+	insertStmt, indexStmt := l.insertStmt, l.indexStmt
+	if tx != nil {
+		insertStmt, indexStmt = tx.Stmt(insertStmt), tx.Stmt(indexStmt)
 	}
 
-	// Extract FeatureCollection
-	dataObj, ok := data["data"].(map[string]interface{})
-	if !ok {
-		return nil, fmt.Errorf("no 'data' field in JSON")
+	// The geometry column sits between the object and the option columns
+	cadNum := obj.CadNum.String()
+	row := objectRowValues(obj, l.optionColumns)
+	values := make([]interface{}, 0, len(row)+1)
+	values = append(values, row[:len(objectRowColumns)]...)
+	values = append(values, gpkgGeometry)
+	values = append(values, row[len(objectRowColumns):]...)
+
+	result, err := insertStmt.Exec(values...)
+	if err != nil {
+		log.Printf("Failed to insert object %s: %v", cadNum, err)
+		return false, nil
+	}
+	fid, err := result.LastInsertId()
+	if err != nil {
+		return false, fmt.Errorf("failed to read fid of object %s: %w", cadNum, err)
 	}
 
-	features, ok := dataObj["features"].([]interface{})
-	if !ok || len(features) == 0 {
-		return nil, fmt.Errorf("no features in JSON")
+	// Index the geometry and extend the layer envelope and dimensions
+	if !geometry.IsEmpty() {
+		envelope := CalculateEnvelope(geometry)
+		if _, err := indexStmt.Exec(fid, envelope[0], envelope[1], envelope[2], envelope[3]); err != nil {
+			return false, fmt.Errorf("failed to index object %s: %w", cadNum, err)
+		}
+		l.bounds.Union(geometry.Bounds())
+	}
+	if geometry.CoordLayout().HasZ() {
+		l.zCount++
 	}
+	if geometry.CoordLayout().HasM() {
+		l.mCount++
+	}
+	l.types[geometry.GeometryType()]++
+	l.count++
+	return true, nil
+}
 
-	// Get first feature's geometry
-	feature, ok := features[0].(map[string]interface{})
-	if !ok {
-		return nil, fmt.Errorf("invalid feature structure")
+// replace writes the new version of a changed object and deletes the old
+// one from prev, which may be another table. Both run in one transaction:
+// cad_num is unique, so the old row goes first, and it is restored by the
+// rollback when the table rejects the new version.
+func (l *featureLayer) replace(db *sql.DB, prev *featureLayer, obj *CadastralObject, geometry geom.Geometry, gpkgGeometry []byte) (bool, error) {
+	cadNum := obj.CadNum.String()
+	tx, err := db.Begin()
+	if err != nil {
+		return false, fmt.Errorf("failed to begin replacing object %s: %w", cadNum, err)
+	}
+	if _, err := tx.Stmt(prev.deleteStmt).Exec(cadNum); err != nil {
+		tx.Rollback()
+		return false, fmt.Errorf("failed to delete object %s from %s: %w", cadNum, prev.table, err)
 	}
+	inserted, err := l.insert(tx, obj, geometry, gpkgGeometry)
+	if err != nil || !inserted {
+		tx.Rollback()
+		if err == nil {
+			log.Printf("Keeping the previous version of object %s", cadNum)
+		}
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("failed to replace object %s: %w", cadNum, err)
+	}
+	return true, nil
+}
 
-	geometry, ok := feature["geometry"].(map[string]interface{})
-	if !ok {
-		return nil, fmt.Errorf("no geometry in feature")
+// delete removes a feature that is no longer exportable
+func (l *featureLayer) delete(cadNum string) error {
+	if _, err := l.deleteStmt.Exec(cadNum); err != nil {
+		return fmt.Errorf("failed to delete object %s from %s: %w", cadNum, l.table, err)
 	}
+	return nil
+}
 
-	return geometry, nil
+// finish records the envelope, geometry type and dimensions of the layer
+// and creates its spatial index triggers
+func (l *featureLayer) finish(db *sql.DB) error {
+	// Update envelope in gpkg_contents with calculated bounds; for a table
+	// that already existed they are read back from the spatial index
+	bounds := l.bounds
+	if l.existing != nil {
+		var err error
+		if bounds, err = spatialIndexExtent(db, l.table); err != nil {
+			return err
+		}
+	}
+	if err := updateContentsEnvelope(db, l.table, bounds); err != nil {
+		return fmt.Errorf("failed to update envelope: %w", err)
+	}
+
+	// Register the geometry type and whether Z and M values are prohibited,
+	// mandatory or optional
+	geometryType := l.geometryTypeName()
+	z, m := dimensionFlag(l.zCount, l.count), dimensionFlag(l.mCount, l.count)
+	if e := l.existing; e != nil && e.rows > 0 {
+		if l.count == 0 {
+			geometryType, z, m = e.geometryType, e.z, e.m
+		} else {
+			if geometryType != e.geometryType {
+				geometryType = "GEOMETRY"
+			}
+			z, m = mergeDimensionFlags(z, e.z), mergeDimensionFlags(m, e.m)
+		}
+	}
+	if err := updateGeometryColumn(db, l.table, geometryType, z, m); err != nil {
+		return fmt.Errorf("failed to update geometry column of %s: %w", l.table, err)
+	}
+
+	if len(l.types) > 1 {
+		log.Printf("Table %s mixes geometry types %v, registered as GEOMETRY", l.table, l.types)
+	}
+	log.Printf("Table %s: %d objects written", l.table, l.count)
+
+	return createSpatialIndexTriggers(db, l.table, "geometry", "fid")
+}
+
+// geometryTypeName returns the gpkg_geometry_columns type of the layer: the
+// type of all its features, or GEOMETRY if they differ or there are none
+func (l *featureLayer) geometryTypeName() string {
+	if len(l.types) != 1 {
+		return "GEOMETRY"
+	}
+	for name := range l.types {
+		return strings.ToUpper(name)
+	}
+	return "GEOMETRY"
+}
+
+// close releases the prepared statements
+func (l *featureLayer) close() {
+	l.insertStmt.Close()
+	l.indexStmt.Close()
+	l.deleteStmt.Close()
+}
+
+// updateContentsEnvelope updates the envelope and last change time of a
+// table in gpkg_contents; empty bounds clear the envelope
+func updateContentsEnvelope(db *sql.DB, table string, b geom.Bounds) error {
+	var minX, minY, maxX, maxY interface{}
+	if !b.IsEmpty() {
+		minX, minY, maxX, maxY = b.MinX, b.MinY, b.MaxX, b.MaxY
+	}
+	_, err := db.Exec(`
+		UPDATE gpkg_contents 
+		SET min_x = ?, min_y = ?, max_x = ?, max_y = ?,
+			last_change = strftime('%Y-%m-%dT%H:%M:%fZ', 'now')
+		WHERE table_name = ?
+	`, minX, minY, maxX, maxY, table)
+
+	return err
+}
+
+// updateGeometryColumn updates the geometry type and the z and m flags in
+// gpkg_geometry_columns
+func updateGeometryColumn(db *sql.DB, table, geometryType string, z, m int) error {
+	_, err := db.Exec(`
+		UPDATE gpkg_geometry_columns
+		SET geometry_type_name = ?, z = ?, m = ?
+		WHERE table_name = ? AND column_name = 'geometry'
+	`, geometryType, z, m, table)
+
+	return err
+}
+
+// dimensionFlag returns the gpkg_geometry_columns z/m value for a dimension
+// present in withDim of total geometries: 0 prohibited, 1 mandatory, 2 optional
+func dimensionFlag(withDim, total int) int {
+	switch {
+	case withDim == 0:
+		return 0
+	case withDim == total:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// mergeDimensionFlags combines the z/m values of the rows already in a
+// table and the rows just written
+func mergeDimensionFlags(a, b int) int {
+	if a == b {
+		return a
+	}
+	return 2
+}
+
+// formatUpdateDate returns the update date as stored in the GeoPackage
+func formatUpdateDate(d sql.NullTime) sql.NullString {
+	if !d.Valid {
+		return sql.NullString{}
+	}
+	return sql.NullString{String: d.Time.Format("2006-01-02"), Valid: true}
 }
 
 // Helper functions for nullable SQL types
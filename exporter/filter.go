@@ -0,0 +1,363 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"exporter/crs"
+	"exporter/geom"
+	"github.com/lib/pq"
+)
+
+// Filter restricts the set of exported objects. Attribute conditions are
+// translated into parameterised SQL; the spatial conditions are checked
+// against the decoded geometry because object.data is plain jsonb.
+type Filter struct {
+	QuarterCodes []int64
+	AreaCodes    []int64
+	RegionCodes  []int64
+	Statuses     []string
+	Categories   []string
+	UpdatedFrom  time.Time
+	UpdatedTo    time.Time
+	CostMin      *float64
+	CostMax      *float64
+
+	// Spatial filter in EPSG:3857, resolved from the flags by Prepare
+	BBox   *[4]float64 // min_x, min_y, max_x, max_y
+	Within []*geom.Polygon
+
+	crs        string
+	bboxFlag   string
+	withinFlag string
+}
+
+// registerFilterFlags adds the filter flags to a command flag set
+func registerFilterFlags(fs *flag.FlagSet, f *Filter) {
+	fs.Func("quarter", "Comma-separated quarter codes to export (e.g. 130101,130104)", func(s string) error {
+		return parseIntList(s, &f.QuarterCodes)
+	})
+	fs.Func("area-code", "Comma-separated cadastral area codes to export (e.g. 50)", func(s string) error {
+		return parseIntList(s, &f.AreaCodes)
+	})
+	fs.Func("region-code", "Comma-separated region codes to export (e.g. 16)", func(s string) error {
+		return parseIntList(s, &f.RegionCodes)
+	})
+	fs.Func("status", "Comma-separated object statuses to export (e.g. 'Учтенный')", func(s string) error {
+		f.Statuses = append(f.Statuses, splitList(s)...)
+		return nil
+	})
+	fs.Func("category", "Comma-separated land_record_category_type values to export", func(s string) error {
+		f.Categories = append(f.Categories, splitList(s)...)
+		return nil
+	})
+	fs.Func("updated-from", "Export objects updated on or after this date (YYYY-MM-DD)", func(s string) error {
+		return parseDate(s, &f.UpdatedFrom)
+	})
+	fs.Func("updated-to", "Export objects updated on or before this date (YYYY-MM-DD)", func(s string) error {
+		return parseDate(s, &f.UpdatedTo)
+	})
+	fs.Func("cost-min", "Minimum cost_value", func(s string) error {
+		return parseFloatPtr(s, &f.CostMin)
+	})
+	fs.Func("cost-max", "Maximum cost_value", func(s string) error {
+		return parseFloatPtr(s, &f.CostMax)
+	})
+	fs.StringVar(&f.bboxFlag, "bbox", "", "Bounding box 'min_x,min_y,max_x,max_y' that exported geometries must intersect")
+	fs.StringVar(&f.withinFlag, "within", "", "GeoJSON file with a Polygon or MultiPolygon that exported geometries must intersect")
+	fs.StringVar(&f.crs, "filter-crs", "EPSG:4326", "CRS of -bbox and -within coordinates (e.g. EPSG:4326, EPSG:3857, msk16-1)")
+}
+
+// Prepare resolves the spatial flags into EPSG:3857 geometries. It must be
+// called after the flag set has been parsed.
+func (f *Filter) Prepare() error {
+	filterCRS := crs.WGS84
+	if f.crs != "" {
+		var err error
+		if filterCRS, err = crs.Lookup(f.crs); err != nil {
+			return fmt.Errorf("invalid -filter-crs: %w", err)
+		}
+	}
+	toSource := crs.NewTransformer(filterCRS, sourceCRS)
+
+	if f.bboxFlag != "" {
+		parts := splitList(f.bboxFlag)
+		if len(parts) != 4 {
+			return fmt.Errorf("invalid -bbox %q: expected 4 comma-separated numbers", f.bboxFlag)
+		}
+		var bbox [4]float64
+		for i, part := range parts {
+			v, err := strconv.ParseFloat(part, 64)
+			if err != nil {
+				return fmt.Errorf("invalid -bbox %q: %w", f.bboxFlag, err)
+			}
+			bbox[i] = v
+		}
+		if bbox[0] > bbox[2] || bbox[1] > bbox[3] {
+			return fmt.Errorf("invalid -bbox %q: min is greater than max", f.bboxFlag)
+		}
+		if !toSource.Identity() {
+			// Reproject the corners and take the box around them
+			b := geom.EmptyBounds()
+			for _, corner := range [][2]float64{
+				{bbox[0], bbox[1]}, {bbox[2], bbox[1]}, {bbox[2], bbox[3]}, {bbox[0], bbox[3]},
+			} {
+				b.Extend(toSource.Transform(corner[0], corner[1]))
+			}
+			bbox = [4]float64{b.MinX, b.MinY, b.MaxX, b.MaxY}
+		}
+		f.BBox = &bbox
+	}
+
+	if f.withinFlag != "" {
+		polygons, err := readFilterPolygons(f.withinFlag, toSource)
+		if err != nil {
+			return fmt.Errorf("invalid -within: %w", err)
+		}
+		f.Within = polygons
+	}
+
+	return nil
+}
+
+// SQL returns additional WHERE conditions (each prefixed with AND) and their
+// arguments, numbering placeholders from $1
+func (f *Filter) SQL() (string, []interface{}) {
+	if f == nil {
+		return "", nil
+	}
+
+	var conds []string
+	var args []interface{}
+	add := func(cond string, arg interface{}) {
+		args = append(args, arg)
+		conds = append(conds, strings.ReplaceAll(cond, "?", fmt.Sprintf("$%d", len(args))))
+	}
+
+	if len(f.QuarterCodes) > 0 {
+		add("o.quarter_code = ANY(?)", pq.Array(f.QuarterCodes))
+	}
+	if len(f.AreaCodes) > 0 {
+		add("o.quarter_code IN (SELECT q.code FROM quarter q WHERE q.area_code = ANY(?))", pq.Array(f.AreaCodes))
+	}
+	if len(f.RegionCodes) > 0 {
+		add(`o.quarter_code IN (
+			SELECT q.code FROM quarter q
+			JOIN area a ON a.code = q.area_code
+			WHERE a.region_code = ANY(?))`, pq.Array(f.RegionCodes))
+	}
+	if len(f.Statuses) > 0 {
+		add("o.status = ANY(?)", pq.Array(f.Statuses))
+	}
+	if len(f.Categories) > 0 {
+		add("o.land_record_category_type = ANY(?)", pq.Array(f.Categories))
+	}
+	if !f.UpdatedFrom.IsZero() {
+		add("o.update_date >= ?", f.UpdatedFrom)
+	}
+	if !f.UpdatedTo.IsZero() {
+		add("o.update_date <= ?", f.UpdatedTo)
+	}
+	if f.CostMin != nil {
+		add("o.cost_value >= ?", *f.CostMin)
+	}
+	if f.CostMax != nil {
+		add("o.cost_value <= ?", *f.CostMax)
+	}
+
+	var sb strings.Builder
+	for _, cond := range conds {
+		sb.WriteString("\n\tAND ")
+		sb.WriteString(cond)
+	}
+	return sb.String(), args
+}
+
+// Describe returns the filter as the flags that set it, e.g.
+// "-quarter 130101,130104 -updated-from 2024-01-01", or "none"
+func (f *Filter) Describe() string {
+	if f == nil {
+		return "none"
+	}
+
+	var parts []string
+	add := func(flag, value string) {
+		parts = append(parts, fmt.Sprintf("-%s %s", flag, value))
+	}
+	joinInts := func(values []int64) string {
+		s := make([]string, len(values))
+		for i, v := range values {
+			s[i] = strconv.FormatInt(v, 10)
+		}
+		return strings.Join(s, ",")
+	}
+
+	if len(f.QuarterCodes) > 0 {
+		add("quarter", joinInts(f.QuarterCodes))
+	}
+	if len(f.AreaCodes) > 0 {
+		add("area-code", joinInts(f.AreaCodes))
+	}
+	if len(f.RegionCodes) > 0 {
+		add("region-code", joinInts(f.RegionCodes))
+	}
+	if len(f.Statuses) > 0 {
+		add("status", strconv.Quote(strings.Join(f.Statuses, ",")))
+	}
+	if len(f.Categories) > 0 {
+		add("category", strconv.Quote(strings.Join(f.Categories, ",")))
+	}
+	if !f.UpdatedFrom.IsZero() {
+		add("updated-from", f.UpdatedFrom.Format("2006-01-02"))
+	}
+	if !f.UpdatedTo.IsZero() {
+		add("updated-to", f.UpdatedTo.Format("2006-01-02"))
+	}
+	if f.CostMin != nil {
+		add("cost-min", strconv.FormatFloat(*f.CostMin, 'f', -1, 64))
+	}
+	if f.CostMax != nil {
+		add("cost-max", strconv.FormatFloat(*f.CostMax, 'f', -1, 64))
+	}
+	if f.bboxFlag != "" {
+		add("bbox", f.bboxFlag)
+	}
+	if f.withinFlag != "" {
+		add("within", f.withinFlag)
+	}
+	if (f.bboxFlag != "" || f.withinFlag != "") && f.crs != "" {
+		add("filter-crs", f.crs)
+	}
+
+	if len(parts) == 0 {
+		return "none"
+	}
+	return strings.Join(parts, " ")
+}
+
+// MatchGeometry reports whether a decoded EPSG:3857 geometry passes the
+// spatial part of the filter
+func (f *Filter) MatchGeometry(geometry geom.Geometry) bool {
+	if f == nil || (f.BBox == nil && f.Within == nil) {
+		return true
+	}
+
+	if f.BBox != nil {
+		rect := geom.Bounds{MinX: f.BBox[0], MinY: f.BBox[1], MaxX: f.BBox[2], MaxY: f.BBox[3]}
+		if !geometry.Bounds().Intersects(rect) || !geom.Intersects(geometry, rect.Polygon()) {
+			return false
+		}
+	}
+
+	if f.Within != nil {
+		matched := false
+		for _, polygon := range f.Within {
+			if geom.Intersects(geometry, polygon) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	return true
+}
+
+// readFilterPolygons reads the polygons of a GeoJSON geometry, feature or
+// feature collection file and converts them to EPSG:3857
+func readFilterPolygons(path string, toSource *crs.Transformer) ([]*geom.Polygon, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc struct {
+		Type     string          `json:"type"`
+		Geometry json.RawMessage `json:"geometry"`
+		Features []struct {
+			Geometry json.RawMessage `json:"geometry"`
+		} `json:"features"`
+	}
+	if err := json.Unmarshal(content, &doc); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	var geometries []json.RawMessage
+	switch doc.Type {
+	case "FeatureCollection":
+		for _, feature := range doc.Features {
+			geometries = append(geometries, feature.Geometry)
+		}
+	case "Feature":
+		geometries = append(geometries, doc.Geometry)
+	default:
+		geometries = append(geometries, content)
+	}
+
+	var polygons []*geom.Polygon
+	for _, raw := range geometries {
+		if len(raw) == 0 || string(raw) == "null" {
+			continue
+		}
+		geometry, err := geom.UnmarshalGeoJSON(raw)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+		polygons = append(polygons, geom.Polygons(geometry)...)
+	}
+	if len(polygons) == 0 {
+		return nil, fmt.Errorf("no Polygon or MultiPolygon geometry in %s", path)
+	}
+
+	for _, polygon := range polygons {
+		transformGeometry(polygon, toSource)
+	}
+
+	return polygons, nil
+}
+
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func parseIntList(s string, dst *[]int64) error {
+	for _, item := range splitList(s) {
+		v, err := strconv.ParseInt(item, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid code %q", item)
+		}
+		*dst = append(*dst, v)
+	}
+	return nil
+}
+
+func parseDate(s string, dst *time.Time) error {
+	t, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		return fmt.Errorf("invalid date %q, expected YYYY-MM-DD", s)
+	}
+	*dst = t
+	return nil
+}
+
+func parseFloatPtr(s string, dst **float64) error {
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return fmt.Errorf("invalid number %q", s)
+	}
+	*dst = &v
+	return nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/binary"
+	"sort"
+)
+
+// fbTable is a FlatBuffers table under construction. Field values are
+// uint8, bool, uint16, int32 or uint64 scalars, or references: a string,
+// a []byte, []uint32 or []float64 vector, a nested *fbTable or a vector of
+// tables.
+type fbTable struct {
+	fields []fbField
+}
+
+// fbField is a table field by its slot number in the schema
+type fbField struct {
+	slot  int
+	value interface{}
+}
+
+// set stores a field value; fields with the schema default can be left out
+func (t *fbTable) set(slot int, value interface{}) {
+	t.fields = append(t.fields, fbField{slot, value})
+}
+
+// fbBuilder lays out a FlatBuffer front to back: each table follows its
+// vtable and precedes the strings, vectors and tables it refers to, so that
+// every unsigned offset points forward as the format requires
+type fbBuilder struct {
+	buf []byte
+}
+
+// fbBuild serializes a root table into a FlatBuffer
+func fbBuild(root *fbTable) []byte {
+	b := &fbBuilder{buf: make([]byte, 4)}
+	pos := b.table(root)
+	binary.LittleEndian.PutUint32(b.buf, uint32(pos))
+	return b.buf
+}
+
+// fbFieldSize returns the inline size of a field value; references take a
+// 32-bit offset
+func fbFieldSize(value interface{}) int {
+	switch value.(type) {
+	case uint8, bool:
+		return 1
+	case uint16:
+		return 2
+	case uint64:
+		return 8
+	default:
+		return 4
+	}
+}
+
+// pad appends zero bytes until the buffer length is rem modulo align
+func (b *fbBuilder) pad(align, rem int) {
+	for len(b.buf)%align != rem {
+		b.buf = append(b.buf, 0)
+	}
+}
+
+// table writes a vtable, the table and then its referenced values, and
+// returns the table position
+func (b *fbBuilder) table(t *fbTable) int {
+	// Larger fields first keeps the inline fields aligned without gaps
+	fields := append([]fbField(nil), t.fields...)
+	sort.SliceStable(fields, func(i, j int) bool {
+		return fbFieldSize(fields[i].value) > fbFieldSize(fields[j].value)
+	})
+
+	offsets := make([]int, len(fields))
+	size, align, slots := 4, 4, 0
+	for i, f := range fields {
+		n := fbFieldSize(f.value)
+		size = (size + n - 1) / n * n
+		offsets[i] = size
+		size += n
+		align = max(align, n)
+		slots = max(slots, f.slot+1)
+	}
+
+	b.pad(2, 0)
+	vtablePos := len(b.buf)
+	b.buf = binary.LittleEndian.AppendUint16(b.buf, uint16(4+2*slots))
+	b.buf = binary.LittleEndian.AppendUint16(b.buf, uint16(size))
+	vtable := make([]uint16, slots)
+	for i, f := range fields {
+		vtable[f.slot] = uint16(offsets[i])
+	}
+	for _, v := range vtable {
+		b.buf = binary.LittleEndian.AppendUint16(b.buf, v)
+	}
+
+	b.pad(align, 0)
+	pos := len(b.buf)
+	b.buf = append(b.buf, make([]byte, size)...)
+	binary.LittleEndian.PutUint32(b.buf[pos:], uint32(int32(pos-vtablePos)))
+	for i, f := range fields {
+		at := b.buf[pos+offsets[i]:]
+		switch v := f.value.(type) {
+		case uint8:
+			at[0] = v
+		case bool:
+			if v {
+				at[0] = 1
+			}
+		case uint16:
+			binary.LittleEndian.PutUint16(at, v)
+		case int32:
+			binary.LittleEndian.PutUint32(at, uint32(v))
+		case uint64:
+			binary.LittleEndian.PutUint64(at, v)
+		}
+	}
+
+	for i, f := range fields {
+		if ref, ok := b.reference(f.value); ok {
+			at := pos + offsets[i]
+			binary.LittleEndian.PutUint32(b.buf[at:], uint32(ref-at))
+		}
+	}
+	return pos
+}
+
+// reference writes a referenced value and returns its position; ok is
+// false for scalars
+func (b *fbBuilder) reference(value interface{}) (pos int, ok bool) {
+	switch v := value.(type) {
+	case string:
+		b.pad(4, 0)
+		pos = len(b.buf)
+		b.buf = binary.LittleEndian.AppendUint32(b.buf, uint32(len(v)))
+		b.buf = append(append(b.buf, v...), 0)
+	case []byte:
+		b.pad(4, 0)
+		pos = len(b.buf)
+		b.buf = binary.LittleEndian.AppendUint32(b.buf, uint32(len(v)))
+		b.buf = append(b.buf, v...)
+	case []uint32:
+		b.pad(4, 0)
+		pos = len(b.buf)
+		b.buf = binary.LittleEndian.AppendUint32(b.buf, uint32(len(v)))
+		for _, x := range v {
+			b.buf = binary.LittleEndian.AppendUint32(b.buf, x)
+		}
+	case []float64:
+		// The elements, not the length, are 8-byte aligned
+		b.pad(8, 4)
+		pos = len(b.buf)
+		b.buf = binary.LittleEndian.AppendUint32(b.buf, uint32(len(v)))
+		for _, x := range v {
+			b.buf = appendFloat64LE(b.buf, x)
+		}
+	case *fbTable:
+		pos = b.table(v)
+	case []*fbTable:
+		b.pad(4, 0)
+		pos = len(b.buf)
+		b.buf = binary.LittleEndian.AppendUint32(b.buf, uint32(len(v)))
+		b.buf = append(b.buf, make([]byte, 4*len(v))...)
+		for i, t := range v {
+			at := pos + 4 + 4*i
+			ref := b.table(t)
+			binary.LittleEndian.PutUint32(b.buf[at:], uint32(ref-at))
+		}
+	default:
+		return 0, false
+	}
+	return pos, true
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"reflect"
+	"testing"
+)
+
+// fbReader reads a table of a FlatBuffer the way the format specifies:
+// the table starts with a signed offset back to its vtable, which holds
+// the vtable and table sizes followed by the field offsets by slot
+type fbReader struct {
+	t      *testing.T
+	buf    []byte
+	pos    int
+	vtable int
+}
+
+// readFBRoot returns the root table of a FlatBuffer
+func readFBRoot(t *testing.T, buf []byte) fbReader {
+	return readFBTable(t, buf, int(binary.LittleEndian.Uint32(buf)))
+}
+
+// readFBTable returns the table at pos
+func readFBTable(t *testing.T, buf []byte, pos int) fbReader {
+	vtable := pos - int(int32(binary.LittleEndian.Uint32(buf[pos:])))
+	if vtable < 0 || vtable%2 != 0 {
+		t.Fatalf("table at %d: vtable at %d", pos, vtable)
+	}
+	return fbReader{t: t, buf: buf, pos: pos, vtable: vtable}
+}
+
+// field returns the position of a field, or 0 if it is not set
+func (r fbReader) field(slot int) int {
+	size := int(binary.LittleEndian.Uint16(r.buf[r.vtable:]))
+	if 4+2*slot >= size {
+		return 0
+	}
+	offset := int(binary.LittleEndian.Uint16(r.buf[r.vtable+4+2*slot:]))
+	if offset == 0 {
+		return 0
+	}
+	return r.pos + offset
+}
+
+// ref follows the unsigned offset of a reference field, which must point
+// forward
+func (r fbReader) ref(slot int) int {
+	at := r.field(slot)
+	if at == 0 {
+		r.t.Fatalf("slot %d is not set", slot)
+	}
+	offset := int(binary.LittleEndian.Uint32(r.buf[at:]))
+	if offset == 0 || at+offset >= len(r.buf) {
+		r.t.Fatalf("slot %d: offset %d out of range", slot, offset)
+	}
+	return at + offset
+}
+
+// vector returns the position of the first element and the length of a
+// vector field
+func (r fbReader) vector(slot int) (int, int) {
+	pos := r.ref(slot)
+	return pos + 4, int(binary.LittleEndian.Uint32(r.buf[pos:]))
+}
+
+// str returns a string field, checking its terminating zero
+func (r fbReader) str(slot int) string {
+	pos, n := r.vector(slot)
+	if r.buf[pos+n] != 0 {
+		r.t.Errorf("slot %d: string is not zero-terminated", slot)
+	}
+	return string(r.buf[pos : pos+n])
+}
+
+// table returns a nested table field
+func (r fbReader) table(slot int) fbReader {
+	return readFBTable(r.t, r.buf, r.ref(slot))
+}
+
+// tables returns the tables of a vector of tables
+func (r fbReader) tables(slot int) []fbReader {
+	pos, n := r.vector(slot)
+	var tables []fbReader
+	for i := 0; i < n; i++ {
+		at := pos + 4*i
+		tables = append(tables, readFBTable(r.t, r.buf, at+int(binary.LittleEndian.Uint32(r.buf[at:]))))
+	}
+	return tables
+}
+
+// aligned reports an error if a field is not aligned to its size
+func (r fbReader) aligned(slot, size int) int {
+	at := r.field(slot)
+	if at%size != 0 {
+		r.t.Errorf("slot %d at %d is not %d-byte aligned", slot, at, size)
+	}
+	return at
+}
+
+func TestFlatBuffersLayout(t *testing.T) {
+	nested := &fbTable{}
+	nested.set(0, "nested")
+	nested.set(1, int32(-7))
+	item := func(name string, v uint64) *fbTable {
+		t := &fbTable{}
+		t.set(0, name)
+		t.set(2, v)
+		return t
+	}
+
+	root := &fbTable{}
+	root.set(0, uint8(5))
+	root.set(1, true)
+	root.set(2, uint16(0xBEEF))
+	root.set(3, int32(-123456))
+	root.set(4, uint64(1)<<40+3)
+	root.set(5, "Кадастр")
+	root.set(6, []float64{1.5, -2.25, math.MaxFloat64})
+	root.set(7, nested)
+	root.set(8, []*fbTable{item("a", 1), item("b", 2)})
+	root.set(9, []uint32{7, 8, 9})
+	root.set(10, []byte{0xCA, 0xFE, 0x01})
+	// Slot 11 stays unset, as fields with the schema default are left out
+	root.set(12, uint8(9))
+
+	buf := fbBuild(root)
+	r := readFBRoot(t, buf)
+
+	// The vtable lists every slot up to the last set one and the inline
+	// size of the table, and precedes the table
+	if size := binary.LittleEndian.Uint16(buf[r.vtable:]); size != 4+2*13 {
+		t.Errorf("vtable size %d, want %d", size, 4+2*13)
+	}
+	if r.vtable >= r.pos {
+		t.Errorf("vtable at %d does not precede the table at %d", r.vtable, r.pos)
+	}
+	// Inline fields are sorted by size: the vtable offset, padding to the
+	// uint64 at 8, the int32 and 6 references, the uint16 and 3 bytes
+	if size := binary.LittleEndian.Uint16(buf[r.vtable+2:]); size != 8+8+7*4+2+3 {
+		t.Errorf("table size %d, want %d", size, 8+8+7*4+2+3)
+	}
+	if r.pos%8 != 0 {
+		t.Errorf("table at %d is not aligned to its uint64 field", r.pos)
+	}
+
+	if v := buf[r.field(0)]; v != 5 {
+		t.Errorf("uint8 = %d, want 5", v)
+	}
+	if v := buf[r.field(1)]; v != 1 {
+		t.Errorf("bool = %d, want 1", v)
+	}
+	if v := binary.LittleEndian.Uint16(buf[r.aligned(2, 2):]); v != 0xBEEF {
+		t.Errorf("uint16 = %#x, want 0xBEEF", v)
+	}
+	if v := int32(binary.LittleEndian.Uint32(buf[r.aligned(3, 4):])); v != -123456 {
+		t.Errorf("int32 = %d, want -123456", v)
+	}
+	if v := binary.LittleEndian.Uint64(buf[r.aligned(4, 8):]); v != uint64(1)<<40+3 {
+		t.Errorf("uint64 = %d, want %d", v, uint64(1)<<40+3)
+	}
+	if r.field(11) != 0 {
+		t.Errorf("unset slot 11 has an offset")
+	}
+	if v := buf[r.field(12)]; v != 9 {
+		t.Errorf("uint8 after a gap = %d, want 9", v)
+	}
+
+	if s := r.str(5); s != "Кадастр" {
+		t.Errorf("string = %q", s)
+	}
+
+	pos, n := r.vector(6)
+	if pos%8 != 0 {
+		t.Errorf("float64 elements at %d are not 8-byte aligned", pos)
+	}
+	var floats []float64
+	for i := 0; i < n; i++ {
+		floats = append(floats, math.Float64frombits(binary.LittleEndian.Uint64(buf[pos+8*i:])))
+	}
+	if !reflect.DeepEqual(floats, []float64{1.5, -2.25, math.MaxFloat64}) {
+		t.Errorf("float64 vector = %v", floats)
+	}
+
+	n7 := r.table(7)
+	if s := n7.str(0); s != "nested" {
+		t.Errorf("nested string = %q", s)
+	}
+	if v := int32(binary.LittleEndian.Uint32(buf[n7.field(1):])); v != -7 {
+		t.Errorf("nested int32 = %d, want -7", v)
+	}
+
+	items := r.tables(8)
+	if len(items) != 2 {
+		t.Fatalf("%d tables in the vector, want 2", len(items))
+	}
+	for i, want := range []string{"a", "b"} {
+		if s := items[i].str(0); s != want {
+			t.Errorf("table %d name = %q, want %q", i, s, want)
+		}
+		if items[i].field(1) != 0 {
+			t.Errorf("table %d has unset slot 1", i)
+		}
+		if v := binary.LittleEndian.Uint64(buf[items[i].aligned(2, 8):]); v != uint64(i+1) {
+			t.Errorf("table %d value = %d, want %d", i, v, i+1)
+		}
+	}
+
+	pos, n = r.vector(9)
+	var uints []uint32
+	for i := 0; i < n; i++ {
+		uints = append(uints, binary.LittleEndian.Uint32(buf[pos+4*i:]))
+	}
+	if !reflect.DeepEqual(uints, []uint32{7, 8, 9}) {
+		t.Errorf("uint32 vector = %v", uints)
+	}
+
+	pos, n = r.vector(10)
+	if !reflect.DeepEqual(buf[pos:pos+n], []byte{0xCA, 0xFE, 0x01}) {
+		t.Errorf("byte vector = %x", buf[pos:pos+n])
+	}
+}
+
+func TestFlatBuffersEmptyTable(t *testing.T) {
+	buf := fbBuild(&fbTable{})
+	r := readFBRoot(t, buf)
+	if size := binary.LittleEndian.Uint16(buf[r.vtable:]); size != 4 {
+		t.Errorf("vtable size %d, want 4", size)
+	}
+	if size := binary.LittleEndian.Uint16(buf[r.vtable+2:]); size != 4 {
+		t.Errorf("table size %d, want 4", size)
+	}
+	if r.field(0) != 0 {
+		t.Errorf("empty table has a field")
+	}
+}
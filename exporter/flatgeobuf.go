@@ -0,0 +1,600 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"exporter/crs"
+	"exporter/geom"
+)
+
+// flatGeobufMagic starts every FlatGeobuf file: "fgb", major version 3,
+// "fgb" and patch version 0
+var flatGeobufMagic = []byte{'f', 'g', 'b', 3, 'f', 'g', 'b', 0}
+
+const (
+	// fgbIndexNodeSize is the number of children of an R-tree node
+	fgbIndexNodeSize = 16
+	// fgbNodeItemSize is the size of an index node: min x, min y, max x,
+	// max y and the offset of the first child or of the feature
+	fgbNodeItemSize = 40
+	// hilbertMax is the largest cell coordinate of the Hilbert curve
+	hilbertMax = 1<<16 - 1
+)
+
+// FlatGeobuf geometry types
+const (
+	fgbUnknown            = 0
+	fgbPoint              = 1
+	fgbLineString         = 2
+	fgbPolygon            = 3
+	fgbMultiPoint         = 4
+	fgbMultiLineString    = 5
+	fgbMultiPolygon       = 6
+	fgbGeometryCollection = 7
+)
+
+// FlatGeobuf column types used for feature properties
+const (
+	fgbColumnBool   = 2
+	fgbColumnLong   = 7
+	fgbColumnDouble = 10
+	fgbColumnString = 11
+	fgbColumnJSON   = 12
+)
+
+// fgbNoType marks a column that only had null values so far
+const fgbNoType = 0xFF
+
+// fgbColumn is a property column of a FlatGeobuf file
+type fgbColumn struct {
+	name string
+	typ  byte
+}
+
+// flatGeobufSpool collects the features of a FlatGeobuf file. The header
+// needs the column schema and the index precedes the features in Hilbert
+// order, so features are spooled to a temporary file as WKB and JSON
+// properties and the file is assembled when it is finished.
+type flatGeobufSpool struct {
+	spool    *recordSpool
+	features []spooledFeature
+	columns  []fgbColumn
+	index    map[string]int
+
+	geometryType int
+	hasZ, hasM   bool
+}
+
+// createFlatGeobufSpool creates the spool of the FlatGeobuf file at path
+func createFlatGeobufSpool(path string) (*flatGeobufSpool, error) {
+	spool, err := createRecordSpool(path)
+	if err != nil {
+		return nil, err
+	}
+	return &flatGeobufSpool{
+		spool: spool,
+		index: make(map[string]int),
+	}, nil
+}
+
+// add spools a GeoJSON feature map, widening the column types to fit its
+// properties
+func (s *flatGeobufSpool) add(feature map[string]interface{}) error {
+	g, ok := feature["geometry"].(geom.Geometry)
+	if !ok {
+		return fmt.Errorf("FlatGeobuf features need a geometry, got %T", feature["geometry"])
+	}
+	if g.IsEmpty() {
+		return fmt.Errorf("FlatGeobuf features need a non-empty geometry")
+	}
+	layout := g.CoordLayout()
+	wkb, err := geom.MarshalWKB(g, layout)
+	if err != nil {
+		return fmt.Errorf("failed to encode geometry: %w", err)
+	}
+	properties, _ := feature["properties"].(map[string]interface{})
+	data, err := json.Marshal(properties)
+	if err != nil {
+		return fmt.Errorf("failed to encode properties: %w", err)
+	}
+
+	names := make([]string, 0, len(properties))
+	for name := range properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		i, ok := s.index[name]
+		if !ok {
+			i = len(s.columns)
+			s.index[name] = i
+			s.columns = append(s.columns, fgbColumn{name: name, typ: fgbNoType})
+		}
+		s.columns[i].typ = widenColumnType(s.columns[i].typ, fgbValueType(properties[name]))
+	}
+
+	record := binary.LittleEndian.AppendUint32(nil, uint32(len(wkb)))
+	record = append(record, wkb...)
+	record = binary.LittleEndian.AppendUint32(record, uint32(len(data)))
+	record = append(record, data...)
+	spooled, err := s.spool.addFeature(record, g.Bounds())
+	if err != nil {
+		return err
+	}
+
+	geometryType := fgbGeometryType(g)
+	if len(s.features) == 0 {
+		s.geometryType, s.hasZ, s.hasM = geometryType, layout.HasZ(), layout.HasM()
+	} else {
+		if s.geometryType != geometryType {
+			s.geometryType = fgbUnknown
+		}
+		s.hasZ = s.hasZ && layout.HasZ()
+		s.hasM = s.hasM && layout.HasM()
+	}
+	s.features = append(s.features, spooled)
+	return nil
+}
+
+// fgbValueType returns the column type of a property value, fgbNoType for
+// null. Whole floats, such as numbers decoded from NSPD JSON, count as Long.
+func fgbValueType(value interface{}) byte {
+	switch v := value.(type) {
+	case nil:
+		return fgbNoType
+	case bool:
+		return fgbColumnBool
+	case int, int32, int64:
+		return fgbColumnLong
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < 1<<53 {
+			return fgbColumnLong
+		}
+		return fgbColumnDouble
+	case string:
+		return fgbColumnString
+	default:
+		return fgbColumnJSON
+	}
+}
+
+// widenColumnType returns a column type holding values of both types:
+// Long widens to Double, anything else mixed becomes JSON
+func widenColumnType(a, b byte) byte {
+	switch {
+	case a == b || b == fgbNoType:
+		return a
+	case a == fgbNoType:
+		return b
+	case (a == fgbColumnLong || a == fgbColumnDouble) && (b == fgbColumnLong || b == fgbColumnDouble):
+		return fgbColumnDouble
+	default:
+		return fgbColumnJSON
+	}
+}
+
+// fgbGeometryType returns the FlatGeobuf type of a geometry
+func fgbGeometryType(g geom.Geometry) int {
+	switch g.(type) {
+	case *geom.Point:
+		return fgbPoint
+	case *geom.LineString:
+		return fgbLineString
+	case *geom.Polygon:
+		return fgbPolygon
+	case *geom.MultiPoint:
+		return fgbMultiPoint
+	case *geom.MultiLineString:
+		return fgbMultiLineString
+	case *geom.MultiPolygon:
+		return fgbMultiPolygon
+	case *geom.GeometryCollection:
+		return fgbGeometryCollection
+	default:
+		return fgbUnknown
+	}
+}
+
+// finish writes the FlatGeobuf file from the spool and removes the spool:
+// the magic bytes, the header, the packed Hilbert R-tree and the features
+// in the order of the tree leaves
+func (s *flatGeobufSpool) finish(path string, target *crs.CRS) (err error) {
+	defer s.spool.discard()
+	if err := s.spool.resume(); err != nil {
+		return err
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", path, err)
+	}
+	defer func() {
+		if cerr := file.Close(); err == nil && cerr != nil {
+			err = fmt.Errorf("failed to write %s: %w", path, cerr)
+		}
+	}()
+
+	extent := s.spool.extent
+	sortByHilbert(s.features, extent)
+
+	name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	header := fbBuild(s.header(name, extent, target))
+	var levels [][2]int
+	var nodes []fgbNode
+	if len(s.features) > 0 {
+		levels = fgbLevelBounds(len(s.features), fgbIndexNodeSize)
+		nodes = make([]fgbNode, levels[0][1])
+	}
+
+	w := bufio.NewWriter(file)
+	w.Write(flatGeobufMagic)
+	w.Write(binary.LittleEndian.AppendUint32(nil, uint32(len(header))))
+	w.Write(header)
+	indexPos := int64(len(flatGeobufMagic) + 4 + len(header))
+	w.Write(make([]byte, len(nodes)*fgbNodeItemSize))
+
+	var offset uint64
+	for i, f := range s.features {
+		record, err := s.spool.read(f.spoolRecord)
+		if err != nil {
+			return err
+		}
+		feature, err := s.encodeFeature(record)
+		if err != nil {
+			return err
+		}
+		w.Write(binary.LittleEndian.AppendUint32(nil, uint32(len(feature))))
+		w.Write(feature)
+
+		b := f.bounds
+		nodes[levels[0][0]+i] = fgbNode{b.MinX, b.MinY, b.MaxX, b.MaxY, offset}
+		offset += uint64(4 + len(feature))
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+
+	if len(nodes) > 0 {
+		fgbBuildNodes(nodes, levels, fgbIndexNodeSize)
+		index := make([]byte, 0, len(nodes)*fgbNodeItemSize)
+		for _, n := range nodes {
+			index = n.append(index)
+		}
+		if _, err := file.WriteAt(index, indexPos); err != nil {
+			return fmt.Errorf("failed to write %s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// header returns the Header table: layer name, extent, geometry type,
+// columns, feature count, index node size and CRS
+func (s *flatGeobufSpool) header(name string, extent geom.Bounds, target *crs.CRS) *fbTable {
+	h := &fbTable{}
+	h.set(0, name)
+	if !extent.IsEmpty() {
+		h.set(1, []float64{extent.MinX, extent.MinY, extent.MaxX, extent.MaxY})
+	}
+	h.set(2, uint8(s.geometryType))
+	if s.hasZ {
+		h.set(3, true)
+	}
+	if s.hasM {
+		h.set(4, true)
+	}
+
+	columns := make([]*fbTable, len(s.columns))
+	for i, c := range s.columns {
+		typ := c.typ
+		if typ == fgbNoType {
+			typ = fgbColumnString
+		}
+		columns[i] = &fbTable{}
+		columns[i].set(0, c.name)
+		columns[i].set(1, typ)
+		if title, ok := columnTitles[c.name]; ok {
+			columns[i].set(2, title)
+		}
+	}
+	if len(columns) > 0 {
+		h.set(7, columns)
+	}
+	h.set(8, uint64(len(s.features)))
+
+	// A node size of 0 tells readers there is no index
+	nodeSize := uint16(fgbIndexNodeSize)
+	if len(s.features) == 0 {
+		nodeSize = 0
+	}
+	h.set(9, nodeSize)
+
+	if target != nil {
+		c := &fbTable{}
+		c.set(0, target.Organization)
+		c.set(1, int32(target.OrganizationID))
+		c.set(2, target.Name)
+		c.set(4, target.WKT())
+		h.set(10, c)
+	}
+	return h
+}
+
+// encodeFeature converts a spooled record into a Feature FlatBuffer
+func (s *flatGeobufSpool) encodeFeature(record []byte) ([]byte, error) {
+	n := binary.LittleEndian.Uint32(record)
+	g, _, err := geom.UnmarshalWKB(record[4 : 4+n])
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode spooled geometry: %w", err)
+	}
+	data := record[8+n:]
+
+	var properties map[string]interface{}
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	if err := d.Decode(&properties); err != nil {
+		return nil, fmt.Errorf("failed to decode spooled properties: %w", err)
+	}
+	values, err := s.encodeProperties(properties)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &fbTable{}
+	f.set(0, fgbGeometry(g))
+	if len(values) > 0 {
+		f.set(1, values)
+	}
+	return fbBuild(f), nil
+}
+
+// encodeProperties encodes the non-null properties as the column index
+// followed by the value: fixed-size little-endian numbers, or a 32-bit
+// length and UTF-8 bytes for strings and JSON
+func (s *flatGeobufSpool) encodeProperties(properties map[string]interface{}) ([]byte, error) {
+	var b []byte
+	for i, c := range s.columns {
+		value := properties[c.name]
+		if value == nil {
+			continue
+		}
+		b = binary.LittleEndian.AppendUint16(b, uint16(i))
+		switch c.typ {
+		case fgbColumnBool:
+			if value.(bool) {
+				b = append(b, 1)
+			} else {
+				b = append(b, 0)
+			}
+		case fgbColumnLong:
+			v, err := value.(json.Number).Int64()
+			if err != nil {
+				return nil, fmt.Errorf("invalid value of %s: %w", c.name, err)
+			}
+			b = binary.LittleEndian.AppendUint64(b, uint64(v))
+		case fgbColumnDouble:
+			v, err := value.(json.Number).Float64()
+			if err != nil {
+				return nil, fmt.Errorf("invalid value of %s: %w", c.name, err)
+			}
+			b = appendFloat64LE(b, v)
+		case fgbColumnString:
+			v := value.(string)
+			b = binary.LittleEndian.AppendUint32(b, uint32(len(v)))
+			b = append(b, v...)
+		default:
+			v, err := json.Marshal(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value of %s: %w", c.name, err)
+			}
+			b = binary.LittleEndian.AppendUint32(b, uint32(len(v)))
+			b = append(b, v...)
+		}
+	}
+	return b, nil
+}
+
+// fgbGeometry returns the Geometry table of a geometry. Coordinates are
+// split into xy, z and m vectors; ends holds the end of every ring or line
+// when there is more than one, and multi polygons and collections are
+// written as parts.
+func fgbGeometry(g geom.Geometry) *fbTable {
+	t := &fbTable{}
+	layout := g.CoordLayout()
+	switch g := g.(type) {
+	case *geom.Point:
+		setFGBCoords(t, [][]float64{g.Coords}, layout)
+	case *geom.LineString:
+		setFGBCoords(t, [][]float64{g.Coords}, layout)
+	case *geom.Polygon:
+		setFGBCoords(t, g.Rings, layout)
+	case *geom.MultiPoint:
+		setFGBCoords(t, [][]float64{g.Coords}, layout)
+	case *geom.MultiLineString:
+		setFGBCoords(t, g.Lines, layout)
+	case *geom.MultiPolygon:
+		parts := make([]*fbTable, len(g.Polygons))
+		for i := range g.Polygons {
+			parts[i] = fgbGeometry(g.PolygonAt(i))
+		}
+		t.set(7, parts)
+	case *geom.GeometryCollection:
+		parts := make([]*fbTable, len(g.Geometries))
+		for i, part := range g.Geometries {
+			parts[i] = fgbGeometry(part)
+		}
+		t.set(7, parts)
+	}
+	t.set(6, uint8(fgbGeometryType(g)))
+	return t
+}
+
+// setFGBCoords sets the coordinate vectors of a geometry made of one or
+// more flat coordinate sequences
+func setFGBCoords(t *fbTable, sequences [][]float64, layout geom.Layout) {
+	stride := layout.Stride()
+	var xy, z, m []float64
+	var ends []uint32
+	var points uint32
+	for _, coords := range sequences {
+		for i := 0; i+stride <= len(coords); i += stride {
+			xy = append(xy, coords[i], coords[i+1])
+			if layout.HasZ() {
+				z = append(z, coords[i+layout.ZIndex()])
+			}
+			if layout.HasM() {
+				m = append(m, coords[i+layout.MIndex()])
+			}
+		}
+		points += uint32(len(coords) / stride)
+		ends = append(ends, points)
+	}
+	if len(sequences) > 1 {
+		t.set(0, ends)
+	}
+	if len(xy) > 0 {
+		t.set(1, xy)
+	}
+	if len(z) > 0 {
+		t.set(2, z)
+	}
+	if len(m) > 0 {
+		t.set(3, m)
+	}
+}
+
+// fgbNode is an R-tree node item
+type fgbNode struct {
+	minX, minY, maxX, maxY float64
+	offset                 uint64
+}
+
+// append appends the little-endian node item
+func (n fgbNode) append(b []byte) []byte {
+	b = appendFloat64LE(b, n.minX)
+	b = appendFloat64LE(b, n.minY)
+	b = appendFloat64LE(b, n.maxX)
+	b = appendFloat64LE(b, n.maxY)
+	return binary.LittleEndian.AppendUint64(b, n.offset)
+}
+
+// sortByHilbert orders spooled features by the Hilbert value of their
+// bounds centers within the extent, descending like the reference
+// implementation
+func sortByHilbert(features []spooledFeature, extent geom.Bounds) {
+	width, height := extent.MaxX-extent.MinX, extent.MaxY-extent.MinY
+	values := make(map[int64]uint32, len(features))
+	for _, f := range features {
+		var x, y uint32
+		b := f.bounds
+		if width != 0 {
+			x = uint32(math.Floor(hilbertMax * ((b.MinX+b.MaxX)/2 - extent.MinX) / width))
+		}
+		if height != 0 {
+			y = uint32(math.Floor(hilbertMax * ((b.MinY+b.MaxY)/2 - extent.MinY) / height))
+		}
+		values[f.offset] = hilbert(x, y)
+	}
+	sort.SliceStable(features, func(i, j int) bool {
+		return values[features[i].offset] > values[features[j].offset]
+	})
+}
+
+// hilbert returns the position of a cell on the Hilbert curve of order 16
+// (http://threadlocalmutex.com/?p=126)
+func hilbert(x, y uint32) uint32 {
+	a := x ^ y
+	b := 0xFFFF ^ a
+	c := 0xFFFF ^ (x | y)
+	d := x & (y ^ 0xFFFF)
+
+	A := a | (b >> 1)
+	B := (a >> 1) ^ a
+	C := ((c >> 1) ^ (b & (d >> 1))) ^ c
+	D := ((a & (c >> 1)) ^ (d >> 1)) ^ d
+
+	a, b, c, d = A, B, C, D
+	A = (a & (a >> 2)) ^ (b & (b >> 2))
+	B = (a & (b >> 2)) ^ (b & ((a ^ b) >> 2))
+	C ^= (a & (c >> 2)) ^ (b & (d >> 2))
+	D ^= (b & (c >> 2)) ^ ((a ^ b) & (d >> 2))
+
+	a, b, c, d = A, B, C, D
+	A = (a & (a >> 4)) ^ (b & (b >> 4))
+	B = (a & (b >> 4)) ^ (b & ((a ^ b) >> 4))
+	C ^= (a & (c >> 4)) ^ (b & (d >> 4))
+	D ^= (b & (c >> 4)) ^ ((a ^ b) & (d >> 4))
+
+	a, b, c, d = A, B, C, D
+	C ^= (a & (c >> 8)) ^ (b & (d >> 8))
+	D ^= (b & (c >> 8)) ^ ((a ^ b) & (d >> 8))
+
+	a = C ^ (C >> 1)
+	b = D ^ (D >> 1)
+
+	i0 := x ^ y
+	i1 := b | (0xFFFF ^ (i0 | a))
+
+	i0 = (i0 | (i0 << 8)) & 0x00FF00FF
+	i0 = (i0 | (i0 << 4)) & 0x0F0F0F0F
+	i0 = (i0 | (i0 << 2)) & 0x33333333
+	i0 = (i0 | (i0 << 1)) & 0x55555555
+
+	i1 = (i1 | (i1 << 8)) & 0x00FF00FF
+	i1 = (i1 | (i1 << 4)) & 0x0F0F0F0F
+	i1 = (i1 | (i1 << 2)) & 0x33333333
+	i1 = (i1 | (i1 << 1)) & 0x55555555
+
+	return (i1 << 1) | i0
+}
+
+// fgbLevelBounds returns the [start, end) node ranges of the tree levels,
+// leaves first. Nodes are stored root first, so the leaves take the last
+// numItems slots.
+func fgbLevelBounds(numItems, nodeSize int) [][2]int {
+	counts := []int{numItems}
+	numNodes := numItems
+	for n := numItems; ; {
+		n = (n + nodeSize - 1) / nodeSize
+		counts = append(counts, n)
+		numNodes += n
+		if n == 1 {
+			break
+		}
+	}
+	levels := make([][2]int, len(counts))
+	end := numNodes
+	for i, n := range counts {
+		levels[i] = [2]int{end - n, end}
+		end -= n
+	}
+	return levels
+}
+
+// fgbBuildNodes fills the parent levels bottom up: every parent covers up
+// to nodeSize consecutive children and points at the first of them
+func fgbBuildNodes(nodes []fgbNode, levels [][2]int, nodeSize int) {
+	for i := 0; i < len(levels)-1; i++ {
+		pos, end := levels[i][0], levels[i][1]
+		parent := levels[i+1][0]
+		for pos < end {
+			n := fgbNode{math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1), uint64(pos)}
+			for j := 0; j < nodeSize && pos < end; j++ {
+				c := nodes[pos]
+				n.minX, n.minY = math.Min(n.minX, c.minX), math.Min(n.minY, c.minY)
+				n.maxX, n.maxY = math.Max(n.maxX, c.maxX), math.Max(n.maxY, c.maxY)
+				pos++
+			}
+			nodes[parent] = n
+			parent++
+		}
+	}
+}
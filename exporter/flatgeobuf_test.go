@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"exporter/crs"
+	"exporter/geom"
+)
+
+func TestFGBLevelBounds(t *testing.T) {
+	tests := []struct {
+		items int
+		want  [][2]int
+	}{
+		{1, [][2]int{{1, 2}, {0, 1}}},
+		{16, [][2]int{{1, 17}, {0, 1}}},
+		{20, [][2]int{{3, 23}, {1, 3}, {0, 1}}},
+		// 300 leaves, 19 nodes, 2 nodes and the root
+		{300, [][2]int{{22, 322}, {3, 22}, {1, 3}, {0, 1}}},
+	}
+	for _, tt := range tests {
+		if got := fgbLevelBounds(tt.items, fgbIndexNodeSize); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("fgbLevelBounds(%d) = %v, want %v", tt.items, got, tt.want)
+		}
+	}
+}
+
+func TestFGBBuildNodes(t *testing.T) {
+	// 20 leaves: one full parent of 16 and one of the last 4
+	levels := fgbLevelBounds(20, fgbIndexNodeSize)
+	nodes := make([]fgbNode, levels[0][1])
+	for i := 0; i < 20; i++ {
+		x, y := float64(i), float64(-i)
+		nodes[levels[0][0]+i] = fgbNode{x, y, x + 0.5, y + 0.5, uint64(100 * i)}
+	}
+	fgbBuildNodes(nodes, levels, fgbIndexNodeSize)
+
+	want := []fgbNode{
+		{0, -19, 19.5, 0.5, 1},
+		{0, -15, 15.5, 0.5, 3},
+		{16, -19, 19.5, -15.5, 19},
+	}
+	if !reflect.DeepEqual(nodes[:3], want) {
+		t.Errorf("parent nodes = %v, want %v", nodes[:3], want)
+	}
+	// Leaves keep their feature offsets
+	if n := nodes[levels[0][0]+19]; n.offset != 1900 {
+		t.Errorf("last leaf offset = %d, want 1900", n.offset)
+	}
+}
+
+func TestFlatGeobufFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "parcels.fgb")
+	ff, err := createFeatureFile(path, GeoJSONOptions{Format: formatFlatGeobuf, CRS: crs.WebMercator})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const count = 20
+	for i := 0; i < count; i++ {
+		feature := map[string]interface{}{
+			"geometry":   &geom.Point{Layout: geom.XY, Coords: []float64{float64(i % 5), float64(i / 5)}},
+			"properties": map[string]interface{}{"code": i},
+		}
+		if err := ff.WriteFeature(feature); err != nil {
+			t.Fatal(err)
+		}
+	}
+	empty := map[string]interface{}{"geometry": &geom.Point{Layout: geom.XY}}
+	if err := ff.WriteFeature(empty); err == nil || !strings.Contains(err.Error(), "non-empty geometry") {
+		t.Errorf("empty geometry: error %v", err)
+	}
+	if err := ff.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path + ".spool"); !os.IsNotExist(err) {
+		t.Errorf("spool was not removed: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data[:8], flatGeobufMagic) {
+		t.Fatalf("magic bytes %x", data[:8])
+	}
+	headerSize := int(binary.LittleEndian.Uint32(data[8:]))
+	header := readFBRoot(t, data[12:12+headerSize])
+	if s := header.str(0); s != "parcels" {
+		t.Errorf("name = %q", s)
+	}
+	if n := binary.LittleEndian.Uint64(header.buf[header.field(8):]); n != count {
+		t.Errorf("features_count = %d, want %d", n, count)
+	}
+	if n := binary.LittleEndian.Uint16(header.buf[header.field(9):]); n != fgbIndexNodeSize {
+		t.Errorf("index_node_size = %d, want %d", n, fgbIndexNodeSize)
+	}
+	if c := header.table(10); binary.LittleEndian.Uint32(c.buf[c.field(1):]) != 3857 {
+		t.Errorf("crs code = %d, want 3857", binary.LittleEndian.Uint32(c.buf[c.field(1):]))
+	}
+
+	// The index follows the header: the root covers the extent and points
+	// at the first node of the next level
+	levels := fgbLevelBounds(count, fgbIndexNodeSize)
+	indexPos := 12 + headerSize
+	node := func(i int) fgbNode {
+		b := data[indexPos+i*fgbNodeItemSize:]
+		f := func(j int) float64 { return math.Float64frombits(binary.LittleEndian.Uint64(b[8*j:])) }
+		return fgbNode{f(0), f(1), f(2), f(3), binary.LittleEndian.Uint64(b[32:])}
+	}
+	if root := node(0); root != (fgbNode{0, 0, 4, 3, 1}) {
+		t.Errorf("root node = %v, want {0 0 4 3 1}", root)
+	}
+
+	// Every leaf points at a feature, relative to the end of the index,
+	// whose point is the leaf's bounding box
+	featuresPos := indexPos + levels[0][1]*fgbNodeItemSize
+	offset, seen := 0, map[[2]float64]bool{}
+	for i := levels[0][0]; i < levels[0][1]; i++ {
+		leaf := node(i)
+		if leaf.offset != uint64(offset) {
+			t.Fatalf("leaf %d offset = %d, want %d", i, leaf.offset, offset)
+		}
+		size := int(binary.LittleEndian.Uint32(data[featuresPos+offset:]))
+		feature := readFBRoot(t, data[featuresPos+offset+4:featuresPos+offset+4+size])
+		pos, n := feature.table(0).vector(1)
+		if n != 2 {
+			t.Fatalf("feature %d has %d ordinates", i, n)
+		}
+		x := math.Float64frombits(binary.LittleEndian.Uint64(feature.buf[pos:]))
+		y := math.Float64frombits(binary.LittleEndian.Uint64(feature.buf[pos+8:]))
+		if leaf.minX != x || leaf.maxX != x || leaf.minY != y || leaf.maxY != y {
+			t.Errorf("leaf %d %v does not match point (%v, %v)", i, leaf, x, y)
+		}
+		seen[[2]float64{x, y}] = true
+		offset += 4 + size
+	}
+	if len(seen) != count {
+		t.Errorf("%d distinct features, want %d", len(seen), count)
+	}
+	if featuresPos+offset != len(data) {
+		t.Errorf("features end at %d, file has %d bytes", featuresPos+offset, len(data))
+	}
+}
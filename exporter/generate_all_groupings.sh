@@ -22,9 +22,9 @@ echo ""
 mkdir -p "$OUTPUT_DIR"
 
 # Check if exporter exists
-if [ ! -f "./export_geojson" ]; then
+if [ ! -f "./gisdb" ]; then
     echo -e "${YELLOW}Building exporter...${NC}"
-    go build -o export_geojson export_geojson.go
+    go build -o gisdb .
 fi
 
 # Function to run exporter and check result
@@ -37,7 +37,7 @@ run_export() {
     echo "  Group by: $group_by"
     echo "  Output: $OUTPUT_DIR/$output_name"
     
-    if ./export_geojson -group-by "$group_by" -output "$OUTPUT_DIR/$output_name" 2>&1 | grep -E "(Total exported|Created:|Failed)"; then
+    if ./gisdb export geojson -group-by "$group_by" -output "$OUTPUT_DIR/$output_name" 2>&1 | grep -E "(Total exported|Created:|Failed)"; then
         echo -e "${GREEN}  ✓ Success${NC}"
     else
         echo -e "${YELLOW}  ⚠ Check output above${NC}"
@@ -49,7 +49,7 @@ run_export() {
 echo -e "${BLUE}=== Single File (No Grouping) ===${NC}"
 echo "Generating: Single FeatureCollection with all features"
 echo "  Output: $OUTPUT_DIR/cadastral_all.geojson"
-if ./export_geojson -output "$OUTPUT_DIR/cadastral_all.geojson" 2>&1 | grep -E "(Total exported|Failed)"; then
+if ./gisdb export geojson -output "$OUTPUT_DIR/cadastral_all.geojson" 2>&1 | grep -E "(Total exported|Failed)"; then
     echo -e "${GREEN}  ✓ Success${NC}"
 else
     echo -e "${YELLOW}  ⚠ Check output above${NC}"
@@ -80,6 +80,17 @@ run_export "land_record_category_type" "cadastral_by_land_record_category" "Grou
 # Group by load_status
 run_export "load_status" "cadastral_by_load_status" "Grouped by load status"
 
+# Vector tiles for map.html
+echo -e "${BLUE}=== Vector Tiles ===${NC}"
+echo "Generating: PMTiles archive for the web map"
+echo "  Output: $OUTPUT_DIR/cadastral.pmtiles"
+if ./gisdb export tiles -output "$OUTPUT_DIR/cadastral.pmtiles" 2>&1 | grep -E "(Total exported|Failed)"; then
+    echo -e "${GREEN}  ✓ Success${NC}"
+else
+    echo -e "${YELLOW}  ⚠ Check output above${NC}"
+fi
+echo ""
+
 # Summary
 echo -e "${BLUE}=== Summary ===${NC}"
 echo "All exports completed!"
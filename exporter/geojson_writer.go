@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bufio"
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"exporter/crs"
+)
+
+// featureSink receives GeoJSON features one at a time as they are decoded
+type featureSink interface {
+	WriteFeature(feature map[string]interface{}) error
+	Close() error
+}
+
+// GeoJSON output formats
+const (
+	formatGeoJSON    = "geojson"    // a single FeatureCollection per file
+	formatGeoJSONSeq = "geojsonseq" // RFC 8142 GeoJSON Text Sequence
+	formatNDJSON     = "ndjson"     // newline-delimited GeoJSON features
+	formatFlatGeobuf = "fgb"        // FlatGeobuf with a packed Hilbert R-tree
+)
+
+// recordSeparator starts every text in an RFC 8142 sequence
+const recordSeparator = 0x1E
+
+// checkGeoJSONFormat validates a -format value
+func checkGeoJSONFormat(format string) error {
+	switch format {
+	case formatGeoJSON, formatGeoJSONSeq, formatNDJSON, formatFlatGeobuf:
+		return nil
+	default:
+		return fmt.Errorf("unknown GeoJSON format %q (expected %s, %s, %s or %s)",
+			format, formatGeoJSON, formatGeoJSONSeq, formatNDJSON, formatFlatGeobuf)
+	}
+}
+
+// geojsonFileExtension returns the file extension used for a format
+func geojsonFileExtension(format string) string {
+	switch format {
+	case formatGeoJSONSeq:
+		return ".geojsons"
+	case formatNDJSON:
+		return ".ndjson"
+	case formatFlatGeobuf:
+		return ".fgb"
+	default:
+		return ".geojson"
+	}
+}
+
+// featureFile streams features into a file. For the geojson format the
+// FeatureCollection header is written when the file is created and the
+// footer when it is closed; the sequence formats write one feature per line.
+// FlatGeobuf features are spooled and the file is written when it is closed.
+type featureFile struct {
+	path  string
+	opts  GeoJSONOptions
+	file  *os.File
+	w     *bufio.Writer
+	count int
+	bbox  []float64
+	fgb   *flatGeobufSpool
+}
+
+// createFeatureFile creates a feature file, truncating it unless appending
+// to a sequence format was requested
+func createFeatureFile(path string, opts GeoJSONOptions) (*featureFile, error) {
+	ff := &featureFile{path: path, opts: opts}
+	if opts.Format == formatFlatGeobuf {
+		fgb, err := createFlatGeobufSpool(path)
+		if err != nil {
+			return nil, err
+		}
+		ff.fgb = fgb
+		return ff, nil
+	}
+
+	flags := os.O_CREATE | os.O_TRUNC
+	if opts.Append && opts.Format != formatGeoJSON {
+		flags = os.O_CREATE | os.O_APPEND
+	}
+	if err := ff.open(flags); err != nil {
+		return nil, err
+	}
+
+	if opts.Format == formatGeoJSON {
+		header := `{"type":"FeatureCollection",`
+		if opts.CRS != nil && opts.CRS != crs.WGS84 {
+			member, _ := json.Marshal(legacyCRS(opts.CRS))
+			header += `"crs":` + string(member) + `,`
+		}
+		if _, err := ff.w.WriteString(header + `"features":[`); err != nil {
+			ff.suspend()
+			return nil, fmt.Errorf("failed to write %s: %w", path, err)
+		}
+	}
+	return ff, nil
+}
+
+// open opens the underlying file for writing with the extra flags
+func (ff *featureFile) open(flags int) error {
+	file, err := os.OpenFile(ff.path, os.O_WRONLY|flags, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", ff.path, err)
+	}
+	ff.file = file
+	ff.w = bufio.NewWriter(file)
+	return nil
+}
+
+// resume reopens a suspended file in append mode
+func (ff *featureFile) resume() error {
+	if ff.fgb != nil {
+		return ff.fgb.spool.resume()
+	}
+	return ff.open(os.O_APPEND)
+}
+
+// suspend flushes and closes the file handle without finishing the collection
+func (ff *featureFile) suspend() error {
+	if ff.fgb != nil {
+		return ff.fgb.spool.suspend()
+	}
+	if ff.file == nil {
+		return nil
+	}
+	err := ff.w.Flush()
+	if cerr := ff.file.Close(); err == nil {
+		err = cerr
+	}
+	ff.file, ff.w = nil, nil
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", ff.path, err)
+	}
+	return nil
+}
+
+// WriteFeature appends a feature to the file
+func (ff *featureFile) WriteFeature(feature map[string]interface{}) error {
+	if ff.fgb != nil {
+		if err := ff.fgb.add(feature); err != nil {
+			return fmt.Errorf("failed to write %s: %w", ff.path, err)
+		}
+		ff.count++
+		return nil
+	}
+
+	var data []byte
+	var err error
+	if ff.opts.Format == formatGeoJSON {
+		data, err = json.MarshalIndent(feature, "    ", "  ")
+	} else {
+		data, err = json.Marshal(feature)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to encode feature: %w", err)
+	}
+
+	switch ff.opts.Format {
+	case formatGeoJSON:
+		if ff.count > 0 {
+			ff.w.WriteByte(',')
+		}
+		ff.w.WriteString("\n    ")
+		ff.w.Write(data)
+	case formatGeoJSONSeq:
+		ff.w.WriteByte(recordSeparator)
+		ff.w.Write(data)
+		ff.w.WriteByte('\n')
+	case formatNDJSON:
+		ff.w.Write(data)
+		ff.w.WriteByte('\n')
+	}
+
+	// bufio errors are sticky, so checking the last write is enough
+	if _, err := ff.w.Write(nil); err != nil {
+		return fmt.Errorf("failed to write %s: %w", ff.path, err)
+	}
+
+	if bbox, ok := feature["bbox"].([]float64); ok {
+		ff.bbox = extendBBox(ff.bbox, bbox)
+	}
+
+	ff.count++
+	return nil
+}
+
+// Close finishes the file and closes it
+func (ff *featureFile) Close() error {
+	if ff.fgb != nil {
+		// Later calls, such as a deferred Close, find nothing to finish
+		fgb := ff.fgb
+		ff.fgb = nil
+		return fgb.finish(ff.path, ff.opts.CRS)
+	}
+	if ff.file == nil {
+		return nil
+	}
+	if ff.opts.Format == formatGeoJSON {
+		if ff.count > 0 {
+			ff.w.WriteString("\n")
+		}
+		ff.w.WriteString("]")
+		if ff.bbox != nil {
+			bbox, _ := json.Marshal(ff.bbox)
+			ff.w.WriteString(`,"bbox":` + string(bbox))
+		}
+		ff.w.WriteString("}\n")
+	}
+	return ff.suspend()
+}
+
+// groupedFeatureWriter writes one feature file per value of a property.
+// At most maxOpen files are kept open; the least recently used file is
+// suspended and reopened in append mode when its group reappears.
+type groupedFeatureWriter struct {
+	dir      string
+	baseName string
+	opts     GeoJSONOptions
+
+	groups map[string]*featureFile
+	order  []string
+	lru    *list.List
+	open   map[string]*list.Element
+}
+
+// newGroupedFeatureWriter prepares the output directory for grouped export
+func newGroupedFeatureWriter(opts GeoJSONOptions) (*groupedFeatureWriter, error) {
+	if opts.MaxOpenFiles < 1 {
+		return nil, fmt.Errorf("maximum number of open files must be positive")
+	}
+
+	// Create directory for multiple files
+	outputFile := opts.OutputFile
+	outputDir := outputFile
+	// If output looks like a file (has extension), extract directory
+	if strings.Contains(outputDir, ".") && filepath.Ext(outputDir) != "" {
+		outputDir = filepath.Dir(outputDir)
+		if outputDir == "." {
+			outputDir = filepath.Base(outputFile)
+			outputDir = strings.TrimSuffix(outputDir, filepath.Ext(outputDir))
+		}
+	}
+
+	// Remove existing file if it exists
+	if info, err := os.Stat(outputDir); err == nil {
+		if !info.IsDir() {
+			os.Remove(outputDir)
+		}
+	}
+
+	// Ensure directory exists
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create output directory: %w", err)
+	}
+
+	baseName := "cadastral"
+	if strings.Contains(outputFile, ".") {
+		ext := filepath.Ext(outputFile)
+		baseName = strings.TrimSuffix(filepath.Base(outputFile), ext)
+	}
+
+	return &groupedFeatureWriter{
+		dir:      outputDir,
+		baseName: baseName,
+		opts:     opts,
+		groups:   make(map[string]*featureFile),
+		lru:      list.New(),
+		open:     make(map[string]*list.Element),
+	}, nil
+}
+
+// WriteFeature appends a feature to the file of its group
+func (g *groupedFeatureWriter) WriteFeature(feature map[string]interface{}) error {
+	properties, _ := feature["properties"].(map[string]interface{})
+	groupValue := getGroupValue(properties, g.opts.GroupBy)
+	if groupValue == "" {
+		groupValue = "unknown"
+	}
+
+	ff, err := g.acquire(groupValue)
+	if err != nil {
+		return err
+	}
+	return ff.WriteFeature(feature)
+}
+
+// acquire returns the open file of a group, creating or resuming it and
+// suspending the least recently used file when the pool is full
+func (g *groupedFeatureWriter) acquire(groupValue string) (*featureFile, error) {
+	if elem, ok := g.open[groupValue]; ok {
+		g.lru.MoveToFront(elem)
+		return g.groups[groupValue], nil
+	}
+
+	if g.lru.Len() >= g.opts.MaxOpenFiles {
+		oldest := g.lru.Back()
+		oldestGroup := oldest.Value.(string)
+		g.lru.Remove(oldest)
+		delete(g.open, oldestGroup)
+		if err := g.groups[oldestGroup].suspend(); err != nil {
+			return nil, err
+		}
+	}
+
+	ff, exists := g.groups[groupValue]
+	if exists {
+		if err := ff.resume(); err != nil {
+			return nil, err
+		}
+	} else {
+		// Sanitize group value for filename and include the grouping field name
+		filename := filepath.Join(g.dir, fmt.Sprintf("%s_%s_%s%s",
+			g.baseName, g.opts.GroupBy, sanitizeFilename(groupValue), geojsonFileExtension(g.opts.Format)))
+		created, err := createFeatureFile(filename, g.opts)
+		if err != nil {
+			return nil, err
+		}
+		ff = created
+		g.groups[groupValue] = ff
+		g.order = append(g.order, groupValue)
+	}
+
+	g.open[groupValue] = g.lru.PushFront(groupValue)
+	return ff, nil
+}
+
+// Close finishes every group file, reopening suspended ones to write the footer
+func (g *groupedFeatureWriter) Close() error {
+	var firstErr error
+	for _, groupValue := range g.order {
+		ff := g.groups[groupValue]
+		if _, isOpen := g.open[groupValue]; !isOpen {
+			if err := ff.resume(); err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				continue
+			}
+		}
+		if err := ff.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		log.Printf("  Created: %s (%d features)", ff.path, ff.count)
+	}
+
+	g.groups = map[string]*featureFile{}
+	g.order = nil
+	g.lru.Init()
+	g.open = map[string]*list.Element{}
+	return firstErr
+}
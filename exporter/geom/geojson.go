@@ -0,0 +1,332 @@
+package geom
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// MarshalJSON encodes the point as a GeoJSON geometry object
+func (g *Point) MarshalJSON() ([]byte, error) {
+	return appendGeoJSON(nil, g)
+}
+
+// MarshalJSON encodes the linestring as a GeoJSON geometry object
+func (g *LineString) MarshalJSON() ([]byte, error) {
+	return appendGeoJSON(nil, g)
+}
+
+// MarshalJSON encodes the polygon as a GeoJSON geometry object
+func (g *Polygon) MarshalJSON() ([]byte, error) {
+	return appendGeoJSON(nil, g)
+}
+
+// MarshalJSON encodes the multipoint as a GeoJSON geometry object
+func (g *MultiPoint) MarshalJSON() ([]byte, error) {
+	return appendGeoJSON(nil, g)
+}
+
+// MarshalJSON encodes the multilinestring as a GeoJSON geometry object
+func (g *MultiLineString) MarshalJSON() ([]byte, error) {
+	return appendGeoJSON(nil, g)
+}
+
+// MarshalJSON encodes the multipolygon as a GeoJSON geometry object
+func (g *MultiPolygon) MarshalJSON() ([]byte, error) {
+	return appendGeoJSON(nil, g)
+}
+
+// MarshalJSON encodes the collection as a GeoJSON geometry object
+func (g *GeometryCollection) MarshalJSON() ([]byte, error) {
+	return appendGeoJSON(nil, g)
+}
+
+// appendGeoJSON appends a geometry as a GeoJSON object. M-only positions are
+// widened to ZM with a zero Z, since GeoJSON cannot express M without Z.
+func appendGeoJSON(b []byte, g Geometry) ([]byte, error) {
+	b = append(b, `{"type":"`...)
+	b = append(b, g.GeometryType()...)
+	b = append(b, '"')
+
+	if c, ok := g.(*GeometryCollection); ok {
+		b = append(b, `,"geometries":[`...)
+		for i, member := range c.Geometries {
+			if i > 0 {
+				b = append(b, ',')
+			}
+			var err error
+			if b, err = appendGeoJSON(b, member); err != nil {
+				return nil, err
+			}
+		}
+		return append(b, "]}"...), nil
+	}
+
+	layout := g.CoordLayout()
+	b = append(b, `,"coordinates":`...)
+	var err error
+	switch g := g.(type) {
+	case *Point:
+		if g.IsEmpty() {
+			b = append(b, "[]"...)
+		} else {
+			b, err = appendPosition(b, g.Coords, layout)
+		}
+	case *LineString:
+		b, err = appendPositions(b, g.Coords, layout)
+	case *MultiPoint:
+		b, err = appendPositions(b, g.Coords, layout)
+	case *Polygon:
+		b, err = appendRings(b, g.Rings, layout)
+	case *MultiLineString:
+		b, err = appendRings(b, g.Lines, layout)
+	case *MultiPolygon:
+		b = append(b, '[')
+		for i, polygon := range g.Polygons {
+			if i > 0 {
+				b = append(b, ',')
+			}
+			if b, err = appendRings(b, polygon, layout); err != nil {
+				return nil, err
+			}
+		}
+		b = append(b, ']')
+	default:
+		return nil, fmt.Errorf("unsupported geometry type: %s", g.GeometryType())
+	}
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '}'), nil
+}
+
+func appendRings(b []byte, rings [][]float64, layout Layout) ([]byte, error) {
+	b = append(b, '[')
+	for i, ring := range rings {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		var err error
+		if b, err = appendPositions(b, ring, layout); err != nil {
+			return nil, err
+		}
+	}
+	return append(b, ']'), nil
+}
+
+func appendPositions(b []byte, coords []float64, layout Layout) ([]byte, error) {
+	stride := layout.Stride()
+	b = append(b, '[')
+	for i := 0; i+stride <= len(coords); i += stride {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		var err error
+		if b, err = appendPosition(b, coords[i:i+stride], layout); err != nil {
+			return nil, err
+		}
+	}
+	return append(b, ']'), nil
+}
+
+func appendPosition(b []byte, p []float64, layout Layout) ([]byte, error) {
+	values := p
+	if layout == XYM {
+		values = []float64{p[0], p[1], 0, p[2]}
+	}
+	b = append(b, '[')
+	for i, v := range values {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		var err error
+		if b, err = appendFloat(b, v); err != nil {
+			return nil, err
+		}
+	}
+	return append(b, ']'), nil
+}
+
+// appendFloat formats a number the way encoding/json does
+func appendFloat(b []byte, f float64) ([]byte, error) {
+	if math.IsInf(f, 0) || math.IsNaN(f) {
+		return nil, fmt.Errorf("unsupported coordinate value %v", f)
+	}
+	format := byte('f')
+	if abs := math.Abs(f); abs != 0 && (abs < 1e-6 || abs >= 1e21) {
+		format = 'e'
+	}
+	b = strconv.AppendFloat(b, f, format, -1, 64)
+	if format == 'e' {
+		// Clean up e-09 to e-9
+		n := len(b)
+		if n >= 4 && b[n-4] == 'e' && b[n-3] == '-' && b[n-2] == '0' {
+			b[n-2] = b[n-1]
+			b = b[:n-1]
+		}
+	}
+	return b, nil
+}
+
+// rawGeometry is a GeoJSON geometry object with undecoded coordinates
+type rawGeometry struct {
+	Type        string            `json:"type"`
+	Coordinates json.RawMessage   `json:"coordinates"`
+	Geometries  []json.RawMessage `json:"geometries"`
+}
+
+// UnmarshalGeoJSON decodes a GeoJSON geometry object. Positions may have 2,
+// 3 or 4 ordinates; the layout is taken from the widest position and shorter
+// positions are padded with zeros.
+func UnmarshalGeoJSON(data []byte) (Geometry, error) {
+	var raw rawGeometry
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("invalid geometry: %w", err)
+	}
+	if raw.Type == "" {
+		return nil, fmt.Errorf("geometry type not found")
+	}
+
+	if raw.Type == "GeometryCollection" {
+		if raw.Geometries == nil {
+			return nil, fmt.Errorf("geometries not found")
+		}
+		c := &GeometryCollection{Geometries: make([]Geometry, len(raw.Geometries))}
+		for i, member := range raw.Geometries {
+			g, err := UnmarshalGeoJSON(member)
+			if err != nil {
+				return nil, err
+			}
+			c.Geometries[i] = g
+			if g.CoordLayout().Stride() > c.Layout.Stride() {
+				c.Layout = g.CoordLayout()
+			}
+		}
+		return c, nil
+	}
+
+	if len(raw.Coordinates) == 0 || string(raw.Coordinates) == "null" {
+		return nil, fmt.Errorf("coordinates not found")
+	}
+
+	switch raw.Type {
+	case "Point":
+		var p []float64
+		if err := json.Unmarshal(raw.Coordinates, &p); err != nil {
+			return nil, fmt.Errorf("invalid point coordinates: %w", err)
+		}
+		if len(p) == 0 {
+			return &Point{}, nil
+		}
+		layout, err := positionsLayout([][]float64{p})
+		if err != nil {
+			return nil, err
+		}
+		return &Point{Layout: layout, Coords: flatten([][]float64{p}, layout)}, nil
+
+	case "LineString", "MultiPoint":
+		var points [][]float64
+		if err := json.Unmarshal(raw.Coordinates, &points); err != nil {
+			return nil, fmt.Errorf("invalid %s coordinates: %w", raw.Type, err)
+		}
+		layout, err := positionsLayout(points)
+		if err != nil {
+			return nil, err
+		}
+		if raw.Type == "LineString" {
+			return &LineString{Layout: layout, Coords: flatten(points, layout)}, nil
+		}
+		return &MultiPoint{Layout: layout, Coords: flatten(points, layout)}, nil
+
+	case "Polygon", "MultiLineString":
+		var rings [][][]float64
+		if err := json.Unmarshal(raw.Coordinates, &rings); err != nil {
+			return nil, fmt.Errorf("invalid %s coordinates: %w", raw.Type, err)
+		}
+		layout, err := positionsLayout(concat(rings))
+		if err != nil {
+			return nil, err
+		}
+		flat := flattenRings(rings, layout)
+		if raw.Type == "Polygon" {
+			return &Polygon{Layout: layout, Rings: flat}, nil
+		}
+		return &MultiLineString{Layout: layout, Lines: flat}, nil
+
+	case "MultiPolygon":
+		var polygons [][][][]float64
+		if err := json.Unmarshal(raw.Coordinates, &polygons); err != nil {
+			return nil, fmt.Errorf("invalid MultiPolygon coordinates: %w", err)
+		}
+		var all [][]float64
+		for _, polygon := range polygons {
+			all = append(all, concat(polygon)...)
+		}
+		layout, err := positionsLayout(all)
+		if err != nil {
+			return nil, err
+		}
+		g := &MultiPolygon{Layout: layout, Polygons: make([][][]float64, len(polygons))}
+		for i, polygon := range polygons {
+			g.Polygons[i] = flattenRings(polygon, layout)
+		}
+		return g, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported geometry type: %s", raw.Type)
+	}
+}
+
+// positionsLayout returns the layout of the widest position: 3 ordinates
+// are XYZ and 4 are XYZM
+func positionsLayout(points [][]float64) (Layout, error) {
+	width := 2
+	for _, p := range points {
+		if len(p) < 2 {
+			return XY, fmt.Errorf("position with %d ordinates", len(p))
+		}
+		if len(p) > width {
+			width = len(p)
+		}
+	}
+	switch width {
+	case 2:
+		return XY, nil
+	case 3:
+		return XYZ, nil
+	default:
+		return XYZM, nil
+	}
+}
+
+func flatten(points [][]float64, layout Layout) []float64 {
+	stride := layout.Stride()
+	flat := make([]float64, 0, len(points)*stride)
+	for _, p := range points {
+		for i := 0; i < stride; i++ {
+			if i < len(p) {
+				flat = append(flat, p[i])
+			} else {
+				flat = append(flat, 0)
+			}
+		}
+	}
+	return flat
+}
+
+func flattenRings(rings [][][]float64, layout Layout) [][]float64 {
+	flat := make([][]float64, len(rings))
+	for i, ring := range rings {
+		flat[i] = flatten(ring, layout)
+	}
+	return flat
+}
+
+func concat(rings [][][]float64) [][]float64 {
+	var points [][]float64
+	for _, ring := range rings {
+		points = append(points, ring...)
+	}
+	return points
+}
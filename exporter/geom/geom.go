@@ -0,0 +1,373 @@
+// Package geom provides a typed geometry model for the OGC Simple Features
+// types. Coordinates are stored in flat []float64 slices with a stride given
+// by the geometry layout, so geometries are cheap to allocate and transform.
+package geom
+
+import "math"
+
+// Layout describes the ordinates stored for each position
+type Layout int
+
+const (
+	XY Layout = iota
+	XYZ
+	XYM
+	XYZM
+)
+
+// Stride returns the number of ordinates per position
+func (l Layout) Stride() int {
+	switch l {
+	case XYZ, XYM:
+		return 3
+	case XYZM:
+		return 4
+	default:
+		return 2
+	}
+}
+
+// HasZ reports whether positions carry a Z value
+func (l Layout) HasZ() bool {
+	return l == XYZ || l == XYZM
+}
+
+// HasM reports whether positions carry an M value
+func (l Layout) HasM() bool {
+	return l == XYM || l == XYZM
+}
+
+// ZIndex returns the index of Z within a position, or -1
+func (l Layout) ZIndex() int {
+	if l.HasZ() {
+		return 2
+	}
+	return -1
+}
+
+// MIndex returns the index of M within a position, or -1
+func (l Layout) MIndex() int {
+	switch l {
+	case XYM:
+		return 2
+	case XYZM:
+		return 3
+	default:
+		return -1
+	}
+}
+
+// layoutFor returns the layout with the given Z and M presence
+func layoutFor(hasZ, hasM bool) Layout {
+	switch {
+	case hasZ && hasM:
+		return XYZM
+	case hasZ:
+		return XYZ
+	case hasM:
+		return XYM
+	default:
+		return XY
+	}
+}
+
+// Geometry is implemented by every geometry type
+type Geometry interface {
+	// GeometryType returns the GeoJSON / Simple Features type name
+	GeometryType() string
+	// CoordLayout returns the layout of the coordinates
+	CoordLayout() Layout
+	// IsEmpty reports whether the geometry has no positions
+	IsEmpty() bool
+	// Bounds returns the XY bounding box of the geometry
+	Bounds() Bounds
+	// EachPosition calls fn with every position; fn may modify it in place
+	EachPosition(fn func(p []float64))
+}
+
+// Point is a single position; an empty point has no coordinates
+type Point struct {
+	Layout Layout
+	Coords []float64
+}
+
+// LineString is a sequence of positions
+type LineString struct {
+	Layout Layout
+	Coords []float64
+}
+
+// Polygon is an exterior ring followed by holes, each ring closed
+type Polygon struct {
+	Layout Layout
+	Rings  [][]float64
+}
+
+// MultiPoint is a set of positions
+type MultiPoint struct {
+	Layout Layout
+	Coords []float64
+}
+
+// MultiLineString is a set of linestrings
+type MultiLineString struct {
+	Layout Layout
+	Lines  [][]float64
+}
+
+// MultiPolygon is a set of polygons, each a list of rings
+type MultiPolygon struct {
+	Layout   Layout
+	Polygons [][][]float64
+}
+
+// GeometryCollection is a heterogeneous set of geometries
+type GeometryCollection struct {
+	Layout     Layout
+	Geometries []Geometry
+}
+
+func (g *Point) GeometryType() string              { return "Point" }
+func (g *LineString) GeometryType() string         { return "LineString" }
+func (g *Polygon) GeometryType() string            { return "Polygon" }
+func (g *MultiPoint) GeometryType() string         { return "MultiPoint" }
+func (g *MultiLineString) GeometryType() string    { return "MultiLineString" }
+func (g *MultiPolygon) GeometryType() string       { return "MultiPolygon" }
+func (g *GeometryCollection) GeometryType() string { return "GeometryCollection" }
+
+func (g *Point) CoordLayout() Layout              { return g.Layout }
+func (g *LineString) CoordLayout() Layout         { return g.Layout }
+func (g *Polygon) CoordLayout() Layout            { return g.Layout }
+func (g *MultiPoint) CoordLayout() Layout         { return g.Layout }
+func (g *MultiLineString) CoordLayout() Layout    { return g.Layout }
+func (g *MultiPolygon) CoordLayout() Layout       { return g.Layout }
+func (g *GeometryCollection) CoordLayout() Layout { return g.Layout }
+
+func (g *Point) IsEmpty() bool              { return len(g.Coords) == 0 }
+func (g *LineString) IsEmpty() bool         { return len(g.Coords) == 0 }
+func (g *Polygon) IsEmpty() bool            { return isEmpty(g) }
+func (g *MultiPoint) IsEmpty() bool         { return len(g.Coords) == 0 }
+func (g *MultiLineString) IsEmpty() bool    { return isEmpty(g) }
+func (g *MultiPolygon) IsEmpty() bool       { return isEmpty(g) }
+func (g *GeometryCollection) IsEmpty() bool { return isEmpty(g) }
+
+func (g *Point) Bounds() Bounds              { return bounds(g) }
+func (g *LineString) Bounds() Bounds         { return bounds(g) }
+func (g *Polygon) Bounds() Bounds            { return bounds(g) }
+func (g *MultiPoint) Bounds() Bounds         { return bounds(g) }
+func (g *MultiLineString) Bounds() Bounds    { return bounds(g) }
+func (g *MultiPolygon) Bounds() Bounds       { return bounds(g) }
+func (g *GeometryCollection) Bounds() Bounds { return bounds(g) }
+
+func (g *Point) EachPosition(fn func(p []float64)) {
+	eachFlat(g.Coords, g.Layout.Stride(), fn)
+}
+
+func (g *LineString) EachPosition(fn func(p []float64)) {
+	eachFlat(g.Coords, g.Layout.Stride(), fn)
+}
+
+func (g *Polygon) EachPosition(fn func(p []float64)) {
+	for _, ring := range g.Rings {
+		eachFlat(ring, g.Layout.Stride(), fn)
+	}
+}
+
+func (g *MultiPoint) EachPosition(fn func(p []float64)) {
+	eachFlat(g.Coords, g.Layout.Stride(), fn)
+}
+
+func (g *MultiLineString) EachPosition(fn func(p []float64)) {
+	for _, line := range g.Lines {
+		eachFlat(line, g.Layout.Stride(), fn)
+	}
+}
+
+func (g *MultiPolygon) EachPosition(fn func(p []float64)) {
+	for _, polygon := range g.Polygons {
+		for _, ring := range polygon {
+			eachFlat(ring, g.Layout.Stride(), fn)
+		}
+	}
+}
+
+func (g *GeometryCollection) EachPosition(fn func(p []float64)) {
+	for _, member := range g.Geometries {
+		member.EachPosition(fn)
+	}
+}
+
+// NumPoints returns the number of positions in flat coordinates
+func (g *LineString) NumPoints() int { return len(g.Coords) / g.Layout.Stride() }
+
+// NumPoints returns the number of points
+func (g *MultiPoint) NumPoints() int { return len(g.Coords) / g.Layout.Stride() }
+
+// Point returns the i-th point of a MultiPoint
+func (g *MultiPoint) Point(i int) *Point {
+	stride := g.Layout.Stride()
+	return &Point{Layout: g.Layout, Coords: g.Coords[i*stride : (i+1)*stride]}
+}
+
+// PolygonAt returns the i-th polygon of a MultiPolygon sharing its coordinates
+func (g *MultiPolygon) PolygonAt(i int) *Polygon {
+	return &Polygon{Layout: g.Layout, Rings: g.Polygons[i]}
+}
+
+// LineAt returns the i-th linestring of a MultiLineString sharing its coordinates
+func (g *MultiLineString) LineAt(i int) *LineString {
+	return &LineString{Layout: g.Layout, Coords: g.Lines[i]}
+}
+
+func eachFlat(coords []float64, stride int, fn func(p []float64)) {
+	for i := 0; i+stride <= len(coords); i += stride {
+		fn(coords[i : i+stride : i+stride])
+	}
+}
+
+func isEmpty(g Geometry) bool {
+	empty := true
+	g.EachPosition(func(p []float64) { empty = false })
+	return empty
+}
+
+func bounds(g Geometry) Bounds {
+	b := EmptyBounds()
+	g.EachPosition(func(p []float64) { b.Extend(p[0], p[1]) })
+	return b
+}
+
+// OrdinateRange returns the minimum and maximum of the Z or M ordinate of a
+// geometry; ok is false if the layout has no such ordinate or it is empty
+func OrdinateRange(g Geometry, m bool) (min, max float64, ok bool) {
+	index := g.CoordLayout().ZIndex()
+	if m {
+		index = g.CoordLayout().MIndex()
+	}
+	if index < 0 {
+		return 0, 0, false
+	}
+
+	min, max = math.Inf(1), math.Inf(-1)
+	g.EachPosition(func(p []float64) {
+		min = math.Min(min, p[index])
+		max = math.Max(max, p[index])
+	})
+	return min, max, !math.IsInf(min, 1)
+}
+
+// Transform applies fn to the X and Y of every position in place, keeping
+// Z and M values
+func Transform(g Geometry, fn func(x, y float64) (float64, float64)) {
+	g.EachPosition(func(p []float64) {
+		p[0], p[1] = fn(p[0], p[1])
+	})
+}
+
+// Clone returns a deep copy of a geometry
+func Clone(g Geometry) Geometry {
+	switch g := g.(type) {
+	case *Point:
+		return &Point{Layout: g.Layout, Coords: cloneFlat(g.Coords)}
+	case *LineString:
+		return &LineString{Layout: g.Layout, Coords: cloneFlat(g.Coords)}
+	case *Polygon:
+		return &Polygon{Layout: g.Layout, Rings: cloneRings(g.Rings)}
+	case *MultiPoint:
+		return &MultiPoint{Layout: g.Layout, Coords: cloneFlat(g.Coords)}
+	case *MultiLineString:
+		return &MultiLineString{Layout: g.Layout, Lines: cloneRings(g.Lines)}
+	case *MultiPolygon:
+		polygons := make([][][]float64, len(g.Polygons))
+		for i, polygon := range g.Polygons {
+			polygons[i] = cloneRings(polygon)
+		}
+		return &MultiPolygon{Layout: g.Layout, Polygons: polygons}
+	case *GeometryCollection:
+		members := make([]Geometry, len(g.Geometries))
+		for i, member := range g.Geometries {
+			members[i] = Clone(member)
+		}
+		return &GeometryCollection{Layout: g.Layout, Geometries: members}
+	}
+	return g
+}
+
+// Promote returns single geometries as the matching multi geometry with one
+// member (an empty one for empty input); other geometries are returned as is.
+// The result shares coordinates with g.
+func Promote(g Geometry) Geometry {
+	switch g := g.(type) {
+	case *Point:
+		return &MultiPoint{Layout: g.Layout, Coords: g.Coords}
+	case *LineString:
+		if g.IsEmpty() {
+			return &MultiLineString{Layout: g.Layout}
+		}
+		return &MultiLineString{Layout: g.Layout, Lines: [][]float64{g.Coords}}
+	case *Polygon:
+		if g.IsEmpty() {
+			return &MultiPolygon{Layout: g.Layout}
+		}
+		return &MultiPolygon{Layout: g.Layout, Polygons: [][][]float64{g.Rings}}
+	}
+	return g
+}
+
+func cloneFlat(coords []float64) []float64 {
+	return append([]float64(nil), coords...)
+}
+
+func cloneRings(rings [][]float64) [][]float64 {
+	out := make([][]float64, len(rings))
+	for i, ring := range rings {
+		out[i] = cloneFlat(ring)
+	}
+	return out
+}
+
+// Bounds is an axis-aligned XY bounding box
+type Bounds struct {
+	MinX, MinY, MaxX, MaxY float64
+}
+
+// EmptyBounds returns bounds that contain nothing and grow with Extend
+func EmptyBounds() Bounds {
+	return Bounds{MinX: math.Inf(1), MinY: math.Inf(1), MaxX: math.Inf(-1), MaxY: math.Inf(-1)}
+}
+
+// IsEmpty reports whether no position has been added to the bounds
+func (b Bounds) IsEmpty() bool {
+	return b.MinX > b.MaxX || b.MinY > b.MaxY
+}
+
+// Extend grows the bounds to contain a position
+func (b *Bounds) Extend(x, y float64) {
+	b.MinX = math.Min(b.MinX, x)
+	b.MinY = math.Min(b.MinY, y)
+	b.MaxX = math.Max(b.MaxX, x)
+	b.MaxY = math.Max(b.MaxY, y)
+}
+
+// Union grows the bounds to contain other bounds
+func (b *Bounds) Union(o Bounds) {
+	if o.IsEmpty() {
+		return
+	}
+	b.Extend(o.MinX, o.MinY)
+	b.Extend(o.MaxX, o.MaxY)
+}
+
+// Intersects reports whether two bounds overlap or touch
+func (b Bounds) Intersects(o Bounds) bool {
+	return !b.IsEmpty() && !o.IsEmpty() &&
+		b.MinX <= o.MaxX && o.MinX <= b.MaxX &&
+		b.MinY <= o.MaxY && o.MinY <= b.MaxY
+}
+
+// Polygon returns the bounds as a rectangular polygon
+func (b Bounds) Polygon() *Polygon {
+	return &Polygon{Layout: XY, Rings: [][]float64{{
+		b.MinX, b.MinY, b.MaxX, b.MinY, b.MaxX, b.MaxY, b.MinX, b.MaxY, b.MinX, b.MinY,
+	}}}
+}
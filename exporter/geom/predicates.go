@@ -0,0 +1,166 @@
+package geom
+
+import "math"
+
+// Polygons returns the polygons of a Polygon, MultiPolygon or collection,
+// sharing their coordinates
+func Polygons(g Geometry) []*Polygon {
+	switch g := g.(type) {
+	case *Polygon:
+		return []*Polygon{g}
+	case *MultiPolygon:
+		polygons := make([]*Polygon, len(g.Polygons))
+		for i := range g.Polygons {
+			polygons[i] = g.PolygonAt(i)
+		}
+		return polygons
+	case *GeometryCollection:
+		var polygons []*Polygon
+		for _, member := range g.Geometries {
+			polygons = append(polygons, Polygons(member)...)
+		}
+		return polygons
+	}
+	return nil
+}
+
+// Intersects reports whether a geometry intersects a polygon: a vertex of
+// the geometry lies inside the polygon, an edge crosses a polygon edge, or
+// the polygon lies inside a polygonal geometry
+func Intersects(g Geometry, polygon *Polygon) bool {
+	if c, ok := g.(*GeometryCollection); ok {
+		for _, member := range c.Geometries {
+			if Intersects(member, polygon) {
+				return true
+			}
+		}
+		return false
+	}
+	if !g.Bounds().Intersects(polygon.Bounds()) {
+		return false
+	}
+
+	// A vertex of the geometry lies inside the polygon
+	inside := false
+	g.EachPosition(func(p []float64) {
+		if !inside && PointInPolygon(p[0], p[1], polygon) {
+			inside = true
+		}
+	})
+	if inside {
+		return true
+	}
+
+	// An edge of the geometry crosses an edge of the polygon
+	stride := g.CoordLayout().Stride()
+	polygonStride := polygon.Layout.Stride()
+	for _, line := range lines(g) {
+		for i := stride; i+stride <= len(line); i += stride {
+			for _, ring := range polygon.Rings {
+				for j := polygonStride; j+polygonStride <= len(ring); j += polygonStride {
+					if SegmentsIntersect(
+						line[i-stride], line[i-stride+1], line[i], line[i+1],
+						ring[j-polygonStride], ring[j-polygonStride+1], ring[j], ring[j+1],
+					) {
+						return true
+					}
+				}
+			}
+		}
+	}
+
+	// The polygon lies entirely inside a polygonal geometry
+	if len(polygon.Rings) > 0 && len(polygon.Rings[0]) >= 2 {
+		x, y := polygon.Rings[0][0], polygon.Rings[0][1]
+		for _, part := range Polygons(g) {
+			if PointInPolygon(x, y, part) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// lines returns the linestrings and rings of a geometry as flat coordinates
+func lines(g Geometry) [][]float64 {
+	switch g := g.(type) {
+	case *LineString:
+		return [][]float64{g.Coords}
+	case *MultiLineString:
+		return g.Lines
+	case *Polygon:
+		return g.Rings
+	case *MultiPolygon:
+		var rings [][]float64
+		for _, polygon := range g.Polygons {
+			rings = append(rings, polygon...)
+		}
+		return rings
+	}
+	return nil
+}
+
+// PointInPolygon tests a point against a polygon with holes using the even-odd rule
+func PointInPolygon(x, y float64, polygon *Polygon) bool {
+	stride := polygon.Layout.Stride()
+	inside := false
+	for _, ring := range polygon.Rings {
+		n := len(ring) / stride
+		for i, j := 0, n-1; i < n; j, i = i, i+1 {
+			ax, ay := ring[i*stride], ring[i*stride+1]
+			bx, by := ring[j*stride], ring[j*stride+1]
+			if (ay > y) != (by > y) && x < (bx-ax)*(y-ay)/(by-ay)+ax {
+				inside = !inside
+			}
+		}
+	}
+	return inside
+}
+
+// SegmentsIntersect reports whether segments (x1,y1)-(x2,y2) and
+// (x3,y3)-(x4,y4) intersect
+func SegmentsIntersect(x1, y1, x2, y2, x3, y3, x4, y4 float64) bool {
+	cross := func(ax, ay, bx, by, cx, cy float64) float64 {
+		return (bx-ax)*(cy-ay) - (by-ay)*(cx-ax)
+	}
+	onSegment := func(ax, ay, bx, by, cx, cy float64) bool {
+		return math.Min(ax, bx) <= cx && cx <= math.Max(ax, bx) &&
+			math.Min(ay, by) <= cy && cy <= math.Max(ay, by)
+	}
+
+	d1 := cross(x3, y3, x4, y4, x1, y1)
+	d2 := cross(x3, y3, x4, y4, x2, y2)
+	d3 := cross(x1, y1, x2, y2, x3, y3)
+	d4 := cross(x1, y1, x2, y2, x4, y4)
+
+	if ((d1 > 0 && d2 < 0) || (d1 < 0 && d2 > 0)) &&
+		((d3 > 0 && d4 < 0) || (d3 < 0 && d4 > 0)) {
+		return true
+	}
+	return (d1 == 0 && onSegment(x3, y3, x4, y4, x1, y1)) ||
+		(d2 == 0 && onSegment(x3, y3, x4, y4, x2, y2)) ||
+		(d3 == 0 && onSegment(x1, y1, x2, y2, x3, y3)) ||
+		(d4 == 0 && onSegment(x1, y1, x2, y2, x4, y4))
+}
+
+// RingSignedArea returns twice the signed area of a closed ring in flat
+// coordinates, positive for counter-clockwise rings
+func RingSignedArea(ring []float64, layout Layout) float64 {
+	stride := layout.Stride()
+	var area float64
+	for i := 0; i+2*stride <= len(ring); i += stride {
+		area += ring[i]*ring[i+stride+1] - ring[i+stride]*ring[i+1]
+	}
+	return area
+}
+
+// ReverseRing reverses the order of the positions of a ring in place
+func ReverseRing(ring []float64, layout Layout) {
+	stride := layout.Stride()
+	for a, b := 0, len(ring)-stride; a < b; a, b = a+stride, b-stride {
+		for k := 0; k < stride; k++ {
+			ring[a+k], ring[b+k] = ring[b+k], ring[a+k]
+		}
+	}
+}
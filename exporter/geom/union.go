@@ -0,0 +1,308 @@
+package geom
+
+import (
+	"math"
+	"sort"
+)
+
+// Union returns the union of polygons as an XY MultiPolygon, e.g. to
+// dissolve the parcels of a cadastral quarter. Shared boundaries disappear;
+// gaps between polygons remain as holes. The edges of all polygons are split
+// at their mutual intersections, and the pieces with the union inside on
+// exactly one side are linked into rings.
+func Union(polygons []*Polygon) *MultiPolygon {
+	result := &MultiPolygon{Layout: XY}
+
+	var parts []*Polygon
+	extent := EmptyBounds()
+	for _, polygon := range polygons {
+		if polygon.IsEmpty() {
+			continue
+		}
+		parts = append(parts, polygon)
+		extent.Union(polygon.Bounds())
+	}
+	if len(parts) == 0 {
+		return result
+	}
+
+	// Distances below tol count as touching; offset is how far beside an
+	// edge the union is probed
+	scale := math.Max(extent.MaxX-extent.MinX, extent.MaxY-extent.MinY)
+	scale = math.Max(scale, math.Max(math.Abs(extent.MaxX), math.Abs(extent.MaxY)))
+	tol := scale * 1e-12
+	offset := scale * 1e-9
+
+	edges := nodeEdges(collectEdges(parts), tol)
+	edges = boundaryEdges(edges, parts, offset)
+	rings := linkRings(edges)
+
+	// Counter-clockwise rings are shells, clockwise rings are holes
+	var shells, holes [][]float64
+	for _, ring := range rings {
+		switch area := RingSignedArea(ring, XY); {
+		case area > 0:
+			shells = append(shells, ring)
+		case area < 0:
+			holes = append(holes, ring)
+		}
+	}
+	for _, shell := range shells {
+		result.Polygons = append(result.Polygons, [][]float64{shell})
+	}
+
+	// Each hole belongs to the smallest shell around the union interior
+	// next to its first edge
+	for _, hole := range holes {
+		x, y := besideEdge(hole[0], hole[1], hole[2], hole[3], offset)
+		best, bestArea := -1, math.Inf(1)
+		for i, shell := range shells {
+			if !PointInPolygon(x, y, &Polygon{Layout: XY, Rings: [][]float64{shell}}) {
+				continue
+			}
+			if area := RingSignedArea(shell, XY); area < bestArea {
+				best, bestArea = i, area
+			}
+		}
+		if best >= 0 {
+			result.Polygons[best] = append(result.Polygons[best], hole)
+		}
+	}
+
+	return result
+}
+
+// edge is a directed segment
+type edge struct {
+	x1, y1, x2, y2 float64
+}
+
+func (e edge) minX() float64 { return math.Min(e.x1, e.x2) }
+func (e edge) maxX() float64 { return math.Max(e.x1, e.x2) }
+
+// collectEdges returns the non-degenerate ring segments of polygons
+func collectEdges(polygons []*Polygon) []edge {
+	var edges []edge
+	for _, polygon := range polygons {
+		stride := polygon.Layout.Stride()
+		for _, ring := range polygon.Rings {
+			for i := stride; i+1 < len(ring); i += stride {
+				e := edge{ring[i-stride], ring[i-stride+1], ring[i], ring[i+1]}
+				if e.x1 != e.x2 || e.y1 != e.y2 {
+					edges = append(edges, e)
+				}
+			}
+		}
+	}
+	return edges
+}
+
+// nodeEdges splits edges at every point where they touch or cross another
+// edge, so that all pieces meet at shared end points
+func nodeEdges(edges []edge, tol float64) []edge {
+	splits := make([][][2]float64, len(edges))
+
+	order := make([]int, len(edges))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(a, b int) bool { return edges[order[a]].minX() < edges[order[b]].minX() })
+
+	// Sweep along X, comparing edges whose X ranges overlap
+	for a, i := range order {
+		ei := edges[i]
+		for _, j := range order[a+1:] {
+			ej := edges[j]
+			if ej.minX() > ei.maxX()+tol {
+				break
+			}
+			if math.Min(ej.y1, ej.y2) > math.Max(ei.y1, ei.y2)+tol ||
+				math.Min(ei.y1, ei.y2) > math.Max(ej.y1, ej.y2)+tol {
+				continue
+			}
+
+			// End points lying on the other edge
+			touched := false
+			for _, p := range [][2]float64{{ej.x1, ej.y1}, {ej.x2, ej.y2}} {
+				if onEdge(ei, p[0], p[1], tol) {
+					splits[i] = append(splits[i], p)
+					touched = true
+				}
+			}
+			for _, p := range [][2]float64{{ei.x1, ei.y1}, {ei.x2, ei.y2}} {
+				if onEdge(ej, p[0], p[1], tol) {
+					splits[j] = append(splits[j], p)
+					touched = true
+				}
+			}
+			if touched {
+				continue
+			}
+
+			// Proper crossing
+			if x, y, ok := crossing(ei, ej); ok {
+				splits[i] = append(splits[i], [2]float64{x, y})
+				splits[j] = append(splits[j], [2]float64{x, y})
+			}
+		}
+	}
+
+	var noded []edge
+	for i, e := range edges {
+		if len(splits[i]) == 0 {
+			noded = append(noded, e)
+			continue
+		}
+		points := splits[i]
+		dx, dy := e.x2-e.x1, e.y2-e.y1
+		sort.Slice(points, func(a, b int) bool {
+			return (points[a][0]-e.x1)*dx+(points[a][1]-e.y1)*dy < (points[b][0]-e.x1)*dx+(points[b][1]-e.y1)*dy
+		})
+		x, y := e.x1, e.y1
+		for _, p := range append(points, [2]float64{e.x2, e.y2}) {
+			if p[0] == x && p[1] == y {
+				continue
+			}
+			noded = append(noded, edge{x, y, p[0], p[1]})
+			x, y = p[0], p[1]
+		}
+	}
+	return noded
+}
+
+// onEdge reports whether (x, y) lies within tol of the interior of e
+func onEdge(e edge, x, y, tol float64) bool {
+	if (x == e.x1 && y == e.y1) || (x == e.x2 && y == e.y2) {
+		return false
+	}
+	dx, dy := e.x2-e.x1, e.y2-e.y1
+	length2 := dx*dx + dy*dy
+	t := ((x-e.x1)*dx + (y-e.y1)*dy) / length2
+	if t <= 0 || t >= 1 {
+		return false
+	}
+	cross := dx*(y-e.y1) - dy*(x-e.x1)
+	return cross*cross <= tol*tol*length2
+}
+
+// crossing returns the point where a and b cross in their interiors
+func crossing(a, b edge) (float64, float64, bool) {
+	rx, ry := a.x2-a.x1, a.y2-a.y1
+	sx, sy := b.x2-b.x1, b.y2-b.y1
+	denom := rx*sy - ry*sx
+	if denom == 0 {
+		return 0, 0, false
+	}
+	qx, qy := b.x1-a.x1, b.y1-a.y1
+	t := (qx*sy - qy*sx) / denom
+	u := (qx*ry - qy*rx) / denom
+	if t <= 0 || t >= 1 || u <= 0 || u >= 1 {
+		return 0, 0, false
+	}
+	return a.x1 + t*rx, a.y1 + t*ry, true
+}
+
+// besideEdge returns the point at distance offset left of the middle of the
+// segment (x1, y1)-(x2, y2)
+func besideEdge(x1, y1, x2, y2, offset float64) (float64, float64) {
+	dx, dy := x2-x1, y2-y1
+	length := math.Hypot(dx, dy)
+	return (x1+x2)/2 - dy/length*offset, (y1+y2)/2 + dx/length*offset
+}
+
+// boundaryEdges keeps the noded edges with the union inside on one side
+// only, directed so that the inside is on their left. Duplicates left by
+// overlapping polygons are dropped.
+func boundaryEdges(edges []edge, polygons []*Polygon, offset float64) []edge {
+	bounds := make([]Bounds, len(polygons))
+	for i, polygon := range polygons {
+		bounds[i] = polygon.Bounds()
+	}
+	inside := func(x, y float64) bool {
+		for i, polygon := range polygons {
+			b := bounds[i]
+			if x >= b.MinX && x <= b.MaxX && y >= b.MinY && y <= b.MaxY && PointInPolygon(x, y, polygon) {
+				return true
+			}
+		}
+		return false
+	}
+
+	seen := map[edge]bool{}
+	var kept []edge
+	for _, e := range edges {
+		// Probe closer to short edges so that the probes stay beside them
+		d := math.Min(offset, math.Hypot(e.x2-e.x1, e.y2-e.y1)/100)
+		lx, ly := besideEdge(e.x1, e.y1, e.x2, e.y2, d)
+		rx, ry := besideEdge(e.x2, e.y2, e.x1, e.y1, d)
+		left, right := inside(lx, ly), inside(rx, ry)
+		if left == right {
+			continue
+		}
+		if right {
+			e = edge{e.x2, e.y2, e.x1, e.y1}
+		}
+		if !seen[e] {
+			seen[e] = true
+			kept = append(kept, e)
+		}
+	}
+	return kept
+}
+
+// linkRings joins directed boundary edges into closed rings. Where several
+// edges leave a vertex, the first one clockwise from the incoming edge is
+// taken, which keeps rings that touch at a point apart.
+func linkRings(edges []edge) [][]float64 {
+	outgoing := map[[2]float64][]int{}
+	for i, e := range edges {
+		start := [2]float64{e.x1, e.y1}
+		outgoing[start] = append(outgoing[start], i)
+	}
+
+	used := make([]bool, len(edges))
+	var rings [][]float64
+	for first := range edges {
+		if used[first] {
+			continue
+		}
+		start := [2]float64{edges[first].x1, edges[first].y1}
+		ring := []float64{start[0], start[1]}
+		current := first
+		closed := false
+		for {
+			used[current] = true
+			e := edges[current]
+			ring = append(ring, e.x2, e.y2)
+			end := [2]float64{e.x2, e.y2}
+			if end == start {
+				closed = true
+				break
+			}
+
+			back := math.Atan2(e.y1-e.y2, e.x1-e.x2)
+			next, nextTurn := -1, math.Inf(1)
+			for _, candidate := range outgoing[end] {
+				if used[candidate] {
+					continue
+				}
+				c := edges[candidate]
+				turn := math.Mod(back-math.Atan2(c.y2-c.y1, c.x2-c.x1)+4*math.Pi, 2*math.Pi)
+				if turn == 0 {
+					turn = 2 * math.Pi
+				}
+				if turn < nextTurn {
+					next, nextTurn = candidate, turn
+				}
+			}
+			if next < 0 {
+				break
+			}
+			current = next
+		}
+		if closed && len(ring) >= 8 {
+			rings = append(rings, ring)
+		}
+	}
+	return rings
+}
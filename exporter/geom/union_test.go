@@ -0,0 +1,234 @@
+package geom
+
+import (
+	"math"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// rect returns a counter-clockwise rectangle ring
+func rect(minX, minY, maxX, maxY float64) []float64 {
+	return []float64{minX, minY, maxX, minY, maxX, maxY, minX, maxY, minX, minY}
+}
+
+// polygon returns an XY polygon of the rings
+func polygon(rings ...[]float64) *Polygon {
+	return &Polygon{Layout: XY, Rings: rings}
+}
+
+func TestUnion(t *testing.T) {
+	square := rect(0, 0, 4, 4)
+	hole := rect(1, 1, 3, 3)
+	ReverseRing(hole, XY)
+
+	tests := []struct {
+		name     string
+		polygons []*Polygon
+		// rings is the number of rings of each resulting polygon, sorted
+		rings []int
+		area  float64
+		// inside and outside are probe points
+		inside, outside [][2]float64
+	}{
+		{
+			name:     "adjacent squares",
+			polygons: []*Polygon{polygon(rect(0, 0, 2, 2)), polygon(rect(2, 0, 4, 2))},
+			rings:    []int{1},
+			area:     8,
+			inside:   [][2]float64{{1, 1}, {2, 1}, {3, 1}},
+			outside:  [][2]float64{{2, 3}},
+		},
+		{
+			name:     "adjacent squares sharing part of an edge",
+			polygons: []*Polygon{polygon(rect(0, 0, 2, 2)), polygon(rect(2, 1, 4, 3))},
+			rings:    []int{1},
+			area:     8,
+			inside:   [][2]float64{{2, 1.5}, {3, 2.5}},
+			outside:  [][2]float64{{1, 2.5}, {3, 0.5}},
+		},
+		{
+			name:     "overlapping squares",
+			polygons: []*Polygon{polygon(rect(0, 0, 2, 2)), polygon(rect(1, 1, 3, 3))},
+			rings:    []int{1},
+			area:     7,
+			inside:   [][2]float64{{0.5, 0.5}, {1.5, 1.5}, {2.5, 2.5}},
+			outside:  [][2]float64{{2.5, 0.5}, {0.5, 2.5}},
+		},
+		{
+			name:     "identical squares",
+			polygons: []*Polygon{polygon(rect(0, 0, 2, 2)), polygon(rect(0, 0, 2, 2))},
+			rings:    []int{1},
+			area:     4,
+		},
+		{
+			name:     "nested squares",
+			polygons: []*Polygon{polygon(rect(0, 0, 4, 4)), polygon(rect(1, 1, 2, 2))},
+			rings:    []int{1},
+			area:     16,
+		},
+		{
+			name: "clockwise input",
+			polygons: []*Polygon{
+				polygon([]float64{0, 0, 0, 2, 2, 2, 2, 0, 0, 0}),
+				polygon([]float64{2, 0, 2, 2, 4, 2, 4, 0, 2, 0}),
+			},
+			rings: []int{1},
+			area:  8,
+		},
+		{
+			name:     "square and crossing triangle",
+			polygons: []*Polygon{polygon(rect(0, 0, 2, 2)), polygon([]float64{1, 1, 4, 1, 1, 4, 1, 1})},
+			rings:    []int{1},
+			area:     7.5,
+			inside:   [][2]float64{{3, 1.5}, {1.5, 3}},
+			outside:  [][2]float64{{3, 0.5}, {3, 2.5}},
+		},
+		{
+			name:     "disjoint squares",
+			polygons: []*Polygon{polygon(rect(0, 0, 2, 2)), polygon(rect(3, 0, 5, 2))},
+			rings:    []int{1, 1},
+			area:     8,
+			outside:  [][2]float64{{2.5, 1}},
+		},
+		{
+			name:     "squares touching at a corner",
+			polygons: []*Polygon{polygon(rect(0, 0, 1, 1)), polygon(rect(1, 1, 2, 2))},
+			rings:    []int{1, 1},
+			area:     2,
+		},
+		{
+			name:     "polygon with a hole",
+			polygons: []*Polygon{polygon(square, hole)},
+			rings:    []int{2},
+			area:     12,
+			inside:   [][2]float64{{0.5, 2}},
+			outside:  [][2]float64{{2, 2}},
+		},
+		{
+			name:     "hole partly filled",
+			polygons: []*Polygon{polygon(square, hole), polygon(rect(1, 1, 2, 3))},
+			rings:    []int{2},
+			area:     14,
+			inside:   [][2]float64{{1.5, 2}},
+			outside:  [][2]float64{{2.5, 2}},
+		},
+		{
+			name:     "hole filled",
+			polygons: []*Polygon{polygon(square, hole), polygon(rect(1, 1, 3, 3))},
+			rings:    []int{1},
+			area:     16,
+			inside:   [][2]float64{{2, 2}},
+		},
+		{
+			name:     "island in a hole",
+			polygons: []*Polygon{polygon(square, hole), polygon(rect(1.5, 1.5, 2.5, 2.5))},
+			rings:    []int{1, 2},
+			area:     13,
+			inside:   [][2]float64{{2, 2}, {0.5, 0.5}},
+			outside:  [][2]float64{{1.2, 1.2}},
+		},
+		{
+			name:     "hole overlapped by a neighbour",
+			polygons: []*Polygon{polygon(square, hole), polygon(rect(2, 2, 6, 6))},
+			rings:    []int{2},
+			area:     12 + 16 - 3,
+			inside:   [][2]float64{{2.5, 2.5}, {5, 5}},
+			outside:  [][2]float64{{1.5, 1.5}, {5, 1}},
+		},
+		{
+			name: "gap between parcels",
+			polygons: []*Polygon{
+				polygon(rect(0, 0, 3, 1)), polygon(rect(0, 2, 3, 3)),
+				polygon(rect(0, 1, 1, 2)), polygon(rect(2, 1, 3, 2)),
+			},
+			rings:   []int{2},
+			area:    8,
+			outside: [][2]float64{{1.5, 1.5}},
+		},
+	}
+
+	for _, tt := range tests {
+		got := Union(tt.polygons)
+		if got.Layout != XY {
+			t.Errorf("%s: layout %d", tt.name, got.Layout)
+		}
+
+		var rings []int
+		var area float64
+		for _, p := range got.Polygons {
+			rings = append(rings, len(p))
+			for i, ring := range p {
+				n := len(ring)
+				if n < 8 || ring[0] != ring[n-2] || ring[1] != ring[n-1] {
+					t.Errorf("%s: ring %v is not closed", tt.name, ring)
+					continue
+				}
+				a := RingSignedArea(ring, XY) / 2
+				if (i == 0) != (a > 0) {
+					t.Errorf("%s: ring %d has signed area %v", tt.name, i, a)
+				}
+				area += a
+			}
+		}
+		sort.Ints(rings)
+		if !reflect.DeepEqual(rings, tt.rings) {
+			t.Errorf("%s: rings %v, want %v", tt.name, rings, tt.rings)
+		}
+		if math.Abs(area-tt.area) > 1e-9 {
+			t.Errorf("%s: area %v, want %v", tt.name, area, tt.area)
+		}
+
+		contains := func(x, y float64) bool {
+			for _, p := range got.Polygons {
+				if PointInPolygon(x, y, &Polygon{Layout: XY, Rings: p}) {
+					return true
+				}
+			}
+			return false
+		}
+		for _, p := range tt.inside {
+			if !contains(p[0], p[1]) {
+				t.Errorf("%s: %v is not inside the union", tt.name, p)
+			}
+		}
+		for _, p := range tt.outside {
+			if contains(p[0], p[1]) {
+				t.Errorf("%s: %v is inside the union", tt.name, p)
+			}
+		}
+	}
+}
+
+func TestUnionEmpty(t *testing.T) {
+	got := Union([]*Polygon{{Layout: XY}})
+	if !got.IsEmpty() || got.Layout != XY {
+		t.Errorf("union of empty polygons = %#v", got)
+	}
+	if got := Union(nil); !got.IsEmpty() {
+		t.Errorf("union of nothing = %#v", got)
+	}
+}
+
+// Coordinates of real parcels are large projected values; shared edges
+// must still dissolve
+func TestUnionProjectedCoordinates(t *testing.T) {
+	x, y := 5468000.123, 7510000.456
+	got := Union([]*Polygon{
+		polygon(rect(x, y, x+10.1, y+20.2)),
+		polygon(rect(x+10.1, y, x+30.3, y+20.2)),
+	})
+	if len(got.Polygons) != 1 || len(got.Polygons[0]) != 1 {
+		t.Fatalf("got %d polygons", len(got.Polygons))
+	}
+	// Measured relative to the corner, as the products of the large
+	// coordinates lose the precision of the area
+	ring := append([]float64(nil), got.Polygons[0][0]...)
+	for i := 0; i < len(ring); i += 2 {
+		ring[i] -= x
+		ring[i+1] -= y
+	}
+	if area := RingSignedArea(ring, XY) / 2; math.Abs(area-30.3*20.2) > 1e-6 {
+		t.Errorf("area %v, want %v", area, 30.3*20.2)
+	}
+}
@@ -0,0 +1,395 @@
+package geom
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// WKB geometry type codes (OGC Simple Features). ISO WKB adds 1000 for Z,
+// 2000 for M and 3000 for ZM to the base code.
+const (
+	WKBPoint              = 1
+	WKBLineString         = 2
+	WKBPolygon            = 3
+	WKBMultiPoint         = 4
+	WKBMultiLineString    = 5
+	WKBMultiPolygon       = 6
+	WKBGeometryCollection = 7
+
+	wkbZ = 1000
+	wkbM = 2000
+)
+
+// EWKB (PostGIS extended WKB) type code flags
+const (
+	ewkbZ    = 0x80000000
+	ewkbM    = 0x40000000
+	ewkbSRID = 0x20000000
+)
+
+// WKBTypeCode returns the WKB base type code of a geometry
+func WKBTypeCode(g Geometry) uint32 {
+	switch g.(type) {
+	case *Point:
+		return WKBPoint
+	case *LineString:
+		return WKBLineString
+	case *Polygon:
+		return WKBPolygon
+	case *MultiPoint:
+		return WKBMultiPoint
+	case *MultiLineString:
+		return WKBMultiLineString
+	case *MultiPolygon:
+		return WKBMultiPolygon
+	default:
+		return WKBGeometryCollection
+	}
+}
+
+// MarshalWKB encodes a geometry as little-endian ISO WKB in the given layout.
+// Ordinates missing from the geometry layout are written as 0.
+func MarshalWKB(g Geometry, layout Layout) ([]byte, error) {
+	enc := &wkbEncoder{layout: layout}
+	if err := enc.geometry(g); err != nil {
+		return nil, err
+	}
+	return enc.buf, nil
+}
+
+// wkbEncoder appends WKB to a buffer
+type wkbEncoder struct {
+	buf    []byte
+	layout Layout
+}
+
+func (e *wkbEncoder) uint32(v uint32) {
+	e.buf = binary.LittleEndian.AppendUint32(e.buf, v)
+}
+
+func (e *wkbEncoder) float64(v float64) {
+	e.buf = binary.LittleEndian.AppendUint64(e.buf, math.Float64bits(v))
+}
+
+// header writes the byte order and the ISO type code of a geometry
+func (e *wkbEncoder) header(baseType uint32) {
+	code := baseType
+	if e.layout.HasZ() {
+		code += wkbZ
+	}
+	if e.layout.HasM() {
+		code += wkbM
+	}
+	e.buf = append(e.buf, 1) // Little-endian
+	e.uint32(code)
+}
+
+// position writes one position given in the source layout
+func (e *wkbEncoder) position(p []float64, from Layout) {
+	e.float64(p[0])
+	e.float64(p[1])
+	if e.layout.HasZ() {
+		e.float64(ordinate(p, from.ZIndex()))
+	}
+	if e.layout.HasM() {
+		e.float64(ordinate(p, from.MIndex()))
+	}
+}
+
+func (e *wkbEncoder) positions(coords []float64, from Layout) {
+	stride := from.Stride()
+	e.uint32(uint32(len(coords) / stride))
+	eachFlat(coords, stride, func(p []float64) {
+		e.position(p, from)
+	})
+}
+
+func (e *wkbEncoder) point(coords []float64, from Layout) {
+	e.header(WKBPoint)
+	if len(coords) == 0 {
+		// Empty point: all coordinates NaN
+		for i := 0; i < e.layout.Stride(); i++ {
+			e.float64(math.NaN())
+		}
+		return
+	}
+	e.position(coords, from)
+}
+
+func (e *wkbEncoder) lineString(coords []float64, from Layout) {
+	e.header(WKBLineString)
+	e.positions(coords, from)
+}
+
+func (e *wkbEncoder) polygon(rings [][]float64, from Layout) {
+	e.header(WKBPolygon)
+	e.uint32(uint32(len(rings)))
+	for _, ring := range rings {
+		e.positions(ring, from)
+	}
+}
+
+// geometry writes a geometry; multi geometry members are complete WKB geometries
+func (e *wkbEncoder) geometry(g Geometry) error {
+	switch g := g.(type) {
+	case *Point:
+		e.point(g.Coords, g.Layout)
+	case *LineString:
+		e.lineString(g.Coords, g.Layout)
+	case *Polygon:
+		e.polygon(g.Rings, g.Layout)
+	case *MultiPoint:
+		e.header(WKBMultiPoint)
+		e.uint32(uint32(g.NumPoints()))
+		eachFlat(g.Coords, g.Layout.Stride(), func(p []float64) {
+			e.point(p, g.Layout)
+		})
+	case *MultiLineString:
+		e.header(WKBMultiLineString)
+		e.uint32(uint32(len(g.Lines)))
+		for _, line := range g.Lines {
+			e.lineString(line, g.Layout)
+		}
+	case *MultiPolygon:
+		e.header(WKBMultiPolygon)
+		e.uint32(uint32(len(g.Polygons)))
+		for _, polygon := range g.Polygons {
+			e.polygon(polygon, g.Layout)
+		}
+	case *GeometryCollection:
+		e.header(WKBGeometryCollection)
+		e.uint32(uint32(len(g.Geometries)))
+		for _, member := range g.Geometries {
+			if err := e.geometry(member); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported geometry type: %T", g)
+	}
+	return nil
+}
+
+// ordinate returns p[index], or 0 if the ordinate is not present
+func ordinate(p []float64, index int) float64 {
+	if index < 0 || index >= len(p) {
+		return 0
+	}
+	return p[index]
+}
+
+// UnmarshalWKB decodes big- or little-endian WKB in OGC, ISO (Z/M type codes
+// 1000-3000) or PostGIS EWKB (flagged Z/M and embedded SRID) form. The SRID
+// is 0 unless the data is EWKB carrying one.
+func UnmarshalWKB(data []byte) (Geometry, int, error) {
+	d := &wkbDecoder{data: data}
+	g, err := d.geometry()
+	if err != nil {
+		return nil, 0, err
+	}
+	if d.offset != len(data) {
+		return nil, 0, fmt.Errorf("%d trailing bytes after WKB geometry", len(data)-d.offset)
+	}
+	return g, d.srid, nil
+}
+
+// wkbDecoder reads WKB from a buffer; every nested geometry carries its own
+// byte order
+type wkbDecoder struct {
+	data   []byte
+	offset int
+	order  binary.ByteOrder
+	srid   int
+}
+
+func (d *wkbDecoder) need(n int) error {
+	if d.offset+n > len(d.data) {
+		return fmt.Errorf("unexpected end of WKB at offset %d", d.offset)
+	}
+	return nil
+}
+
+func (d *wkbDecoder) uint32() (uint32, error) {
+	if err := d.need(4); err != nil {
+		return 0, err
+	}
+	v := d.order.Uint32(d.data[d.offset:])
+	d.offset += 4
+	return v, nil
+}
+
+// count reads an element count and checks it against the remaining bytes
+func (d *wkbDecoder) count(minElementSize int) (int, error) {
+	n, err := d.uint32()
+	if err != nil {
+		return 0, err
+	}
+	if int(n)*minElementSize > len(d.data)-d.offset {
+		return 0, fmt.Errorf("element count %d exceeds WKB size", n)
+	}
+	return int(n), nil
+}
+
+// floats reads n ordinates and appends them to dst
+func (d *wkbDecoder) floats(dst []float64, n int) ([]float64, error) {
+	if err := d.need(n * 8); err != nil {
+		return nil, err
+	}
+	for i := 0; i < n; i++ {
+		dst = append(dst, math.Float64frombits(d.order.Uint64(d.data[d.offset:])))
+		d.offset += 8
+	}
+	return dst, nil
+}
+
+func (d *wkbDecoder) positions(layout Layout) ([]float64, error) {
+	stride := layout.Stride()
+	n, err := d.count(stride * 8)
+	if err != nil {
+		return nil, err
+	}
+	return d.floats(make([]float64, 0, n*stride), n*stride)
+}
+
+func (d *wkbDecoder) rings(layout Layout) ([][]float64, error) {
+	n, err := d.count(4)
+	if err != nil {
+		return nil, err
+	}
+	rings := make([][]float64, n)
+	for i := range rings {
+		if rings[i], err = d.positions(layout); err != nil {
+			return nil, err
+		}
+	}
+	return rings, nil
+}
+
+// header reads the byte order and type code of a geometry
+func (d *wkbDecoder) header() (uint32, Layout, error) {
+	if err := d.need(1); err != nil {
+		return 0, XY, err
+	}
+	switch d.data[d.offset] {
+	case 0:
+		d.order = binary.BigEndian
+	case 1:
+		d.order = binary.LittleEndian
+	default:
+		return 0, XY, fmt.Errorf("invalid WKB byte order %d", d.data[d.offset])
+	}
+	d.offset++
+
+	code, err := d.uint32()
+	if err != nil {
+		return 0, XY, err
+	}
+
+	hasZ := code&ewkbZ != 0
+	hasM := code&ewkbM != 0
+	if code&ewkbSRID != 0 {
+		srid, err := d.uint32()
+		if err != nil {
+			return 0, XY, err
+		}
+		d.srid = int(srid)
+	}
+	code &^= ewkbZ | ewkbM | ewkbSRID
+
+	switch code / 1000 {
+	case 1:
+		hasZ = true
+	case 2:
+		hasM = true
+	case 3:
+		hasZ, hasM = true, true
+	}
+	base := code % 1000
+	if base < WKBPoint || base > WKBGeometryCollection {
+		return 0, XY, fmt.Errorf("unsupported WKB geometry type %d", code)
+	}
+	return base, layoutFor(hasZ, hasM), nil
+}
+
+func (d *wkbDecoder) geometry() (Geometry, error) {
+	base, layout, err := d.header()
+	if err != nil {
+		return nil, err
+	}
+
+	switch base {
+	case WKBPoint:
+		p, err := d.floats(nil, layout.Stride())
+		if err != nil {
+			return nil, err
+		}
+		if math.IsNaN(p[0]) && math.IsNaN(p[1]) {
+			return &Point{Layout: layout}, nil
+		}
+		return &Point{Layout: layout, Coords: p}, nil
+
+	case WKBLineString:
+		coords, err := d.positions(layout)
+		if err != nil {
+			return nil, err
+		}
+		return &LineString{Layout: layout, Coords: coords}, nil
+
+	case WKBPolygon:
+		rings, err := d.rings(layout)
+		if err != nil {
+			return nil, err
+		}
+		return &Polygon{Layout: layout, Rings: rings}, nil
+	}
+
+	n, err := d.count(5)
+	if err != nil {
+		return nil, err
+	}
+	members := make([]Geometry, n)
+	for i := range members {
+		member, err := d.geometry()
+		if err != nil {
+			return nil, err
+		}
+		if base != WKBGeometryCollection {
+			if WKBTypeCode(member) != base-3 {
+				return nil, fmt.Errorf("%s member of WKB type %d", member.GeometryType(), base)
+			}
+			if member.CoordLayout() != layout {
+				return nil, fmt.Errorf("member dimensions differ from WKB type %d", base)
+			}
+		}
+		members[i] = member
+	}
+
+	switch base {
+	case WKBMultiPoint:
+		// Flat coordinates cannot hold an empty member, and dropping it
+		// would change the number of points
+		g := &MultiPoint{Layout: layout}
+		for i, member := range members {
+			if member.IsEmpty() {
+				return nil, fmt.Errorf("empty point %d in WKB MultiPoint", i)
+			}
+			g.Coords = append(g.Coords, member.(*Point).Coords...)
+		}
+		return g, nil
+	case WKBMultiLineString:
+		g := &MultiLineString{Layout: layout, Lines: make([][]float64, n)}
+		for i, member := range members {
+			g.Lines[i] = member.(*LineString).Coords
+		}
+		return g, nil
+	case WKBMultiPolygon:
+		g := &MultiPolygon{Layout: layout, Polygons: make([][][]float64, n)}
+		for i, member := range members {
+			g.Polygons[i] = member.(*Polygon).Rings
+		}
+		return g, nil
+	default:
+		return &GeometryCollection{Layout: layout, Geometries: members}, nil
+	}
+}
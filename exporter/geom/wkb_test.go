@@ -0,0 +1,289 @@
+package geom
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var layouts = []Layout{XY, XYZ, XYM, XYZM}
+
+// positions returns flat coordinates in the layout for the XY pairs, with
+// Z = x + 100 and M = y + 1000 where the layout has them
+func positions(layout Layout, xy ...float64) []float64 {
+	var coords []float64
+	for i := 0; i+1 < len(xy); i += 2 {
+		x, y := xy[i], xy[i+1]
+		coords = append(coords, x, y)
+		if layout.HasZ() {
+			coords = append(coords, x+100)
+		}
+		if layout.HasM() {
+			coords = append(coords, y+1000)
+		}
+	}
+	return coords
+}
+
+// testGeometries returns a non-empty geometry of every type in the layout
+func testGeometries(l Layout) []Geometry {
+	square := positions(l, 0, 0, 4, 0, 4, 4, 0, 4, 0, 0)
+	hole := positions(l, 1, 1, 1, 2, 2, 2, 1, 1)
+	return []Geometry{
+		&Point{Layout: l, Coords: positions(l, 1, 2)},
+		&LineString{Layout: l, Coords: positions(l, 0, 0, 1, 1, 2, 0)},
+		&Polygon{Layout: l, Rings: [][]float64{square, hole}},
+		&MultiPoint{Layout: l, Coords: positions(l, 1, 2, 3, 4)},
+		&MultiLineString{Layout: l, Lines: [][]float64{positions(l, 0, 0, 1, 1), positions(l, 5, 5, 6, 7)}},
+		&MultiPolygon{Layout: l, Polygons: [][][]float64{{square, hole}, {positions(l, 10, 10, 11, 10, 11, 11, 10, 10)}}},
+		&GeometryCollection{Layout: l, Geometries: []Geometry{
+			&Point{Layout: l, Coords: positions(l, 7, 8)},
+			&LineString{Layout: l, Coords: positions(l, 0, 0, 9, 9)},
+			&Polygon{Layout: l, Rings: [][]float64{square}},
+		}},
+	}
+}
+
+func TestWKBRoundTrip(t *testing.T) {
+	for _, layout := range layouts {
+		for _, g := range testGeometries(layout) {
+			wkb, err := MarshalWKB(g, layout)
+			if err != nil {
+				t.Fatalf("%s %d: %v", g.GeometryType(), layout, err)
+			}
+			got, srid, err := UnmarshalWKB(wkb)
+			if err != nil {
+				t.Fatalf("%s %d: %v", g.GeometryType(), layout, err)
+			}
+			if srid != 0 {
+				t.Errorf("%s %d: srid = %d, want 0", g.GeometryType(), layout, srid)
+			}
+			if !reflect.DeepEqual(got, g) {
+				t.Errorf("%s %d: got %#v, want %#v", g.GeometryType(), layout, got, g)
+			}
+		}
+	}
+}
+
+func TestWKBTypeCodes(t *testing.T) {
+	offsets := map[Layout]uint32{XY: 0, XYZ: 1000, XYM: 2000, XYZM: 3000}
+	for _, layout := range layouts {
+		for _, g := range testGeometries(layout) {
+			wkb, err := MarshalWKB(g, layout)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if wkb[0] != 1 {
+				t.Errorf("%s: byte order %d, want little-endian", g.GeometryType(), wkb[0])
+			}
+			want := WKBTypeCode(g) + offsets[layout]
+			if code := binary.LittleEndian.Uint32(wkb[1:]); code != want {
+				t.Errorf("%s %d: type code %d, want %d", g.GeometryType(), layout, code, want)
+			}
+		}
+	}
+}
+
+func TestWKBEmpty(t *testing.T) {
+	for _, layout := range layouts {
+		for _, g := range []Geometry{
+			&Point{Layout: layout},
+			&LineString{Layout: layout},
+			&Polygon{Layout: layout},
+			&MultiPoint{Layout: layout},
+			&MultiLineString{Layout: layout},
+			&MultiPolygon{Layout: layout},
+			&GeometryCollection{Layout: layout},
+		} {
+			wkb, err := MarshalWKB(g, layout)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, _, err := UnmarshalWKB(wkb)
+			if err != nil {
+				t.Fatalf("empty %s %d: %v", g.GeometryType(), layout, err)
+			}
+			if got.GeometryType() != g.GeometryType() || got.CoordLayout() != layout || !got.IsEmpty() {
+				t.Errorf("empty %s %d: got %#v", g.GeometryType(), layout, got)
+			}
+		}
+	}
+
+	// An empty point is encoded as NaN coordinates
+	wkb, _ := MarshalWKB(&Point{Layout: XY}, XY)
+	for i := 0; i < 2; i++ {
+		if v := math.Float64frombits(binary.LittleEndian.Uint64(wkb[5+8*i:])); !math.IsNaN(v) {
+			t.Errorf("empty point ordinate %d = %v, want NaN", i, v)
+		}
+	}
+}
+
+func TestWKBLayoutConversion(t *testing.T) {
+	g := &LineString{Layout: XYM, Coords: []float64{1, 2, 3, 4, 5, 6}}
+
+	// Missing Z is written as 0
+	wkb, err := MarshalWKB(g, XYZM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _, err := UnmarshalWKB(wkb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &LineString{Layout: XYZM, Coords: []float64{1, 2, 0, 3, 4, 5, 0, 6}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("XYM as XYZM: got %#v, want %#v", got, want)
+	}
+
+	// M is dropped
+	wkb, err = MarshalWKB(g, XY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _, err = UnmarshalWKB(wkb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = &LineString{Layout: XY, Coords: []float64{1, 2, 4, 5}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("XYM as XY: got %#v, want %#v", got, want)
+	}
+}
+
+// wkbBuilder writes WKB by hand in either byte order
+type wkbBuilder struct {
+	buf   bytes.Buffer
+	order binary.ByteOrder
+}
+
+func (b *wkbBuilder) header(code uint32) *wkbBuilder {
+	if b.order == binary.LittleEndian {
+		b.buf.WriteByte(1)
+	} else {
+		b.buf.WriteByte(0)
+	}
+	return b.uint32(code)
+}
+
+func (b *wkbBuilder) uint32(v uint32) *wkbBuilder {
+	binary.Write(&b.buf, b.order, v)
+	return b
+}
+
+func (b *wkbBuilder) floats(values ...float64) *wkbBuilder {
+	for _, v := range values {
+		binary.Write(&b.buf, b.order, v)
+	}
+	return b
+}
+
+func TestUnmarshalWKB(t *testing.T) {
+	be := func() *wkbBuilder { return &wkbBuilder{order: binary.BigEndian} }
+	le := func() *wkbBuilder { return &wkbBuilder{order: binary.LittleEndian} }
+
+	tests := []struct {
+		name string
+		wkb  []byte
+		want Geometry
+		srid int
+	}{
+		{
+			name: "big-endian point",
+			wkb:  be().header(1).floats(1, 2).buf.Bytes(),
+			want: &Point{Layout: XY, Coords: []float64{1, 2}},
+		},
+		{
+			name: "big-endian ISO linestring Z",
+			wkb:  be().header(1002).uint32(2).floats(1, 2, 3, 4, 5, 6).buf.Bytes(),
+			want: &LineString{Layout: XYZ, Coords: []float64{1, 2, 3, 4, 5, 6}},
+		},
+		{
+			name: "mixed byte order multipoint",
+			wkb: func() []byte {
+				b := be().header(4).uint32(2)
+				b.buf.Write(le().header(1).floats(1, 2).buf.Bytes())
+				b.buf.Write(be().header(1).floats(3, 4).buf.Bytes())
+				return b.buf.Bytes()
+			}(),
+			want: &MultiPoint{Layout: XY, Coords: []float64{1, 2, 3, 4}},
+		},
+		{
+			name: "EWKB point ZM with SRID",
+			wkb:  le().header(1|ewkbZ|ewkbM|ewkbSRID).uint32(3857).floats(1, 2, 3, 4).buf.Bytes(),
+			want: &Point{Layout: XYZM, Coords: []float64{1, 2, 3, 4}},
+			srid: 3857,
+		},
+		{
+			name: "big-endian EWKB polygon M with SRID",
+			wkb: be().header(3|ewkbM|ewkbSRID).uint32(4326).
+				uint32(1).uint32(4).floats(0, 0, 1, 1, 0, 2, 1, 1, 3, 0, 0, 4).buf.Bytes(),
+			want: &Polygon{Layout: XYM, Rings: [][]float64{{0, 0, 1, 1, 0, 2, 1, 1, 3, 0, 0, 4}}},
+			srid: 4326,
+		},
+		{
+			name: "EWKB multipolygon Z with SRID on the outer geometry only",
+			wkb: func() []byte {
+				b := le().header(6 | ewkbZ | ewkbSRID).uint32(28409).uint32(1)
+				b.buf.Write(le().header(3|ewkbZ).uint32(1).uint32(4).floats(0, 0, 1, 1, 0, 1, 1, 1, 1, 0, 0, 1).buf.Bytes())
+				return b.buf.Bytes()
+			}(),
+			want: &MultiPolygon{Layout: XYZ, Polygons: [][][]float64{{{0, 0, 1, 1, 0, 1, 1, 1, 1, 0, 0, 1}}}},
+			srid: 28409,
+		},
+	}
+	for _, tt := range tests {
+		got, srid, err := UnmarshalWKB(tt.wkb)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %#v, want %#v", tt.name, got, tt.want)
+		}
+		if srid != tt.srid {
+			t.Errorf("%s: srid = %d, want %d", tt.name, srid, tt.srid)
+		}
+	}
+}
+
+func TestUnmarshalWKBErrors(t *testing.T) {
+	le := func() *wkbBuilder { return &wkbBuilder{order: binary.LittleEndian} }
+	point := le().header(1).floats(1, 2).buf.Bytes()
+
+	tests := []struct {
+		name string
+		wkb  []byte
+		err  string
+	}{
+		{"empty input", nil, "unexpected end"},
+		{"invalid byte order", []byte{2, 1, 0, 0, 0}, "invalid WKB byte order"},
+		{"unknown type", le().header(8).buf.Bytes(), "unsupported WKB geometry type"},
+		{"truncated point", point[:len(point)-1], "unexpected end"},
+		{"trailing bytes", append(append([]byte(nil), point...), 0), "trailing bytes"},
+		{"count beyond data", le().header(2).uint32(1000).floats(1, 2).buf.Bytes(), "exceeds WKB size"},
+		{
+			"wrong member type",
+			append(le().header(5).uint32(1).buf.Bytes(), point...),
+			"Point member",
+		},
+		{
+			"empty multipoint member",
+			append(append(le().header(4).uint32(2).buf.Bytes(), point...), le().header(1).floats(math.NaN(), math.NaN()).buf.Bytes()...),
+			"empty point 1",
+		},
+		{
+			"member dimensions",
+			append(le().header(1004).uint32(1).buf.Bytes(), point...),
+			"member dimensions",
+		},
+	}
+	for _, tt := range tests {
+		_, _, err := UnmarshalWKB(tt.wkb)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: error %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
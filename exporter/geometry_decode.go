@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	"exporter/geom"
+)
+
+// gpkgFlagExtended marks a GeoPackage extension geometry type in the header
+const gpkgFlagExtended = 0x20
+
+// GPKGGeometry is a decoded GeoPackage binary geometry
+type GPKGGeometry struct {
+	Version byte
+	SRSID   int32
+	Empty   bool
+
+	// EnvelopeType is the envelope contents indicator: 0 none, 1 XY,
+	// 2 XYZ, 3 XYM, 4 XYZM. Envelope holds min_x, max_x, min_y, max_y
+	// followed by min/max Z and M as present.
+	EnvelopeType int
+	Envelope     []float64
+
+	// Geometry is the decoded WKB; SRID is set when the WKB is EWKB
+	Geometry geom.Geometry
+	SRID     int
+}
+
+// DecodeGPKG decodes a GeoPackage binary geometry blob
+func DecodeGPKG(blob []byte) (*GPKGGeometry, error) {
+	if len(blob) < 8 {
+		return nil, fmt.Errorf("geometry blob too short: %d bytes", len(blob))
+	}
+	if blob[0] != 'G' || blob[1] != 'P' {
+		return nil, fmt.Errorf("invalid GeoPackage magic number %#x %#x", blob[0], blob[1])
+	}
+
+	flags := blob[3]
+	if flags&gpkgFlagExtended != 0 {
+		return nil, fmt.Errorf("extended GeoPackage geometry types are not supported")
+	}
+
+	var order binary.ByteOrder = binary.BigEndian
+	if flags&gpkgFlagLittleEndian != 0 {
+		order = binary.LittleEndian
+	}
+
+	g := &GPKGGeometry{
+		Version:      blob[2],
+		SRSID:        int32(order.Uint32(blob[4:8])),
+		Empty:        flags&gpkgFlagEmpty != 0,
+		EnvelopeType: int(flags>>1) & 0x07,
+	}
+
+	var envelopeValues int
+	switch g.EnvelopeType {
+	case 0:
+	case 1:
+		envelopeValues = 4
+	case 2, 3:
+		envelopeValues = 6
+	case 4:
+		envelopeValues = 8
+	default:
+		return nil, fmt.Errorf("invalid envelope contents indicator %d", g.EnvelopeType)
+	}
+
+	offset := 8
+	if len(blob) < offset+envelopeValues*8 {
+		return nil, fmt.Errorf("geometry blob too short for envelope")
+	}
+	for i := 0; i < envelopeValues; i++ {
+		g.Envelope = append(g.Envelope, math.Float64frombits(order.Uint64(blob[offset:])))
+		offset += 8
+	}
+
+	geometry, srid, err := geom.UnmarshalWKB(blob[offset:])
+	if err != nil {
+		return nil, err
+	}
+	g.Geometry = geometry
+	g.SRID = srid
+	return g, nil
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"strings"
+	"testing"
+
+	"exporter/geom"
+)
+
+// testPositions returns flat coordinates in the layout for the XY pairs,
+// with Z = x + 100 and M = y + 1000 where the layout has them
+func testPositions(layout geom.Layout, xy ...float64) []float64 {
+	var coords []float64
+	for i := 0; i+1 < len(xy); i += 2 {
+		x, y := xy[i], xy[i+1]
+		coords = append(coords, x, y)
+		if layout.HasZ() {
+			coords = append(coords, x+100)
+		}
+		if layout.HasM() {
+			coords = append(coords, y+1000)
+		}
+	}
+	return coords
+}
+
+func TestGPKGRoundTrip(t *testing.T) {
+	tests := []struct {
+		name     string
+		geometry func(l geom.Layout) geom.Geometry
+		// envelope is min_x, max_x, min_y, max_y
+		envelope [4]float64
+	}{
+		{"Point", func(l geom.Layout) geom.Geometry {
+			return &geom.Point{Layout: l, Coords: testPositions(l, 1, 2)}
+		}, [4]float64{1, 1, 2, 2}},
+		{"LineString", func(l geom.Layout) geom.Geometry {
+			return &geom.LineString{Layout: l, Coords: testPositions(l, 0, 5, 3, -1, 2, 2)}
+		}, [4]float64{0, 3, -1, 5}},
+		{"Polygon", func(l geom.Layout) geom.Geometry {
+			return &geom.Polygon{Layout: l, Rings: [][]float64{
+				testPositions(l, 0, 0, 4, 0, 4, 4, 0, 4, 0, 0),
+				testPositions(l, 1, 1, 1, 2, 2, 2, 1, 1),
+			}}
+		}, [4]float64{0, 4, 0, 4}},
+		{"MultiPoint", func(l geom.Layout) geom.Geometry {
+			return &geom.MultiPoint{Layout: l, Coords: testPositions(l, 1, 2, -3, 4)}
+		}, [4]float64{-3, 1, 2, 4}},
+		{"MultiLineString", func(l geom.Layout) geom.Geometry {
+			return &geom.MultiLineString{Layout: l, Lines: [][]float64{
+				testPositions(l, 0, 0, 1, 1),
+				testPositions(l, 5, 5, 6, 7),
+			}}
+		}, [4]float64{0, 6, 0, 7}},
+		{"MultiPolygon", func(l geom.Layout) geom.Geometry {
+			return &geom.MultiPolygon{Layout: l, Polygons: [][][]float64{
+				{testPositions(l, 0, 0, 1, 0, 1, 1, 0, 0)},
+				{testPositions(l, 10, 10, 11, 10, 11, 12, 10, 10)},
+			}}
+		}, [4]float64{0, 11, 0, 12}},
+		{"GeometryCollection", func(l geom.Layout) geom.Geometry {
+			return &geom.GeometryCollection{Layout: l, Geometries: []geom.Geometry{
+				&geom.Point{Layout: l, Coords: testPositions(l, 7, 8)},
+				&geom.LineString{Layout: l, Coords: testPositions(l, -2, 0, 9, 3)},
+			}}
+		}, [4]float64{-2, 9, 0, 8}},
+	}
+
+	layouts := []struct {
+		name         string
+		layout       geom.Layout
+		envelopeType int
+	}{
+		{"XY", geom.XY, 1},
+		{"XYZ", geom.XYZ, 2},
+		{"XYM", geom.XYM, 3},
+		{"XYZM", geom.XYZM, 4},
+	}
+
+	for _, tt := range tests {
+		for _, l := range layouts {
+			name := tt.name + " " + l.name
+			g := tt.geometry(l.layout)
+			blob, err := ConvertGeometryToGPKG(g, 4326)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if blob[3]&gpkgFlagLittleEndian == 0 {
+				t.Errorf("%s: header is not flagged little-endian", name)
+			}
+
+			decoded, err := DecodeGPKG(blob)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if decoded.Version != 0 || decoded.SRSID != 4326 || decoded.Empty || decoded.SRID != 0 {
+				t.Errorf("%s: header %+v", name, decoded)
+			}
+			if decoded.EnvelopeType != l.envelopeType {
+				t.Errorf("%s: envelope type %d, want %d", name, decoded.EnvelopeType, l.envelopeType)
+			}
+
+			e := tt.envelope
+			want := e[:]
+			if l.layout.HasZ() {
+				want = append(want, e[0]+100, e[1]+100)
+			}
+			if l.layout.HasM() {
+				want = append(want, e[2]+1000, e[3]+1000)
+			}
+			if !reflect.DeepEqual(decoded.Envelope, want) {
+				t.Errorf("%s: envelope %v, want %v", name, decoded.Envelope, want)
+			}
+			if !reflect.DeepEqual(decoded.Geometry, g) {
+				t.Errorf("%s: geometry %#v, want %#v", name, decoded.Geometry, g)
+			}
+		}
+	}
+}
+
+func TestGPKGEmpty(t *testing.T) {
+	for _, g := range []geom.Geometry{
+		&geom.Point{Layout: geom.XY},
+		&geom.LineString{Layout: geom.XYZ},
+		&geom.Polygon{Layout: geom.XYM},
+		&geom.MultiPoint{Layout: geom.XYZM},
+		&geom.MultiLineString{Layout: geom.XY},
+		&geom.MultiPolygon{Layout: geom.XYZ},
+		&geom.GeometryCollection{Layout: geom.XY},
+	} {
+		blob, err := ConvertGeometryToGPKG(g, 3857)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := DecodeGPKG(blob)
+		if err != nil {
+			t.Fatalf("empty %s: %v", g.GeometryType(), err)
+		}
+		if !decoded.Empty || decoded.EnvelopeType != 0 || decoded.Envelope != nil {
+			t.Errorf("empty %s: header %+v", g.GeometryType(), decoded)
+		}
+		if d := decoded.Geometry; d.GeometryType() != g.GeometryType() || d.CoordLayout() != g.CoordLayout() || !d.IsEmpty() {
+			t.Errorf("empty %s: geometry %#v", g.GeometryType(), d)
+		}
+	}
+}
+
+// gpkgBlob builds a GeoPackage geometry by hand in either byte order
+func gpkgBlob(order binary.ByteOrder, flags byte, srsID int32, envelope []float64, wkb []byte) []byte {
+	var buf bytes.Buffer
+	buf.Write([]byte{'G', 'P', 0, flags})
+	binary.Write(&buf, order, srsID)
+	for _, v := range envelope {
+		binary.Write(&buf, order, v)
+	}
+	buf.Write(wkb)
+	return buf.Bytes()
+}
+
+// wkbPoint encodes a point in either byte order with the raw type code,
+// followed by the SRID when given
+func wkbPoint(order binary.ByteOrder, code uint32, srid uint32, coords ...float64) []byte {
+	var buf bytes.Buffer
+	if order == binary.LittleEndian {
+		buf.WriteByte(1)
+	} else {
+		buf.WriteByte(0)
+	}
+	binary.Write(&buf, order, code)
+	if srid != 0 {
+		binary.Write(&buf, order, srid)
+	}
+	for _, v := range coords {
+		binary.Write(&buf, order, v)
+	}
+	return buf.Bytes()
+}
+
+func TestDecodeGPKG(t *testing.T) {
+	tests := []struct {
+		name         string
+		blob         []byte
+		srsID        int32
+		envelopeType int
+		envelope     []float64
+		geometry     geom.Geometry
+		srid         int
+	}{
+		{
+			name:         "big-endian header and WKB",
+			blob:         gpkgBlob(binary.BigEndian, gpkgEnvelopeXY, 28409, []float64{1, 1, 2, 2}, wkbPoint(binary.BigEndian, 1, 0, 1, 2)),
+			srsID:        28409,
+			envelopeType: 1,
+			envelope:     []float64{1, 1, 2, 2},
+			geometry:     &geom.Point{Layout: geom.XY, Coords: []float64{1, 2}},
+		},
+		{
+			name:     "big-endian header with little-endian WKB",
+			blob:     gpkgBlob(binary.BigEndian, 0, 4326, nil, wkbPoint(binary.LittleEndian, 1001, 0, 1, 2, 3)),
+			srsID:    4326,
+			geometry: &geom.Point{Layout: geom.XYZ, Coords: []float64{1, 2, 3}},
+		},
+		{
+			name: "EWKB with SRID",
+			blob: gpkgBlob(binary.LittleEndian, gpkgFlagLittleEndian|gpkgEnvelopeXYZ, 3857, []float64{1, 1, 2, 2, 3, 3},
+				wkbPoint(binary.LittleEndian, 1|0x80000000|0x20000000, 3857, 1, 2, 3)),
+			srsID:        3857,
+			envelopeType: 2,
+			envelope:     []float64{1, 1, 2, 2, 3, 3},
+			geometry:     &geom.Point{Layout: geom.XYZ, Coords: []float64{1, 2, 3}},
+			srid:         3857,
+		},
+		{
+			name: "big-endian EWKB M with SRID",
+			blob: gpkgBlob(binary.BigEndian, gpkgEnvelopeXYM, 4326, []float64{1, 1, 2, 2, 4, 4},
+				wkbPoint(binary.BigEndian, 1|0x40000000|0x20000000, 4326, 1, 2, 4)),
+			srsID:        4326,
+			envelopeType: 3,
+			envelope:     []float64{1, 1, 2, 2, 4, 4},
+			geometry:     &geom.Point{Layout: geom.XYM, Coords: []float64{1, 2, 4}},
+			srid:         4326,
+		},
+	}
+	for _, tt := range tests {
+		decoded, err := DecodeGPKG(tt.blob)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if decoded.SRSID != tt.srsID || decoded.EnvelopeType != tt.envelopeType || decoded.SRID != tt.srid {
+			t.Errorf("%s: header %+v", tt.name, decoded)
+		}
+		if !reflect.DeepEqual(decoded.Envelope, tt.envelope) {
+			t.Errorf("%s: envelope %v, want %v", tt.name, decoded.Envelope, tt.envelope)
+		}
+		if !reflect.DeepEqual(decoded.Geometry, tt.geometry) {
+			t.Errorf("%s: geometry %#v, want %#v", tt.name, decoded.Geometry, tt.geometry)
+		}
+	}
+}
+
+func TestDecodeGPKGErrors(t *testing.T) {
+	point := wkbPoint(binary.LittleEndian, 1, 0, 1, 2)
+	tests := []struct {
+		name string
+		blob []byte
+		err  string
+	}{
+		{"too short", []byte("GP\x00\x01"), "too short"},
+		{"bad magic", gpkgBlob(binary.LittleEndian, gpkgFlagLittleEndian, 0, nil, point)[1:], "magic"},
+		{"extended type", gpkgBlob(binary.LittleEndian, gpkgFlagLittleEndian|gpkgFlagExtended, 0, nil, point), "extended"},
+		{"invalid envelope", gpkgBlob(binary.LittleEndian, gpkgFlagLittleEndian|5<<1, 0, nil, point), "envelope contents"},
+		{"truncated envelope", gpkgBlob(binary.LittleEndian, gpkgFlagLittleEndian|gpkgEnvelopeXYZM, 0, []float64{1, 2}, nil), "envelope"},
+		{"invalid WKB", gpkgBlob(binary.LittleEndian, gpkgFlagLittleEndian, 0, nil, point[:7]), "unexpected end"},
+	}
+	for _, tt := range tests {
+		_, err := DecodeGPKG(tt.blob)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: error %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
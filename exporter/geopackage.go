@@ -3,22 +3,42 @@ package main
 import (
 	"database/sql"
 	"fmt"
+	"strings"
+
+	"exporter/crs"
+)
+
+// GeoPackage header values: application_id is "GPKG" as a big-endian
+// integer and user_version the spec version 1.3.0
+const (
+	gpkgApplicationID = 0x47504B47
+	gpkgUserVersion   = 10300
 )
 
 // InitGeoPackage initializes a GeoPackage file with required metadata tables
-func InitGeoPackage(db *sql.DB) error {
+// and the spatial reference systems, including the target CRS. Feature tables
+// are created by createFeatureTable.
+func InitGeoPackage(db *sql.DB, target *crs.CRS) error {
 	// Enable foreign keys
 	if _, err := db.Exec("PRAGMA foreign_keys = ON"); err != nil {
 		return fmt.Errorf("failed to enable foreign keys: %w", err)
 	}
 
+	// Mark the file as a GeoPackage 1.3 ("GPKG" in the application id)
+	if _, err := db.Exec(fmt.Sprintf("PRAGMA application_id = %d", gpkgApplicationID)); err != nil {
+		return fmt.Errorf("failed to set application_id: %w", err)
+	}
+	if _, err := db.Exec(fmt.Sprintf("PRAGMA user_version = %d", gpkgUserVersion)); err != nil {
+		return fmt.Errorf("failed to set user_version: %w", err)
+	}
+
 	// Create gpkg_spatial_ref_sys table
 	if err := createSpatialRefSysTable(db); err != nil {
 		return err
 	}
 
 	// Insert required SRS entries
-	if err := insertSpatialRefSystems(db); err != nil {
+	if err := insertSpatialRefSystems(db, target); err != nil {
 		return err
 	}
 
@@ -32,18 +52,18 @@ func InitGeoPackage(db *sql.DB) error {
 		return err
 	}
 
-	// Create cadastral_objects table
-	if err := createCadastralObjectsTable(db); err != nil {
+	// Create gpkg_extensions table
+	if err := createExtensionsTable(db); err != nil {
 		return err
 	}
 
-	// Register table in gpkg_contents
-	if err := registerTableInContents(db); err != nil {
+	// Create the Schema extension tables
+	if err := createSchemaTables(db); err != nil {
 		return err
 	}
 
-	// Register geometry column
-	if err := registerGeometryColumn(db); err != nil {
+	// Create the Metadata extension tables
+	if err := createMetadataTables(db); err != nil {
 		return err
 	}
 
@@ -67,33 +87,44 @@ func createSpatialRefSysTable(db *sql.DB) error {
 	return nil
 }
 
-func insertSpatialRefSystems(db *sql.DB) error {
-	// Insert EPSG:3857 (Web Mercator) - the CRS used in the data
+// insertSpatialRefSystems registers EPSG:4326 and the undefined cartesian
+// and geographic systems (required by the GeoPackage spec), EPSG:3857 (the
+// CRS of the source data) and the target CRS
+func insertSpatialRefSystems(db *sql.DB, target *crs.CRS) error {
 	_, err := db.Exec(`
-		INSERT OR REPLACE INTO gpkg_spatial_ref_sys 
+		INSERT INTO gpkg_spatial_ref_sys
 		(srs_name, srs_id, organization, organization_coordsys_id, definition, description)
-		VALUES 
-		('WGS 84 / Pseudo-Mercator', 3857, 'EPSG', 3857, 
-		 'PROJCS["WGS 84 / Pseudo-Mercator",GEOGCS["WGS 84",DATUM["WGS_1984",SPHEROID["WGS 84",6378137,298.257223563,AUTHORITY["EPSG","7030"]],AUTHORITY["EPSG","6326"]],PRIMEM["Greenwich",0,AUTHORITY["EPSG","8901"]],UNIT["degree",0.0174532925199433,AUTHORITY["EPSG","9122"]],AUTHORITY["EPSG","4326"]],PROJECTION["Mercator_1SP"],PARAMETER["central_meridian",0],PARAMETER["scale_factor",1],PARAMETER["false_easting",0],PARAMETER["false_northing",0],UNIT["metre",1,AUTHORITY["EPSG","9001"]],AXIS["X",EAST],AXIS["Y",NORTH],EXTENSION["PROJ4","+proj=merc +a=6378137 +b=6378137 +lat_ts=0.0 +lon_0=0.0 +x_0=0.0 +y_0=0 +k=1.0 +units=m +nadgrids=@null +wktext +no_defs"],AUTHORITY["EPSG","3857"]]',
-		 'Popular Visualisation CRS / Mercator')
+		VALUES
+		('Undefined cartesian SRS', -1, 'NONE', -1, 'undefined', 'undefined cartesian coordinate reference system'),
+		('Undefined geographic SRS', 0, 'NONE', 0, 'undefined', 'undefined geographic coordinate reference system')
+		ON CONFLICT (srs_id) DO NOTHING
 	`)
 	if err != nil {
-		return fmt.Errorf("failed to insert EPSG:3857: %w", err)
+		return fmt.Errorf("failed to insert undefined spatial reference systems: %w", err)
 	}
 
-	// Insert EPSG:4326 (WGS84) - required by GeoPackage spec
-	_, err = db.Exec(`
-		INSERT OR REPLACE INTO gpkg_spatial_ref_sys 
+	for _, c := range []*crs.CRS{crs.WGS84, sourceCRS, target} {
+		if err := insertSpatialRefSys(db, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// insertSpatialRefSys writes the gpkg_spatial_ref_sys row of a CRS
+func insertSpatialRefSys(db *sql.DB, c *crs.CRS) error {
+	_, err := db.Exec(`
+		INSERT INTO gpkg_spatial_ref_sys 
 		(srs_name, srs_id, organization, organization_coordsys_id, definition, description)
-		VALUES 
-		('WGS 84', 4326, 'EPSG', 4326,
-		 'GEOGCS["WGS 84",DATUM["WGS_1984",SPHEROID["WGS 84",6378137,298.257223563,AUTHORITY["EPSG","7030"]],AUTHORITY["EPSG","6326"]],PRIMEM["Greenwich",0,AUTHORITY["EPSG","8901"]],UNIT["degree",0.0174532925199433,AUTHORITY["EPSG","9122"]],AUTHORITY["EPSG","4326"]]',
-		 'WGS 84')
-	`)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (srs_id) DO UPDATE SET
+			srs_name = excluded.srs_name, organization = excluded.organization,
+			organization_coordsys_id = excluded.organization_coordsys_id,
+			definition = excluded.definition, description = excluded.description
+	`, c.Name, c.SRSID, c.Organization, c.OrganizationID, c.WKT(), c.Description)
 	if err != nil {
-		return fmt.Errorf("failed to insert EPSG:4326: %w", err)
+		return fmt.Errorf("failed to insert %s: %w", c, err)
 	}
-
 	return nil
 }
 
@@ -139,11 +170,38 @@ func createGeometryColumnsTable(db *sql.DB) error {
 	return nil
 }
 
-func createCadastralObjectsTable(db *sql.DB) error {
-	_, err := db.Exec(`
-		CREATE TABLE IF NOT EXISTS cadastral_objects (
-			code INTEGER NOT NULL PRIMARY KEY,
-			quarter_code INTEGER NOT NULL,
+// createFeatureTable creates a cadastral objects feature table, registers it
+// in gpkg_contents and gpkg_geometry_columns and creates its spatial index.
+// The geometry type is registered as GEOMETRY until the export knows better.
+func createFeatureTable(db *sql.DB, table, identifier string, target *crs.CRS, optionColumns []OptionColumn) error {
+	if err := createCadastralObjectsTable(db, table, optionColumns); err != nil {
+		return err
+	}
+	if err := registerTableInContents(db, table, identifier, "Cadastral objects from NSPD", target); err != nil {
+		return err
+	}
+	if err := registerGeometryColumn(db, table, target); err != nil {
+		return err
+	}
+	return createSpatialIndex(db, table, "geometry")
+}
+
+// createCadastralObjectsTable creates a cadastral objects table with a
+// typed column for each mapped NSPD option. Objects are keyed by their full
+// cadastral number, as object codes repeat across quarters; fid is the
+// integer key the spatial index refers to.
+func createCadastralObjectsTable(db *sql.DB, table string, optionColumns []OptionColumn) error {
+	var extra strings.Builder
+	for _, c := range optionColumns {
+		fmt.Fprintf(&extra, "\n\t\t\t%s %s,", c.columnName(), c.Type)
+	}
+
+	_, err := db.Exec(fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s (
+			fid INTEGER PRIMARY KEY AUTOINCREMENT,
+			cad_num TEXT NOT NULL UNIQUE,
+			code INTEGER NOT NULL,
+			quarter_code INTEGER NOT NULL REFERENCES cadastral_quarters(code),
 			load_status TEXT,
 			update_date DATE,
 			area INTEGER,
@@ -153,38 +211,41 @@ func createCadastralObjectsTable(db *sql.DB) error {
 			status TEXT,
 			land_record_type TEXT,
 			land_record_subtype TEXT,
-			land_record_category_type TEXT,
+			land_record_category_type TEXT,%s
 			geometry BLOB NOT NULL
 		)
-	`)
+	`, table, extra.String()))
 	if err != nil {
-		return fmt.Errorf("failed to create cadastral_objects table: %w", err)
+		return fmt.Errorf("failed to create %s table: %w", table, err)
+	}
+	if _, err := db.Exec(fmt.Sprintf("CREATE INDEX IF NOT EXISTS idx_%s_quarter_code ON %s(quarter_code)", table, table)); err != nil {
+		return fmt.Errorf("failed to create index on %s: %w", table, err)
 	}
 	return nil
 }
 
-func registerTableInContents(db *sql.DB) error {
+func registerTableInContents(db *sql.DB, table, identifier, description string, target *crs.CRS) error {
 	_, err := db.Exec(`
 		INSERT OR REPLACE INTO gpkg_contents 
 		(table_name, data_type, identifier, description, srs_id)
 		VALUES 
-		('cadastral_objects', 'features', 'Cadastral Objects', 'Cadastral objects from Kazan', 3857)
-	`)
+		(?, 'features', ?, ?, ?)
+	`, table, identifier, description, target.SRSID)
 	if err != nil {
-		return fmt.Errorf("failed to register table in gpkg_contents: %w", err)
+		return fmt.Errorf("failed to register %s in gpkg_contents: %w", table, err)
 	}
 	return nil
 }
 
-func registerGeometryColumn(db *sql.DB) error {
+func registerGeometryColumn(db *sql.DB, table string, target *crs.CRS) error {
 	_, err := db.Exec(`
 		INSERT OR REPLACE INTO gpkg_geometry_columns 
 		(table_name, column_name, geometry_type_name, srs_id, z, m)
 		VALUES 
-		('cadastral_objects', 'geometry', 'POLYGON', 3857, 0, 0)
-	`)
+		(?, 'geometry', 'GEOMETRY', ?, 0, 0)
+	`, table, target.SRSID)
 	if err != nil {
-		return fmt.Errorf("failed to register geometry column: %w", err)
+		return fmt.Errorf("failed to register geometry column of %s: %w", table, err)
 	}
 	return nil
 }
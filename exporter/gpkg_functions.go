@@ -0,0 +1,77 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// gpkgDriver is the SQLite driver for GeoPackage files. It registers the
+// GeoPackage SQL functions used by the R-tree index triggers, so rows can be
+// inserted and updated once the triggers exist.
+const gpkgDriver = "sqlite3_gpkg"
+
+func init() {
+	sql.Register(gpkgDriver, &sqlite3.SQLiteDriver{
+		ConnectHook: registerGPKGFunctions,
+	})
+}
+
+// registerGPKGFunctions registers ST_MinX, ST_MaxX, ST_MinY, ST_MaxY and
+// ST_IsEmpty (GeoPackage 1.3, Annex F.3) on a connection
+func registerGPKGFunctions(conn *sqlite3.SQLiteConn) error {
+	envelopeFunc := func(index int) func(interface{}) (interface{}, error) {
+		return func(blob interface{}) (interface{}, error) {
+			envelope, ok, err := blobEnvelope(blob)
+			if err != nil || !ok {
+				return nil, err
+			}
+			return envelope[index], nil
+		}
+	}
+
+	for name, impl := range map[string]interface{}{
+		"ST_MinX": envelopeFunc(0),
+		"ST_MaxX": envelopeFunc(1),
+		"ST_MinY": envelopeFunc(2),
+		"ST_MaxY": envelopeFunc(3),
+		"ST_IsEmpty": func(blob interface{}) (interface{}, error) {
+			data, ok := blob.([]byte)
+			if !ok || data == nil {
+				return nil, nil
+			}
+			g, err := DecodeGPKG(data)
+			if err != nil {
+				return nil, err
+			}
+			return g.Empty || g.Geometry.IsEmpty(), nil
+		},
+	} {
+		if err := conn.RegisterFunc(name, impl, true); err != nil {
+			return fmt.Errorf("failed to register %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// blobEnvelope returns [min_x, max_x, min_y, max_y] of a GeoPackage geometry
+// blob, read from its header envelope when present. ok is false for NULL and
+// empty geometries.
+func blobEnvelope(blob interface{}) ([4]float64, bool, error) {
+	data, ok := blob.([]byte)
+	if !ok || data == nil {
+		return [4]float64{}, false, nil
+	}
+	g, err := DecodeGPKG(data)
+	if err != nil {
+		return [4]float64{}, false, err
+	}
+	if g.Empty || g.Geometry.IsEmpty() {
+		return [4]float64{}, false, nil
+	}
+	if len(g.Envelope) >= 4 {
+		return [4]float64{g.Envelope[0], g.Envelope[1], g.Envelope[2], g.Envelope[3]}, true, nil
+	}
+	return CalculateEnvelope(g.Geometry), true, nil
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+
+	"exporter/geom"
+)
+
+// cadastralObjectColumns are the columns every cadastral objects table has
+// besides its fid: the object attributes and the geometry
+var cadastralObjectColumns = append(append([]string(nil), objectRowColumns...), "geometry")
+
+// existingObject is an object already stored in the GeoPackage
+type existingObject struct {
+	table      string
+	code       int
+	updateDate sql.NullString
+}
+
+// validateGeoPackage checks that an existing file was written by this
+// exporter with the same target CRS and a compatible geometry type policy,
+// so that it can be updated in place
+func validateGeoPackage(db *sql.DB, opts GPKGOptions) error {
+	for _, table := range []string{
+		"gpkg_spatial_ref_sys", "gpkg_contents", "gpkg_geometry_columns", "gpkg_extensions",
+		quartersTable, areasTable,
+	} {
+		var n int
+		if err := db.QueryRow("SELECT count(*) FROM sqlite_master WHERE name = ?", table).Scan(&n); err != nil {
+			return fmt.Errorf("failed to read schema: %w", err)
+		}
+		if n == 0 {
+			return fmt.Errorf("missing table %s", table)
+		}
+	}
+
+	tables, err := existingFeatureTables(db)
+	if err != nil {
+		return err
+	}
+	if len(tables) == 0 {
+		return fmt.Errorf("no cadastral objects table")
+	}
+
+	for _, table := range tables {
+		split := table != defaultTable
+		if split != (opts.GeometryType == geometryTypeSplit) {
+			return fmt.Errorf("table %s does not match -geometry-type %s", table, opts.GeometryType)
+		}
+
+		var srsID int
+		err := db.QueryRow(
+			"SELECT srs_id FROM gpkg_geometry_columns WHERE table_name = ? AND column_name = 'geometry'", table,
+		).Scan(&srsID)
+		if err != nil {
+			return fmt.Errorf("failed to read geometry column of %s: %w", table, err)
+		}
+		if srsID != opts.CRS.SRSID {
+			return fmt.Errorf("table %s uses srs_id %d, not %s", table, srsID, opts.CRS)
+		}
+
+		columns, err := tableColumns(db, table)
+		if err != nil {
+			return err
+		}
+		for _, column := range cadastralObjectColumns {
+			if !columns[column] {
+				return fmt.Errorf("table %s has no column %s", table, column)
+			}
+		}
+		for _, c := range opts.OptionColumns {
+			if !columns[c.columnName()] {
+				return fmt.Errorf("table %s has no column %s for option %s", table, c.columnName(), c.Option)
+			}
+		}
+	}
+	return nil
+}
+
+// tableColumns returns the column names of a table
+func tableColumns(db *sql.DB, table string) (map[string]bool, error) {
+	rows, err := db.Query(fmt.Sprintf("SELECT name FROM pragma_table_info('%s')", table))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read columns of %s: %w", table, err)
+	}
+	defer rows.Close()
+
+	columns := map[string]bool{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, fmt.Errorf("failed to read columns of %s: %w", table, err)
+		}
+		columns[name] = true
+	}
+	return columns, rows.Err()
+}
+
+// existingFeatureTables returns the registered cadastral objects tables:
+// cadastral_objects or its per-type cadastral_objects_<type> tables
+func existingFeatureTables(db *sql.DB) ([]string, error) {
+	rows, err := db.Query(`
+		SELECT table_name FROM gpkg_geometry_columns
+		WHERE table_name = ? OR table_name LIKE ? ESCAPE '\'
+		ORDER BY table_name
+	`, defaultTable, strings.ReplaceAll(defaultTable, "_", `\_`)+`\_%`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read feature tables: %w", err)
+	}
+	defer rows.Close()
+
+	var tables []string
+	for rows.Next() {
+		var table string
+		if err := rows.Scan(&table); err != nil {
+			return nil, fmt.Errorf("failed to read feature tables: %w", err)
+		}
+		tables = append(tables, table)
+	}
+	return tables, rows.Err()
+}
+
+// loadGeometryColumn returns the registration and row count of a feature
+// table, or nil if the table does not exist yet
+func loadGeometryColumn(db *sql.DB, table string) (*geometryColumn, error) {
+	var c geometryColumn
+	err := db.QueryRow(`
+		SELECT geometry_type_name, z, m FROM gpkg_geometry_columns
+		WHERE table_name = ? AND column_name = 'geometry'
+	`, table).Scan(&c.geometryType, &c.z, &c.m)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read geometry column of %s: %w", table, err)
+	}
+	if err := db.QueryRow(fmt.Sprintf("SELECT count(*) FROM %s", table)).Scan(&c.rows); err != nil {
+		return nil, fmt.Errorf("failed to count rows of %s: %w", table, err)
+	}
+	return &c, nil
+}
+
+// loadExistingObjects returns the table, code and update date of every
+// object in the file by cadastral number
+func loadExistingObjects(db *sql.DB) (map[string]existingObject, error) {
+	tables, err := existingFeatureTables(db)
+	if err != nil {
+		return nil, err
+	}
+
+	objects := map[string]existingObject{}
+	for _, table := range tables {
+		rows, err := db.Query(fmt.Sprintf("SELECT cad_num, code, update_date FROM %s", table))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read objects of %s: %w", table, err)
+		}
+		for rows.Next() {
+			var cadNum string
+			obj := existingObject{table: table}
+			if err := rows.Scan(&cadNum, &obj.code, &obj.updateDate); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("failed to read objects of %s: %w", table, err)
+			}
+			objects[cadNum] = obj
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read objects of %s: %w", table, err)
+		}
+	}
+	return objects, nil
+}
+
+// removeObsoleteObjects deletes the objects of the file that are no longer
+// exportable: missing from PostgreSQL, without data or not SUCCESS. Objects
+// merely outside the current filter are kept.
+func removeObsoleteObjects(src *Source, existing map[string]existingObject, layers map[string]*featureLayer) (int, error) {
+	codes := make([]int64, 0, len(existing))
+	for _, obj := range existing {
+		codes = append(codes, int64(obj.code))
+	}
+	exportable, err := src.ExportableNumbers(codes)
+	if err != nil {
+		return 0, err
+	}
+
+	var removed int
+	for cadNum, obj := range existing {
+		if exportable[cadNum] {
+			continue
+		}
+		if err := layers[obj.table].delete(cadNum); err != nil {
+			return removed, err
+		}
+		log.Printf("Removed object %s", cadNum)
+		removed++
+	}
+	return removed, nil
+}
+
+// spatialIndexExtent returns the extent of a feature table from its R-tree
+func spatialIndexExtent(db *sql.DB, table string) (geom.Bounds, error) {
+	var minX, minY, maxX, maxY sql.NullFloat64
+	err := db.QueryRow(fmt.Sprintf(
+		"SELECT min(minx), min(miny), max(maxx), max(maxy) FROM %s", rtreeTable(table, "geometry")),
+	).Scan(&minX, &minY, &maxX, &maxY)
+	if err != nil {
+		return geom.Bounds{}, fmt.Errorf("failed to read extent of %s: %w", table, err)
+	}
+	if !minX.Valid {
+		return geom.EmptyBounds(), nil
+	}
+	return geom.Bounds{MinX: minX.Float64, MinY: minY.Float64, MaxX: maxX.Float64, MaxY: maxY.Float64}, nil
+}
+
+// tableExists reports whether a table is registered in gpkg_contents
+func tableExists(db *sql.DB, table string) (bool, error) {
+	var n int
+	if err := db.QueryRow("SELECT count(*) FROM gpkg_contents WHERE table_name = ?", table).Scan(&n); err != nil {
+		return false, fmt.Errorf("failed to read gpkg_contents: %w", err)
+	}
+	return n > 0, nil
+}
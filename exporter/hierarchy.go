@@ -0,0 +1,331 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+
+	"exporter/crs"
+	"exporter/geom"
+)
+
+// Feature tables of the administrative hierarchy. Their geometries are the
+// dissolved union of the exported parcels, as the database stores no quarter
+// or area boundaries.
+const (
+	quartersTable = "cadastral_quarters"
+	areasTable    = "cadastral_areas"
+)
+
+// createHierarchyTables creates the cadastral_areas and cadastral_quarters
+// feature tables unless the file has them already. They must exist before
+// the object tables, whose quarter_code references cadastral_quarters.
+func createHierarchyTables(db *sql.DB, target *crs.CRS) error {
+	if exists, err := tableExists(db, quartersTable); err != nil || exists {
+		return err
+	}
+
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS cadastral_areas (
+			code INTEGER NOT NULL PRIMARY KEY,
+			region_code INTEGER NOT NULL,
+			name TEXT,
+			description TEXT,
+			region_name TEXT,
+			quarter_count INTEGER NOT NULL DEFAULT 0,
+			object_count INTEGER NOT NULL DEFAULT 0,
+			total_area INTEGER,
+			total_cost_value REAL,
+			geometry BLOB NOT NULL
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create %s table: %w", areasTable, err)
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS cadastral_quarters (
+			code INTEGER NOT NULL PRIMARY KEY,
+			area_code INTEGER NOT NULL REFERENCES cadastral_areas(code),
+			name TEXT,
+			description TEXT,
+			area_name TEXT,
+			region_code INTEGER NOT NULL,
+			region_name TEXT,
+			object_count INTEGER NOT NULL DEFAULT 0,
+			total_area INTEGER,
+			total_cost_value REAL,
+			geometry BLOB NOT NULL
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create %s table: %w", quartersTable, err)
+	}
+	if _, err := db.Exec("CREATE INDEX IF NOT EXISTS idx_cadastral_quarters_area_code ON cadastral_quarters(area_code)"); err != nil {
+		return fmt.Errorf("failed to create index on %s: %w", quartersTable, err)
+	}
+
+	for _, layer := range []struct{ table, identifier, description string }{
+		{areasTable, "Cadastral Areas", "Cadastral areas dissolved from the exported objects"},
+		{quartersTable, "Cadastral Quarters", "Cadastral quarters dissolved from the exported objects"},
+	} {
+		if err := registerTableInContents(db, layer.table, layer.identifier, layer.description, target); err != nil {
+			return err
+		}
+		if err := registerGeometryColumn(db, layer.table, target); err != nil {
+			return err
+		}
+		if err := createSpatialIndex(db, layer.table, "geometry"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// insertHierarchy inserts the quarters and their areas with empty
+// geometries, so that exported objects can reference them, and refreshes the
+// names of those already in the file. The geometries and totals are filled
+// in by dissolveHierarchy.
+func insertHierarchy(db *sql.DB, quarters []Quarter, srsID int32) error {
+	empty, err := ConvertGeometryToGPKG(&geom.MultiPolygon{Layout: geom.XY}, srsID)
+	if err != nil {
+		return err
+	}
+
+	for _, q := range quarters {
+		_, err := db.Exec(`
+			INSERT INTO cadastral_areas
+			(code, region_code, name, description, region_name, geometry)
+			VALUES (?, ?, ?, ?, ?, ?)
+			ON CONFLICT (code) DO UPDATE SET
+				region_code = excluded.region_code, name = excluded.name,
+				description = excluded.description, region_name = excluded.region_name
+		`, q.AreaCode, q.RegionCode, q.AreaName, q.AreaDescription, q.RegionName, empty)
+		if err != nil {
+			return fmt.Errorf("failed to insert area %d: %w", q.AreaCode, err)
+		}
+
+		_, err = db.Exec(`
+			INSERT INTO cadastral_quarters
+			(code, area_code, name, description, area_name, region_code, region_name, geometry)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (code) DO UPDATE SET
+				area_code = excluded.area_code, name = excluded.name,
+				description = excluded.description, area_name = excluded.area_name,
+				region_code = excluded.region_code, region_name = excluded.region_name
+		`, q.Code, q.AreaCode, q.Name, q.Description, q.AreaName, q.RegionCode, q.RegionName, empty)
+		if err != nil {
+			return fmt.Errorf("failed to insert quarter %d: %w", q.Code, err)
+		}
+	}
+	return nil
+}
+
+// hierarchyTotals accumulates the objects of a quarter or area
+type hierarchyTotals struct {
+	objects   int
+	area      sql.NullInt64
+	costValue sql.NullFloat64
+	geometry  *geom.MultiPolygon
+}
+
+func (t *hierarchyTotals) add(o *hierarchyTotals) {
+	t.objects += o.objects
+	if o.area.Valid {
+		t.area.Int64 += o.area.Int64
+		t.area.Valid = true
+	}
+	if o.costValue.Valid {
+		t.costValue.Float64 += o.costValue.Float64
+		t.costValue.Valid = true
+	}
+}
+
+// dissolveHierarchy computes the geometry and totals of every quarter and
+// area from the objects in the feature tables, removes quarters and areas
+// without objects and indexes the rest
+func dissolveHierarchy(db *sql.DB, featureTables []string, srsID int32) error {
+	quarters, err := dissolveQuarters(db, featureTables)
+	if err != nil {
+		return err
+	}
+
+	// Areas dissolve the already merged quarters
+	areaOf := map[int]int{}
+	rows, err := db.Query("SELECT code, area_code FROM cadastral_quarters")
+	if err != nil {
+		return fmt.Errorf("failed to read quarters: %w", err)
+	}
+	for rows.Next() {
+		var code, areaCode int
+		if err := rows.Scan(&code, &areaCode); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to read quarters: %w", err)
+		}
+		areaOf[code] = areaCode
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to read quarters: %w", err)
+	}
+
+	areas := map[int]*hierarchyTotals{}
+	areaParts := map[int][]*geom.Polygon{}
+	for code, totals := range quarters {
+		areaCode, ok := areaOf[code]
+		if !ok {
+			continue
+		}
+		area, ok := areas[areaCode]
+		if !ok {
+			area = &hierarchyTotals{}
+			areas[areaCode] = area
+		}
+		area.add(totals)
+		areaParts[areaCode] = append(areaParts[areaCode], geom.Polygons(totals.geometry)...)
+	}
+	for areaCode, area := range areas {
+		area.geometry = geom.Union(areaParts[areaCode])
+	}
+
+	if err := writeHierarchyTotals(db, quartersTable, quarters, srsID); err != nil {
+		return err
+	}
+	if err := writeHierarchyTotals(db, areasTable, areas, srsID); err != nil {
+		return err
+	}
+
+	// Quarters and areas whose objects were all filtered out
+	for _, table := range []string{quartersTable, areasTable} {
+		if _, err := db.Exec(fmt.Sprintf("DELETE FROM %s WHERE object_count = 0", table)); err != nil {
+			return fmt.Errorf("failed to remove empty rows of %s: %w", table, err)
+		}
+		if err := createSpatialIndexTriggers(db, table, "geometry", "code"); err != nil {
+			return err
+		}
+	}
+	_, err = db.Exec(`
+		UPDATE cadastral_areas
+		SET quarter_count = (SELECT count(*) FROM cadastral_quarters q WHERE q.area_code = cadastral_areas.code)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to count quarters of areas: %w", err)
+	}
+
+	log.Printf("Dissolved %d quarters and %d areas", len(quarters), len(areas))
+	return nil
+}
+
+// dissolveQuarters reads the objects of the feature tables grouped by
+// quarter and merges the polygons of each quarter
+func dissolveQuarters(db *sql.DB, featureTables []string) (map[int]*hierarchyTotals, error) {
+	quarters := map[int]*hierarchyTotals{}
+	if len(featureTables) == 0 {
+		return quarters, nil
+	}
+
+	selects := make([]string, len(featureTables))
+	for i, table := range featureTables {
+		selects[i] = fmt.Sprintf("SELECT quarter_code, area, cost_value, geometry FROM %s", table)
+	}
+	rows, err := db.Query(strings.Join(selects, " UNION ALL ") + " ORDER BY quarter_code")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read objects: %w", err)
+	}
+	defer rows.Close()
+
+	var current *hierarchyTotals
+	var parts []*geom.Polygon
+	finish := func() {
+		if current != nil {
+			current.geometry = geom.Union(parts)
+		}
+		parts = nil
+	}
+
+	for rows.Next() {
+		var quarterCode int
+		var area sql.NullInt64
+		var costValue sql.NullFloat64
+		var blob []byte
+		if err := rows.Scan(&quarterCode, &area, &costValue, &blob); err != nil {
+			return nil, fmt.Errorf("failed to read objects: %w", err)
+		}
+
+		if quarters[quarterCode] == nil {
+			finish()
+			current = &hierarchyTotals{}
+			quarters[quarterCode] = current
+		}
+		current.add(&hierarchyTotals{objects: 1, area: area, costValue: costValue})
+
+		g, err := DecodeGPKG(blob)
+		if err != nil {
+			log.Printf("Failed to decode geometry in quarter %d: %v", quarterCode, err)
+			continue
+		}
+		if g.Geometry != nil {
+			parts = append(parts, geom.Polygons(g.Geometry)...)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read objects: %w", err)
+	}
+	finish()
+
+	return quarters, nil
+}
+
+// writeHierarchyTotals stores the dissolved geometries and totals of a
+// hierarchy table and records its extent
+func writeHierarchyTotals(db *sql.DB, table string, totals map[int]*hierarchyTotals, srsID int32) error {
+	stmt, err := db.Prepare(fmt.Sprintf(`
+		UPDATE %s
+		SET object_count = ?, total_area = ?, total_cost_value = ?, geometry = ?
+		WHERE code = ?
+	`, table))
+	if err != nil {
+		return fmt.Errorf("failed to prepare update of %s: %w", table, err)
+	}
+	defer stmt.Close()
+
+	indexStmt, err := db.Prepare(fmt.Sprintf(
+		"INSERT OR REPLACE INTO %s VALUES (?, ?, ?, ?, ?)", rtreeTable(table, "geometry")))
+	if err != nil {
+		return fmt.Errorf("failed to prepare spatial index statement: %w", err)
+	}
+	defer indexStmt.Close()
+
+	// Rows left at zero are removed by dissolveHierarchy
+	if _, err := db.Exec(fmt.Sprintf("UPDATE %s SET object_count = 0", table)); err != nil {
+		return fmt.Errorf("failed to reset totals of %s: %w", table, err)
+	}
+
+	extent := geom.EmptyBounds()
+	for code, t := range totals {
+		geometry := t.geometry
+		blob, err := ConvertGeometryToGPKG(geometry, srsID)
+		if err != nil {
+			return fmt.Errorf("failed to encode geometry of %s %d: %w", table, code, err)
+		}
+
+		if _, err := stmt.Exec(t.objects, getNullableInt64(t.area), getNullableFloat64(t.costValue), blob, code); err != nil {
+			return fmt.Errorf("failed to update %s %d: %w", table, code, err)
+		}
+		if !geometry.IsEmpty() {
+			envelope := CalculateEnvelope(geometry)
+			if _, err := indexStmt.Exec(code, envelope[0], envelope[1], envelope[2], envelope[3]); err != nil {
+				return fmt.Errorf("failed to index %s %d: %w", table, code, err)
+			}
+			extent.Union(geometry.Bounds())
+		}
+	}
+
+	if !extent.IsEmpty() {
+		if err := updateContentsEnvelope(db, table, extent); err != nil {
+			return fmt.Errorf("failed to update envelope: %w", err)
+		}
+	}
+	return updateGeometryColumn(db, table, "MULTIPOLYGON", 0, 0)
+}
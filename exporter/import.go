@@ -0,0 +1,677 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"strings"
+	"time"
+
+	"exporter/crs"
+	"exporter/geom"
+)
+
+// Conflict policies of the import command for objects that differ from
+// the stored SUCCESS row
+const (
+	conflictSkip   = "skip"   // keep the stored object and report the conflict
+	conflictUpdate = "update" // overwrite the stored object
+	conflictNewer  = "newer"  // overwrite it if the imported update_date is later
+)
+
+// geometryTolerance is the largest coordinate difference, in EPSG:3857
+// metres, at which an imported geometry equals the stored one
+const geometryTolerance = 1e-3
+
+// maxVarcharLength is the length of the varchar columns of object
+const maxVarcharLength = 128
+
+// ImportOptions configures the import of a GeoPackage or GeoJSON file
+type ImportOptions struct {
+	Input string
+	// Layer is the GeoPackage table to read; all feature tables but the
+	// quarter and area layers by default
+	Layer string
+	// SourceCRS overrides the CRS declared by the file
+	SourceCRS  *crs.CRS
+	OnConflict string
+	// DryRun rolls the transaction back after reporting
+	DryRun        bool
+	OptionColumns []OptionColumn
+}
+
+// validate checks the conflict policy
+func (o ImportOptions) validate() error {
+	switch o.OnConflict {
+	case conflictSkip, conflictUpdate, conflictNewer:
+		return nil
+	}
+	return fmt.Errorf("unknown conflict policy %q (expected %s, %s or %s)",
+		o.OnConflict, conflictSkip, conflictUpdate, conflictNewer)
+}
+
+// importStats counts the outcome of an import
+type importStats struct {
+	inserted, updated, unchanged, conflicts, invalid int
+}
+
+// ImportData reads the features of opts.Input, converts them to cadastral
+// objects and upserts them with their quarters, areas and regions into
+// PostgreSQL in one transaction. Conflicts with stored rows and features
+// that cannot be imported are reported to w as tab-separated lines.
+func ImportData(pgDB *sql.DB, opts ImportOptions, w io.Writer) error {
+	format, err := importFormat(opts.Input)
+	if err != nil {
+		return err
+	}
+
+	tx, err := pgDB.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	imp := &importer{
+		tx:       tx,
+		opts:     opts,
+		report:   w,
+		names:    map[int]Quarter{},
+		regions:  map[int]bool{},
+		areas:    map[int]int{},
+		quarters: map[int]int{},
+	}
+	fmt.Fprintln(w, "SOURCE\tCAD_NUM\tRESULT\tDETAIL")
+
+	if format == "gpkg" {
+		err = readGeoPackageFeatures(opts.Input, opts.Layer, opts.SourceCRS, imp.names, imp.importFeature)
+	} else {
+		err = readGeoJSONFeatures(opts.Input, format, opts.SourceCRS, imp.importFeature)
+	}
+	if err != nil {
+		return err
+	}
+
+	st := imp.stats
+	log.Printf("Imported %d features: %d inserted, %d updated, %d unchanged, %d conflicts, %d invalid",
+		st.inserted+st.updated+st.unchanged+st.conflicts+st.invalid,
+		st.inserted, st.updated, st.unchanged, st.conflicts, st.invalid)
+
+	if opts.DryRun {
+		log.Printf("Dry run, rolling back")
+		return nil
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit import: %w", err)
+	}
+	return nil
+}
+
+// importer writes converted features to PostgreSQL, caching the parents
+// already checked: regions by code, areas and quarters with their parent
+type importer struct {
+	tx     *sql.Tx
+	opts   ImportOptions
+	report io.Writer
+	stats  importStats
+
+	// names are the quarter, area and region names found in the file
+	names    map[int]Quarter
+	regions  map[int]bool
+	areas    map[int]int
+	quarters map[int]int
+}
+
+// importFeature converts and writes one feature. Only database errors stop
+// the import; invalid features and conflicts are reported.
+func (imp *importer) importFeature(f importedFeature) error {
+	obj, err := objectFromFeature(f, imp.opts.OptionColumns)
+	if err != nil {
+		imp.stats.invalid++
+		imp.reportLine(f.source, cadNumOf(f), "invalid", err.Error())
+		return nil
+	}
+	cadNum := obj.CadNum.String()
+
+	conflict, err := imp.ensureQuarter(obj.CadNum)
+	if err != nil {
+		return err
+	}
+	if conflict != "" {
+		imp.stats.conflicts++
+		imp.reportLine(f.source, cadNum, "conflict", conflict)
+		return nil
+	}
+
+	existing, err := imp.loadObject(obj.Code)
+	if err != nil {
+		return err
+	}
+	if existing == nil {
+		if err := imp.insertObject(obj); err != nil {
+			return err
+		}
+		imp.stats.inserted++
+		return nil
+	}
+
+	if existing.QuarterCode != obj.QuarterCode {
+		imp.stats.conflicts++
+		imp.reportLine(f.source, cadNum, "conflict",
+			fmt.Sprintf("object code %d belongs to quarter %d", obj.Code, existing.QuarterCode))
+		return nil
+	}
+
+	// Objects NSPD has not delivered yet are filled in
+	if existing.LoadStatus != "SUCCESS" || existing.Data == "" {
+		if err := imp.updateObject(obj); err != nil {
+			return err
+		}
+		imp.stats.updated++
+		return nil
+	}
+
+	differences := compareObjects(existing, obj)
+	if len(differences) == 0 {
+		imp.stats.unchanged++
+		return nil
+	}
+	detail := strings.Join(differences, "; ")
+
+	overwrite := imp.opts.OnConflict == conflictUpdate
+	if imp.opts.OnConflict == conflictNewer {
+		overwrite = !existing.UpdateDate.Valid || obj.UpdateDate.Time.After(existing.UpdateDate.Time)
+		if !overwrite {
+			detail += fmt.Sprintf("; stored update_date %s is not older", formatNullDate(existing.UpdateDate))
+		}
+	}
+	if !overwrite {
+		imp.stats.conflicts++
+		imp.reportLine(f.source, cadNum, "conflict", detail)
+		return nil
+	}
+
+	if err := imp.updateObject(obj); err != nil {
+		return err
+	}
+	imp.stats.updated++
+	imp.reportLine(f.source, cadNum, "overwritten", detail)
+	return nil
+}
+
+// reportLine writes one line of the import report
+func (imp *importer) reportLine(source, cadNum, result, detail string) {
+	fmt.Fprintf(imp.report, "%s\t%s\t%s\t%s\n", source, cadNum, result,
+		strings.NewReplacer("\t", " ", "\n", " ").Replace(detail))
+}
+
+// ensureQuarter inserts the region, area and quarter of a cadastral number
+// unless they exist. It returns a conflict if the stored area belongs to
+// another region or the stored quarter to another area.
+func (imp *importer) ensureQuarter(n CadastralNumber) (string, error) {
+	names := imp.names[n.Quarter]
+
+	if !imp.regions[n.Region] {
+		_, err := imp.tx.Exec(`
+			INSERT INTO region (code, name) VALUES ($1, $2)
+			ON CONFLICT (code) DO NOTHING
+		`, n.Region, names.RegionName)
+		if err != nil {
+			return "", fmt.Errorf("failed to insert region %d: %w", n.Region, err)
+		}
+		imp.regions[n.Region] = true
+	}
+
+	region, ok := imp.areas[n.Area]
+	if !ok {
+		err := imp.tx.QueryRow("SELECT region_code FROM area WHERE code = $1", n.Area).Scan(&region)
+		if err == sql.ErrNoRows {
+			region = n.Region
+			_, err = imp.tx.Exec(`
+				INSERT INTO area (code, region_code, name, description) VALUES ($1, $2, $3, $4)
+			`, n.Area, n.Region, names.AreaName, names.AreaDescription)
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to insert area %d: %w", n.Area, err)
+		}
+		imp.areas[n.Area] = region
+	}
+	if region != n.Region {
+		return fmt.Sprintf("area %d belongs to region %d", n.Area, region), nil
+	}
+
+	area, ok := imp.quarters[n.Quarter]
+	if !ok {
+		err := imp.tx.QueryRow("SELECT area_code FROM quarter WHERE code = $1", n.Quarter).Scan(&area)
+		if err == sql.ErrNoRows {
+			area = n.Area
+			_, err = imp.tx.Exec(`
+				INSERT INTO quarter (code, area_code, name, description) VALUES ($1, $2, $3, $4)
+			`, n.Quarter, n.Area, names.Name, names.Description)
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to insert quarter %d: %w", n.Quarter, err)
+		}
+		imp.quarters[n.Quarter] = area
+	}
+	if area != n.Area {
+		return fmt.Sprintf("quarter %d belongs to area %d", n.Quarter, area), nil
+	}
+	return "", nil
+}
+
+// loadObject reads the stored object with the given code, or returns nil
+func (imp *importer) loadObject(code int) (*CadastralObject, error) {
+	var obj CadastralObject
+	var data sql.NullString
+	err := imp.tx.QueryRow(`
+		SELECT
+			o.code,
+			o.quarter_code,
+			COALESCE(o.load_status::text, ''),
+			o.update_date,
+			o.data::text,
+			o.area,
+			o.cost_value,
+			o.permitted_use_established_by_document,
+			o.right_type,
+			o.status,
+			o.land_record_type,
+			o.land_record_subtype,
+			o.land_record_category_type
+		FROM object o
+		WHERE o.code = $1
+	`, code).Scan(
+		&obj.Code,
+		&obj.QuarterCode,
+		&obj.LoadStatus,
+		&obj.UpdateDate,
+		&data,
+		&obj.Area,
+		&obj.CostValue,
+		&obj.PermittedUseEstablishedByDoc,
+		&obj.RightType,
+		&obj.Status,
+		&obj.LandRecordType,
+		&obj.LandRecordSubtype,
+		&obj.LandRecordCategoryType,
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read object %d: %w", code, err)
+	}
+
+	// Stored data that does not decode is treated as missing
+	obj.Data = data.String
+	if obj.Data != "" && decodeObjectData(&obj) != nil {
+		obj.Data = ""
+	}
+	return &obj, nil
+}
+
+// objectValues returns the values of the object columns after code
+func objectValues(obj *CadastralObject) []interface{} {
+	return []interface{}{
+		obj.QuarterCode,
+		obj.LoadStatus,
+		formatUpdateDate(obj.UpdateDate),
+		obj.Data,
+		obj.Area,
+		obj.CostValue,
+		obj.PermittedUseEstablishedByDoc,
+		obj.RightType,
+		obj.Status,
+		obj.LandRecordType,
+		obj.LandRecordSubtype,
+		obj.LandRecordCategoryType,
+	}
+}
+
+// insertObject inserts a new object
+func (imp *importer) insertObject(obj *CadastralObject) error {
+	_, err := imp.tx.Exec(`
+		INSERT INTO object (
+			code, quarter_code, load_status, update_date, data, area, cost_value,
+			permitted_use_established_by_document, right_type, status,
+			land_record_type, land_record_subtype, land_record_category_type
+		) VALUES ($1, $2, $3::object_status, $4::date, $5::jsonb, $6, $7, $8, $9, $10, $11, $12, $13)
+	`, append([]interface{}{obj.Code}, objectValues(obj)...)...)
+	if err != nil {
+		return fmt.Errorf("failed to insert object %s: %w", obj.CadNum, err)
+	}
+	return nil
+}
+
+// updateObject overwrites the stored object with the same code
+func (imp *importer) updateObject(obj *CadastralObject) error {
+	_, err := imp.tx.Exec(`
+		UPDATE object SET
+			quarter_code = $2,
+			load_status = $3::object_status,
+			update_date = $4::date,
+			data = $5::jsonb,
+			area = $6,
+			cost_value = $7,
+			permitted_use_established_by_document = $8,
+			right_type = $9,
+			status = $10,
+			land_record_type = $11,
+			land_record_subtype = $12,
+			land_record_category_type = $13
+		WHERE code = $1
+	`, append([]interface{}{obj.Code}, objectValues(obj)...)...)
+	if err != nil {
+		return fmt.Errorf("failed to update object %s: %w", obj.CadNum, err)
+	}
+	return nil
+}
+
+// compareObjects lists the columns, and the geometry, in which an imported
+// object differs from the stored one
+func compareObjects(stored, imported *CadastralObject) []string {
+	var differences []string
+	compare := func(column string, a, b interface{}) {
+		if fmt.Sprint(a) != fmt.Sprint(b) {
+			differences = append(differences, fmt.Sprintf("%s: %v -> %v", column, a, b))
+		}
+	}
+	compare("area", getNullableInt64(stored.Area), getNullableInt64(imported.Area))
+	compare("cost_value", getNullableFloat64(stored.CostValue), getNullableFloat64(imported.CostValue))
+	compare("permitted_use_established_by_document",
+		getNullableString(stored.PermittedUseEstablishedByDoc), getNullableString(imported.PermittedUseEstablishedByDoc))
+	compare("right_type", getNullableString(stored.RightType), getNullableString(imported.RightType))
+	compare("status", getNullableString(stored.Status), getNullableString(imported.Status))
+	compare("land_record_type", getNullableString(stored.LandRecordType), getNullableString(imported.LandRecordType))
+	compare("land_record_subtype", getNullableString(stored.LandRecordSubtype), getNullableString(imported.LandRecordSubtype))
+	compare("land_record_category_type",
+		getNullableString(stored.LandRecordCategoryType), getNullableString(imported.LandRecordCategoryType))
+
+	if !geometriesEqual(stored.Geometry, imported.Geometry, geometryTolerance) {
+		differences = append(differences, "geometry")
+	}
+	return differences
+}
+
+// geometriesEqual reports whether two geometries have the same type and
+// positions, each ordinate within the tolerance
+func geometriesEqual(a, b geom.Geometry, tolerance float64) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	if a.GeometryType() != b.GeometryType() || a.CoordLayout() != b.CoordLayout() {
+		return false
+	}
+	var pa, pb []float64
+	a.EachPosition(func(p []float64) { pa = append(pa, p...) })
+	b.EachPosition(func(p []float64) { pb = append(pb, p...) })
+	if len(pa) != len(pb) {
+		return false
+	}
+	for i := range pa {
+		if math.Abs(pa[i]-pb[i]) > tolerance {
+			return false
+		}
+	}
+	return true
+}
+
+// cadNumOf returns the cadastral number a feature names, for reports
+func cadNumOf(f importedFeature) string {
+	if s, ok := f.properties["cad_num"].(string); ok {
+		return s
+	}
+	return ""
+}
+
+// objectFromFeature converts an imported feature to a cadastral object.
+// The cadastral number comes from the cad_num property, the cad_num option
+// or a string feature id; object columns from the properties of the same
+// name, falling back to the NSPD options. Data is rebuilt as the NSPD
+// response the Kotlin importer stores, with the geometry in EPSG:3857.
+func objectFromFeature(f importedFeature, optionColumns []OptionColumn) (*CadastralObject, error) {
+	if f.geometryErr != nil {
+		return nil, fmt.Errorf("invalid geometry: %w", f.geometryErr)
+	}
+	if f.geometry == nil || f.geometry.IsEmpty() {
+		return nil, fmt.Errorf("no geometry")
+	}
+
+	options, err := featureOptions(f.properties, optionColumns)
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := featureCadastralNumber(f, options)
+	if err != nil {
+		return nil, err
+	}
+	for column, want := range map[string]int{"code": n.Object, "quarter_code": n.Quarter} {
+		if v, ok := f.properties[column]; ok && v != nil {
+			got, err := parseOptionNumber(v)
+			if err != nil || got != float64(want) {
+				return nil, fmt.Errorf("%s %v does not match cadastral number %s", column, v, n)
+			}
+		}
+	}
+
+	obj := &CadastralObject{
+		CadNum:      n,
+		Code:        n.Object,
+		QuarterCode: n.Quarter,
+		LoadStatus:  "SUCCESS",
+	}
+	if err := fillObjectColumns(obj, f.properties, options); err != nil {
+		return nil, err
+	}
+
+	// Options carry the cadastral number and the object columns, as in
+	// NSPD responses
+	options["cad_num"] = n.String()
+	options["quarter_cad_number"] = n.QuarterNumber()
+	for _, column := range []string{"area", "cost_value", "permitted_use_established_by_document",
+		"right_type", "status", "land_record_type", "land_record_subtype", "land_record_category_type"} {
+		if _, ok := options[column]; ok {
+			continue
+		}
+		if v := objectColumnValue(obj, column); v != nil {
+			options[column] = v
+		}
+	}
+
+	// Remaining properties are the NSPD feature properties
+	properties := map[string]interface{}{}
+	skip := map[string]bool{"fid": true, "nspd_id": true, "options": true}
+	for _, column := range cadastralObjectColumns {
+		skip[column] = true
+	}
+	for _, c := range optionColumns {
+		skip[c.columnName()] = true
+	}
+	for k, v := range f.properties {
+		if !skip[k] {
+			properties[k] = v
+		}
+	}
+	for _, key := range []string{"descr", "label"} {
+		if _, ok := properties[key]; !ok {
+			properties[key] = n.String()
+		}
+	}
+	properties["options"] = options
+
+	// Keep the NSPD feature id; feature ids written by the exporter are
+	// cadastral numbers
+	id := f.properties["nspd_id"]
+	if _, ok := f.id.(float64); ok && id == nil {
+		id = f.id
+	}
+
+	// NSPD names the CRS of its geometries by code rather than by URN
+	transformGeometry(f.geometry, crs.NewTransformer(f.crs, sourceCRS))
+	nspdCRS := map[string]interface{}{
+		"type":       "name",
+		"properties": map[string]interface{}{"name": sourceCRS.String()},
+	}
+	feature := map[string]interface{}{
+		"type":       "Feature",
+		"geometry":   geometryWithCRS{f.geometry, nspdCRS},
+		"properties": properties,
+	}
+	if id != nil {
+		feature["id"] = id
+	}
+	data, err := json.Marshal(map[string]interface{}{
+		"data": map[string]interface{}{
+			"type":     "FeatureCollection",
+			"features": []interface{}{feature},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode data: %w", err)
+	}
+	obj.Data = string(data)
+
+	if err := decodeObjectData(obj); err != nil {
+		return nil, fmt.Errorf("failed to rebuild data: %w", err)
+	}
+	return obj, nil
+}
+
+// featureOptions returns the NSPD options of a feature: its options
+// property, an object or a JSON string, completed with the mapped option
+// columns it has
+func featureOptions(properties map[string]interface{}, optionColumns []OptionColumn) (map[string]interface{}, error) {
+	options := map[string]interface{}{}
+	switch v := properties["options"].(type) {
+	case map[string]interface{}:
+		for k, value := range v {
+			options[k] = value
+		}
+	case string:
+		if err := json.Unmarshal([]byte(v), &options); err != nil {
+			return nil, fmt.Errorf("invalid options: %w", err)
+		}
+	}
+
+	for _, c := range optionColumns {
+		v, ok := properties[c.columnName()]
+		if _, exists := options[c.Option]; exists || !ok || v == nil {
+			continue
+		}
+		if b, ok := v.([]byte); ok {
+			v = string(b)
+		}
+		options[c.Option] = v
+	}
+	return options, nil
+}
+
+// featureCadastralNumber finds and parses the cadastral number of a feature
+func featureCadastralNumber(f importedFeature, options map[string]interface{}) (CadastralNumber, error) {
+	for _, v := range []interface{}{f.properties["cad_num"], options["cad_num"], f.id} {
+		if s, ok := v.(string); ok && s != "" {
+			return ParseCadastralNumber(s)
+		}
+	}
+	return CadastralNumber{}, fmt.Errorf("no cadastral number (cad_num property or option)")
+}
+
+// fillObjectColumns sets the object columns from the properties, falling
+// back to the options. The area falls back to the declared and specified
+// areas like in the Kotlin importer; update_date defaults to today, the day
+// the data was received.
+func fillObjectColumns(obj *CadastralObject, properties, options map[string]interface{}) error {
+	field := func(key, columnType string) (interface{}, error) {
+		c := OptionColumn{Option: key, Type: columnType}
+		v, err := c.value(properties)
+		if v == nil && err == nil {
+			v, err = c.value(options)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", key, err)
+		}
+		return v, nil
+	}
+
+	for _, key := range []string{"area", "declared_area", "specified_area"} {
+		v, err := field(key, "REAL")
+		if err != nil {
+			return err
+		}
+		if v != nil {
+			area := math.Round(v.(float64))
+			if area < 0 || area > math.MaxInt32 {
+				return fmt.Errorf("invalid %s: %v is out of range", key, v)
+			}
+			obj.Area = sql.NullInt64{Int64: int64(area), Valid: true}
+			break
+		}
+	}
+
+	v, err := field("cost_value", "REAL")
+	if err != nil {
+		return err
+	}
+	if v != nil {
+		obj.CostValue = sql.NullFloat64{Float64: v.(float64), Valid: true}
+	}
+
+	for key, dest := range map[string]*sql.NullString{
+		"permitted_use_established_by_document": &obj.PermittedUseEstablishedByDoc,
+		"right_type":                            &obj.RightType,
+		"status":                                &obj.Status,
+		"land_record_type":                      &obj.LandRecordType,
+		"land_record_subtype":                   &obj.LandRecordSubtype,
+		"land_record_category_type":             &obj.LandRecordCategoryType,
+	} {
+		v, err := field(key, "TEXT")
+		if err != nil {
+			return err
+		}
+		if v == nil {
+			continue
+		}
+		s := v.(string)
+		if len([]rune(s)) > maxVarcharLength {
+			return fmt.Errorf("%s is longer than %d characters", key, maxVarcharLength)
+		}
+		*dest = sql.NullString{String: s, Valid: true}
+	}
+
+	// Only the properties carry the update date; options have their own dates
+	date := time.Now()
+	if v, err := (OptionColumn{Option: "update_date", Type: "DATE"}).value(properties); err != nil {
+		return fmt.Errorf("invalid update_date: %w", err)
+	} else if v != nil {
+		date, _ = time.Parse("2006-01-02", v.(string))
+	}
+	obj.UpdateDate = sql.NullTime{Time: time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, time.UTC), Valid: true}
+	return nil
+}
+
+// objectColumnValue returns the value of an object column, nil if NULL
+func objectColumnValue(obj *CadastralObject, column string) interface{} {
+	switch column {
+	case "area":
+		return getNullableInt64(obj.Area)
+	case "cost_value":
+		return getNullableFloat64(obj.CostValue)
+	case "permitted_use_established_by_document":
+		return getNullableString(obj.PermittedUseEstablishedByDoc)
+	case "right_type":
+		return getNullableString(obj.RightType)
+	case "status":
+		return getNullableString(obj.Status)
+	case "land_record_type":
+		return getNullableString(obj.LandRecordType)
+	case "land_record_subtype":
+		return getNullableString(obj.LandRecordSubtype)
+	case "land_record_category_type":
+		return getNullableString(obj.LandRecordCategoryType)
+	}
+	return nil
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"exporter/crs"
+	"exporter/geom"
+)
+
+// importedFeature is a feature read from an import file, with its
+// properties or columns and its geometry in the file's CRS
+type importedFeature struct {
+	// source locates the feature in the file for reports, e.g.
+	// "cadastral_objects:12" or "feature 3"
+	source     string
+	id         interface{}
+	properties map[string]interface{}
+	geometry   geom.Geometry
+	// geometryErr is why the geometry could not be decoded
+	geometryErr error
+	crs         *crs.CRS
+}
+
+// importFormat returns the input format of a file from its extension:
+// gpkg, geojson (a FeatureCollection) or geojsonseq (one feature per line,
+// optionally prefixed with the RS character)
+func importFormat(path string) (string, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".gpkg":
+		return "gpkg", nil
+	case ".geojson", ".json":
+		return formatGeoJSON, nil
+	case ".geojsons", ".geojsonl", ".ndjson", ".jsonl":
+		return formatGeoJSONSeq, nil
+	}
+	return "", fmt.Errorf("unknown input format of %s (expected .gpkg, .geojson, .geojsons or .ndjson)", path)
+}
+
+// readGeoPackageFeatures calls fn for every feature of the given table, or
+// of every feature table except the quarter and area layers. Geometries are
+// in the CRS of their table's srs_id unless override is set. Before the
+// first feature it adds the quarters of a cadastral_quarters layer, as
+// written by the exporter, to quarters.
+func readGeoPackageFeatures(path, layer string, override *crs.CRS, quarters map[int]Quarter, fn func(importedFeature) error) error {
+	db, err := OpenGeoPackageReadOnly(path)
+	if err != nil {
+		return err
+	}
+	defer CloseDB(db)
+
+	if err := readGeoPackageQuarters(db, quarters); err != nil {
+		return err
+	}
+
+	rows, err := db.Query(`
+		SELECT table_name, column_name, srs_id FROM gpkg_geometry_columns
+		WHERE (? = '' AND table_name NOT IN (?, ?)) OR table_name = ?
+		ORDER BY table_name
+	`, layer, quartersTable, areasTable, layer)
+	if err != nil {
+		return fmt.Errorf("failed to read feature tables: %w", err)
+	}
+	type featureTable struct {
+		table, column string
+		srsID         int
+	}
+	var tables []featureTable
+	for rows.Next() {
+		var t featureTable
+		if err := rows.Scan(&t.table, &t.column, &t.srsID); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to read feature tables: %w", err)
+		}
+		tables = append(tables, t)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to read feature tables: %w", err)
+	}
+	if len(tables) == 0 {
+		if layer != "" {
+			return fmt.Errorf("no feature table %s", layer)
+		}
+		return fmt.Errorf("no feature tables")
+	}
+
+	for _, t := range tables {
+		tableCRS := override
+		if tableCRS == nil {
+			if tableCRS, err = crs.Lookup(fmt.Sprint(t.srsID)); err != nil {
+				return fmt.Errorf("table %s has an unknown srs_id %d, set -source-crs: %w", t.table, t.srsID, err)
+			}
+		}
+		err := readTableRows(db, t.table, func(id int64, values map[string]interface{}) error {
+			blob, _ := values[t.column].([]byte)
+			delete(values, t.column)
+			f := importedFeature{
+				source:     fmt.Sprintf("%s:%d", t.table, id),
+				properties: values,
+				crs:        tableCRS,
+			}
+			if blob != nil {
+				g, err := DecodeGPKG(blob)
+				if err != nil {
+					f.geometryErr = err
+				} else {
+					f.geometry = g.Geometry
+				}
+			}
+			return fn(f)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readTableRows calls fn with the rowid and the column values of every row
+// of a table. Dates and times become strings, blobs stay []byte.
+func readTableRows(db *sql.DB, table string, fn func(id int64, values map[string]interface{}) error) error {
+	rows, err := db.Query(fmt.Sprintf(`SELECT rowid, * FROM "%s"`, table))
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", table, err)
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", table, err)
+	}
+	for rows.Next() {
+		raw := make([]interface{}, len(columns))
+		dest := make([]interface{}, len(columns))
+		for i := range raw {
+			dest[i] = &raw[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return fmt.Errorf("failed to read %s: %w", table, err)
+		}
+
+		id, _ := raw[0].(int64)
+		values := map[string]interface{}{}
+		for i, column := range columns[1:] {
+			switch v := raw[i+1].(type) {
+			case time.Time:
+				if v.Hour() == 0 && v.Minute() == 0 && v.Second() == 0 && v.Nanosecond() == 0 {
+					values[column] = v.Format("2006-01-02")
+				} else {
+					values[column] = v.UTC().Format(time.RFC3339)
+				}
+			default:
+				values[column] = v
+			}
+		}
+		if err := fn(id, values); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// readGeoPackageQuarters adds the quarters, with the names of their areas
+// and regions, of a GeoPackage written by the exporter; other files have none
+func readGeoPackageQuarters(db *sql.DB, quarters map[int]Quarter) error {
+	exists, err := tableExists(db, quartersTable)
+	if err != nil || !exists {
+		return err
+	}
+
+	rows, err := db.Query(fmt.Sprintf(`
+		SELECT q.code, COALESCE(q.name, ''), COALESCE(q.description, ''), q.area_code,
+			COALESCE(q.area_name, ''), COALESCE(a.description, ''), q.region_code, COALESCE(q.region_name, '')
+		FROM %s q
+		LEFT JOIN %s a ON a.code = q.area_code
+	`, quartersTable, areasTable))
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", quartersTable, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var q Quarter
+		if err := rows.Scan(&q.Code, &q.Name, &q.Description, &q.AreaCode,
+			&q.AreaName, &q.AreaDescription, &q.RegionCode, &q.RegionName); err != nil {
+			return fmt.Errorf("failed to read %s: %w", quartersTable, err)
+		}
+		quarters[q.Code] = q
+	}
+	return rows.Err()
+}
+
+// geoJSONFeature is a GeoJSON feature with the geometry left raw, so that
+// its crs member can be read as well
+type geoJSONFeature struct {
+	Type       string                 `json:"type"`
+	ID         interface{}            `json:"id"`
+	Geometry   json.RawMessage        `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+// legacyCRSMember is the crs member of pre-RFC 7946 GeoJSON
+type legacyCRSMember struct {
+	Properties struct {
+		Name string `json:"name"`
+	} `json:"properties"`
+}
+
+// readGeoJSONFeatures calls fn for every feature of a GeoJSON
+// FeatureCollection or GeoJSON text sequence. Coordinates are in the crs
+// member of the geometry or collection, WGS 84 without one, unless
+// override is set.
+func readGeoJSONFeatures(path, format string, override *crs.CRS, fn func(importedFeature) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open GeoJSON: %w", err)
+	}
+	defer file.Close()
+
+	collectionCRS := crs.WGS84
+
+	if format == formatGeoJSON {
+		var collection struct {
+			Type     string            `json:"type"`
+			CRS      *legacyCRSMember  `json:"crs"`
+			Features []json.RawMessage `json:"features"`
+		}
+		if err := json.NewDecoder(bufio.NewReader(file)).Decode(&collection); err != nil {
+			return fmt.Errorf("failed to parse GeoJSON: %w", err)
+		}
+		if collection.Type != "FeatureCollection" {
+			return fmt.Errorf("expected a FeatureCollection, got %q", collection.Type)
+		}
+		if collection.CRS != nil && override == nil {
+			if collectionCRS, err = lookupLegacyCRS(collection.CRS.Properties.Name); err != nil {
+				return err
+			}
+		}
+		for i, data := range collection.Features {
+			f, err := decodeGeoJSONFeature(data, fmt.Sprintf("feature %d", i+1), collectionCRS, override)
+			if err != nil {
+				return err
+			}
+			if err := fn(f); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 1024*1024), 256*1024*1024)
+	var line int
+	for scanner.Scan() {
+		line++
+		data := bytes.TrimSpace(bytes.TrimPrefix(scanner.Bytes(), []byte{0x1e}))
+		if len(data) == 0 {
+			continue
+		}
+		f, err := decodeGeoJSONFeature(data, fmt.Sprintf("line %d", line), collectionCRS, override)
+		if err != nil {
+			return err
+		}
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read GeoJSON: %w", err)
+	}
+	return nil
+}
+
+// decodeGeoJSONFeature decodes one feature; a crs member on its geometry
+// takes precedence over the CRS of the collection, override over both
+func decodeGeoJSONFeature(data []byte, source string, collectionCRS, override *crs.CRS) (importedFeature, error) {
+	var feature geoJSONFeature
+	if err := json.Unmarshal(data, &feature); err != nil {
+		return importedFeature{}, fmt.Errorf("failed to parse %s: %w", source, err)
+	}
+	f := importedFeature{
+		source:     source,
+		id:         feature.ID,
+		properties: feature.Properties,
+		crs:        collectionCRS,
+	}
+	if f.properties == nil {
+		f.properties = map[string]interface{}{}
+	}
+	if len(feature.Geometry) == 0 || string(feature.Geometry) == "null" {
+		return f, nil
+	}
+
+	var member struct {
+		CRS *legacyCRSMember `json:"crs"`
+	}
+	if override != nil {
+		f.crs = override
+	} else if err := json.Unmarshal(feature.Geometry, &member); err == nil && member.CRS != nil {
+		c, err := lookupLegacyCRS(member.CRS.Properties.Name)
+		if err != nil {
+			return importedFeature{}, fmt.Errorf("%s: %w", source, err)
+		}
+		f.crs = c
+	}
+
+	// An undecodable geometry is reported with the feature
+	f.geometry, f.geometryErr = geom.UnmarshalGeoJSON(feature.Geometry)
+	return f, nil
+}
+
+// lookupLegacyCRS resolves the name of a legacy crs member, e.g.
+// urn:ogc:def:crs:EPSG::3857, EPSG:3857 or urn:ogc:def:crs:OGC:1.3:CRS84.
+// URNs are looked up by organization and code, which also resolves the
+// urn:ogc:def:crs:MSK-16::1 form the exporter writes for МСК-16.
+func lookupLegacyCRS(name string) (*crs.CRS, error) {
+	if strings.HasSuffix(strings.ToUpper(name), "CRS84") {
+		return crs.WGS84, nil
+	}
+	key := name
+	for _, prefix := range []string{"urn:ogc:def:crs:", "urn:x-ogc:def:crs:"} {
+		if len(name) > len(prefix) && strings.EqualFold(name[:len(prefix)], prefix) {
+			// <organization>:<version>:<code>, the version usually empty
+			parts := strings.Split(name[len(prefix):], ":")
+			key = parts[0] + ":" + parts[len(parts)-1]
+		}
+	}
+	c, err := crs.Lookup(key)
+	if err != nil {
+		return nil, fmt.Errorf("unknown crs member %q", name)
+	}
+	return c, nil
+}
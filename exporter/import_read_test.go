@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+
+	"exporter/crs"
+)
+
+func TestLookupLegacyCRS(t *testing.T) {
+	tests := []struct {
+		name string
+		want *crs.CRS
+	}{
+		{"urn:ogc:def:crs:OGC:1.3:CRS84", crs.WGS84},
+		{"urn:ogc:def:crs:EPSG::3857", crs.WebMercator},
+		{"urn:ogc:def:crs:EPSG:6.6:3857", crs.WebMercator},
+		{"urn:x-ogc:def:crs:EPSG:28409", crs.Pulkovo1942GK9},
+		{"EPSG:32639", crs.UTM39N},
+		{"urn:ogc:def:crs:MSK-16::1", crs.MSK16Z1},
+		{"URN:OGC:DEF:CRS:MSK-16::2", crs.MSK16Z2},
+	}
+	for _, tt := range tests {
+		got, err := lookupLegacyCRS(tt.name)
+		if err != nil || got != tt.want {
+			t.Errorf("%s: got %v, %v, want %v", tt.name, got, err, tt.want)
+		}
+	}
+
+	// Every system resolves from the URN the GeoJSON exporter writes
+	for _, c := range crs.All() {
+		if got, err := lookupLegacyCRS(c.URN()); err != nil || got != c {
+			t.Errorf("%s: got %v, %v", c.URN(), got, err)
+		}
+	}
+
+	for _, name := range []string{"urn:ogc:def:crs:EPSG::1", "urn:ogc:def:crs:MSK-16::3", "EPSG:9999"} {
+		if got, err := lookupLegacyCRS(name); err == nil {
+			t.Errorf("%s: got %v, want an error", name, got)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"html"
+	"io"
+	"strconv"
+	"strings"
+
+	"exporter/geom"
+)
+
+// kmlColor is a colour as RGB hex, e.g. "2e7d32"
+type kmlColor string
+
+// kml returns the colour in the KML aabbggrr notation with the given alpha
+func (c kmlColor) kml(alpha string) string {
+	s := string(c)
+	return alpha + s[4:6] + s[2:4] + s[0:2]
+}
+
+// kmlStatusColors colour the parcels by status
+var kmlStatusColors = []kmlStyleRule{
+	{"Учтенный", "2e7d32"},
+	{"Ранее учтенный", "1565c0"},
+	{"Временный", "ef6c00"},
+	{"Архивный", "757575"},
+	{"Аннулированный", "c62828"},
+	{"Снят с учета", "424242"},
+}
+
+// kmlCategoryColors colour the parcels by land category, following the
+// usual colours of cadastral maps; values match by prefix because the
+// category names are long
+var kmlCategoryColors = []kmlStyleRule{
+	{"Земли населенных пунктов", "e57373"},
+	{"Земли сельскохозяйственного назначения", "c0ca33"},
+	{"Земли промышленности", "8e24aa"},
+	{"Земли особо охраняемых территорий", "00897b"},
+	{"Земли лесного фонда", "1b5e20"},
+	{"Земли водного фонда", "1e88e5"},
+	{"Земли запаса", "8d6e63"},
+	{"Категория не установлена", "9e9e9e"},
+}
+
+// kmlFallbackColors colour values without a rule, picked by a hash of the
+// value so that a value keeps its colour across exports
+var kmlFallbackColors = []kmlColor{
+	"d81b60", "5e35b1", "039be5", "43a047", "fdd835", "fb8c00", "6d4c41", "00acc1",
+}
+
+// kmlNullColor colours parcels without a value
+const kmlNullColor kmlColor = "bdbdbd"
+
+// kmlStyleRule assigns a colour to the values starting with a prefix
+type kmlStyleRule struct {
+	prefix string
+	color  kmlColor
+}
+
+// kmlStyleColor returns the colour of a value of the style column
+func kmlStyleColor(rules []kmlStyleRule, value string) kmlColor {
+	if value == "" {
+		return kmlNullColor
+	}
+	for _, r := range rules {
+		if strings.HasPrefix(value, r.prefix) {
+			return r.color
+		}
+	}
+	h := fnv.New32a()
+	h.Write([]byte(value))
+	return kmlFallbackColors[h.Sum32()%uint32(len(kmlFallbackColors))]
+}
+
+// writeKMLStyle writes a shared style with a translucent fill and a solid
+// outline in the colour, used by every placemark of one value. The balloon
+// shows the name and the description without the default directions links.
+func writeKMLStyle(w io.Writer, id string, color kmlColor) {
+	fmt.Fprintf(w, "<Style id=\"%s\"><LineStyle><color>%s</color><width>1.5</width></LineStyle>"+
+		"<PolyStyle><color>%s</color></PolyStyle>"+
+		"<BalloonStyle><text><![CDATA[<h3>$[name]</h3>$[description]]]></text></BalloonStyle></Style>\n",
+		id, color.kml("ff"), color.kml("66"))
+}
+
+// kmlEscape escapes text for XML character data and attributes
+func kmlEscape(s string) string {
+	return html.EscapeString(s)
+}
+
+// appendKMLGeometry appends a geometry as KML. Coordinates are longitude
+// and latitude; Z values are dropped since parcels are clamped to the
+// ground, and multi-part geometries become a MultiGeometry.
+func appendKMLGeometry(buf []byte, g geom.Geometry) []byte {
+	stride := g.CoordLayout().Stride()
+	switch g := g.(type) {
+	case *geom.Point:
+		buf = append(buf, "<Point><coordinates>"...)
+		buf = appendKMLCoordinates(buf, g.Coords, stride)
+		return append(buf, "</coordinates></Point>"...)
+	case *geom.LineString:
+		buf = append(buf, "<LineString><coordinates>"...)
+		buf = appendKMLCoordinates(buf, g.Coords, stride)
+		return append(buf, "</coordinates></LineString>"...)
+	case *geom.Polygon:
+		return appendKMLPolygon(buf, g.Rings, stride)
+	case *geom.MultiPoint:
+		buf = append(buf, "<MultiGeometry>"...)
+		for i := 0; i+stride <= len(g.Coords); i += stride {
+			buf = append(buf, "<Point><coordinates>"...)
+			buf = appendKMLCoordinates(buf, g.Coords[i:i+stride], stride)
+			buf = append(buf, "</coordinates></Point>"...)
+		}
+		return append(buf, "</MultiGeometry>"...)
+	case *geom.MultiLineString:
+		buf = append(buf, "<MultiGeometry>"...)
+		for _, line := range g.Lines {
+			buf = append(buf, "<LineString><coordinates>"...)
+			buf = appendKMLCoordinates(buf, line, stride)
+			buf = append(buf, "</coordinates></LineString>"...)
+		}
+		return append(buf, "</MultiGeometry>"...)
+	case *geom.MultiPolygon:
+		buf = append(buf, "<MultiGeometry>"...)
+		for _, polygon := range g.Polygons {
+			buf = appendKMLPolygon(buf, polygon, stride)
+		}
+		return append(buf, "</MultiGeometry>"...)
+	case *geom.GeometryCollection:
+		buf = append(buf, "<MultiGeometry>"...)
+		for _, member := range g.Geometries {
+			buf = appendKMLGeometry(buf, member)
+		}
+		return append(buf, "</MultiGeometry>"...)
+	}
+	return buf
+}
+
+// appendKMLPolygon appends a polygon: the first ring is the outer boundary
+// and the others are holes
+func appendKMLPolygon(buf []byte, rings [][]float64, stride int) []byte {
+	buf = append(buf, "<Polygon>"...)
+	for i, ring := range rings {
+		boundary := "innerBoundaryIs"
+		if i == 0 {
+			boundary = "outerBoundaryIs"
+		}
+		buf = append(buf, "<"+boundary+"><LinearRing><coordinates>"...)
+		buf = appendKMLCoordinates(buf, ring, stride)
+		buf = append(buf, "</coordinates></LinearRing></"+boundary+">"...)
+	}
+	return append(buf, "</Polygon>"...)
+}
+
+// appendKMLCoordinates appends space-separated lon,lat tuples rounded to
+// 7 decimals, about 1 cm
+func appendKMLCoordinates(buf []byte, coords []float64, stride int) []byte {
+	for i := 0; i+1 < len(coords); i += stride {
+		if i > 0 {
+			buf = append(buf, ' ')
+		}
+		buf = strconv.AppendFloat(buf, coords[i], 'f', 7, 64)
+		buf = append(buf, ',')
+		buf = strconv.AppendFloat(buf, coords[i+1], 'f', 7, 64)
+	}
+	return buf
+}
@@ -1,53 +1,57 @@
 package main
 
 import (
-	"flag"
+	"fmt"
 	"log"
+	"os"
 )
 
-func main() {
-	var (
-		pgHost     = flag.String("pg-host", "localhost", "PostgreSQL host")
-		pgPort     = flag.Int("pg-port", 5432, "PostgreSQL port")
-		pgUser     = flag.String("pg-user", "postgres", "PostgreSQL user")
-		pgPassword = flag.String("pg-password", "postgres", "PostgreSQL password")
-		pgDB       = flag.String("pg-db", "postgres", "PostgreSQL database name")
-		outputFile = flag.String("output", "cadastral.gpkg", "Output GeoPackage file path")
-	)
-	flag.Parse()
-
-	cfg := Config{
-		PostgresHost:     *pgHost,
-		PostgresPort:     *pgPort,
-		PostgresUser:     *pgUser,
-		PostgresPassword: *pgPassword,
-		PostgresDB:       *pgDB,
-		OutputFile:       *outputFile,
-	}
+// version is the exporter version, set at build time with
+// -ldflags "-X main.version=<version>"
+var version = "dev"
 
-	// Connect to PostgreSQL
-	pgDBConn, err := ConnectPostgreSQL(cfg)
-	if err != nil {
-		log.Fatalf("Failed to connect to PostgreSQL: %v", err)
-	}
-	defer CloseDB(pgDBConn)
+const usageText = `Usage: gisdb <command> [flags]
 
-	// Create GeoPackage
-	gpkgDB, err := CreateGeoPackage(cfg.OutputFile)
-	if err != nil {
-		log.Fatalf("Failed to create GeoPackage: %v", err)
-	}
-	defer CloseDB(gpkgDB)
+Commands:
+  export gpkg      Export cadastral objects to a GeoPackage file
+  export geojson   Export cadastral objects to GeoJSON
+  export shapefile Export cadastral objects to ESRI Shapefiles
+  export parquet   Export cadastral objects to GeoParquet
+  export kml       Export cadastral objects to KML or KMZ for Google Earth
+  export tiles     Cut cadastral objects into vector tiles (MBTiles or PMTiles)
+  import           Import cadastral objects from GeoPackage or GeoJSON into PostgreSQL
+  stats            Print statistics about cadastral objects in PostgreSQL
+  validate         Check that every exported object has a convertible geometry
+  validate gpkg    Check GeoPackage files for conformance, printing a JSON report
+
+Run "gisdb <command> -h" for command flags.
+`
 
-	// Initialize GeoPackage structure
-	if err := InitGeoPackage(gpkgDB); err != nil {
-		log.Fatalf("Failed to initialize GeoPackage: %v", err)
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usageText)
+		os.Exit(2)
 	}
 
-	// Export data
-	if err := ExportData(pgDBConn, gpkgDB); err != nil {
-		log.Fatalf("Failed to export data: %v", err)
+	var err error
+	switch os.Args[1] {
+	case "export":
+		err = runExport(os.Args[2:])
+	case "import":
+		err = runImport(os.Args[2:])
+	case "stats":
+		err = runStats(os.Args[2:])
+	case "validate":
+		err = runValidate(os.Args[2:])
+	case "help", "-h", "-help", "--help":
+		fmt.Print(usageText)
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n%s", os.Args[1], usageText)
+		os.Exit(2)
 	}
 
-	log.Printf("Successfully exported data to %s", cfg.OutputFile)
+	if err != nil {
+		log.Fatalf("%s failed: %v", os.Args[1], err)
+	}
 }
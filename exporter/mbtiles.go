@@ -0,0 +1,122 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// tilesetMetadata describes a tileset for the MBTiles metadata table and
+// the PMTiles metadata
+type tilesetMetadata struct {
+	Name        string
+	Description string
+	MinZoom     int
+	MaxZoom     int
+	// Bounds are the minimum longitude and latitude and the maximum
+	// longitude and latitude
+	Bounds [4]float64
+	Layers []vectorLayer
+}
+
+// vectorLayer is an entry of the vector_layers metadata, which lists the
+// layers and attribute types of vector tiles
+type vectorLayer struct {
+	ID          string            `json:"id"`
+	Description string            `json:"description,omitempty"`
+	MinZoom     int               `json:"minzoom"`
+	MaxZoom     int               `json:"maxzoom"`
+	Fields      map[string]string `json:"fields"`
+}
+
+// mbtilesWriter writes tiles to an MBTiles 1.3 SQLite database in a
+// single transaction
+type mbtilesWriter struct {
+	db   *sql.DB
+	tx   *sql.Tx
+	stmt *sql.Stmt
+}
+
+// createMBTiles creates an MBTiles file, replacing an existing one, and
+// writes its metadata
+func createMBTiles(path string, meta tilesetMetadata) (*mbtilesWriter, error) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to remove existing file: %w", err)
+	}
+	db, err := sql.Open(gpkgDriver, path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create MBTiles: %w", err)
+	}
+
+	m := &mbtilesWriter{db: db}
+	if err := m.init(meta); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+// init creates the tables, writes the metadata and starts the transaction
+// the tiles are inserted in
+func (m *mbtilesWriter) init(meta tilesetMetadata) error {
+	_, err := m.db.Exec(`
+		CREATE TABLE metadata (name TEXT, value TEXT);
+		CREATE TABLE tiles (zoom_level INTEGER, tile_column INTEGER, tile_row INTEGER, tile_data BLOB);
+		CREATE UNIQUE INDEX tile_index ON tiles (zoom_level, tile_column, tile_row);
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create MBTiles tables: %w", err)
+	}
+
+	layers, err := json.Marshal(map[string]interface{}{"vector_layers": meta.Layers})
+	if err != nil {
+		return fmt.Errorf("failed to encode metadata: %w", err)
+	}
+	b := meta.Bounds
+	format := func(v float64) string { return strconv.FormatFloat(v, 'f', -1, 64) }
+	for _, row := range [][2]string{
+		{"name", meta.Name},
+		{"description", meta.Description},
+		{"format", "pbf"},
+		{"type", "overlay"},
+		{"minzoom", strconv.Itoa(meta.MinZoom)},
+		{"maxzoom", strconv.Itoa(meta.MaxZoom)},
+		{"bounds", format(b[0]) + "," + format(b[1]) + "," + format(b[2]) + "," + format(b[3])},
+		{"center", format((b[0]+b[2])/2) + "," + format((b[1]+b[3])/2) + "," + strconv.Itoa(meta.MinZoom)},
+		{"json", string(layers)},
+	} {
+		if _, err := m.db.Exec(`INSERT INTO metadata (name, value) VALUES (?, ?)`, row[0], row[1]); err != nil {
+			return fmt.Errorf("failed to write metadata: %w", err)
+		}
+	}
+
+	if m.tx, err = m.db.Begin(); err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	m.stmt, err = m.tx.Prepare(`INSERT INTO tiles (zoom_level, tile_column, tile_row, tile_data) VALUES (?, ?, ?, ?)`)
+	if err != nil {
+		m.tx.Rollback()
+		return fmt.Errorf("failed to prepare tile insert: %w", err)
+	}
+	return nil
+}
+
+// WriteTile inserts a tile; MBTiles rows count from the south (TMS)
+func (m *mbtilesWriter) WriteTile(z, x, y int, data []byte) error {
+	if _, err := m.stmt.Exec(z, x, 1<<z-1-y, data); err != nil {
+		return fmt.Errorf("failed to insert tile %d/%d/%d: %w", z, x, y, err)
+	}
+	return nil
+}
+
+// Close commits the tiles and closes the database
+func (m *mbtilesWriter) Close() error {
+	defer CloseDB(m.db)
+	m.stmt.Close()
+	if err := m.tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit tiles: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"database/sql"
+	"encoding/xml"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+
+	"exporter/crs"
+)
+
+// iso19139URI is the md_standard_uri of the ISO 19115 records written to
+// gpkg_metadata, encoded as ISO 19139 XML
+const iso19139URI = "http://schemas.opengis.net/iso/19139/"
+
+// ExportMetadata is the provenance of one export, recorded in gpkg_metadata
+type ExportMetadata struct {
+	// Source names the PostgreSQL database, without credentials
+	Source string
+	// Filter describes the filter flags of the export
+	Filter    string
+	Mode      string
+	Version   string
+	Timestamp time.Time
+	CRS       *crs.CRS
+	// Stats are the counts of the filtered objects by load_status
+	Stats []LoadStatusStats
+}
+
+// updateDateRange returns the update dates of the first and last exportable
+// object, the period in which the exported NSPD data was fetched
+func (m ExportMetadata) updateDateRange() (first, last sql.NullTime) {
+	for _, st := range m.Stats {
+		if st.Status == "SUCCESS" {
+			return st.FirstUpdate, st.LastUpdate
+		}
+	}
+	return sql.NullTime{}, sql.NullTime{}
+}
+
+// createMetadataTables creates the tables of the GeoPackage Metadata
+// extension and registers the extension
+func createMetadataTables(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS gpkg_metadata (
+			id INTEGER CONSTRAINT m_pk PRIMARY KEY ASC NOT NULL,
+			md_scope TEXT NOT NULL DEFAULT 'dataset',
+			md_standard_uri TEXT NOT NULL,
+			mime_type TEXT NOT NULL DEFAULT 'text/xml',
+			metadata TEXT NOT NULL DEFAULT ''
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create gpkg_metadata: %w", err)
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS gpkg_metadata_reference (
+			reference_scope TEXT NOT NULL,
+			table_name TEXT,
+			column_name TEXT,
+			row_id_value INTEGER,
+			timestamp DATETIME NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ','now')),
+			md_file_id INTEGER NOT NULL,
+			md_parent_id INTEGER,
+			CONSTRAINT crmr_mfi_fk FOREIGN KEY (md_file_id) REFERENCES gpkg_metadata(id),
+			CONSTRAINT crmr_mpi_fk FOREIGN KEY (md_parent_id) REFERENCES gpkg_metadata(id)
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create gpkg_metadata_reference: %w", err)
+	}
+
+	for _, table := range []string{"gpkg_metadata", "gpkg_metadata_reference"} {
+		if err := registerTableExtension(db, table, "gpkg_metadata",
+			"http://www.geopackage.org/spec/#extension_metadata", "read-write"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeExportMetadata adds the provenance record of an export to
+// gpkg_metadata and references it for the whole GeoPackage. Every export
+// adds a record; one made by an append or upsert has the record of the
+// previous export as its parent.
+func writeExportMetadata(db *sql.DB, m ExportMetadata) error {
+	record, err := m.iso19139()
+	if err != nil {
+		return err
+	}
+
+	var parent sql.NullInt64
+	if err := db.QueryRow(
+		"SELECT max(md_file_id) FROM gpkg_metadata_reference WHERE reference_scope = 'geopackage'",
+	).Scan(&parent); err != nil {
+		return fmt.Errorf("failed to read previous metadata: %w", err)
+	}
+
+	result, err := db.Exec(`
+		INSERT INTO gpkg_metadata (md_scope, md_standard_uri, mime_type, metadata)
+		VALUES ('dataset', ?, 'text/xml', ?)
+	`, iso19139URI, record)
+	if err != nil {
+		return fmt.Errorf("failed to write metadata: %w", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("failed to write metadata: %w", err)
+	}
+
+	_, err = db.Exec(`
+		INSERT INTO gpkg_metadata_reference (reference_scope, timestamp, md_file_id, md_parent_id)
+		VALUES ('geopackage', ?, ?, ?)
+	`, m.Timestamp.UTC().Format("2006-01-02T15:04:05.000Z"), id, parent)
+	if err != nil {
+		return fmt.Errorf("failed to write metadata reference: %w", err)
+	}
+	return nil
+}
+
+// iso19139 renders the record as ISO 19139 XML
+func (m ExportMetadata) iso19139() (string, error) {
+	first, last := m.updateDateRange()
+	var counts []string
+	for _, st := range m.Stats {
+		counts = append(counts, fmt.Sprintf("%s %d (%d with data)", st.Status, st.Objects, st.WithData))
+	}
+	if len(counts) == 0 {
+		counts = append(counts, "none")
+	}
+
+	var buf bytes.Buffer
+	err := metadataTemplate.Execute(&buf, map[string]interface{}{
+		"ID":        newFileIdentifier(),
+		"Timestamp": m.Timestamp.UTC().Format(time.RFC3339),
+		"CRS":       m.CRS,
+		"First":     formatNullDate(first),
+		"Last":      formatNullDate(last),
+		"HasRange":  first.Valid && last.Valid,
+		"Version":   m.Version,
+		"Mode":      m.Mode,
+		"Filter":    m.Filter,
+		"Source":    m.Source,
+		"Counts":    strings.Join(counts, ", "),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to render metadata: %w", err)
+	}
+	return buf.String(), nil
+}
+
+// newFileIdentifier returns a random UUID for the metadata record
+func newFileIdentifier() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// xmlEscape escapes text for XML character data and attribute values
+func xmlEscape(v interface{}) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(fmt.Sprint(v)))
+	return buf.String()
+}
+
+// metadataTemplate is an ISO 19115 dataset record in ISO 19139 encoding
+var metadataTemplate = template.Must(template.New("metadata").Funcs(template.FuncMap{"xml": xmlEscape}).Parse(
+	`<?xml version="1.0" encoding="UTF-8"?>
+<gmd:MD_Metadata xmlns:gmd="http://www.isotc211.org/2005/gmd" xmlns:gco="http://www.isotc211.org/2005/gco" xmlns:gml="http://www.opengis.net/gml">
+  <gmd:fileIdentifier><gco:CharacterString>{{.ID}}</gco:CharacterString></gmd:fileIdentifier>
+  <gmd:language><gco:CharacterString>rus</gco:CharacterString></gmd:language>
+  <gmd:hierarchyLevel><gmd:MD_ScopeCode codeList="http://standards.iso.org/iso/19139/resources/gmxCodelists.xml#MD_ScopeCode" codeListValue="dataset">dataset</gmd:MD_ScopeCode></gmd:hierarchyLevel>
+  <gmd:contact gco:nilReason="unknown"/>
+  <gmd:dateStamp><gco:DateTime>{{.Timestamp}}</gco:DateTime></gmd:dateStamp>
+  <gmd:metadataStandardName><gco:CharacterString>ISO 19115:2003/19139</gco:CharacterString></gmd:metadataStandardName>
+  <gmd:referenceSystemInfo>
+    <gmd:MD_ReferenceSystem>
+      <gmd:referenceSystemIdentifier>
+        <gmd:RS_Identifier>
+          <gmd:code><gco:CharacterString>{{xml .CRS.OrganizationID}}</gco:CharacterString></gmd:code>
+          <gmd:codeSpace><gco:CharacterString>{{xml .CRS.Organization}}</gco:CharacterString></gmd:codeSpace>
+        </gmd:RS_Identifier>
+      </gmd:referenceSystemIdentifier>
+    </gmd:MD_ReferenceSystem>
+  </gmd:referenceSystemInfo>
+  <gmd:identificationInfo>
+    <gmd:MD_DataIdentification>
+      <gmd:citation>
+        <gmd:CI_Citation>
+          <gmd:title><gco:CharacterString>Cadastral objects</gco:CharacterString></gmd:title>
+          <gmd:date>
+            <gmd:CI_Date>
+              <gmd:date><gco:DateTime>{{.Timestamp}}</gco:DateTime></gmd:date>
+              <gmd:dateType><gmd:CI_DateTypeCode codeList="http://standards.iso.org/iso/19139/resources/gmxCodelists.xml#CI_DateTypeCode" codeListValue="creation">creation</gmd:CI_DateTypeCode></gmd:dateType>
+            </gmd:CI_Date>
+          </gmd:date>
+        </gmd:CI_Citation>
+      </gmd:citation>
+      <gmd:abstract><gco:CharacterString>Cadastral objects fetched from NSPD, exported from {{xml .Source}} in {{xml .CRS.Name}} ({{xml .CRS}})</gco:CharacterString></gmd:abstract>
+      <gmd:language><gco:CharacterString>rus</gco:CharacterString></gmd:language>
+{{- if .HasRange}}
+      <gmd:extent>
+        <gmd:EX_Extent>
+          <gmd:temporalElement>
+            <gmd:EX_TemporalExtent>
+              <gmd:extent>
+                <gml:TimePeriod gml:id="update_date">
+                  <gml:beginPosition>{{.First}}</gml:beginPosition>
+                  <gml:endPosition>{{.Last}}</gml:endPosition>
+                </gml:TimePeriod>
+              </gmd:extent>
+            </gmd:EX_TemporalExtent>
+          </gmd:temporalElement>
+        </gmd:EX_Extent>
+      </gmd:extent>
+{{- end}}
+    </gmd:MD_DataIdentification>
+  </gmd:identificationInfo>
+  <gmd:dataQualityInfo>
+    <gmd:DQ_DataQuality>
+      <gmd:scope><gmd:DQ_Scope><gmd:level><gmd:MD_ScopeCode codeList="http://standards.iso.org/iso/19139/resources/gmxCodelists.xml#MD_ScopeCode" codeListValue="dataset">dataset</gmd:MD_ScopeCode></gmd:level></gmd:DQ_Scope></gmd:scope>
+      <gmd:lineage>
+        <gmd:LI_Lineage>
+          <gmd:statement><gco:CharacterString>Exported by gisdb {{xml .Version}} in {{xml .Mode}} mode</gco:CharacterString></gmd:statement>
+          <gmd:processStep>
+            <gmd:LI_ProcessStep>
+              <gmd:description><gco:CharacterString>Objects with load_status SUCCESS and data selected by filter: {{xml .Filter}}; reprojected to {{xml .CRS}}</gco:CharacterString></gmd:description>
+              <gmd:dateTime><gco:DateTime>{{.Timestamp}}</gco:DateTime></gmd:dateTime>
+            </gmd:LI_ProcessStep>
+          </gmd:processStep>
+          <gmd:source>
+            <gmd:LI_Source>
+              <gmd:description><gco:CharacterString>{{xml .Source}}; objects matching the filter by load_status: {{xml .Counts}}{{if .HasRange}}; NSPD data fetched {{.First}} to {{.Last}}{{end}}</gco:CharacterString></gmd:description>
+            </gmd:LI_Source>
+          </gmd:source>
+        </gmd:LI_Lineage>
+      </gmd:lineage>
+    </gmd:DQ_DataQuality>
+  </gmd:dataQualityInfo>
+</gmd:MD_Metadata>
+`))
@@ -3,6 +3,9 @@ package main
 import (
 	"database/sql"
 	"encoding/json"
+	"log"
+
+	"exporter/geom"
 )
 
 // GeoJSONFeatureCollection represents a GeoJSON FeatureCollection
@@ -34,6 +37,9 @@ type GeoJSONCRS struct {
 
 // CadastralObject represents a cadastral object from the database
 type CadastralObject struct {
+	// CadNum is the full cadastral number built from the object, quarter,
+	// area and region codes
+	CadNum                       CadastralNumber
 	Code                         int
 	QuarterCode                  int
 	LoadStatus                   string
@@ -47,4 +53,59 @@ type CadastralObject struct {
 	LandRecordType               sql.NullString
 	LandRecordSubtype            sql.NullString
 	LandRecordCategoryType       sql.NullString
+
+	// Decoded from the first feature of the NSPD response in Data
+	FeatureID  interface{}
+	Geometry   geom.Geometry
+	Properties map[string]interface{}
+	Options    map[string]interface{}
+}
+
+// Quarter is a cadastral quarter with the names of its area and region
+type Quarter struct {
+	Code            int
+	Name            string
+	Description     string
+	AreaCode        int
+	AreaName        string
+	AreaDescription string
+	RegionCode      int
+	RegionName      string
+}
+
+// objectRowColumns are the object attribute columns shared by every
+// export: the GeoPackage columns before the geometry, the Shapefile fields,
+// the Parquet columns, the vector tile attributes and the KML data
+var objectRowColumns = []string{
+	"cad_num", "code", "quarter_code", "load_status", "update_date", "area", "cost_value",
+	"permitted_use_established_by_document", "right_type", "status",
+	"land_record_type", "land_record_subtype", "land_record_category_type",
+}
+
+// objectRowValues returns the values of objectRowColumns followed by those
+// of the option columns, nil for NULL
+func objectRowValues(obj *CadastralObject, optionColumns []OptionColumn) []interface{} {
+	values := []interface{}{
+		obj.CadNum.String(),
+		obj.Code,
+		obj.QuarterCode,
+		obj.LoadStatus,
+		getNullableString(formatUpdateDate(obj.UpdateDate)),
+		getNullableInt64(obj.Area),
+		getNullableFloat64(obj.CostValue),
+		getNullableString(obj.PermittedUseEstablishedByDoc),
+		getNullableString(obj.RightType),
+		getNullableString(obj.Status),
+		getNullableString(obj.LandRecordType),
+		getNullableString(obj.LandRecordSubtype),
+		getNullableString(obj.LandRecordCategoryType),
+	}
+	for _, c := range optionColumns {
+		value, err := c.value(obj.Options)
+		if err != nil {
+			log.Printf("Ignoring option %s of object %s: %v", c.Option, obj.CadNum, err)
+		}
+		values = append(values, value)
+	}
+	return values
 }
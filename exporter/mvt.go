@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// mvtExtent is the size of the tile coordinate grid
+const mvtExtent = 4096
+
+// MVT geometry types
+const (
+	mvtPoint      = 1
+	mvtLineString = 2
+	mvtPolygon    = 3
+)
+
+// MVT geometry commands
+const (
+	mvtMoveTo    = 1
+	mvtLineTo    = 2
+	mvtClosePath = 7
+)
+
+// Protocol Buffers wire types
+const (
+	wireVarint = 0
+	wire64Bit  = 1
+	wireBytes  = 2
+)
+
+// appendProtoKey appends the key of a field
+func appendProtoKey(b []byte, field, wireType int) []byte {
+	return binary.AppendUvarint(b, uint64(field<<3|wireType))
+}
+
+// appendProtoVarint appends a varint field
+func appendProtoVarint(b []byte, field int, v uint64) []byte {
+	return binary.AppendUvarint(appendProtoKey(b, field, wireVarint), v)
+}
+
+// appendProtoBytes appends a length-delimited field
+func appendProtoBytes(b []byte, field int, data []byte) []byte {
+	b = binary.AppendUvarint(appendProtoKey(b, field, wireBytes), uint64(len(data)))
+	return append(b, data...)
+}
+
+// appendProtoPacked appends a packed repeated uint32 field
+func appendProtoPacked(b []byte, field int, values []uint32) []byte {
+	var data []byte
+	for _, v := range values {
+		data = binary.AppendUvarint(data, uint64(v))
+	}
+	return appendProtoBytes(b, field, data)
+}
+
+// mvtFeature is an encoded tile feature. It has no id: object codes repeat
+// across quarters and the cadastral number does not fit the integer ids
+// that web maps read exactly, so clients promote the cad_num attribute.
+type mvtFeature struct {
+	typ      int
+	tags     []uint32
+	geometry []uint32
+}
+
+// mvtLayer builds a layer of a vector tile, sharing keys and values
+// between its features
+type mvtLayer struct {
+	name     string
+	keys     []string
+	values   []interface{}
+	valueIdx map[interface{}]uint32
+	features []mvtFeature
+}
+
+// newMVTLayer returns an empty layer with the attribute keys
+func newMVTLayer(name string, keys []string) *mvtLayer {
+	return &mvtLayer{name: name, keys: keys, valueIdx: make(map[interface{}]uint32)}
+}
+
+// tags returns the feature tags of attribute values in key order, leaving
+// out nulls. Values are strings, booleans, integers or floats.
+func (l *mvtLayer) tags(values []interface{}) []uint32 {
+	var tags []uint32
+	for i, v := range values {
+		switch n := v.(type) {
+		case nil:
+			continue
+		case int:
+			v = int64(n)
+		}
+		idx, ok := l.valueIdx[v]
+		if !ok {
+			idx = uint32(len(l.values))
+			l.valueIdx[v] = idx
+			l.values = append(l.values, v)
+		}
+		tags = append(tags, uint32(i), idx)
+	}
+	return tags
+}
+
+// add appends a feature
+func (l *mvtLayer) add(f mvtFeature) {
+	l.features = append(l.features, f)
+}
+
+// encode returns the Layer message (version 2)
+func (l *mvtLayer) encode() []byte {
+	var b []byte
+	b = appendProtoBytes(b, 1, []byte(l.name))
+	for _, f := range l.features {
+		var fb []byte
+		fb = appendProtoPacked(fb, 2, f.tags)
+		fb = appendProtoVarint(fb, 3, uint64(f.typ))
+		fb = appendProtoPacked(fb, 4, f.geometry)
+		b = appendProtoBytes(b, 2, fb)
+	}
+	for _, k := range l.keys {
+		b = appendProtoBytes(b, 3, []byte(k))
+	}
+	for _, v := range l.values {
+		var vb []byte
+		switch v := v.(type) {
+		case string:
+			vb = appendProtoBytes(vb, 1, []byte(v))
+		case float64:
+			vb = binary.LittleEndian.AppendUint64(appendProtoKey(vb, 3, wire64Bit), math.Float64bits(v))
+		case int64:
+			vb = appendProtoVarint(vb, 4, uint64(v))
+		case bool:
+			var n uint64
+			if v {
+				n = 1
+			}
+			vb = appendProtoVarint(vb, 7, n)
+		}
+		b = appendProtoBytes(b, 4, vb)
+	}
+	b = appendProtoVarint(b, 5, mvtExtent)
+	return appendProtoVarint(b, 15, 2)
+}
+
+// encodeMVT returns a Tile message holding the non-empty layers
+func encodeMVT(layers ...*mvtLayer) []byte {
+	var b []byte
+	for _, l := range layers {
+		if len(l.features) > 0 {
+			b = appendProtoBytes(b, 3, l.encode())
+		}
+	}
+	return b
+}
+
+// mvtGeometry encodes geometry commands with zigzag-encoded deltas from
+// the cursor, which carries over between the parts of a feature
+type mvtGeometry struct {
+	commands []uint32
+	x, y     int32
+}
+
+// command appends a command integer
+func (g *mvtGeometry) command(id, count int) {
+	g.commands = append(g.commands, uint32(id&0x7|count<<3))
+}
+
+// point appends the parameters of a position and moves the cursor
+func (g *mvtGeometry) point(x, y int32) {
+	dx, dy := x-g.x, y-g.y
+	g.commands = append(g.commands, uint32((dx<<1)^(dx>>31)), uint32((dy<<1)^(dy>>31)))
+	g.x, g.y = x, y
+}
+
+// points appends MoveTo for a set of points
+func (g *mvtGeometry) points(xy []int32) {
+	g.command(mvtMoveTo, len(xy)/2)
+	for i := 0; i < len(xy); i += 2 {
+		g.point(xy[i], xy[i+1])
+	}
+}
+
+// line appends MoveTo and LineTo for a path
+func (g *mvtGeometry) line(xy []int32) {
+	g.command(mvtMoveTo, 1)
+	g.point(xy[0], xy[1])
+	g.command(mvtLineTo, len(xy)/2-1)
+	for i := 2; i < len(xy); i += 2 {
+		g.point(xy[i], xy[i+1])
+	}
+}
+
+// ring appends a closed ring, whose last position repeats the first
+func (g *mvtGeometry) ring(xy []int32) {
+	g.line(xy[:len(xy)-2])
+	g.command(mvtClosePath, 1)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"exporter/geom"
+)
+
+// decodeMVTGeometry decodes a command stream into its parts: the positions
+// of each MoveTo and the LineTos after it, with ClosePath flagged
+func decodeMVTGeometry(t *testing.T, commands []uint32) (parts [][]int32, closed []bool) {
+	var x, y int32
+	for i := 0; i < len(commands); {
+		id, count := commands[i]&0x7, int(commands[i]>>3)
+		i++
+		switch id {
+		case mvtMoveTo, mvtLineTo:
+			if i+2*count > len(commands) {
+				t.Fatalf("command %d with %d positions runs past the end", id, count)
+			}
+			for j := 0; j < count; j++ {
+				dx, dy := commands[i], commands[i+1]
+				x += int32(dx>>1) ^ -int32(dx&1)
+				y += int32(dy>>1) ^ -int32(dy&1)
+				i += 2
+				if id == mvtMoveTo {
+					parts = append(parts, nil)
+					closed = append(closed, false)
+				} else if len(parts) == 0 {
+					t.Fatalf("LineTo before MoveTo")
+				}
+				parts[len(parts)-1] = append(parts[len(parts)-1], x, y)
+			}
+		case mvtClosePath:
+			if count != 1 || len(parts) == 0 {
+				t.Fatalf("ClosePath with count %d after %d parts", count, len(parts))
+			}
+			closed[len(parts)-1] = true
+		default:
+			t.Fatalf("unknown command %d", id)
+		}
+	}
+	return parts, closed
+}
+
+// ringArea returns the signed area of an open ring in tile units, positive
+// for rings that are clockwise on screen with y down
+func ringArea(xy []int32) int64 {
+	var sum int64
+	for i := 0; i < len(xy); i += 2 {
+		j := (i + 2) % len(xy)
+		sum += int64(xy[i])*int64(xy[j+1]) - int64(xy[j])*int64(xy[i+1])
+	}
+	return sum / 2
+}
+
+// Examples of the Mapbox Vector Tile specification 2.1, section 4.3.5
+func TestMVTGeometrySpecExamples(t *testing.T) {
+	g := &mvtGeometry{}
+	g.points([]int32{5, 7, 3, 2})
+	if want := []uint32{17, 10, 14, 3, 9}; !reflect.DeepEqual(g.commands, want) {
+		t.Errorf("multipoint = %v, want %v", g.commands, want)
+	}
+
+	g = &mvtGeometry{}
+	g.line([]int32{2, 2, 2, 10, 10, 10})
+	if want := []uint32{9, 4, 4, 18, 0, 16, 16, 0}; !reflect.DeepEqual(g.commands, want) {
+		t.Errorf("linestring = %v, want %v", g.commands, want)
+	}
+
+	g = &mvtGeometry{}
+	g.ring([]int32{3, 6, 8, 12, 20, 34, 3, 6})
+	if want := []uint32{9, 6, 12, 18, 10, 12, 24, 44, 15}; !reflect.DeepEqual(g.commands, want) {
+		t.Errorf("polygon = %v, want %v", g.commands, want)
+	}
+
+	// The cursor carries over from one polygon to the next
+	g = &mvtGeometry{}
+	g.ring([]int32{0, 0, 10, 0, 10, 10, 0, 10, 0, 0})
+	g.ring([]int32{11, 11, 20, 11, 20, 20, 11, 20, 11, 11})
+	g.ring([]int32{13, 13, 13, 17, 17, 17, 17, 13, 13, 13})
+	want := []uint32{
+		9, 0, 0, 26, 20, 0, 0, 20, 19, 0, 15,
+		9, 22, 2, 26, 18, 0, 0, 18, 17, 0, 15,
+		9, 4, 13, 26, 0, 8, 8, 0, 0, 7, 15,
+	}
+	if !reflect.DeepEqual(g.commands, want) {
+		t.Errorf("multipolygon = %v, want %v", g.commands, want)
+	}
+}
+
+func TestMVTPolygonEncoding(t *testing.T) {
+	// Tile 0/0/0 in EPSG:3857 coordinates from tile units
+	box := newTileBox(0, 0, 0)
+	world := func(units ...float64) []float64 {
+		coords := make([]float64, len(units))
+		for i := 0; i < len(units); i += 2 {
+			coords[i] = units[i]/box.scale + box.minX
+			coords[i+1] = box.maxY - units[i+1]/box.scale
+		}
+		return coords
+	}
+	// GIS orientation with y up: a counter-clockwise exterior and a
+	// clockwise hole, both the other way round on screen
+	exterior := world(1000, 3000, 3000, 3000, 3000, 1000, 1000, 1000, 1000, 3000)
+	hole := world(1500, 1500, 2500, 1500, 2500, 2500, 1500, 2500, 1500, 1500)
+	polygon := &geom.Polygon{Layout: geom.XY, Rings: [][]float64{exterior, hole}}
+	if geom.RingSignedArea(exterior, geom.XY) <= 0 || geom.RingSignedArea(hole, geom.XY) >= 0 {
+		t.Fatal("test rings do not have the GIS orientation")
+	}
+
+	tl := &tiler{}
+	typ, commands := tl.encodeGeometry(polygon, box)
+	if typ != mvtPolygon {
+		t.Fatalf("type %d, want %d", typ, mvtPolygon)
+	}
+	parts, closed := decodeMVTGeometry(t, commands)
+	if len(parts) != 2 {
+		t.Fatalf("%d rings, want 2", len(parts))
+	}
+	for i, ring := range parts {
+		if !closed[i] {
+			t.Errorf("ring %d has no ClosePath", i)
+		}
+		// The closing position is implied by ClosePath
+		if n := len(ring); n != 8 || (ring[0] == ring[n-2] && ring[1] == ring[n-1]) {
+			t.Errorf("ring %d = %v, want 4 positions without the repeated first", i, ring)
+		}
+	}
+	if a := ringArea(parts[0]); a != 2000*2000 {
+		t.Errorf("exterior area %d, want %d (clockwise on screen)", a, 2000*2000)
+	}
+	if a := ringArea(parts[1]); a != -1000*1000 {
+		t.Errorf("hole area %d, want %d (counter-clockwise on screen)", a, -1000*1000)
+	}
+	for i, bounds := range [][4]int32{{1000, 1000, 3000, 3000}, {1500, 1500, 2500, 2500}} {
+		for j := 0; j < len(parts[i]); j += 2 {
+			x, y := parts[i][j], parts[i][j+1]
+			if (x != bounds[0] && x != bounds[2]) || (y != bounds[1] && y != bounds[3]) {
+				t.Errorf("ring %d position (%d, %d) is not a corner of %v", i, x, y, bounds)
+			}
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OptionColumn maps a key of the NSPD options object
+// (data.features[0].properties.options) to a typed GeoPackage column
+type OptionColumn struct {
+	Option string `json:"option"`
+	// Column is the column name; it defaults to the option key
+	Column string `json:"column,omitempty"`
+	// Type is a GeoPackage data type: TEXT, INTEGER, REAL, BOOLEAN, DATE
+	// or DATETIME
+	Type string `json:"type"`
+	// Title is the human title written to gpkg_data_columns; the columns
+	// of the default mapping have built-in titles
+	Title string `json:"title,omitempty"`
+}
+
+// defaultOptionColumns are the options written when no -options-schema is
+// given. Options already stored as object columns (area, cost_value, status,
+// right_type, ...) are left out.
+var defaultOptionColumns = []OptionColumn{
+	{Option: "readable_address", Type: "TEXT"},
+	{Option: "quarter_cad_number", Type: "TEXT"},
+	{Option: "ownership_type", Type: "TEXT"},
+	{Option: "common_data_status", Type: "TEXT"},
+	{Option: "previously_posted", Type: "TEXT"},
+	{Option: "specified_area", Type: "REAL"},
+	{Option: "declared_area", Type: "REAL"},
+	{Option: "land_record_area", Type: "REAL"},
+	{Option: "land_record_area_declaration", Type: "REAL"},
+	{Option: "land_record_area_verified", Type: "REAL"},
+	{Option: "registration_date", Type: "DATE"},
+	{Option: "land_record_reg_date", Type: "DATE"},
+	{Option: "cost_index", Type: "REAL"},
+	{Option: "cost_application_date", Type: "DATE"},
+	{Option: "cost_approvement_date", Type: "DATE"},
+	{Option: "cost_determination_date", Type: "DATE"},
+	{Option: "cost_registration_date", Type: "DATE"},
+	{Option: "determination_couse", Column: "determination_cause", Type: "TEXT"},
+}
+
+// columnNamePattern restricts column names to plain SQL identifiers
+var columnNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// loadOptionColumns reads an options schema: a JSON array of OptionColumn.
+// An empty path returns the default mapping.
+func loadOptionColumns(path string) ([]OptionColumn, error) {
+	if path == "" {
+		return defaultOptionColumns, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read options schema: %w", err)
+	}
+	var columns []OptionColumn
+	if err := json.Unmarshal(data, &columns); err != nil {
+		return nil, fmt.Errorf("failed to parse options schema: %w", err)
+	}
+
+	// Object columns and option columns share the table, and their titles
+	// the gpkg_data_columns names
+	used := map[string]bool{}
+	titles := map[string]bool{}
+	for _, name := range cadastralObjectColumns {
+		used[name] = true
+		titles[columnTitles[name]] = true
+	}
+	for i := range columns {
+		c := &columns[i]
+		if c.Option == "" {
+			return nil, fmt.Errorf("options schema entry %d has no option", i+1)
+		}
+		if c.Column == "" {
+			c.Column = c.Option
+		}
+		c.Type = strings.ToUpper(c.Type)
+
+		if !columnNamePattern.MatchString(c.Column) {
+			return nil, fmt.Errorf("invalid column name %q for option %s", c.Column, c.Option)
+		}
+		if used[strings.ToLower(c.Column)] {
+			return nil, fmt.Errorf("duplicate column %s for option %s", c.Column, c.Option)
+		}
+		used[strings.ToLower(c.Column)] = true
+
+		title := c.Title
+		if title == "" {
+			title = columnTitles[c.Column]
+		}
+		if title != "" {
+			if titles[title] {
+				return nil, fmt.Errorf("duplicate title %q for option %s", title, c.Option)
+			}
+			titles[title] = true
+		}
+
+		switch c.Type {
+		case "TEXT", "INTEGER", "REAL", "BOOLEAN", "DATE", "DATETIME":
+		default:
+			return nil, fmt.Errorf("unsupported type %q for option %s (expected TEXT, INTEGER, REAL, BOOLEAN, DATE or DATETIME)", c.Type, c.Option)
+		}
+	}
+	return columns, nil
+}
+
+// columnName returns the column of the option
+func (c OptionColumn) columnName() string {
+	if c.Column == "" {
+		return c.Option
+	}
+	return c.Column
+}
+
+// value converts the option of an object to the column type. Missing, null
+// and empty values become NULL.
+func (c OptionColumn) value(options map[string]interface{}) (interface{}, error) {
+	raw, ok := options[c.Option]
+	if !ok || raw == nil {
+		return nil, nil
+	}
+	if s, ok := raw.(string); ok {
+		raw = strings.TrimSpace(s)
+		if raw == "" {
+			return nil, nil
+		}
+	}
+
+	switch c.Type {
+	case "TEXT":
+		switch v := raw.(type) {
+		case string:
+			return v, nil
+		case float64:
+			return strconv.FormatFloat(v, 'f', -1, 64), nil
+		case bool:
+			return strconv.FormatBool(v), nil
+		default:
+			data, err := json.Marshal(v)
+			return string(data), err
+		}
+
+	case "REAL":
+		return parseOptionNumber(raw)
+
+	case "INTEGER":
+		f, err := parseOptionNumber(raw)
+		if err != nil {
+			return nil, err
+		}
+		if f != math.Trunc(f) {
+			return nil, fmt.Errorf("%v is not an integer", raw)
+		}
+		return int64(f), nil
+
+	case "BOOLEAN":
+		switch v := raw.(type) {
+		case bool:
+			return v, nil
+		case float64:
+			return v != 0, nil
+		case string:
+			switch strings.ToLower(v) {
+			case "true", "1", "да":
+				return true, nil
+			case "false", "0", "нет":
+				return false, nil
+			}
+		}
+		return nil, fmt.Errorf("%v is not a boolean", raw)
+
+	case "DATE", "DATETIME":
+		s, ok := raw.(string)
+		if !ok {
+			return nil, fmt.Errorf("%v is not a date", raw)
+		}
+		t, err := parseOptionTime(s)
+		if err != nil {
+			return nil, err
+		}
+		if c.Type == "DATE" {
+			return t.Format("2006-01-02"), nil
+		}
+		return t.UTC().Format("2006-01-02T15:04:05.000Z"), nil
+	}
+	return nil, fmt.Errorf("unsupported type %s", c.Type)
+}
+
+// parseOptionNumber accepts JSON numbers, SQLite integers and numeric
+// strings, including a decimal comma
+func parseOptionNumber(raw interface{}) (float64, error) {
+	switch v := raw.(type) {
+	case float64:
+		return v, nil
+	case int64:
+		return float64(v), nil
+	case string:
+		f, err := strconv.ParseFloat(strings.ReplaceAll(v, ",", "."), 64)
+		if err != nil {
+			return 0, fmt.Errorf("%q is not a number", v)
+		}
+		return f, nil
+	}
+	return 0, fmt.Errorf("%v is not a number", raw)
+}
+
+// optionTimeLayouts are the date formats found in NSPD options
+var optionTimeLayouts = []string{
+	"2006-01-02",
+	"2006-01-02T15:04:05Z07:00",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"02.01.2006",
+}
+
+// parseOptionTime parses an NSPD date or timestamp
+func parseOptionTime(s string) (time.Time, error) {
+	for _, layout := range optionTimeLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%q is not a date", s)
+}
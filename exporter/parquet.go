@@ -0,0 +1,532 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+)
+
+// parquetMagic starts and ends every Parquet file
+var parquetMagic = []byte("PAR1")
+
+// parquetPageSize is the encoded size at which a column chunk starts a new
+// data page
+const parquetPageSize = 1 << 20
+
+// Parquet physical types
+const (
+	parquetBoolean   = 0
+	parquetInt32     = 1
+	parquetInt64     = 2
+	parquetDouble    = 5
+	parquetByteArray = 6
+)
+
+// parquetAnnotation is the logical type of a column, written both as a
+// LogicalType and as the legacy converted type for older readers
+type parquetAnnotation int
+
+const (
+	annotationNone parquetAnnotation = iota
+	annotationString
+	annotationDate
+	annotationTimestampMillis
+)
+
+// schema sets the converted_type and logicalType of a SchemaElement
+func (a parquetAnnotation) schema(e *thriftStruct) {
+	logical := &thriftStruct{}
+	switch a {
+	case annotationString:
+		e.set(6, int32(0))
+		logical.set(1, &thriftStruct{})
+	case annotationDate:
+		e.set(6, int32(6))
+		logical.set(6, &thriftStruct{})
+	case annotationTimestampMillis:
+		e.set(6, int32(9))
+		unit := &thriftStruct{}
+		unit.set(1, &thriftStruct{})
+		timestamp := &thriftStruct{}
+		timestamp.set(1, true)
+		timestamp.set(2, unit)
+		logical.set(8, timestamp)
+	default:
+		return
+	}
+	e.set(10, logical)
+}
+
+// Parquet repetition types, encodings, codecs and page types
+const (
+	parquetRequired = 0
+	parquetOptional = 1
+
+	parquetPlain = 0
+	parquetRLE   = 3
+
+	parquetUncompressed = 0
+	parquetGzip         = 2
+
+	parquetDataPage = 0
+)
+
+// parquetField is a node of a Parquet schema: a leaf column with a
+// physical type or a group of required fields
+type parquetField struct {
+	name       string
+	typ        int32
+	optional   bool
+	annotation parquetAnnotation
+	children   []parquetField
+}
+
+// parquetLeaf is a column of values: a schema leaf with its path from the
+// root and its maximum definition level
+type parquetLeaf struct {
+	field  parquetField
+	path   []string
+	maxDef int
+}
+
+// parquetLeaves flattens the schema into its columns in schema order
+func parquetLeaves(fields []parquetField, path []string, def int) []parquetLeaf {
+	var leaves []parquetLeaf
+	for _, f := range fields {
+		p := append(append([]string(nil), path...), f.name)
+		d := def
+		if f.optional {
+			d++
+		}
+		if f.children != nil {
+			leaves = append(leaves, parquetLeaves(f.children, p, d)...)
+		} else {
+			leaves = append(leaves, parquetLeaf{field: f, path: p, maxDef: d})
+		}
+	}
+	return leaves
+}
+
+// parquetColumnChunk encodes the values of one column in the current row
+// group as PLAIN data pages with RLE definition levels
+type parquetColumnChunk struct {
+	leaf  parquetLeaf
+	codec int32
+
+	// the page being filled
+	levels    []bool
+	values    []byte
+	booleans  int
+	numValues int
+
+	pages        []byte
+	uncompressed int64
+	count        int64
+	nulls        int64
+	min, max     []byte
+	hasStats     bool
+}
+
+// add appends a value of the column's physical type, nil for null
+func (c *parquetColumnChunk) add(value interface{}) error {
+	if value == nil {
+		if c.leaf.maxDef == 0 {
+			return fmt.Errorf("column %s is required", c.leaf.field.name)
+		}
+		c.levels = append(c.levels, false)
+		c.nulls++
+	} else {
+		if c.leaf.maxDef > 0 {
+			c.levels = append(c.levels, true)
+		}
+		if err := c.appendValue(value); err != nil {
+			return fmt.Errorf("column %s: %w", c.leaf.field.name, err)
+		}
+	}
+	c.numValues++
+	c.count++
+	if len(c.values) >= parquetPageSize {
+		return c.flushPage()
+	}
+	return nil
+}
+
+// appendValue PLAIN-encodes a value and updates the chunk statistics
+func (c *parquetColumnChunk) appendValue(value interface{}) error {
+	var stat []byte
+	switch c.leaf.field.typ {
+	case parquetBoolean:
+		v, ok := value.(bool)
+		if !ok {
+			return fmt.Errorf("expected a boolean, got %T", value)
+		}
+		if c.booleans%8 == 0 {
+			c.values = append(c.values, 0)
+		}
+		if v {
+			c.values[len(c.values)-1] |= 1 << (c.booleans % 8)
+			stat = []byte{1}
+		} else {
+			stat = []byte{0}
+		}
+		c.booleans++
+	case parquetInt32:
+		v, ok := value.(int32)
+		if !ok {
+			return fmt.Errorf("expected an int32, got %T", value)
+		}
+		stat = binary.LittleEndian.AppendUint32(nil, uint32(v))
+		c.values = append(c.values, stat...)
+	case parquetInt64:
+		v, ok := value.(int64)
+		if !ok {
+			return fmt.Errorf("expected an int64, got %T", value)
+		}
+		stat = binary.LittleEndian.AppendUint64(nil, uint64(v))
+		c.values = append(c.values, stat...)
+	case parquetDouble:
+		v, ok := value.(float64)
+		if !ok {
+			return fmt.Errorf("expected a float64, got %T", value)
+		}
+		c.values = appendFloat64LE(c.values, v)
+		if !math.IsNaN(v) {
+			stat = appendFloat64LE(nil, v)
+		}
+	case parquetByteArray:
+		var v []byte
+		switch b := value.(type) {
+		case []byte:
+			v = b
+		case string:
+			v = []byte(b)
+		default:
+			return fmt.Errorf("expected a byte array, got %T", value)
+		}
+		c.values = binary.LittleEndian.AppendUint32(c.values, uint32(len(v)))
+		c.values = append(c.values, v...)
+		// Statistics of plain binary such as WKB are of no use
+		if c.leaf.field.annotation == annotationString {
+			stat = v
+		}
+	}
+	if stat != nil {
+		c.updateStats(stat)
+	}
+	return nil
+}
+
+// updateStats widens the chunk minimum and maximum to a PLAIN-encoded value
+func (c *parquetColumnChunk) updateStats(v []byte) {
+	if !c.hasStats {
+		c.min = append([]byte(nil), v...)
+		c.max = append([]byte(nil), v...)
+		c.hasStats = true
+		return
+	}
+	if parquetLess(c.leaf.field.typ, v, c.min) {
+		c.min = append(c.min[:0], v...)
+	}
+	if parquetLess(c.leaf.field.typ, c.max, v) {
+		c.max = append(c.max[:0], v...)
+	}
+}
+
+// parquetLess compares PLAIN-encoded values in the type-defined order:
+// signed for numbers, unsigned bytewise for strings
+func parquetLess(typ int32, a, b []byte) bool {
+	switch typ {
+	case parquetInt32:
+		return int32(binary.LittleEndian.Uint32(a)) < int32(binary.LittleEndian.Uint32(b))
+	case parquetInt64:
+		return int64(binary.LittleEndian.Uint64(a)) < int64(binary.LittleEndian.Uint64(b))
+	case parquetDouble:
+		return math.Float64frombits(binary.LittleEndian.Uint64(a)) < math.Float64frombits(binary.LittleEndian.Uint64(b))
+	default:
+		return bytes.Compare(a, b) < 0
+	}
+}
+
+// flushPage closes the current data page: definition levels of optional
+// columns followed by the values, compressed as a whole
+func (c *parquetColumnChunk) flushPage() error {
+	if c.numValues == 0 {
+		return nil
+	}
+	var data []byte
+	if c.leaf.maxDef > 0 {
+		levels := encodeParquetLevels(c.levels)
+		data = binary.LittleEndian.AppendUint32(nil, uint32(len(levels)))
+		data = append(data, levels...)
+	}
+	data = append(data, c.values...)
+
+	compressed := data
+	if c.codec == parquetGzip {
+		var err error
+		if compressed, err = gzipBytes(data); err != nil {
+			return fmt.Errorf("failed to compress page: %w", err)
+		}
+	}
+
+	dataHeader := &thriftStruct{}
+	dataHeader.set(1, int32(c.numValues))
+	dataHeader.set(2, int32(parquetPlain))
+	dataHeader.set(3, int32(parquetRLE))
+	dataHeader.set(4, int32(parquetRLE))
+	header := &thriftStruct{}
+	header.set(1, int32(parquetDataPage))
+	header.set(2, int32(len(data)))
+	header.set(3, int32(len(compressed)))
+	header.set(5, dataHeader)
+	encoded := appendThrift(nil, header)
+
+	c.pages = append(c.pages, encoded...)
+	c.pages = append(c.pages, compressed...)
+	c.uncompressed += int64(len(encoded) + len(data))
+
+	c.levels, c.values = c.levels[:0], c.values[:0]
+	c.booleans, c.numValues = 0, 0
+	return nil
+}
+
+// encodeParquetLevels encodes definition levels of bit width 1 in the
+// RLE/bit-packed hybrid encoding, as RLE runs only
+func encodeParquetLevels(levels []bool) []byte {
+	var buf []byte
+	for i := 0; i < len(levels); {
+		j := i + 1
+		for j < len(levels) && levels[j] == levels[i] {
+			j++
+		}
+		buf = binary.AppendUvarint(buf, uint64(j-i)<<1)
+		if levels[i] {
+			buf = append(buf, 1)
+		} else {
+			buf = append(buf, 0)
+		}
+		i = j
+	}
+	return buf
+}
+
+// metadata returns the ColumnMetaData of the chunk written at offset
+func (c *parquetColumnChunk) metadata(offset int64) *thriftStruct {
+	m := &thriftStruct{}
+	m.set(1, c.leaf.field.typ)
+	m.set(2, []int32{parquetPlain, parquetRLE})
+	m.set(3, c.leaf.path)
+	m.set(4, c.codec)
+	m.set(5, c.count)
+	m.set(6, c.uncompressed)
+	m.set(7, int64(len(c.pages)))
+	m.set(9, offset)
+
+	stats := &thriftStruct{}
+	stats.set(3, c.nulls)
+	if c.hasStats {
+		min, max := c.min, c.max
+		// Zeros are written as -0 for the minimum and +0 for the maximum
+		if c.leaf.field.typ == parquetDouble {
+			if math.Float64frombits(binary.LittleEndian.Uint64(min)) == 0 {
+				min = appendFloat64LE(nil, math.Copysign(0, -1))
+			}
+			if math.Float64frombits(binary.LittleEndian.Uint64(max)) == 0 {
+				max = appendFloat64LE(nil, 0)
+			}
+		}
+		stats.set(5, max)
+		stats.set(6, min)
+	}
+	m.set(12, stats)
+	return m
+}
+
+// reset empties the chunk for the next row group
+func (c *parquetColumnChunk) reset() {
+	*c = parquetColumnChunk{leaf: c.leaf, codec: c.codec, levels: c.levels[:0], values: c.values[:0]}
+}
+
+// parquetWriter writes rows to a Parquet file, buffering a row group of
+// column chunks in memory. The footer holds the schema, the row groups with
+// column statistics and the key-value metadata.
+type parquetWriter struct {
+	path   string
+	file   *os.File
+	w      *bufio.Writer
+	offset int64
+
+	schema       []parquetField
+	chunks       []*parquetColumnChunk
+	rowGroupSize int
+	rows         int
+	numRows      int64
+	rowGroups    []*thriftStruct
+
+	// metadata is written to the footer as key-value pairs
+	metadata [][2]string
+}
+
+// createParquet creates a Parquet file, replacing an existing one
+func createParquet(path string, schema []parquetField, codec int32, rowGroupSize int) (*parquetWriter, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s: %w", path, err)
+	}
+	p := &parquetWriter{
+		path:         path,
+		file:         file,
+		w:            bufio.NewWriter(file),
+		schema:       schema,
+		rowGroupSize: rowGroupSize,
+	}
+	for _, leaf := range parquetLeaves(schema, nil, 0) {
+		p.chunks = append(p.chunks, &parquetColumnChunk{leaf: leaf, codec: codec})
+	}
+	p.write(parquetMagic)
+	return p, nil
+}
+
+// write appends bytes to the file and advances the offset; errors are
+// reported by the final flush
+func (p *parquetWriter) write(data []byte) {
+	p.w.Write(data)
+	p.offset += int64(len(data))
+}
+
+// WriteRow adds a row with a value for each leaf column in schema order
+func (p *parquetWriter) WriteRow(values []interface{}) error {
+	if len(values) != len(p.chunks) {
+		return fmt.Errorf("row has %d values for %d columns", len(values), len(p.chunks))
+	}
+	for i, v := range values {
+		if err := p.chunks[i].add(v); err != nil {
+			return err
+		}
+	}
+	p.rows++
+	p.numRows++
+	if p.rows >= p.rowGroupSize {
+		return p.flushRowGroup()
+	}
+	return nil
+}
+
+// flushRowGroup writes the buffered column chunks one after another
+func (p *parquetWriter) flushRowGroup() error {
+	if p.rows == 0 {
+		return nil
+	}
+	start := p.offset
+	var columns []*thriftStruct
+	var size int64
+	for _, c := range p.chunks {
+		if err := c.flushPage(); err != nil {
+			return err
+		}
+		chunk := &thriftStruct{}
+		chunk.set(2, p.offset)
+		chunk.set(3, c.metadata(p.offset))
+		columns = append(columns, chunk)
+		size += c.uncompressed
+		p.write(c.pages)
+		c.reset()
+	}
+
+	group := &thriftStruct{}
+	group.set(1, columns)
+	group.set(2, size)
+	group.set(3, int64(p.rows))
+	group.set(5, start)
+	group.set(6, p.offset-start)
+	group.set(7, int16(len(p.rowGroups)))
+	p.rowGroups = append(p.rowGroups, group)
+	p.rows = 0
+	return nil
+}
+
+// Close writes the last row group and the footer
+func (p *parquetWriter) Close() (err error) {
+	defer func() {
+		if cerr := p.file.Close(); err == nil && cerr != nil {
+			err = fmt.Errorf("failed to write %s: %w", p.path, cerr)
+		}
+	}()
+	if err := p.flushRowGroup(); err != nil {
+		return err
+	}
+
+	root := &thriftStruct{}
+	root.set(4, "schema")
+	root.set(5, int32(len(p.schema)))
+	elements := append([]*thriftStruct{root}, parquetSchemaElements(p.schema)...)
+
+	var keyValues []*thriftStruct
+	for _, kv := range p.metadata {
+		s := &thriftStruct{}
+		s.set(1, kv[0])
+		s.set(2, kv[1])
+		keyValues = append(keyValues, s)
+	}
+
+	// Every column uses the type-defined sort order for its statistics
+	orders := make([]*thriftStruct, len(p.chunks))
+	for i := range orders {
+		orders[i] = &thriftStruct{}
+		orders[i].set(1, &thriftStruct{})
+	}
+
+	footer := &thriftStruct{}
+	footer.set(1, int32(1))
+	footer.set(2, elements)
+	footer.set(3, p.numRows)
+	footer.set(4, p.rowGroups)
+	if len(keyValues) > 0 {
+		footer.set(5, keyValues)
+	}
+	footer.set(6, "gisdb "+version)
+	footer.set(7, orders)
+
+	data := appendThrift(nil, footer)
+	p.write(data)
+	p.write(binary.LittleEndian.AppendUint32(nil, uint32(len(data))))
+	p.write(parquetMagic)
+	if err := p.w.Flush(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", p.path, err)
+	}
+	return nil
+}
+
+// discard closes and removes an unfinished file
+func (p *parquetWriter) discard() {
+	p.file.Close()
+	os.Remove(p.path)
+}
+
+// parquetSchemaElements flattens the schema depth first into
+// SchemaElements, groups followed by their children
+func parquetSchemaElements(fields []parquetField) []*thriftStruct {
+	var elements []*thriftStruct
+	for _, f := range fields {
+		e := &thriftStruct{}
+		repetition := int32(parquetRequired)
+		if f.optional {
+			repetition = parquetOptional
+		}
+		e.set(3, repetition)
+		e.set(4, f.name)
+		if f.children != nil {
+			e.set(5, int32(len(f.children)))
+			elements = append(elements, e)
+			elements = append(elements, parquetSchemaElements(f.children)...)
+			continue
+		}
+		e.set(1, f.typ)
+		f.annotation.schema(e)
+		elements = append(elements, e)
+	}
+	return elements
+}
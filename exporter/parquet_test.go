@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"exporter/crs"
+	"exporter/geom"
+)
+
+// readParquetFooter checks the magic bytes around a Parquet file and
+// decodes its FileMetaData
+func readParquetFooter(t *testing.T, path string) map[int16]interface{} {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) < 12 || !bytes.Equal(data[:4], parquetMagic) || !bytes.Equal(data[len(data)-4:], parquetMagic) {
+		t.Fatalf("file does not start and end with %q", parquetMagic)
+	}
+	size := int(binary.LittleEndian.Uint32(data[len(data)-8:]))
+	footer := data[len(data)-8-size : len(data)-8]
+	r := &thriftReader{t: t, buf: footer}
+	metadata := r.readStruct()
+	if r.pos != len(footer) {
+		t.Fatalf("footer of %d bytes decoded to %d", len(footer), r.pos)
+	}
+	return metadata
+}
+
+// parquetColumnStats returns the ColumnMetaData of each column of a row
+// group by its dotted path
+func parquetColumnStats(group map[int16]interface{}) map[string]map[int16]interface{} {
+	columns := make(map[string]map[int16]interface{})
+	for _, c := range group[1].([]interface{}) {
+		m := c.(map[int16]interface{})[3].(map[int16]interface{})
+		var path []string
+		for _, p := range m[3].([]interface{}) {
+			path = append(path, string(p.([]byte)))
+		}
+		columns[strings.Join(path, ".")] = m
+	}
+	return columns
+}
+
+func TestParquetFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cadastral.parquet")
+	spool, err := createParquetSpool(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Two clusters of points that fill a row group each, and an object
+	// without a geometry
+	points := [][2]float64{{10, 11}, {0, 0}, {10, 10}, {0, 1}}
+	var geometries []geom.Geometry
+	for _, p := range points {
+		geometries = append(geometries, &geom.Point{Layout: geom.XY, Coords: []float64{p[0], p[1]}})
+	}
+	geometries = append(geometries, &geom.MultiPolygon{Layout: geom.XY})
+	for i, g := range geometries {
+		cadNum, err := ParseCadastralNumber(fmt.Sprintf("16:50:011001:%d", i+1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		obj := &CadastralObject{CadNum: cadNum, Code: i + 1, QuarterCode: 11001, LoadStatus: "loaded"}
+		if err := spool.add(g, objectRowValues(obj, nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	opts := ParquetOptions{OutputFile: path, CRS: crs.WGS84, RowGroupSize: 2, Compression: compressionGzip}
+	if err := spool.finish(opts); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path + ".spool"); !os.IsNotExist(err) {
+		t.Errorf("spool was not removed: %v", err)
+	}
+
+	metadata := readParquetFooter(t, path)
+	if n := metadata[3].(int64); n != 5 {
+		t.Errorf("num_rows = %d, want 5", n)
+	}
+
+	// The geometry and bbox are optional for the null geometry
+	for _, e := range metadata[2].([]interface{}) {
+		e := e.(map[int16]interface{})
+		switch string(e[4].([]byte)) {
+		case "geometry", "bbox":
+			if e[3].(int64) != parquetOptional {
+				t.Errorf("%s is not optional", e[4])
+			}
+		case "cad_num":
+			if e[3].(int64) != parquetRequired {
+				t.Errorf("cad_num is not required")
+			}
+		}
+	}
+
+	var geo map[string]interface{}
+	for _, kv := range metadata[5].([]interface{}) {
+		kv := kv.(map[int16]interface{})
+		if string(kv[1].([]byte)) == "geo" {
+			if err := json.Unmarshal(kv[2].([]byte), &geo); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if geo == nil {
+		t.Fatal("no geo metadata")
+	}
+	if geo["version"] != geoParquetVersion || geo["primary_column"] != "geometry" {
+		t.Errorf("geo metadata %v", geo)
+	}
+	column := geo["columns"].(map[string]interface{})["geometry"].(map[string]interface{})
+	if column["encoding"] != "WKB" {
+		t.Errorf("encoding %v", column["encoding"])
+	}
+	if !reflect.DeepEqual(column["geometry_types"], []interface{}{"Point"}) {
+		t.Errorf("geometry_types %v, want [Point]", column["geometry_types"])
+	}
+	if !reflect.DeepEqual(column["bbox"], []interface{}{0.0, 0.0, 10.0, 11.0}) {
+		t.Errorf("bbox %v, want [0 0 10 11]", column["bbox"])
+	}
+	if _, ok := column["crs"]; ok {
+		t.Errorf("crs is set for the default CRS")
+	}
+
+	// Row groups follow the Hilbert order and carry the bbox of their rows
+	// in the statistics; the null geometry comes last
+	double := func(v interface{}) float64 {
+		return math.Float64frombits(binary.LittleEndian.Uint64(v.([]byte)))
+	}
+	groups := metadata[4].([]interface{})
+	if len(groups) != 3 {
+		t.Fatalf("%d row groups, want 3", len(groups))
+	}
+	boxes := map[[4]float64]bool{}
+	for i, g := range groups {
+		g := g.(map[int16]interface{})
+		columns := parquetColumnStats(g)
+		wantRows, wantNulls := int64(2), int64(0)
+		if i == 2 {
+			wantRows, wantNulls = 1, 1
+		}
+		if n := g[3].(int64); n != wantRows {
+			t.Errorf("row group %d has %d rows, want %d", i, n, wantRows)
+		}
+		for _, name := range []string{"geometry", "bbox.xmin", "bbox.ymin", "bbox.xmax", "bbox.ymax"} {
+			stats := columns[name][12].(map[int16]interface{})
+			if n := stats[3].(int64); n != wantNulls {
+				t.Errorf("row group %d: %s has %d nulls, want %d", i, name, n, wantNulls)
+			}
+		}
+		if i == 2 {
+			if _, ok := columns["bbox.xmin"][12].(map[int16]interface{})[6]; ok {
+				t.Errorf("row group of a null geometry has bbox statistics")
+			}
+			continue
+		}
+		stat := func(name string, id int16) float64 {
+			return double(columns[name][12].(map[int16]interface{})[id])
+		}
+		boxes[[4]float64{stat("bbox.xmin", 6), stat("bbox.ymin", 6), stat("bbox.xmax", 5), stat("bbox.ymax", 5)}] = true
+	}
+	want := map[[4]float64]bool{{0, 0, 0, 1}: true, {10, 10, 10, 11}: true}
+	if !reflect.DeepEqual(boxes, want) {
+		t.Errorf("row group boxes %v, want %v", boxes, want)
+	}
+}
+
+func TestParquetRequiredGeometry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cadastral.parquet")
+	spool, err := createParquetSpool(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cadNum, err := ParseCadastralNumber("16:50:011001:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj := &CadastralObject{CadNum: cadNum, LoadStatus: "loaded"}
+	point := &geom.Point{Layout: geom.XY, Coords: []float64{1, 2}}
+	if err := spool.add(point, objectRowValues(obj, nil)); err != nil {
+		t.Fatal(err)
+	}
+	opts := ParquetOptions{OutputFile: path, CRS: crs.WebMercator, RowGroupSize: 10, Compression: compressionNone}
+	if err := spool.finish(opts); err != nil {
+		t.Fatal(err)
+	}
+
+	metadata := readParquetFooter(t, path)
+	for _, e := range metadata[2].([]interface{}) {
+		e := e.(map[int16]interface{})
+		if name := string(e[4].([]byte)); (name == "geometry" || name == "bbox") && e[3].(int64) != parquetRequired {
+			t.Errorf("%s is not required without null geometries", name)
+		}
+	}
+	for _, kv := range metadata[5].([]interface{}) {
+		kv := kv.(map[int16]interface{})
+		if string(kv[1].([]byte)) == "geo" && !strings.Contains(string(kv[2].([]byte)), `"crs":`) {
+			t.Errorf("geo metadata has no crs for EPSG:3857")
+		}
+	}
+}
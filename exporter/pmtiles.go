@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+const (
+	// pmtilesHeaderSize is the size of the PMTiles version 3 header
+	pmtilesHeaderSize = 127
+	// pmtilesRootSize is the space for the root directory: the header and
+	// the root directory must fit the first 16 KiB
+	pmtilesRootSize = 16384 - pmtilesHeaderSize
+
+	pmtilesCompressionGzip = 2
+	pmtilesTileTypeMVT     = 1
+)
+
+// pmtilesTileID returns the PMTiles id of a tile: the number of tiles of
+// the lower zoom levels plus the position of the tile on the Hilbert curve
+// of its level
+func pmtilesTileID(z, x, y int) uint64 {
+	id := (uint64(1)<<(2*z) - 1) / 3
+	for s := 1 << z >> 1; s > 0; s >>= 1 {
+		var rx, ry int
+		if x&s != 0 {
+			rx = 1
+		}
+		if y&s != 0 {
+			ry = 1
+		}
+		id += uint64(s) * uint64(s) * uint64((3*rx)^ry)
+		if ry == 0 {
+			if rx == 1 {
+				x, y = s-1-x&(s-1), s-1-y&(s-1)
+			}
+			x, y = y, x
+		}
+	}
+	return id
+}
+
+// pmtilesEntry is a directory entry: a run of tiles sharing data, or with
+// a run length of 0 a leaf directory
+type pmtilesEntry struct {
+	tileID    uint64
+	offset    uint64
+	length    uint32
+	runLength uint32
+}
+
+// pmtilesWriter writes a single-file PMTiles version 3 archive. Tile data
+// is spooled to a temporary file until the directories, which precede it,
+// are known.
+type pmtilesWriter struct {
+	path    string
+	meta    tilesetMetadata
+	spool   *os.File
+	w       *bufio.Writer
+	entries []pmtilesEntry
+	size    uint64
+}
+
+// createPMTiles starts a PMTiles archive
+func createPMTiles(path string, meta tilesetMetadata) (*pmtilesWriter, error) {
+	spool, err := os.Create(path + ".tiles")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create tile spool: %w", err)
+	}
+	return &pmtilesWriter{path: path, meta: meta, spool: spool, w: bufio.NewWriter(spool)}, nil
+}
+
+// WriteTile appends a tile; tiles must come in ascending tile id order,
+// which keeps the archive clustered
+func (p *pmtilesWriter) WriteTile(z, x, y int, data []byte) error {
+	id := pmtilesTileID(z, x, y)
+	if n := len(p.entries); n > 0 && id <= p.entries[n-1].tileID {
+		return fmt.Errorf("tile %d/%d/%d is out of order", z, x, y)
+	}
+	if _, err := p.w.Write(data); err != nil {
+		return fmt.Errorf("failed to write tile spool: %w", err)
+	}
+	p.entries = append(p.entries, pmtilesEntry{tileID: id, offset: p.size, length: uint32(len(data)), runLength: 1})
+	p.size += uint64(len(data))
+	return nil
+}
+
+// Close writes the archive: header, root directory, metadata, leaf
+// directories and the tile data
+func (p *pmtilesWriter) Close() (err error) {
+	defer func() {
+		p.spool.Close()
+		os.Remove(p.spool.Name())
+	}()
+	if err := p.w.Flush(); err != nil {
+		return fmt.Errorf("failed to write tile spool: %w", err)
+	}
+
+	root, leaves, err := pmtilesDirectories(p.entries)
+	if err != nil {
+		return err
+	}
+	metadata, err := json.Marshal(map[string]interface{}{
+		"name":          p.meta.Name,
+		"description":   p.meta.Description,
+		"type":          "overlay",
+		"vector_layers": p.meta.Layers,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode metadata: %w", err)
+	}
+	if metadata, err = gzipBytes(metadata); err != nil {
+		return err
+	}
+
+	file, err := os.Create(p.path)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", p.path, err)
+	}
+	defer func() {
+		if cerr := file.Close(); err == nil && cerr != nil {
+			err = fmt.Errorf("failed to write %s: %w", p.path, cerr)
+		}
+	}()
+
+	rootOffset := uint64(pmtilesHeaderSize)
+	metadataOffset := rootOffset + uint64(len(root))
+	leavesOffset := metadataOffset + uint64(len(metadata))
+	dataOffset := leavesOffset + uint64(len(leaves))
+
+	h := []byte("PMTiles\x03")
+	for _, v := range []uint64{
+		rootOffset, uint64(len(root)),
+		metadataOffset, uint64(len(metadata)),
+		leavesOffset, uint64(len(leaves)),
+		dataOffset, p.size,
+		uint64(len(p.entries)), uint64(len(p.entries)), uint64(len(p.entries)),
+	} {
+		h = binary.LittleEndian.AppendUint64(h, v)
+	}
+	h = append(h, 1, pmtilesCompressionGzip, pmtilesCompressionGzip, pmtilesTileTypeMVT,
+		byte(p.meta.MinZoom), byte(p.meta.MaxZoom))
+	b := p.meta.Bounds
+	for _, v := range []float64{b[0], b[1], b[2], b[3]} {
+		h = binary.LittleEndian.AppendUint32(h, uint32(int32(math.Round(v*1e7))))
+	}
+	h = append(h, byte(p.meta.MinZoom))
+	h = binary.LittleEndian.AppendUint32(h, uint32(int32(math.Round((b[0]+b[2])/2*1e7))))
+	h = binary.LittleEndian.AppendUint32(h, uint32(int32(math.Round((b[1]+b[3])/2*1e7))))
+
+	w := bufio.NewWriter(file)
+	for _, section := range [][]byte{h, root, metadata, leaves} {
+		w.Write(section)
+	}
+	if _, err := p.spool.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to read tile spool: %w", err)
+	}
+	if _, err := io.Copy(w, p.spool); err != nil {
+		return fmt.Errorf("failed to write %s: %w", p.path, err)
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", p.path, err)
+	}
+	return nil
+}
+
+// pmtilesDirectories returns the root directory and the leaf directories.
+// All entries go in the root if it fits; otherwise they are split into
+// leaves, growing the leaves until the root of leaf entries fits.
+func pmtilesDirectories(entries []pmtilesEntry) (root, leaves []byte, err error) {
+	if root, err = encodePMTilesDirectory(entries); err != nil || len(root) <= pmtilesRootSize {
+		return root, nil, err
+	}
+
+	for leafSize := max(len(entries)/3500, 4096); ; leafSize += leafSize / 5 {
+		var rootEntries []pmtilesEntry
+		leaves = nil
+		for i := 0; i < len(entries); i += leafSize {
+			leaf, err := encodePMTilesDirectory(entries[i:min(i+leafSize, len(entries))])
+			if err != nil {
+				return nil, nil, err
+			}
+			rootEntries = append(rootEntries, pmtilesEntry{
+				tileID: entries[i].tileID,
+				offset: uint64(len(leaves)),
+				length: uint32(len(leaf)),
+			})
+			leaves = append(leaves, leaf...)
+		}
+		if root, err = encodePMTilesDirectory(rootEntries); err != nil || len(root) <= pmtilesRootSize {
+			return root, leaves, err
+		}
+	}
+}
+
+// encodePMTilesDirectory serializes and compresses directory entries:
+// the count, then the tile id deltas, run lengths, lengths and offsets as
+// varints. An offset is written as 0 when the data directly follows the
+// previous entry and as offset+1 otherwise.
+func encodePMTilesDirectory(entries []pmtilesEntry) ([]byte, error) {
+	b := binary.AppendUvarint(nil, uint64(len(entries)))
+	var last uint64
+	for _, e := range entries {
+		b = binary.AppendUvarint(b, e.tileID-last)
+		last = e.tileID
+	}
+	for _, e := range entries {
+		b = binary.AppendUvarint(b, uint64(e.runLength))
+	}
+	for _, e := range entries {
+		b = binary.AppendUvarint(b, uint64(e.length))
+	}
+	for i, e := range entries {
+		if i > 0 && e.offset == entries[i-1].offset+uint64(entries[i-1].length) {
+			b = binary.AppendUvarint(b, 0)
+		} else {
+			b = binary.AppendUvarint(b, e.offset+1)
+		}
+	}
+	return gzipBytes(b)
+}
+
+// gzipBytes compresses data with gzip
+func gzipBytes(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, fmt.Errorf("failed to compress: %w", err)
+	}
+	if err := zw.Close(); err != nil {
+		return nil, fmt.Errorf("failed to compress: %w", err)
+	}
+	return buf.Bytes(), nil
+}
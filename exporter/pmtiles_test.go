@@ -0,0 +1,61 @@
+package main
+
+import "testing"
+
+func TestPMTilesTileID(t *testing.T) {
+	// Published values of the PMTiles version 3 specification and its
+	// reference implementations
+	tests := []struct {
+		z, x, y int
+		id      uint64
+	}{
+		{0, 0, 0, 0},
+		{1, 0, 0, 1},
+		{1, 0, 1, 2},
+		{1, 1, 1, 3},
+		{1, 1, 0, 4},
+		{2, 0, 0, 5},
+		{12, 3423, 1763, 19078479},
+	}
+	for _, tt := range tests {
+		if id := pmtilesTileID(tt.z, tt.x, tt.y); id != tt.id {
+			t.Errorf("pmtilesTileID(%d, %d, %d) = %d, want %d", tt.z, tt.x, tt.y, id, tt.id)
+		}
+	}
+}
+
+// The ids of a level fill the range after the lower levels, and tiles with
+// consecutive ids are neighbours along the Hilbert curve
+func TestPMTilesTileIDLevels(t *testing.T) {
+	var base uint64
+	for z := 0; z <= 6; z++ {
+		n := 1 << z
+		tiles := make(map[uint64][2]int, n*n)
+		for x := 0; x < n; x++ {
+			for y := 0; y < n; y++ {
+				id := pmtilesTileID(z, x, y)
+				if id < base || id >= base+uint64(n*n) {
+					t.Fatalf("zoom %d: id %d of %d/%d outside [%d, %d)", z, id, x, y, base, base+uint64(n*n))
+				}
+				if prev, ok := tiles[id]; ok {
+					t.Fatalf("zoom %d: %d/%d and %d/%d share id %d", z, prev[0], prev[1], x, y, id)
+				}
+				tiles[id] = [2]int{x, y}
+			}
+		}
+		for id := base + 1; id < base+uint64(n*n); id++ {
+			a, b := tiles[id-1], tiles[id]
+			if d := intAbs(a[0]-b[0]) + intAbs(a[1]-b[1]); d != 1 {
+				t.Errorf("zoom %d: ids %d and %d are tiles %v and %v", z, id-1, id, a, b)
+			}
+		}
+		base += uint64(n * n)
+	}
+}
+
+func intAbs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+
+	"exporter/crs"
+	"exporter/geom"
+)
+
+// legacyCRS returns the pre-RFC 7946 "crs" member naming a CRS
+func legacyCRS(c *crs.CRS) map[string]interface{} {
+	return map[string]interface{}{
+		"type": "name",
+		"properties": map[string]interface{}{
+			"name": c.URN(),
+		},
+	}
+}
+
+// geometryWithCRS encodes a geometry with a "crs" member, for GeoJSON
+// sequences whose features cannot share a collection level crs
+type geometryWithCRS struct {
+	geometry geom.Geometry
+	crs      interface{}
+}
+
+// MarshalJSON encodes the geometry object and appends the crs member
+func (g geometryWithCRS) MarshalJSON() ([]byte, error) {
+	b, err := json.Marshal(g.geometry)
+	if err != nil {
+		return nil, err
+	}
+	crs, err := json.Marshal(g.crs)
+	if err != nil {
+		return nil, err
+	}
+	b = append(b[:len(b)-1], `,"crs":`...)
+	b = append(b, crs...)
+	return append(b, '}'), nil
+}
+
+// applyRFC7946 makes a WGS84 geometry conform to RFC 7946: polygon rings
+// are oriented counter-clockwise (exterior) and clockwise (holes), and
+// polygons crossing the antimeridian are split into a MultiPolygon.
+// It returns the resulting geometry and its bbox [west, south, east, north],
+// where west is greater than east for geometries crossing the antimeridian.
+func applyRFC7946(geometry geom.Geometry) (geom.Geometry, []float64, error) {
+	stride := geometry.CoordLayout().Stride()
+
+	switch g := geometry.(type) {
+	case *geom.Point:
+		if g.IsEmpty() {
+			return g, nil, nil
+		}
+		return g, []float64{g.Coords[0], g.Coords[1], g.Coords[0], g.Coords[1]}, nil
+
+	case *geom.MultiPoint:
+		return g, coordinatesBBox([][]float64{g.Coords}, stride, false), nil
+
+	case *geom.LineString:
+		line, crosses := unwrapLongitudes(g.Coords, stride)
+		g.Coords = wrapLongitudes(line, stride)
+		return g, coordinatesBBox([][]float64{g.Coords}, stride, crosses), nil
+
+	case *geom.MultiLineString:
+		var bbox []float64
+		for i, line := range g.Lines {
+			unwrapped, crosses := unwrapLongitudes(line, stride)
+			g.Lines[i] = wrapLongitudes(unwrapped, stride)
+			bbox = extendBBox(bbox, coordinatesBBox([][]float64{g.Lines[i]}, stride, crosses))
+		}
+		return g, bbox, nil
+
+	case *geom.GeometryCollection:
+		var bbox []float64
+		for i, member := range g.Geometries {
+			converted, memberBBox, err := applyRFC7946(member)
+			if err != nil {
+				return nil, nil, err
+			}
+			g.Geometries[i] = converted
+			bbox = extendBBox(bbox, memberBBox)
+		}
+		return g, bbox, nil
+
+	case *geom.Polygon, *geom.MultiPolygon:
+		var polygons [][][]float64
+		if polygon, ok := g.(*geom.Polygon); ok {
+			polygons = [][][]float64{polygon.Rings}
+		} else {
+			polygons = g.(*geom.MultiPolygon).Polygons
+		}
+
+		layout := geometry.CoordLayout()
+		var result [][][]float64
+		var allRings [][]float64
+		crosses := false
+		for _, polygon := range polygons {
+			parts, split := splitAntimeridian(polygon, stride)
+			crosses = crosses || split
+			for _, part := range parts {
+				orientPolygon(part, layout)
+				allRings = append(allRings, part...)
+			}
+			result = append(result, parts...)
+		}
+
+		bbox := coordinatesBBox(allRings, stride, crosses)
+		if _, ok := g.(*geom.Polygon); ok && len(result) == 1 {
+			return &geom.Polygon{Layout: layout, Rings: result[0]}, bbox, nil
+		}
+		return &geom.MultiPolygon{Layout: layout, Polygons: result}, bbox, nil
+
+	default:
+		return nil, nil, fmt.Errorf("unsupported geometry type: %s", geometry.GeometryType())
+	}
+}
+
+// roundCoordinates rounds every coordinate of a geometry to the given
+// number of decimals
+func roundCoordinates(geometry geom.Geometry, decimals int) {
+	scale := math.Pow(10, float64(decimals))
+	geometry.EachPosition(func(p []float64) {
+		for i, v := range p {
+			p[i] = math.Round(v*scale) / scale
+		}
+	})
+}
+
+// roundBBox rounds the bbox outwards to the given number of decimals so that
+// it still contains the rounded coordinates
+func roundBBox(bbox []float64, decimals int) []float64 {
+	if bbox == nil {
+		return nil
+	}
+	scale := math.Pow(10, float64(decimals))
+	return []float64{
+		math.Floor(bbox[0]*scale) / scale,
+		math.Floor(bbox[1]*scale) / scale,
+		math.Ceil(bbox[2]*scale) / scale,
+		math.Ceil(bbox[3]*scale) / scale,
+	}
+}
+
+// orientPolygon reverses rings so that the exterior ring is counter-clockwise
+// and the holes are clockwise
+func orientPolygon(polygon [][]float64, layout geom.Layout) {
+	for i, ring := range polygon {
+		area := geom.RingSignedArea(ring, layout)
+		if (i == 0 && area < 0) || (i > 0 && area > 0) {
+			geom.ReverseRing(ring, layout)
+		}
+	}
+}
+
+// unwrapLongitudes removes jumps of more than 180 degrees between
+// consecutive points so that a line crossing the antimeridian becomes
+// continuous, reporting whether any point ended up outside [-180, 180]
+func unwrapLongitudes(coords []float64, stride int) ([]float64, bool) {
+	unwrapped := append([]float64(nil), coords...)
+	offset := 0.0
+	crosses := false
+	for i := 0; i < len(coords); i += stride {
+		if i > 0 {
+			delta := coords[i] - coords[i-stride]
+			if delta > 180 {
+				offset -= 360
+			} else if delta < -180 {
+				offset += 360
+			}
+		}
+		unwrapped[i] += offset
+		if unwrapped[i] > 180 || unwrapped[i] < -180 {
+			crosses = true
+		}
+	}
+	return unwrapped, crosses
+}
+
+// wrapLongitudes brings longitudes back into [-180, 180]
+func wrapLongitudes(coords []float64, stride int) []float64 {
+	for i := 0; i < len(coords); i += stride {
+		for coords[i] > 180 {
+			coords[i] -= 360
+		}
+		for coords[i] < -180 {
+			coords[i] += 360
+		}
+	}
+	return coords
+}
+
+// splitAntimeridian cuts a polygon crossing the antimeridian into the part
+// east of it and the part west of it, as RFC 7946 section 3.1.9 requires
+func splitAntimeridian(polygon [][]float64, stride int) ([][][]float64, bool) {
+	unwrapped := make([][]float64, len(polygon))
+	crosses := false
+	for i, ring := range polygon {
+		var c bool
+		unwrapped[i], c = unwrapLongitudes(ring, stride)
+		crosses = crosses || c
+
+		// Keep holes in the same continuous longitude range as the exterior
+		if i > 0 && len(unwrapped[i]) > 0 && len(unwrapped[0]) > 0 {
+			shift := math.Round((unwrapped[0][0]-unwrapped[i][0])/360) * 360
+			for j := 0; j < len(unwrapped[i]); j += stride {
+				unwrapped[i][j] += shift
+				if unwrapped[i][j] > 180 || unwrapped[i][j] < -180 {
+					crosses = true
+				}
+			}
+		}
+	}
+	if !crosses {
+		return [][][]float64{polygon}, false
+	}
+
+	// The unwrapped polygon spans a meridian at ±180; clip it on both sides
+	meridian := 180.0
+	if unwrapped[0][0] < 0 {
+		meridian = -180.0
+	}
+
+	var parts [][][]float64
+	for _, keepEast := range []bool{false, true} {
+		var part [][]float64
+		for _, ring := range unwrapped {
+			clipped := clipRingAtLongitude(ring, stride, meridian, keepEast)
+			if len(clipped) >= 4*stride {
+				part = append(part, wrapLongitudes(clipped, stride))
+			} else if len(part) == 0 {
+				// The exterior ring is entirely on the other side
+				break
+			}
+		}
+		if len(part) > 0 {
+			parts = append(parts, part)
+		}
+	}
+	return parts, true
+}
+
+// clipRingAtLongitude clips a closed ring against the half plane east or
+// west of a meridian using the Sutherland–Hodgman algorithm. Z and M values
+// of cut points are interpolated.
+func clipRingAtLongitude(ring []float64, stride int, lon float64, keepEast bool) []float64 {
+	inside := func(p []float64) bool {
+		if keepEast {
+			return p[0] >= lon
+		}
+		return p[0] <= lon
+	}
+	intersect := func(a, b []float64) []float64 {
+		t := (lon - a[0]) / (b[0] - a[0])
+		p := make([]float64, stride)
+		for k := range p {
+			p[k] = a[k] + t*(b[k]-a[k])
+		}
+		p[0] = lon
+		return p
+	}
+
+	var out []float64
+	for i := 0; i+2*stride <= len(ring); i += stride {
+		a, b := ring[i:i+stride], ring[i+stride:i+2*stride]
+		switch {
+		case inside(a) && inside(b):
+			out = append(out, b...)
+		case inside(a) && !inside(b):
+			out = append(out, intersect(a, b)...)
+		case !inside(a) && inside(b):
+			out = append(out, intersect(a, b)...)
+			out = append(out, b...)
+		}
+	}
+	if len(out) > 0 {
+		first := out[:stride]
+		last := out[len(out)-stride:]
+		if first[0] != last[0] || first[1] != last[1] {
+			out = append(out, first...)
+		}
+	}
+
+	// Nudge points on the cut so that the east part sits at +180 and the
+	// west part at -180 once wrapped
+	for i := 0; i < len(out); i += stride {
+		if out[i] == lon && keepEast == (lon > 0) {
+			out[i] = lon - math.Copysign(360, lon)
+		}
+	}
+	return out
+}
+
+// coordinatesBBox returns [west, south, east, north] of the rings; for
+// geometries crossing the antimeridian west is the smallest longitude of the
+// eastern hemisphere and east the largest longitude of the western one
+func coordinatesBBox(rings [][]float64, stride int, crossesAntimeridian bool) []float64 {
+	bbox := []float64{math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)}
+	west, east := math.Inf(1), math.Inf(-1)
+	for _, ring := range rings {
+		for i := 0; i+1 < len(ring); i += stride {
+			x, y := ring[i], ring[i+1]
+			if crossesAntimeridian {
+				if x >= 0 {
+					west = math.Min(west, x)
+				} else {
+					east = math.Max(east, x)
+				}
+			} else {
+				bbox[0] = math.Min(bbox[0], x)
+				bbox[2] = math.Max(bbox[2], x)
+			}
+			bbox[1] = math.Min(bbox[1], y)
+			bbox[3] = math.Max(bbox[3], y)
+		}
+	}
+	if crossesAntimeridian {
+		bbox[0], bbox[2] = west, east
+	}
+	if math.IsInf(bbox[1], 1) {
+		return nil
+	}
+	return bbox
+}
+
+// extendBBox merges bbox b into a, taking bboxes that cross the antimeridian
+// (west > east) into account. A nil a is treated as empty.
+func extendBBox(a, b []float64) []float64 {
+	if len(b) < 4 {
+		return a
+	}
+	if a == nil {
+		return append([]float64(nil), b...)
+	}
+
+	// Work with continuous longitudes where east may exceed 180
+	unwrapEast := func(bbox []float64) float64 {
+		if bbox[0] > bbox[2] {
+			return bbox[2] + 360
+		}
+		return bbox[2]
+	}
+	west := math.Min(a[0], b[0])
+	east := math.Max(unwrapEast(a), unwrapEast(b))
+	if east-west >= 360 {
+		west, east = -180, 180
+	} else if east > 180 {
+		east -= 360
+	}
+
+	return []float64{west, math.Min(a[1], b[1]), east, math.Max(a[3], b[3])}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// createExtensionsTable creates gpkg_extensions, which lists the extensions
+// a GeoPackage uses
+func createExtensionsTable(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS gpkg_extensions (
+			table_name TEXT,
+			column_name TEXT,
+			extension_name TEXT NOT NULL,
+			definition TEXT NOT NULL,
+			scope TEXT NOT NULL,
+			CONSTRAINT ge_tce UNIQUE (table_name, column_name, extension_name)
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create gpkg_extensions: %w", err)
+	}
+	return nil
+}
+
+// registerTableExtension registers an extension that applies to a whole
+// table. column_name is NULL, which the unique constraint of gpkg_extensions
+// does not cover, so the row is only inserted if missing.
+func registerTableExtension(db *sql.DB, table, extension, definition, scope string) error {
+	_, err := db.Exec(`
+		INSERT INTO gpkg_extensions (table_name, column_name, extension_name, definition, scope)
+		SELECT ?, NULL, ?, ?, ?
+		WHERE NOT EXISTS (
+			SELECT 1 FROM gpkg_extensions
+			WHERE table_name = ? AND column_name IS NULL AND extension_name = ?
+		)
+	`, table, extension, definition, scope, table, extension)
+	if err != nil {
+		return fmt.Errorf("failed to register %s extension of %s: %w", extension, table, err)
+	}
+	return nil
+}
+
+// rtreeTable returns the name of the R-tree index of a geometry column
+func rtreeTable(table, column string) string {
+	return "rtree_" + table + "_" + column
+}
+
+// createSpatialIndex creates the R-tree virtual table of a geometry column
+// and registers the gpkg_rtree_index extension for it. The maintenance
+// triggers are created separately by createSpatialIndexTriggers, so the
+// index can be bulk loaded first.
+func createSpatialIndex(db *sql.DB, table, column string) error {
+	rtree := rtreeTable(table, column)
+	if _, err := db.Exec(fmt.Sprintf(
+		"CREATE VIRTUAL TABLE IF NOT EXISTS %s USING rtree(id, minx, maxx, miny, maxy)", rtree)); err != nil {
+		return fmt.Errorf("failed to create %s: %w", rtree, err)
+	}
+
+	_, err := db.Exec(`
+		INSERT OR REPLACE INTO gpkg_extensions
+		(table_name, column_name, extension_name, definition, scope)
+		VALUES (?, ?, 'gpkg_rtree_index', 'http://www.geopackage.org/spec120/#extension_rtree', 'write-only')
+	`, table, column)
+	if err != nil {
+		return fmt.Errorf("failed to register spatial index of %s: %w", table, err)
+	}
+	return nil
+}
+
+// spatialIndexTriggers holds the maintenance triggers of GeoPackage 1.3,
+// Annex F.3, with <t>, <c> and <i> standing for the table, geometry column
+// and primary key column
+var spatialIndexTriggers = []string{
+	`CREATE TRIGGER IF NOT EXISTS rtree_<t>_<c>_insert AFTER INSERT ON <t>
+	WHEN (new.<c> NOT NULL AND NOT ST_IsEmpty(NEW.<c>))
+	BEGIN
+		INSERT OR REPLACE INTO rtree_<t>_<c> VALUES (
+			NEW.<i>,
+			ST_MinX(NEW.<c>), ST_MaxX(NEW.<c>),
+			ST_MinY(NEW.<c>), ST_MaxY(NEW.<c>)
+		);
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS rtree_<t>_<c>_update1 AFTER UPDATE OF <c> ON <t>
+	WHEN OLD.<i> = NEW.<i> AND (NEW.<c> NOTNULL AND NOT ST_IsEmpty(NEW.<c>))
+	BEGIN
+		INSERT OR REPLACE INTO rtree_<t>_<c> VALUES (
+			NEW.<i>,
+			ST_MinX(NEW.<c>), ST_MaxX(NEW.<c>),
+			ST_MinY(NEW.<c>), ST_MaxY(NEW.<c>)
+		);
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS rtree_<t>_<c>_update2 AFTER UPDATE OF <c> ON <t>
+	WHEN OLD.<i> = NEW.<i> AND (NEW.<c> ISNULL OR ST_IsEmpty(NEW.<c>))
+	BEGIN
+		DELETE FROM rtree_<t>_<c> WHERE id = OLD.<i>;
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS rtree_<t>_<c>_update3 AFTER UPDATE ON <t>
+	WHEN OLD.<i> != NEW.<i> AND (NEW.<c> NOTNULL AND NOT ST_IsEmpty(NEW.<c>))
+	BEGIN
+		DELETE FROM rtree_<t>_<c> WHERE id = OLD.<i>;
+		INSERT OR REPLACE INTO rtree_<t>_<c> VALUES (
+			NEW.<i>,
+			ST_MinX(NEW.<c>), ST_MaxX(NEW.<c>),
+			ST_MinY(NEW.<c>), ST_MaxY(NEW.<c>)
+		);
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS rtree_<t>_<c>_update4 AFTER UPDATE ON <t>
+	WHEN OLD.<i> != NEW.<i> AND (NEW.<c> ISNULL OR ST_IsEmpty(NEW.<c>))
+	BEGIN
+		DELETE FROM rtree_<t>_<c> WHERE id IN (OLD.<i>, NEW.<i>);
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS rtree_<t>_<c>_delete AFTER DELETE ON <t>
+	WHEN old.<c> NOT NULL
+	BEGIN
+		DELETE FROM rtree_<t>_<c> WHERE id = OLD.<i>;
+	END`,
+}
+
+// createSpatialIndexTriggers creates the triggers that keep the R-tree of a
+// geometry column in sync with later edits. The triggers call the ST_*
+// functions registered by the gpkgDriver.
+func createSpatialIndexTriggers(db *sql.DB, table, column, idColumn string) error {
+	replacer := strings.NewReplacer("<t>", table, "<c>", column, "<i>", idColumn)
+	for _, trigger := range spatialIndexTriggers {
+		if _, err := db.Exec(replacer.Replace(trigger)); err != nil {
+			return fmt.Errorf("failed to create spatial index trigger on %s: %w", table, err)
+		}
+	}
+	return nil
+}
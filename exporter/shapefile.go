@@ -0,0 +1,520 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"exporter/crs"
+	"exporter/geom"
+)
+
+// Shape types of the ESRI Shapefile Technical Description
+const (
+	shapeNull        = 0
+	shapePoint       = 1
+	shapePolyLine    = 3
+	shapePolygon     = 5
+	shapeMultiPoint  = 8
+	shapePointZ      = 11
+	shapePolyLineZ   = 13
+	shapePolygonZ    = 15
+	shapeMultiPointZ = 18
+	shapePointM      = 21
+	shapePolyLineM   = 23
+	shapePolygonM    = 25
+	shapeMultiPointM = 28
+)
+
+// maxShapefilePartSize is the size limit of the .shp and .dbf of one
+// shapefile: offsets are 32-bit and most readers treat them as signed
+const maxShapefilePartSize = math.MaxInt32
+
+// shapefileNoData is the M value written for positions without one; the
+// specification treats any value below -10^38 as no data
+const shapefileNoData = -1e39
+
+// shapefileHeaderSize is the size of the .shp and .shx headers
+const shapefileHeaderSize = 100
+
+// Shapefile DBF encodings, given by -encoding
+const (
+	encodingUTF8   = "utf-8"
+	encodingCP1251 = "cp1251"
+)
+
+// shapeTypeOf returns the shape type holding a geometry, with Z for XYZ
+// and XYZM layouts and M for XYM; ok is false for geometry collections
+func shapeTypeOf(g geom.Geometry) (shapeType int, ok bool) {
+	switch g.(type) {
+	case *geom.Point:
+		shapeType = shapePoint
+	case *geom.MultiPoint:
+		shapeType = shapeMultiPoint
+	case *geom.LineString, *geom.MultiLineString:
+		shapeType = shapePolyLine
+	case *geom.Polygon, *geom.MultiPolygon:
+		shapeType = shapePolygon
+	default:
+		return shapeNull, false
+	}
+	switch layout := g.CoordLayout(); {
+	case layout.HasZ():
+		shapeType += 10
+	case layout.HasM():
+		shapeType += 20
+	}
+	return shapeType, true
+}
+
+// shapeTypeName returns the lowercase name of a shape type, e.g. polygonz
+func shapeTypeName(shapeType int) string {
+	names := map[int]string{
+		shapePoint: "point", shapePolyLine: "polyline", shapePolygon: "polygon", shapeMultiPoint: "multipoint",
+	}
+	switch {
+	case shapeType > 20:
+		return names[shapeType-20] + "m"
+	case shapeType > 10:
+		return names[shapeType-10] + "z"
+	}
+	return names[shapeType]
+}
+
+// dbfField is a column of a DBF table
+type dbfField struct {
+	Name string
+	// Type is C (character), N (numeric), L (logical) or D (date)
+	Type     byte
+	Length   int
+	Decimals int
+}
+
+// shapefileWriter writes one shapefile: the .shp geometries, the .shx
+// index, the .dbf attributes and the .prj and .cpg sidecars. Headers are
+// rewritten with the final sizes and extent on Close.
+type shapefileWriter struct {
+	base      string
+	shapeType int
+	fields    []dbfField
+	encoding  string
+
+	shp, shx, dbf    *os.File
+	shpW, shxW, dbfW *bufio.Writer
+
+	records    int
+	shpSize    int64
+	dbfSize    int64
+	recordSize int
+	bounds     geom.Bounds
+	zMin, zMax float64
+	mMin, mMax float64
+}
+
+// createShapefile creates the files of a shapefile named base (without
+// extension) for one shape type
+func createShapefile(base string, shapeType int, fields []dbfField, encoding string, target *crs.CRS) (*shapefileWriter, error) {
+	w := &shapefileWriter{
+		base:      base,
+		shapeType: shapeType,
+		fields:    fields,
+		encoding:  encoding,
+		bounds:    geom.EmptyBounds(),
+		zMin:      math.Inf(1), zMax: math.Inf(-1),
+		mMin: math.Inf(1), mMax: math.Inf(-1),
+	}
+
+	// The sidecars are small and complete right away
+	cpg := "UTF-8"
+	if encoding == encodingCP1251 {
+		cpg = "1251"
+	}
+	if err := os.WriteFile(base+".cpg", []byte(cpg+"\n"), 0644); err != nil {
+		return nil, fmt.Errorf("failed to write %s.cpg: %w", base, err)
+	}
+	if err := os.WriteFile(base+".prj", []byte(target.WKT()), 0644); err != nil {
+		return nil, fmt.Errorf("failed to write %s.prj: %w", base, err)
+	}
+
+	files := []struct {
+		file **os.File
+		w    **bufio.Writer
+		ext  string
+	}{{&w.shp, &w.shpW, ".shp"}, {&w.shx, &w.shxW, ".shx"}, {&w.dbf, &w.dbfW, ".dbf"}}
+	for _, f := range files {
+		file, err := os.Create(base + f.ext)
+		if err != nil {
+			w.closeFiles()
+			return nil, fmt.Errorf("failed to create %s%s: %w", base, f.ext, err)
+		}
+		*f.file, *f.w = file, bufio.NewWriter(file)
+	}
+
+	// Headers are written now to reserve their space and again on Close
+	w.shpW.Write(w.mainHeader(shapefileHeaderSize))
+	w.shxW.Write(w.mainHeader(shapefileHeaderSize))
+	header := w.dbfHeader()
+	w.dbfW.Write(header)
+	w.shpSize = shapefileHeaderSize
+	w.dbfSize = int64(len(header))
+
+	w.recordSize = 1
+	for _, f := range fields {
+		w.recordSize += f.Length
+	}
+	return w, nil
+}
+
+// fits reports whether a record with the given shape content still fits
+// within the size limit of the .shp and .dbf files
+func (w *shapefileWriter) fits(content []byte) bool {
+	return w.shpSize+8+int64(len(content)) <= maxShapefilePartSize &&
+		w.dbfSize+int64(w.recordSize)+1 <= maxShapefilePartSize
+}
+
+// write appends a record: the shape content from encodeShape and one value
+// per field. It returns the fields whose values were truncated or did not
+// fit their width.
+func (w *shapefileWriter) write(g geom.Geometry, content []byte, values []interface{}) ([]string, error) {
+	record, overflow := w.dbfRecord(values)
+
+	w.records++
+	var header [8]byte
+	binary.BigEndian.PutUint32(header[0:], uint32(w.records))
+	binary.BigEndian.PutUint32(header[4:], uint32(len(content)/2))
+	w.shpW.Write(header[:])
+	w.shpW.Write(content)
+
+	var index [8]byte
+	binary.BigEndian.PutUint32(index[0:], uint32(w.shpSize/2))
+	binary.BigEndian.PutUint32(index[4:], uint32(len(content)/2))
+	w.shxW.Write(index[:])
+	w.shpSize += 8 + int64(len(content))
+
+	w.dbfW.Write(record)
+	w.dbfSize += int64(len(record))
+
+	// bufio errors are sticky, so checking the last writes is enough
+	for _, bw := range []*bufio.Writer{w.shpW, w.shxW, w.dbfW} {
+		if _, err := bw.Write(nil); err != nil {
+			return nil, fmt.Errorf("failed to write %s: %w", w.base, err)
+		}
+	}
+
+	w.bounds.Union(g.Bounds())
+	if min, max, ok := geom.OrdinateRange(g, false); ok {
+		w.zMin, w.zMax = math.Min(w.zMin, min), math.Max(w.zMax, max)
+	}
+	if min, max, ok := geom.OrdinateRange(g, true); ok {
+		w.mMin, w.mMax = math.Min(w.mMin, min), math.Max(w.mMax, max)
+	}
+	return overflow, nil
+}
+
+// Close writes the final headers and the DBF end marker and closes the files
+func (w *shapefileWriter) Close() error {
+	if w.shp == nil {
+		return nil
+	}
+	w.dbfW.WriteByte(0x1A)
+
+	var err error
+	for _, bw := range []*bufio.Writer{w.shpW, w.shxW, w.dbfW} {
+		if ferr := bw.Flush(); err == nil {
+			err = ferr
+		}
+	}
+	if err == nil {
+		_, err = w.shp.WriteAt(w.mainHeader(w.shpSize), 0)
+	}
+	if err == nil {
+		_, err = w.shx.WriteAt(w.mainHeader(shapefileHeaderSize+8*int64(w.records)), 0)
+	}
+	if err == nil {
+		_, err = w.dbf.WriteAt(w.dbfHeader(), 0)
+	}
+	if cerr := w.closeFiles(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", w.base, err)
+	}
+	return nil
+}
+
+// closeFiles closes whichever files are open
+func (w *shapefileWriter) closeFiles() error {
+	var err error
+	for _, f := range []**os.File{&w.shp, &w.shx, &w.dbf} {
+		if *f != nil {
+			if cerr := (*f).Close(); err == nil {
+				err = cerr
+			}
+			*f = nil
+		}
+	}
+	return err
+}
+
+// mainHeader encodes the .shp/.shx header for a file of the given size.
+// Without records the bounding box is zero.
+func (w *shapefileWriter) mainHeader(size int64) []byte {
+	h := make([]byte, shapefileHeaderSize)
+	binary.BigEndian.PutUint32(h[0:], 9994)
+	binary.BigEndian.PutUint32(h[24:], uint32(size/2))
+	binary.LittleEndian.PutUint32(h[28:], 1000)
+	binary.LittleEndian.PutUint32(h[32:], uint32(w.shapeType))
+
+	box := make([]float64, 8)
+	if !w.bounds.IsEmpty() {
+		box[0], box[1], box[2], box[3] = w.bounds.MinX, w.bounds.MinY, w.bounds.MaxX, w.bounds.MaxY
+	}
+	if !math.IsInf(w.zMin, 1) {
+		box[4], box[5] = w.zMin, w.zMax
+	}
+	if !math.IsInf(w.mMin, 1) {
+		box[6], box[7] = w.mMin, w.mMax
+	}
+	for i, v := range box {
+		binary.LittleEndian.PutUint64(h[36+8*i:], math.Float64bits(v))
+	}
+	return h
+}
+
+// dbfHeader encodes the dBASE III header with the field descriptors
+func (w *shapefileWriter) dbfHeader() []byte {
+	headerSize := 32 + 32*len(w.fields) + 1
+	recordSize := 1
+	for _, f := range w.fields {
+		recordSize += f.Length
+	}
+
+	h := make([]byte, headerSize)
+	now := time.Now()
+	h[0] = 0x03
+	h[1], h[2], h[3] = byte(now.Year()-1900), byte(now.Month()), byte(now.Day())
+	binary.LittleEndian.PutUint32(h[4:], uint32(w.records))
+	binary.LittleEndian.PutUint16(h[8:], uint16(headerSize))
+	binary.LittleEndian.PutUint16(h[10:], uint16(recordSize))
+	// Language driver: Russian Windows for CP1251, none for UTF-8, which
+	// readers take from the .cpg
+	if w.encoding == encodingCP1251 {
+		h[29] = 0xC9
+	}
+
+	for i, f := range w.fields {
+		d := h[32+32*i:]
+		copy(d[:10], f.Name)
+		d[11] = f.Type
+		d[16] = byte(f.Length)
+		d[17] = byte(f.Decimals)
+	}
+	h[headerSize-1] = 0x0D
+	return h
+}
+
+// dbfRecord encodes a record. nil values are blank; strings are encoded
+// and truncated to the field length at a character boundary, numbers that
+// do not fit are left blank. It returns the names of the fields affected.
+func (w *shapefileWriter) dbfRecord(values []interface{}) ([]byte, []string) {
+	record := make([]byte, 0, w.recordSize)
+	record = append(record, ' ')
+	var overflow []string
+
+	for i, f := range w.fields {
+		cell := make([]byte, f.Length)
+		for k := range cell {
+			cell[k] = ' '
+		}
+
+		var text []byte
+		switch v := values[i].(type) {
+		case nil:
+			if f.Type == 'L' {
+				text = []byte{'?'}
+			}
+		case string:
+			if f.Type == 'D' {
+				text = []byte(strings.ReplaceAll(v, "-", ""))
+			} else if w.encoding == encodingCP1251 {
+				text = encodeCP1251(v)
+			} else {
+				text = []byte(v)
+			}
+		case bool:
+			text = []byte{'F'}
+			if v {
+				text = []byte{'T'}
+			}
+		case int:
+			text = []byte(strconv.Itoa(v))
+		case int64:
+			text = []byte(strconv.FormatInt(v, 10))
+		case float64:
+			text = []byte(strconv.FormatFloat(v, 'f', f.Decimals, 64))
+		default:
+			text = []byte(fmt.Sprint(v))
+		}
+
+		if len(text) > f.Length {
+			overflow = append(overflow, f.Name)
+			if f.Type != 'C' {
+				text = nil
+			} else {
+				text = truncateText(text, f.Length, w.encoding)
+			}
+		}
+		if f.Type == 'N' {
+			copy(cell[f.Length-len(text):], text)
+		} else {
+			copy(cell, text)
+		}
+		record = append(record, cell...)
+	}
+	return record, overflow
+}
+
+// truncateText cuts encoded text to at most n bytes without splitting a
+// UTF-8 character
+func truncateText(text []byte, n int, encoding string) []byte {
+	text = text[:n]
+	if encoding == encodingCP1251 {
+		return text
+	}
+	for len(text) > 0 && !utf8.Valid(text) {
+		text = text[:len(text)-1]
+	}
+	return text
+}
+
+// encodeShape encodes the record content of a geometry for a shape type
+// from shapeTypeOf. Polygon rings are reoriented in place: the shapefile
+// wants exterior rings clockwise and holes counter-clockwise. An empty
+// geometry is a null shape, which may appear in a file of any shape type.
+func encodeShape(g geom.Geometry, shapeType int) []byte {
+	if g.IsEmpty() {
+		return binary.LittleEndian.AppendUint32(nil, shapeNull)
+	}
+	layout := g.CoordLayout()
+
+	var parts [][]float64
+	switch g := g.(type) {
+	case *geom.Point:
+		return encodePoint(g.Coords, layout, shapeType)
+	case *geom.MultiPoint:
+		parts = [][]float64{g.Coords}
+	case *geom.LineString:
+		parts = [][]float64{g.Coords}
+	case *geom.MultiLineString:
+		parts = g.Lines
+	case *geom.Polygon:
+		orientShapefileRings(g.Rings, layout)
+		parts = g.Rings
+	case *geom.MultiPolygon:
+		for _, polygon := range g.Polygons {
+			orientShapefileRings(polygon, layout)
+			parts = append(parts, polygon...)
+		}
+	}
+
+	stride := layout.Stride()
+	var numPoints int
+	for _, part := range parts {
+		numPoints += len(part) / stride
+	}
+	base := shapeType % 10
+	hasZ, hasM := shapeType > 10 && shapeType < 20, shapeType > 10
+
+	b := make([]byte, 0, 44+4*len(parts)+16*numPoints+2*(16+8*numPoints))
+	b = binary.LittleEndian.AppendUint32(b, uint32(shapeType))
+	bounds := g.Bounds()
+	for _, v := range []float64{bounds.MinX, bounds.MinY, bounds.MaxX, bounds.MaxY} {
+		b = appendFloat64LE(b, v)
+	}
+	if base != shapeMultiPoint {
+		b = binary.LittleEndian.AppendUint32(b, uint32(len(parts)))
+	}
+	b = binary.LittleEndian.AppendUint32(b, uint32(numPoints))
+	if base != shapeMultiPoint {
+		var start int
+		for _, part := range parts {
+			b = binary.LittleEndian.AppendUint32(b, uint32(start))
+			start += len(part) / stride
+		}
+	}
+	for _, part := range parts {
+		for i := 0; i+stride <= len(part); i += stride {
+			b = appendFloat64LE(b, part[i])
+			b = appendFloat64LE(b, part[i+1])
+		}
+	}
+	if hasZ {
+		b = appendOrdinates(b, g, parts, layout.ZIndex(), false)
+	}
+	if hasM {
+		b = appendOrdinates(b, g, parts, layout.MIndex(), true)
+	}
+	return b
+}
+
+// encodePoint encodes the record content of a point
+func encodePoint(coords []float64, layout geom.Layout, shapeType int) []byte {
+	b := binary.LittleEndian.AppendUint32(nil, uint32(shapeType))
+	b = appendFloat64LE(b, coords[0])
+	b = appendFloat64LE(b, coords[1])
+	if shapeType == shapePointZ {
+		b = appendFloat64LE(b, coords[layout.ZIndex()])
+	}
+	if shapeType == shapePointZ || shapeType == shapePointM {
+		m := shapefileNoData
+		if layout.HasM() {
+			m = coords[layout.MIndex()]
+		}
+		b = appendFloat64LE(b, m)
+	}
+	return b
+}
+
+// appendOrdinates appends the range and values of the Z or M ordinate of
+// every position; M values the layout lacks are written as no data
+func appendOrdinates(b []byte, g geom.Geometry, parts [][]float64, index int, m bool) []byte {
+	min, max, ok := geom.OrdinateRange(g, m)
+	if !ok {
+		min, max = shapefileNoData, shapefileNoData
+	}
+	b = appendFloat64LE(b, min)
+	b = appendFloat64LE(b, max)
+
+	stride := g.CoordLayout().Stride()
+	for _, part := range parts {
+		for i := 0; i+stride <= len(part); i += stride {
+			if index < 0 {
+				b = appendFloat64LE(b, shapefileNoData)
+			} else {
+				b = appendFloat64LE(b, part[i+index])
+			}
+		}
+	}
+	return b
+}
+
+// orientShapefileRings reverses rings so that the exterior ring is
+// clockwise and the holes are counter-clockwise
+func orientShapefileRings(polygon [][]float64, layout geom.Layout) {
+	for i, ring := range polygon {
+		area := geom.RingSignedArea(ring, layout)
+		if (i == 0 && area > 0) || (i > 0 && area < 0) {
+			geom.ReverseRing(ring, layout)
+		}
+	}
+}
+
+func appendFloat64LE(b []byte, v float64) []byte {
+	return binary.LittleEndian.AppendUint64(b, math.Float64bits(v))
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"exporter/geom"
+
+	"github.com/lib/pq"
+)
+
+// objectQuery selects every column of an exportable cadastral object and
+// the region and area that complete its cadastral number.
+// The column order must match the Scan call in ObjectIterator.Next;
+// filter conditions are appended to the WHERE clause.
+const objectQuery = `
+	SELECT
+		a.region_code,
+		q.area_code,
+		o.code,
+		o.quarter_code,
+		o.load_status::text,
+		o.update_date,
+		o.data::text,
+		o.area,
+		o.cost_value,
+		o.permitted_use_established_by_document,
+		o.right_type,
+		o.status,
+		o.land_record_type,
+		o.land_record_subtype,
+		o.land_record_category_type
+	FROM object o
+	JOIN quarter q ON q.code = o.quarter_code
+	JOIN area a ON a.code = q.area_code
+	WHERE o.data IS NOT NULL
+	AND o.load_status = 'SUCCESS'
+`
+
+// quarterQuery selects the quarters, areas and regions of the exportable
+// objects; filter conditions on the objects are appended to the subquery
+const quarterQuery = `
+	SELECT
+		q.code,
+		COALESCE(q.name, ''),
+		COALESCE(q.description, ''),
+		a.code,
+		COALESCE(a.name, ''),
+		COALESCE(a.description, ''),
+		r.code,
+		r.name
+	FROM quarter q
+	JOIN area a ON a.code = q.area_code
+	JOIN region r ON r.code = a.region_code
+	WHERE q.code IN (
+		SELECT o.quarter_code
+		FROM object o
+		WHERE o.data IS NOT NULL
+		AND o.load_status = 'SUCCESS'%s
+	)
+	ORDER BY q.code
+`
+
+// Source reads cadastral objects from PostgreSQL and decodes their NSPD data
+// so that every writer consumes the same stream of objects
+type Source struct {
+	db *sql.DB
+
+	// Filter restricts the exported objects; nil exports everything
+	Filter *Filter
+
+	// OnInvalid is called for rows that cannot be scanned or decoded.
+	// Such rows are skipped; by default they are logged.
+	OnInvalid func(code int, err error)
+}
+
+// NewSource creates a Source reading from the given PostgreSQL connection
+func NewSource(db *sql.DB) *Source {
+	return &Source{
+		db: db,
+		OnInvalid: func(code int, err error) {
+			log.Printf("Skipping object %d: %v", code, err)
+		},
+	}
+}
+
+// Objects runs the object query and returns an iterator over decoded objects
+func (s *Source) Objects() (*ObjectIterator, error) {
+	where, args := s.Filter.SQL()
+	rows, err := s.db.Query(objectQuery+where, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query objects: %w", err)
+	}
+	return &ObjectIterator{source: s, rows: rows}, nil
+}
+
+// Quarters returns the quarters of the objects selected by the filter's
+// attribute conditions, with their area and region names
+func (s *Source) Quarters() ([]Quarter, error) {
+	where, args := s.Filter.SQL()
+	rows, err := s.db.Query(fmt.Sprintf(quarterQuery, where), args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query quarters: %w", err)
+	}
+	defer rows.Close()
+
+	var quarters []Quarter
+	for rows.Next() {
+		var q Quarter
+		if err := rows.Scan(
+			&q.Code,
+			&q.Name,
+			&q.Description,
+			&q.AreaCode,
+			&q.AreaName,
+			&q.AreaDescription,
+			&q.RegionCode,
+			&q.RegionName,
+		); err != nil {
+			return nil, fmt.Errorf("failed to scan quarter: %w", err)
+		}
+		quarters = append(quarters, q)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read quarters: %w", err)
+	}
+	return quarters, nil
+}
+
+// ExportableNumbers returns the cadastral numbers of the objects with the
+// given codes that are exportable: present, with data and load_status SUCCESS
+func (s *Source) ExportableNumbers(codes []int64) (map[string]bool, error) {
+	rows, err := s.db.Query(`
+		SELECT a.region_code, q.area_code, o.quarter_code, o.code
+		FROM object o
+		JOIN quarter q ON q.code = o.quarter_code
+		JOIN area a ON a.code = q.area_code
+		WHERE o.code = ANY($1)
+		AND o.data IS NOT NULL
+		AND o.load_status = 'SUCCESS'
+	`, pq.Array(codes))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query object codes: %w", err)
+	}
+	defer rows.Close()
+
+	exportable := map[string]bool{}
+	for rows.Next() {
+		var n CadastralNumber
+		if err := rows.Scan(&n.Region, &n.Area, &n.Quarter, &n.Object); err != nil {
+			return nil, fmt.Errorf("failed to scan object code: %w", err)
+		}
+		exportable[n.String()] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read object codes: %w", err)
+	}
+	return exportable, nil
+}
+
+// DistinctValues returns the sorted distinct non-empty values of the given
+// object columns across all objects
+func (s *Source) DistinctValues(columns []string) (map[string][]string, error) {
+	values := map[string][]string{}
+	for _, column := range columns {
+		rows, err := s.db.Query(fmt.Sprintf(`
+			SELECT DISTINCT o.%[1]s::text
+			FROM object o
+			WHERE o.%[1]s IS NOT NULL AND o.%[1]s::text <> ''
+			ORDER BY 1
+		`, column))
+		if err != nil {
+			return nil, fmt.Errorf("failed to query values of %s: %w", column, err)
+		}
+		for rows.Next() {
+			var value string
+			if err := rows.Scan(&value); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("failed to scan value of %s: %w", column, err)
+			}
+			values[column] = append(values[column], value)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read values of %s: %w", column, err)
+		}
+	}
+	return values, nil
+}
+
+// LoadStatusStats are the object counts and update date range of one
+// load_status
+type LoadStatusStats struct {
+	Status      string
+	Objects     int
+	WithData    int
+	FirstUpdate sql.NullTime
+	LastUpdate  sql.NullTime
+}
+
+// LoadStatusStats returns the counts of the objects matching the filter's
+// attribute conditions, grouped by load_status
+func (s *Source) LoadStatusStats() ([]LoadStatusStats, error) {
+	where, args := s.Filter.SQL()
+	rows, err := s.db.Query(`
+		SELECT
+			COALESCE(o.load_status::text, ''),
+			count(*),
+			count(o.data),
+			min(o.update_date),
+			max(o.update_date)
+		FROM object o
+		WHERE TRUE`+where+`
+		GROUP BY o.load_status
+		ORDER BY o.load_status
+	`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query statistics: %w", err)
+	}
+	defer rows.Close()
+
+	var stats []LoadStatusStats
+	for rows.Next() {
+		var st LoadStatusStats
+		if err := rows.Scan(&st.Status, &st.Objects, &st.WithData, &st.FirstUpdate, &st.LastUpdate); err != nil {
+			return nil, fmt.Errorf("failed to scan statistics: %w", err)
+		}
+		stats = append(stats, st)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read statistics: %w", err)
+	}
+	return stats, nil
+}
+
+// ObjectIterator iterates over decoded cadastral objects in the style of sql.Rows
+type ObjectIterator struct {
+	source  *Source
+	rows    *sql.Rows
+	current *CadastralObject
+	skipped int
+}
+
+// Next advances to the next decodable object, skipping invalid rows.
+// It returns false when the rows are exhausted or a query error occurred.
+func (it *ObjectIterator) Next() bool {
+	for it.rows.Next() {
+		var obj CadastralObject
+		if err := it.rows.Scan(
+			&obj.CadNum.Region,
+			&obj.CadNum.Area,
+			&obj.Code,
+			&obj.QuarterCode,
+			&obj.LoadStatus,
+			&obj.UpdateDate,
+			&obj.Data,
+			&obj.Area,
+			&obj.CostValue,
+			&obj.PermittedUseEstablishedByDoc,
+			&obj.RightType,
+			&obj.Status,
+			&obj.LandRecordType,
+			&obj.LandRecordSubtype,
+			&obj.LandRecordCategoryType,
+		); err != nil {
+			it.skip(obj.Code, fmt.Errorf("failed to scan row: %w", err))
+			continue
+		}
+
+		obj.CadNum.Quarter, obj.CadNum.Object = obj.QuarterCode, obj.Code
+		if err := obj.CadNum.Validate(); err != nil {
+			it.skip(obj.Code, err)
+			continue
+		}
+
+		if err := decodeObjectData(&obj); err != nil {
+			it.skip(obj.Code, err)
+			continue
+		}
+
+		if !it.source.Filter.MatchGeometry(obj.Geometry) {
+			continue
+		}
+
+		it.current = &obj
+		return true
+	}
+	it.current = nil
+	return false
+}
+
+// Object returns the object the iterator is positioned at
+func (it *ObjectIterator) Object() *CadastralObject {
+	return it.current
+}
+
+// Skipped returns the number of rows skipped as invalid so far
+func (it *ObjectIterator) Skipped() int {
+	return it.skipped
+}
+
+// Err returns the error, if any, that stopped the iteration
+func (it *ObjectIterator) Err() error {
+	return it.rows.Err()
+}
+
+// Close releases the underlying rows
+func (it *ObjectIterator) Close() error {
+	return it.rows.Close()
+}
+
+func (it *ObjectIterator) skip(code int, err error) {
+	it.skipped++
+	if it.source.OnInvalid != nil {
+		it.source.OnInvalid(code, err)
+	}
+}
+
+// decodeObjectData parses the NSPD response stored in obj.Data and fills the
+// feature id, geometry, properties and options of the object
+func decodeObjectData(obj *CadastralObject) error {
+	feature, err := extractFeatureFromJSON(obj.Data)
+	if err != nil {
+		return err
+	}
+
+	if len(feature.Geometry) == 0 || string(feature.Geometry) == "null" {
+		return fmt.Errorf("no geometry in feature")
+	}
+	geometry, err := geom.UnmarshalGeoJSON(feature.Geometry)
+	if err != nil {
+		return err
+	}
+
+	obj.FeatureID = feature.ID
+	obj.Geometry = geometry
+
+	obj.Properties = feature.Properties
+	if obj.Properties == nil {
+		obj.Properties = map[string]interface{}{}
+	}
+	obj.Options, _ = obj.Properties["options"].(map[string]interface{})
+	if obj.Options == nil {
+		obj.Options = map[string]interface{}{}
+	}
+
+	return nil
+}
+
+// nspdFeature is a feature of an NSPD response with the geometry left raw
+// for the typed geometry decoder
+type nspdFeature struct {
+	ID         interface{}            `json:"id"`
+	Geometry   json.RawMessage        `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+// extractFeatureFromJSON extracts the first feature from an NSPD response string
+func extractFeatureFromJSON(dataStr string) (*nspdFeature, error) {
+	var data struct {
+		Data *struct {
+			Features []*nspdFeature `json:"features"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal([]byte(dataStr), &data); err != nil {
+		return nil, fmt.Errorf("failed to parse JSON: %w", err)
+	}
+
+	// Extract FeatureCollection
+	if data.Data == nil {
+		return nil, fmt.Errorf("no 'data' field in JSON")
+	}
+
+	features := data.Data.Features
+	if len(features) == 0 {
+		return nil, fmt.Errorf("no features in JSON")
+	}
+
+	if features[0] == nil {
+		return nil, fmt.Errorf("invalid feature structure")
+	}
+
+	return features[0], nil
+}
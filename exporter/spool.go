@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+
+	"exporter/geom"
+)
+
+// spoolRecord locates a record in a spool
+type spoolRecord struct {
+	offset int64
+	length int
+}
+
+// spooledFeature locates the record of a feature and holds the bounds of
+// its geometry, by which features are sorted
+type spooledFeature struct {
+	spoolRecord
+	bounds geom.Bounds
+}
+
+// recordSpool is a temporary file of encoded records that are written in
+// one pass and read back in another order once every record is known
+type recordSpool struct {
+	path string
+	file *os.File
+	w    *bufio.Writer
+	size int64
+	// extent is the union of the bounds of the features
+	extent geom.Bounds
+}
+
+// createRecordSpool creates the spool of the output file at path
+func createRecordSpool(path string) (*recordSpool, error) {
+	s := &recordSpool{path: path + ".spool", extent: geom.EmptyBounds()}
+	if err := s.open(os.O_TRUNC); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// open opens the spool file for reading and appending with the extra flags
+func (s *recordSpool) open(flags int) error {
+	file, err := os.OpenFile(s.path, os.O_RDWR|os.O_CREATE|flags, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create spool: %w", err)
+	}
+	s.file = file
+	s.w = bufio.NewWriter(file)
+	return nil
+}
+
+// resume reopens a suspended spool
+func (s *recordSpool) resume() error {
+	if s.file != nil {
+		return nil
+	}
+	return s.open(os.O_APPEND)
+}
+
+// suspend flushes the spool and closes its file handle, so that many
+// spools can be filled without holding a descriptor each
+func (s *recordSpool) suspend() error {
+	if s.file == nil {
+		return nil
+	}
+	err := s.w.Flush()
+	if cerr := s.file.Close(); err == nil {
+		err = cerr
+	}
+	s.file, s.w = nil, nil
+	if err != nil {
+		return fmt.Errorf("failed to write spool: %w", err)
+	}
+	return nil
+}
+
+// add appends a record and returns its location
+func (s *recordSpool) add(record []byte) (spoolRecord, error) {
+	if _, err := s.w.Write(record); err != nil {
+		return spoolRecord{}, fmt.Errorf("failed to write spool: %w", err)
+	}
+	r := spoolRecord{offset: s.size, length: len(record)}
+	s.size += int64(len(record))
+	return r, nil
+}
+
+// addFeature appends the record of a feature with the bounds of its
+// geometry
+func (s *recordSpool) addFeature(record []byte, bounds geom.Bounds) (spooledFeature, error) {
+	r, err := s.add(record)
+	if err != nil {
+		return spooledFeature{}, err
+	}
+	s.extent.Union(bounds)
+	return spooledFeature{r, bounds}, nil
+}
+
+// read returns a spooled record
+func (s *recordSpool) read(r spoolRecord) ([]byte, error) {
+	if err := s.w.Flush(); err != nil {
+		return nil, fmt.Errorf("failed to write spool: %w", err)
+	}
+	record := make([]byte, r.length)
+	if _, err := s.file.ReadAt(record, r.offset); err != nil {
+		return nil, fmt.Errorf("failed to read spool: %w", err)
+	}
+	return record, nil
+}
+
+// discard closes and removes the spool
+func (s *recordSpool) discard() {
+	if s.file != nil {
+		s.file.Close()
+		s.file, s.w = nil, nil
+	}
+	os.Remove(s.path)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// Thrift compact protocol type codes
+const (
+	thriftTypeTrue   = 1
+	thriftTypeFalse  = 2
+	thriftTypeI16    = 4
+	thriftTypeI32    = 5
+	thriftTypeI64    = 6
+	thriftTypeBinary = 8
+	thriftTypeList   = 9
+	thriftTypeStruct = 12
+)
+
+// thriftStruct is a Thrift struct under construction, as used by the
+// Parquet page headers and footer. Field values are bool, int16, int32 or
+// int64 scalars, a string or []byte, a nested *thriftStruct, or a
+// list: []int32, []string or []*thriftStruct.
+type thriftStruct struct {
+	fields []thriftField
+}
+
+// thriftField is a struct field by its id in the IDL
+type thriftField struct {
+	id    int16
+	value interface{}
+}
+
+// set stores a field value; optional fields can be left out
+func (s *thriftStruct) set(id int16, value interface{}) {
+	s.fields = append(s.fields, thriftField{id, value})
+}
+
+// appendThrift appends a struct in the compact protocol: the fields in id
+// order, each headed by its id delta and type, and a stop byte
+func appendThrift(buf []byte, s *thriftStruct) []byte {
+	fields := append([]thriftField(nil), s.fields...)
+	sort.SliceStable(fields, func(i, j int) bool { return fields[i].id < fields[j].id })
+
+	var last int16
+	for _, f := range fields {
+		typ := thriftTypeOf(f.value)
+		if b, ok := f.value.(bool); ok && !b {
+			typ = thriftTypeFalse
+		}
+		if delta := f.id - last; delta > 0 && delta <= 15 {
+			buf = append(buf, byte(delta)<<4|typ)
+		} else {
+			buf = append(buf, typ)
+			buf = binary.AppendVarint(buf, int64(f.id))
+		}
+		last = f.id
+		if _, ok := f.value.(bool); !ok {
+			buf = appendThriftValue(buf, f.value)
+		}
+	}
+	return append(buf, 0)
+}
+
+// thriftTypeOf returns the compact type code of a value; booleans in fields
+// carry their value in the type and count as true here
+func thriftTypeOf(value interface{}) byte {
+	switch value.(type) {
+	case bool:
+		return thriftTypeTrue
+	case int16:
+		return thriftTypeI16
+	case int32:
+		return thriftTypeI32
+	case int64:
+		return thriftTypeI64
+	case string, []byte:
+		return thriftTypeBinary
+	case *thriftStruct:
+		return thriftTypeStruct
+	case []int32, []string, []*thriftStruct:
+		return thriftTypeList
+	default:
+		panic(fmt.Sprintf("unsupported Thrift value %T", value))
+	}
+}
+
+// appendThriftValue appends a value without its field header. Integers are
+// zigzag varints; lists start with their size and element type.
+func appendThriftValue(buf []byte, value interface{}) []byte {
+	switch v := value.(type) {
+	case int16:
+		return binary.AppendVarint(buf, int64(v))
+	case int32:
+		return binary.AppendVarint(buf, int64(v))
+	case int64:
+		return binary.AppendVarint(buf, v)
+	case string:
+		buf = binary.AppendUvarint(buf, uint64(len(v)))
+		return append(buf, v...)
+	case []byte:
+		buf = binary.AppendUvarint(buf, uint64(len(v)))
+		return append(buf, v...)
+	case *thriftStruct:
+		return appendThrift(buf, v)
+	case []int32:
+		buf = appendThriftListHeader(buf, len(v), thriftTypeI32)
+		for _, e := range v {
+			buf = binary.AppendVarint(buf, int64(e))
+		}
+		return buf
+	case []string:
+		buf = appendThriftListHeader(buf, len(v), thriftTypeBinary)
+		for _, e := range v {
+			buf = appendThriftValue(buf, e)
+		}
+		return buf
+	case []*thriftStruct:
+		buf = appendThriftListHeader(buf, len(v), thriftTypeStruct)
+		for _, e := range v {
+			buf = appendThrift(buf, e)
+		}
+		return buf
+	default:
+		panic(fmt.Sprintf("unsupported Thrift value %T", value))
+	}
+}
+
+// appendThriftListHeader appends the size and element type of a list;
+// sizes from 15 up follow the header byte as a varint
+func appendThriftListHeader(buf []byte, n int, elemType byte) []byte {
+	if n < 15 {
+		return append(buf, byte(n)<<4|elemType)
+	}
+	buf = append(buf, 0xF0|elemType)
+	return binary.AppendUvarint(buf, uint64(n))
+}
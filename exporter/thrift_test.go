@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+// thriftReader decodes a compact protocol struct into its fields by id:
+// integers as int64, binary as []byte, lists as []interface{} and structs
+// as map[int16]interface{}
+type thriftReader struct {
+	t   *testing.T
+	buf []byte
+	pos int
+}
+
+func (r *thriftReader) byte() byte {
+	if r.pos >= len(r.buf) {
+		r.t.Fatalf("Thrift data ends at %d", r.pos)
+	}
+	b := r.buf[r.pos]
+	r.pos++
+	return b
+}
+
+func (r *thriftReader) uvarint() uint64 {
+	v, n := binary.Uvarint(r.buf[r.pos:])
+	if n <= 0 {
+		r.t.Fatalf("bad varint at %d", r.pos)
+	}
+	r.pos += n
+	return v
+}
+
+// varint reads a zigzag varint
+func (r *thriftReader) varint() int64 {
+	v := r.uvarint()
+	return int64(v>>1) ^ -int64(v&1)
+}
+
+// readStruct reads the fields up to the stop byte; a header with a zero
+// delta is followed by the field id
+func (r *thriftReader) readStruct() map[int16]interface{} {
+	fields := make(map[int16]interface{})
+	var last int16
+	for {
+		b := r.byte()
+		if b == 0 {
+			return fields
+		}
+		id := last + int16(b>>4)
+		if b>>4 == 0 {
+			id = int16(r.varint())
+		}
+		fields[id] = r.readValue(b & 0x0F)
+		last = id
+	}
+}
+
+func (r *thriftReader) readValue(typ byte) interface{} {
+	switch typ {
+	case thriftTypeTrue:
+		return true
+	case thriftTypeFalse:
+		return false
+	case thriftTypeI16, thriftTypeI32, thriftTypeI64:
+		return r.varint()
+	case 7:
+		v := math.Float64frombits(binary.LittleEndian.Uint64(r.buf[r.pos:]))
+		r.pos += 8
+		return v
+	case thriftTypeBinary:
+		n := int(r.uvarint())
+		v := r.buf[r.pos : r.pos+n]
+		r.pos += n
+		return v
+	case thriftTypeList:
+		b := r.byte()
+		n := int(b >> 4)
+		if n == 15 {
+			n = int(r.uvarint())
+		}
+		list := make([]interface{}, n)
+		for i := range list {
+			list[i] = r.readValue(b & 0x0F)
+		}
+		return list
+	case thriftTypeStruct:
+		return r.readStruct()
+	}
+	r.t.Fatalf("unknown Thrift type %d at %d", typ, r.pos)
+	return nil
+}
+
+func TestThriftEncoding(t *testing.T) {
+	field := func(fields ...thriftField) *thriftStruct { return &thriftStruct{fields: fields} }
+	sixteen := make([]int32, 16)
+	tests := []struct {
+		name string
+		s    *thriftStruct
+		want []byte
+	}{
+		{"empty", field(), []byte{0}},
+		{"zero", field(thriftField{1, int32(0)}), []byte{0x15, 0x00, 0}},
+		{"zigzag -1", field(thriftField{1, int32(-1)}), []byte{0x15, 0x01, 0}},
+		{"zigzag 1", field(thriftField{1, int32(1)}), []byte{0x15, 0x02, 0}},
+		{"zigzag -64", field(thriftField{1, int64(-64)}), []byte{0x16, 0x7F, 0}},
+		{"zigzag 64", field(thriftField{1, int32(64)}), []byte{0x15, 0x80, 0x01, 0}},
+		{"i16", field(thriftField{1, int16(-300)}), []byte{0x14, 0xD7, 0x04, 0}},
+		{"true", field(thriftField{1, true}), []byte{0x11, 0}},
+		{"false", field(thriftField{1, false}), []byte{0x12, 0}},
+		{"deltas", field(thriftField{1, int32(1)}, thriftField{3, int32(2)}), []byte{0x15, 0x02, 0x25, 0x04, 0}},
+		{"sorted by id", field(thriftField{3, int32(2)}, thriftField{1, int32(1)}), []byte{0x15, 0x02, 0x25, 0x04, 0}},
+		{"delta 15", field(thriftField{15, int16(3)}), []byte{0xF4, 0x06, 0}},
+		{"delta 16", field(thriftField{16, int32(1)}), []byte{0x05, 0x20, 0x02, 0}},
+		{"delta after long form", field(thriftField{2, true}, thriftField{20, true}, thriftField{21, true}), []byte{0x21, 0x01, 0x28, 0x11, 0}},
+		{"string", field(thriftField{1, "ab"}), []byte{0x18, 0x02, 'a', 'b', 0}},
+		{"bytes", field(thriftField{1, []byte{0xFF}}), []byte{0x18, 0x01, 0xFF, 0}},
+		{"nested deltas restart", field(thriftField{2, field(thriftField{1, int32(1)})}, thriftField{3, int32(2)}), []byte{0x2C, 0x15, 0x02, 0x00, 0x15, 0x04, 0}},
+		{"i32 list", field(thriftField{1, []int32{1, -1}}), []byte{0x19, 0x25, 0x02, 0x01, 0}},
+		{"string list", field(thriftField{1, []string{"a"}}), []byte{0x19, 0x18, 0x01, 'a', 0}},
+		{"struct list", field(thriftField{1, []*thriftStruct{field(), field()}}), []byte{0x19, 0x2C, 0x00, 0x00, 0}},
+		{"long list", field(thriftField{1, sixteen}), append(append([]byte{0x19, 0xF5, 0x10}, make([]byte, 16)...), 0)},
+	}
+	for _, tt := range tests {
+		got := appendThrift(nil, tt.s)
+		if !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: % x, want % x", tt.name, got, tt.want)
+			continue
+		}
+		r := &thriftReader{t: t, buf: got}
+		r.readStruct()
+		if r.pos != len(got) {
+			t.Errorf("%s: decoded %d of %d bytes", tt.name, r.pos, len(got))
+		}
+	}
+}
@@ -0,0 +1,541 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+
+	"exporter/geom"
+)
+
+// webMercatorHalf is half the width of the EPSG:3857 world square
+const webMercatorHalf = 20037508.342789244
+
+// tileBuffer is the margin around a tile, in tile units, within which
+// geometries are kept so that strokes do not end at tile edges
+const tileBuffer = 64
+
+// tileFeature is an object to be tiled: its EPSG:3857 geometry and the
+// attribute values in layer key order
+type tileFeature struct {
+	geometry geom.Geometry
+	values   []interface{}
+}
+
+// Value types of the tile spool records
+const (
+	tileValueNull = iota
+	tileValueString
+	tileValueInt
+	tileValueFloat
+	tileValueBool
+)
+
+// tileSpool collects the features to be tiled. Every zoom level reads the
+// features again, so they are spooled to a temporary file and only their
+// bounds are kept in memory while the levels are cut.
+type tileSpool struct {
+	spool    *recordSpool
+	features []spooledFeature
+}
+
+// createTileSpool creates the spool of the tileset at path
+func createTileSpool(path string) (*tileSpool, error) {
+	spool, err := createRecordSpool(path)
+	if err != nil {
+		return nil, err
+	}
+	return &tileSpool{spool: spool}, nil
+}
+
+// add spools a feature as its WKB geometry and its typed values,
+// which keep integers apart from floats unlike JSON
+func (s *tileSpool) add(f tileFeature) error {
+	wkb, err := geom.MarshalWKB(f.geometry, f.geometry.CoordLayout())
+	if err != nil {
+		return fmt.Errorf("failed to encode geometry: %w", err)
+	}
+	record := binary.LittleEndian.AppendUint32(nil, uint32(len(wkb)))
+	record = append(record, wkb...)
+	for _, value := range f.values {
+		switch v := value.(type) {
+		case nil:
+			record = append(record, tileValueNull)
+		case string:
+			record = append(record, tileValueString)
+			record = binary.LittleEndian.AppendUint32(record, uint32(len(v)))
+			record = append(record, v...)
+		case int:
+			record = append(record, tileValueInt)
+			record = binary.LittleEndian.AppendUint64(record, uint64(v))
+		case int64:
+			record = append(record, tileValueInt)
+			record = binary.LittleEndian.AppendUint64(record, uint64(v))
+		case float64:
+			record = append(record, tileValueFloat)
+			record = binary.LittleEndian.AppendUint64(record, math.Float64bits(v))
+		case bool:
+			record = append(record, tileValueBool)
+			if v {
+				record = append(record, 1)
+			} else {
+				record = append(record, 0)
+			}
+		default:
+			return fmt.Errorf("unsupported attribute value %T", value)
+		}
+	}
+
+	spooled, err := s.spool.addFeature(record, f.geometry.Bounds())
+	if err != nil {
+		return err
+	}
+	s.features = append(s.features, spooled)
+	return nil
+}
+
+// read decodes the spooled feature i
+func (s *tileSpool) read(i int) (*tileFeature, error) {
+	record, err := s.spool.read(s.features[i].spoolRecord)
+	if err != nil {
+		return nil, err
+	}
+	f := &tileFeature{}
+	n := int(binary.LittleEndian.Uint32(record))
+	if f.geometry, _, err = geom.UnmarshalWKB(record[4 : 4+n]); err != nil {
+		return nil, fmt.Errorf("failed to decode spooled geometry: %w", err)
+	}
+	for b := record[4+n:]; len(b) > 0; {
+		typ := b[0]
+		b = b[1:]
+		switch typ {
+		case tileValueNull:
+			f.values = append(f.values, nil)
+		case tileValueString:
+			n := int(binary.LittleEndian.Uint32(b))
+			f.values = append(f.values, string(b[4:4+n]))
+			b = b[4+n:]
+		case tileValueInt:
+			f.values = append(f.values, int64(binary.LittleEndian.Uint64(b)))
+			b = b[8:]
+		case tileValueFloat:
+			f.values = append(f.values, math.Float64frombits(binary.LittleEndian.Uint64(b)))
+			b = b[8:]
+		case tileValueBool:
+			f.values = append(f.values, b[0] == 1)
+			b = b[1:]
+		}
+	}
+	return f, nil
+}
+
+// discard closes and removes the spool
+func (s *tileSpool) discard() {
+	s.spool.discard()
+}
+
+// tileWriter stores encoded tiles; tiles arrive by zoom level and, within
+// a level, in Hilbert order
+type tileWriter interface {
+	WriteTile(z, x, y int, data []byte) error
+	Close() error
+}
+
+// tileKey is the column and row of a tile in XYZ numbering
+type tileKey struct {
+	x, y int
+}
+
+// tiler cuts features into vector tiles of one layer
+type tiler struct {
+	layer string
+	keys  []string
+	// tolerance is the Douglas-Peucker tolerance in tile units
+	tolerance float64
+}
+
+// tileZoom writes the tiles of one zoom level from the spooled features and
+// returns their number
+func (t *tiler) tileZoom(z int, features *tileSpool, w tileWriter) (int, error) {
+	n := 1 << z
+	size := 2 * webMercatorHalf / float64(n)
+	margin := size * tileBuffer / mvtExtent
+	index := func(v float64) int {
+		return min(max(int(math.Floor(v/size)), 0), n-1)
+	}
+
+	tiles := make(map[tileKey][]int32)
+	for i, f := range features.features {
+		x0, x1 := index(f.bounds.MinX-margin+webMercatorHalf), index(f.bounds.MaxX+margin+webMercatorHalf)
+		y0, y1 := index(webMercatorHalf-f.bounds.MaxY-margin), index(webMercatorHalf-f.bounds.MinY+margin)
+		for x := x0; x <= x1; x++ {
+			for y := y0; y <= y1; y++ {
+				k := tileKey{x, y}
+				tiles[k] = append(tiles[k], int32(i))
+			}
+		}
+	}
+
+	keys := make([]tileKey, 0, len(tiles))
+	for k := range tiles {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return pmtilesTileID(z, keys[i].x, keys[i].y) < pmtilesTileID(z, keys[j].x, keys[j].y)
+	})
+
+	// Tiles follow each other along the Hilbert curve, so the features of
+	// the previous tile are kept decoded for their neighbours
+	var count int
+	var previous map[int32]*tileFeature
+	for _, k := range keys {
+		box := newTileBox(z, k.x, k.y)
+		layer := newMVTLayer(t.layer, t.keys)
+		decoded := make(map[int32]*tileFeature, len(tiles[k]))
+		for _, i := range tiles[k] {
+			f, ok := previous[i]
+			if !ok {
+				var err error
+				if f, err = features.read(int(i)); err != nil {
+					return count, err
+				}
+			}
+			decoded[i] = f
+			var tags []uint32
+			for _, g := range tileParts(f.geometry) {
+				typ, geometry := t.encodeGeometry(g, box)
+				if typ == 0 {
+					continue
+				}
+				if tags == nil {
+					tags = layer.tags(f.values)
+				}
+				layer.add(mvtFeature{typ: typ, tags: tags, geometry: geometry})
+			}
+		}
+		previous = decoded
+		if len(layer.features) == 0 {
+			continue
+		}
+
+		data, err := gzipBytes(encodeMVT(layer))
+		if err != nil {
+			return count, err
+		}
+		if err := w.WriteTile(z, k.x, k.y, data); err != nil {
+			return count, err
+		}
+		count++
+	}
+	log.Printf("Zoom %d: %d tiles", z, count)
+	return count, nil
+}
+
+// tileParts splits a geometry collection into its members, as an MVT
+// feature has a single geometry type
+func tileParts(g geom.Geometry) []geom.Geometry {
+	c, ok := g.(*geom.GeometryCollection)
+	if !ok {
+		return []geom.Geometry{g}
+	}
+	var parts []geom.Geometry
+	for _, member := range c.Geometries {
+		parts = append(parts, tileParts(member)...)
+	}
+	return parts
+}
+
+// tileBox maps EPSG:3857 coordinates to the grid of a tile, with y down
+type tileBox struct {
+	minX, maxY, scale float64
+}
+
+// newTileBox returns the grid mapping of tile z/x/y
+func newTileBox(z, x, y int) tileBox {
+	size := 2 * webMercatorHalf / float64(int(1)<<z)
+	return tileBox{
+		minX:  -webMercatorHalf + float64(x)*size,
+		maxY:  webMercatorHalf - float64(y)*size,
+		scale: mvtExtent / size,
+	}
+}
+
+// project returns the XY positions of flat coordinates in tile units
+func (b tileBox) project(coords []float64, layout geom.Layout) []float64 {
+	stride := layout.Stride()
+	xy := make([]float64, 0, len(coords)/stride*2)
+	for i := 0; i+1 < len(coords); i += stride {
+		xy = append(xy, (coords[i]-b.minX)*b.scale, (b.maxY-coords[i+1])*b.scale)
+	}
+	return xy
+}
+
+// encodeGeometry returns the MVT type and commands of a geometry within a
+// tile: projected, simplified, clipped to the buffered tile and snapped to
+// the grid. The type is 0 if nothing is left.
+func (t *tiler) encodeGeometry(g geom.Geometry, box tileBox) (int, []uint32) {
+	const lo, hi = -tileBuffer, mvtExtent + tileBuffer
+	layout := g.CoordLayout()
+	enc := &mvtGeometry{}
+
+	switch g := g.(type) {
+	case *geom.Point, *geom.MultiPoint:
+		var coords []float64
+		if p, ok := g.(*geom.Point); ok {
+			coords = p.Coords
+		} else {
+			coords = g.(*geom.MultiPoint).Coords
+		}
+		var points []int32
+		xy := box.project(coords, layout)
+		for i := 0; i < len(xy); i += 2 {
+			x, y := math.Round(xy[i]), math.Round(xy[i+1])
+			if x >= lo && x <= hi && y >= lo && y <= hi {
+				points = append(points, int32(x), int32(y))
+			}
+		}
+		if len(points) == 0 {
+			return 0, nil
+		}
+		enc.points(points)
+		return mvtPoint, enc.commands
+
+	case *geom.LineString, *geom.MultiLineString:
+		lines := [][]float64{}
+		if l, ok := g.(*geom.LineString); ok {
+			lines = append(lines, l.Coords)
+		} else {
+			lines = g.(*geom.MultiLineString).Lines
+		}
+		for _, line := range lines {
+			xy := simplifyLine(box.project(line, layout), t.tolerance)
+			for _, part := range clipLine(xy, lo, hi) {
+				if part = snapToGrid(part); len(part) >= 4 {
+					enc.line(toInt32(part))
+				}
+			}
+		}
+		if len(enc.commands) == 0 {
+			return 0, nil
+		}
+		return mvtLineString, enc.commands
+
+	case *geom.Polygon, *geom.MultiPolygon:
+		var polygons [][][]float64
+		if p, ok := g.(*geom.Polygon); ok {
+			polygons = [][][]float64{p.Rings}
+		} else {
+			polygons = g.(*geom.MultiPolygon).Polygons
+		}
+		for _, rings := range polygons {
+			for i, ring := range rings {
+				xy := t.tileRing(ring, layout, box)
+				if xy == nil {
+					// Holes of a vanished exterior go with it
+					if i == 0 {
+						break
+					}
+					continue
+				}
+				// Exterior rings have a positive area in the y-down grid,
+				// holes a negative one
+				if area := geom.RingSignedArea(xy, geom.XY); (i == 0) != (area > 0) {
+					geom.ReverseRing(xy, geom.XY)
+				}
+				enc.ring(toInt32(xy))
+			}
+		}
+		if len(enc.commands) == 0 {
+			return 0, nil
+		}
+		return mvtPolygon, enc.commands
+	}
+	return 0, nil
+}
+
+// tileRing returns a ring in tile units, or nil if it collapses to less
+// than a triangle
+func (t *tiler) tileRing(ring []float64, layout geom.Layout, box tileBox) []float64 {
+	const lo, hi = -tileBuffer, mvtExtent + tileBuffer
+	xy := simplifyLine(box.project(ring, layout), t.tolerance)
+	if len(xy) < 8 {
+		return nil
+	}
+	xy = snapToGrid(clipRing(xy, lo, hi))
+	if len(xy) < 8 || geom.RingSignedArea(xy, geom.XY) == 0 {
+		return nil
+	}
+	return xy
+}
+
+// clipRing clips a closed ring to the square [lo, hi]² with the
+// Sutherland-Hodgman algorithm. Parts outside collapse onto the square
+// edges, which is invisible once rendered.
+func clipRing(ring []float64, lo, hi float64) []float64 {
+	b := geom.EmptyBounds()
+	for i := 0; i < len(ring); i += 2 {
+		b.Extend(ring[i], ring[i+1])
+	}
+	if b.MinX >= lo && b.MaxX <= hi && b.MinY >= lo && b.MaxY <= hi {
+		return ring
+	}
+
+	points := ring[:len(ring)-2]
+	for edge := 0; edge < 4 && len(points) > 0; edge++ {
+		axis := edge % 2
+		inside := func(p []float64) bool {
+			if edge < 2 {
+				return p[axis] >= lo
+			}
+			return p[axis] <= hi
+		}
+		bound := lo
+		if edge >= 2 {
+			bound = hi
+		}
+
+		var clipped []float64
+		n := len(points) / 2
+		for i := 0; i < n; i++ {
+			cur := points[2*i : 2*i+2]
+			prev := points[2*((i+n-1)%n) : 2*((i+n-1)%n)+2]
+			if inside(cur) != inside(prev) {
+				t := (bound - prev[axis]) / (cur[axis] - prev[axis])
+				clipped = append(clipped, prev[0]+t*(cur[0]-prev[0]), prev[1]+t*(cur[1]-prev[1]))
+			}
+			if inside(cur) {
+				clipped = append(clipped, cur[0], cur[1])
+			}
+		}
+		points = clipped
+	}
+	if len(points) == 0 {
+		return nil
+	}
+	return append(points, points[0], points[1])
+}
+
+// clipLine clips a path to the square [lo, hi]² segment by segment with the
+// Liang-Barsky algorithm, returning the parts inside
+func clipLine(line []float64, lo, hi float64) [][]float64 {
+	var parts [][]float64
+	var part []float64
+	for i := 0; i+3 < len(line); i += 2 {
+		ax, ay, bx, by := line[i], line[i+1], line[i+2], line[i+3]
+		dx, dy := bx-ax, by-ay
+		t0, t1 := 0.0, 1.0
+		visible := true
+		for _, c := range [4][2]float64{{-dx, ax - lo}, {dx, hi - ax}, {-dy, ay - lo}, {dy, hi - ay}} {
+			p, q := c[0], c[1]
+			if p == 0 {
+				if q < 0 {
+					visible = false
+				}
+				continue
+			}
+			r := q / p
+			if p < 0 {
+				t0 = math.Max(t0, r)
+			} else {
+				t1 = math.Min(t1, r)
+			}
+		}
+		if !visible || t0 > t1 {
+			if part != nil {
+				parts = append(parts, part)
+				part = nil
+			}
+			continue
+		}
+		if part == nil {
+			part = []float64{ax + t0*dx, ay + t0*dy}
+		}
+		part = append(part, ax+t1*dx, ay+t1*dy)
+		if t1 < 1 {
+			parts = append(parts, part)
+			part = nil
+		}
+	}
+	if part != nil {
+		parts = append(parts, part)
+	}
+	return parts
+}
+
+// simplifyLine removes the positions of an XY path that are closer than
+// tolerance to the simplified path, with the Douglas-Peucker algorithm.
+// The first and last positions are kept, so rings stay closed.
+func simplifyLine(xy []float64, tolerance float64) []float64 {
+	n := len(xy) / 2
+	if tolerance <= 0 || n < 3 {
+		return xy
+	}
+	keep := make([]bool, n)
+	keep[0], keep[n-1] = true, true
+	tolerance2 := tolerance * tolerance
+
+	stack := [][2]int{{0, n - 1}}
+	for len(stack) > 0 {
+		first, last := stack[len(stack)-1][0], stack[len(stack)-1][1]
+		stack = stack[:len(stack)-1]
+		farthest, maxDist := -1, tolerance2
+		for i := first + 1; i < last; i++ {
+			if d := segmentDistance2(xy[2*i:2*i+2], xy[2*first:2*first+2], xy[2*last:2*last+2]); d > maxDist {
+				farthest, maxDist = i, d
+			}
+		}
+		if farthest >= 0 {
+			keep[farthest] = true
+			stack = append(stack, [2]int{first, farthest}, [2]int{farthest, last})
+		}
+	}
+
+	simplified := make([]float64, 0, len(xy))
+	for i, k := range keep {
+		if k {
+			simplified = append(simplified, xy[2*i], xy[2*i+1])
+		}
+	}
+	return simplified
+}
+
+// segmentDistance2 returns the squared distance from p to the segment ab
+func segmentDistance2(p, a, b []float64) float64 {
+	x, y := a[0], a[1]
+	dx, dy := b[0]-x, b[1]-y
+	if dx != 0 || dy != 0 {
+		t := ((p[0]-x)*dx + (p[1]-y)*dy) / (dx*dx + dy*dy)
+		if t > 1 {
+			x, y = b[0], b[1]
+		} else if t > 0 {
+			x, y = x+t*dx, y+t*dy
+		}
+	}
+	dx, dy = p[0]-x, p[1]-y
+	return dx*dx + dy*dy
+}
+
+// snapToGrid rounds an XY path to whole tile units in place, dropping
+// positions that repeat the previous one
+func snapToGrid(xy []float64) []float64 {
+	out := xy[:0]
+	for i := 0; i+1 < len(xy); i += 2 {
+		x, y := math.Round(xy[i]), math.Round(xy[i+1])
+		if n := len(out); n >= 2 && out[n-2] == x && out[n-1] == y {
+			continue
+		}
+		out = append(out, x, y)
+	}
+	return out
+}
+
+// toInt32 converts snapped tile coordinates
+func toInt32(xy []float64) []int32 {
+	out := make([]int32, len(xy))
+	for i, v := range xy {
+		out[i] = int32(v)
+	}
+	return out
+}